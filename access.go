@@ -0,0 +1,152 @@
+package ekanite
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	blevequery "github.com/blevesearch/bleve/search/query"
+)
+
+// Role grants access to the events from a set of hosts, source addresses and
+// tenants. Every role must grant access to something.
+type Role struct {
+	Name    string   `json:"name"`
+	Hosts   []string `json:"hosts,omitempty"`   // Host names, which may contain * and ? wildcards.
+	Sources []string `json:"sources,omitempty"` // IPv4 CIDRs, matched against the sender's address.
+	Tenants []string `json:"tenants,omitempty"` // Names of tenants.
+}
+
+// Tenant is a named group of hosts and source addresses, which may be shared by
+// several roles.
+type Tenant struct {
+	Name    string   `json:"name"`
+	Hosts   []string `json:"hosts,omitempty"`
+	Sources []string `json:"sources,omitempty"`
+}
+
+// accessFilter restricts a user to the events from the hosts and source addresses
+// granted by their roles.
+type accessFilter struct {
+	hosts []*regexp.Regexp
+	nets  []*net.IPNet
+	query blevequery.Query // Matches the same events as match.
+}
+
+// newAccessFilter returns the filter granting access to the union of the roles.
+func newAccessFilter(roles []*Role, tenants map[string]*Tenant) (*accessFilter, error) {
+	var hosts, sources []string
+	for _, r := range roles {
+		hosts = append(hosts, r.Hosts...)
+		sources = append(sources, r.Sources...)
+		for _, name := range r.Tenants {
+			t, ok := tenants[name]
+			if !ok {
+				return nil, fmt.Errorf("role %s refers to unknown tenant %s", r.Name, name)
+			}
+			hosts = append(hosts, t.Hosts...)
+			sources = append(sources, t.Sources...)
+		}
+	}
+
+	f := &accessFilter{}
+	var queries []blevequery.Query
+	for _, h := range hosts {
+		f.hosts = append(f.hosts, globRegexp(h))
+		var q blevequery.FieldableQuery
+		if strings.ContainsAny(h, "*?") {
+			q = bleve.NewWildcardQuery(h)
+		} else {
+			q = bleve.NewTermQuery(h)
+		}
+		q.SetField("host")
+		queries = append(queries, q)
+	}
+	for _, s := range sources {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source %s: %s", s, err.Error())
+		}
+		if len(n.Mask) != net.IPv4len {
+			return nil, fmt.Errorf("invalid source %s: only IPv4 networks are supported", s)
+		}
+		f.nets = append(f.nets, n)
+		queries = append(queries, cidrQueries(n)...)
+	}
+	f.query = bleve.NewDisjunctionQuery(queries...)
+	return f, nil
+}
+
+// match returns whether the event with the given indexed fields may be accessed.
+func (f *accessFilter) match(fields map[string]string) bool {
+	if h := fields["host"]; h != "" {
+		for _, re := range f.hosts {
+			if re.MatchString(h) {
+				return true
+			}
+		}
+	}
+	if ip := net.ParseIP(fields["sourceip"]); ip != nil {
+		for _, n := range f.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// restrict returns q, restricted to the events which the user carried by ctx, if
+// any, may access. Every search of an index must restrict its query, so that the
+// restriction cannot be bypassed through query syntax.
+func restrict(ctx context.Context, q blevequery.Query) blevequery.Query {
+	u, ok := UserFromContext(ctx)
+	if !ok || u.access == nil {
+		return q
+	}
+	return bleve.NewConjunctionQuery(q, u.access.query)
+}
+
+// globRegexp returns a regular expression matching the whole of a string against a
+// pattern in which * matches any sequence of characters, and ? any one character.
+func globRegexp(pattern string) *regexp.Regexp {
+	s := regexp.QuoteMeta(pattern)
+	s = strings.Replace(s, `\*`, ".*", -1)
+	s = strings.Replace(s, `\?`, ".", -1)
+	return regexp.MustCompile("^" + s + "$")
+}
+
+// cidrQueries returns queries matching the source addresses, which are indexed as
+// strings, within the IPv4 network. The network is widened to whole octets, and
+// each resulting network matched by its textual prefix, so at most 128 queries are
+// returned.
+func cidrQueries(n *net.IPNet) []blevequery.Query {
+	ip := n.IP.To4()
+	ones, _ := n.Mask.Size()
+	if ones == 0 {
+		return []blevequery.Query{bleve.NewMatchAllQuery()}
+	}
+	octets := (ones + 7) / 8
+
+	var queries []blevequery.Query
+	for i := 0; i < 1<<uint(octets*8-ones); i++ {
+		parts := make([]string, octets)
+		for j := 0; j < octets; j++ {
+			parts[j] = fmt.Sprintf("%d", ip[j])
+		}
+		parts[octets-1] = fmt.Sprintf("%d", int(ip[octets-1])+i)
+
+		var q blevequery.FieldableQuery
+		if octets == net.IPv4len {
+			q = bleve.NewTermQuery(strings.Join(parts, "."))
+		} else {
+			q = bleve.NewPrefixQuery(strings.Join(parts, ".") + ".")
+		}
+		q.SetField("sourceip")
+		queries = append(queries, q)
+	}
+	return queries
+}
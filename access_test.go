@@ -0,0 +1,189 @@
+package ekanite
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+// TestEngine_Access tests that every query path is restricted to the events a
+// user's roles grant access to.
+func TestEngine_Access(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newEngine(dataDir, 2, time.Hour)
+	defer e.Close()
+
+	events := []*Event{
+		newParsedEvent("campus-sw1", "%LINK-3-UPDOWN", 187, "link down", parseTime("1982-02-05T04:10:00Z")),
+		newParsedEvent("campus-sw2", "%LINK-3-UPDOWN", 187, "link down", parseTime("1982-02-05T04:20:00Z")),
+		newParsedEvent("dc-core1", "%LINK-3-UPDOWN", 187, "link down", parseTime("1982-02-05T04:30:00Z")),
+		newParsedEvent("fw1", "%ASA-4-106023", 188, "deny tcp", parseTime("1982-02-05T04:40:00Z")),
+	}
+	events[2].SourceIP = "10.20.5.1:514"
+	events[3].SourceIP = "10.30.1.1:514"
+	if err := e.Index(events); err != nil {
+		t.Fatalf("failed to index events: %s", err.Error())
+	}
+
+	a, err := NewAuthenticator(&Credentials{
+		Tenants: []*Tenant{{Name: "datacenter", Sources: []string{"10.20.4.0/22"}}},
+		Roles: []*Role{
+			{Name: "campus", Hosts: []string{"campus-*"}},
+			{Name: "datacenter", Tenants: []string{"datacenter"}},
+		},
+		Users: []*User{
+			{Name: "campus", Tokens: []string{tokenHash("c")}, Roles: []string{"campus"}},
+			{Name: "noc", Tokens: []string{tokenHash("n")}, Roles: []string{"campus", "datacenter"}},
+			{Name: "security", Tokens: []string{tokenHash("s")}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %s", err.Error())
+	}
+
+	tests := []struct {
+		token string
+		query string
+		exp   []string
+	}{
+		{token: "c", query: "", exp: []string{"campus-sw1", "campus-sw2"}},
+		{token: "c", query: "host:dc-core1", exp: nil},
+		{token: "c", query: "link OR deny", exp: []string{"campus-sw1", "campus-sw2"}},
+		{token: "n", query: "link", exp: []string{"campus-sw1", "campus-sw2", "dc-core1"}},
+		{token: "s", query: "", exp: []string{"campus-sw1", "campus-sw2", "dc-core1", "fw1"}},
+	}
+	for _, tt := range tests {
+		u, err := a.Token(tt.token)
+		if err != nil {
+			t.Fatalf("failed to authenticate: %s", err.Error())
+		}
+		ctx := WithUser(context.Background(), u)
+		req := &SearchRequest{Query: tt.query}
+
+		results, err := e.SearchResults(ctx, req)
+		if err != nil {
+			t.Fatalf("%s %q: failed to search: %s", u.Name, tt.query, err.Error())
+		}
+		var hosts []string
+		for r := range results.C {
+			hosts = append(hosts, r.Fields["host"])
+		}
+		if !equalStrings(hosts, tt.exp) {
+			t.Errorf("%s %q: wrong search results, exp %v, got %v", u.Name, tt.query, tt.exp, hosts)
+		}
+
+		n, err := e.Count(ctx, req)
+		if err != nil || n != uint64(len(tt.exp)) {
+			t.Errorf("%s %q: wrong count, exp %d, got %d (%v)", u.Name, tt.query, len(tt.exp), n, err)
+		}
+
+		ar, err := e.Aggregate(ctx, &AggregateRequest{Query: tt.query, Terms: []TermsRequest{{Field: "host"}}})
+		if err != nil {
+			t.Fatalf("%s %q: failed to aggregate: %s", u.Name, tt.query, err.Error())
+		}
+		var terms []string
+		for _, tc := range ar.Terms[0].Terms {
+			terms = append(terms, tc.Term)
+		}
+		sort.Strings(terms)
+		if !equalStrings(terms, tt.exp) {
+			t.Errorf("%s %q: wrong aggregation, exp %v, got %v", u.Name, tt.query, tt.exp, terms)
+		}
+	}
+
+	// Events outside a user's roles cannot be retrieved by ID.
+	u, _ := a.Token("c")
+	if _, err := e.Surrounding(WithUser(context.Background(), u), events[2].ID(), 1, 1); err != ErrEventNotFound {
+		t.Fatalf("inaccessible event retrieved by ID, err: %v", err)
+	}
+
+	// Tail subscriptions are restricted too.
+	tailer := NewTailer()
+	sub, err := tailer.Subscribe(WithUser(context.Background(), u), "", 0)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err.Error())
+	}
+	tailer.Publish(events)
+	tailer.Unsubscribe(sub)
+	var hosts []string
+	for r := range sub.C() {
+		hosts = append(hosts, r.Fields["host"])
+	}
+	if !equalStrings(hosts, []string{"campus-sw1", "campus-sw2"}) {
+		t.Fatalf("wrong tailed events: %v", hosts)
+	}
+}
+
+func TestNewAuthenticator_InvalidRoles(t *testing.T) {
+	token := []string{tokenHash("t")}
+	tests := []struct {
+		name string
+		c    *Credentials
+	}{
+		{name: "no filter", c: &Credentials{Roles: []*Role{{Name: "empty"}}}},
+		{name: "unknown role", c: &Credentials{Users: []*User{{Name: "u", Tokens: token, Roles: []string{"nope"}}}}},
+		{name: "unknown tenant", c: &Credentials{
+			Roles: []*Role{{Name: "r", Tenants: []string{"nope"}}},
+			Users: []*User{{Name: "u", Tokens: token, Roles: []string{"r"}}},
+		}},
+		{name: "bad cidr", c: &Credentials{
+			Roles: []*Role{{Name: "r", Sources: []string{"10.0.0.0"}}},
+			Users: []*User{{Name: "u", Tokens: token, Roles: []string{"r"}}},
+		}},
+		{name: "ipv6 cidr", c: &Credentials{
+			Roles: []*Role{{Name: "r", Sources: []string{"fd00::/8"}}},
+			Users: []*User{{Name: "u", Tokens: token, Roles: []string{"r"}}},
+		}},
+	}
+	for _, tt := range tests {
+		if _, err := NewAuthenticator(tt.c); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestAccessFilter_Match(t *testing.T) {
+	f, err := newAccessFilter([]*Role{{Name: "r", Hosts: []string{"sw?.campus"}, Sources: []string{"192.168.1.128/25"}}}, nil)
+	if err != nil {
+		t.Fatalf("failed to create filter: %s", err.Error())
+	}
+	tests := []struct {
+		fields map[string]string
+		exp    bool
+	}{
+		{fields: map[string]string{"host": "sw1.campus"}, exp: true},
+		{fields: map[string]string{"host": "sw10.campus"}, exp: false},
+		{fields: map[string]string{"host": "sw1xcampus"}, exp: false},
+		{fields: map[string]string{"sourceip": "192.168.1.200"}, exp: true},
+		{fields: map[string]string{"sourceip": "192.168.1.20"}, exp: false},
+		{fields: map[string]string{}, exp: false},
+	}
+	for _, tt := range tests {
+		if got := f.match(tt.fields); got != tt.exp {
+			t.Errorf("%v: wrong match, exp %v, got %v", tt.fields, tt.exp, got)
+		}
+	}
+}
+
+// tokenHash returns the hash of an API token, as stored in a credentials file.
+func tokenHash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
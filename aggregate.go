@@ -0,0 +1,247 @@
+package ekanite
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+// Aggregation defaults
+const (
+	DefaultTermsSize    = 10
+	MaxHistogramBuckets = 1000
+
+	histogramFacetName = "_histogram"
+)
+
+// facetFields are the indexed keyword fields that support term facets.
+var facetFields = []string{"host", "app", "mnemonic", "severity", "sourceip"}
+
+// TermsRequest requests the most frequent values of an indexed field.
+type TermsRequest struct {
+	Field string // One of host, app, mnemonic, severity or sourceip.
+	Size  int    // Number of terms to return. Zero means DefaultTermsSize.
+}
+
+// AggregateRequest describes the aggregations to compute over the events matching
+// a query within a reference time range.
+type AggregateRequest struct {
+	Query    string         // Query selecting events. Empty selects all events.
+	Start    time.Time      // Inclusive start of the time range. Zero is unbounded.
+	End      time.Time      // Exclusive end of the time range. Zero is unbounded.
+	Terms    []TermsRequest // Term facets to compute.
+	Interval time.Duration  // Width of date histogram buckets. Zero disables the histogram.
+}
+
+// TermCount is the number of events carrying a given term.
+type TermCount struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+}
+
+// TermsResult is the result of a TermsRequest.
+type TermsResult struct {
+	Field   string      `json:"field"`
+	Total   int         `json:"total"`   // Events with a value for the field.
+	Missing int         `json:"missing"` // Events without a value for the field.
+	Other   int         `json:"other"`   // Events whose value is not in Terms.
+	Terms   []TermCount `json:"terms"`
+}
+
+// HistogramBucket is the number of events with a reference time in the bucket
+// starting at Start.
+type HistogramBucket struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+// AggregateResult is the result of an AggregateRequest.
+type AggregateResult struct {
+	Total     uint64            `json:"total"`
+	Terms     []*TermsResult    `json:"terms,omitempty"`
+	Histogram []HistogramBucket `json:"histogram,omitempty"`
+}
+
+// Aggregate computes term facets and a date histogram over all events matching the
+// request. Every index overlapping the requested time range is consulted, and the
+// per-index results are merged.
+func (e *Engine) Aggregate(ctx context.Context, req *AggregateRequest) (*AggregateResult, error) {
+	stats.Add("aggregationsRx", 1)
+	if err := validateQuery(req.Query); err != nil {
+		return nil, err
+	}
+	ctx, done, err := e.beginQuery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	terms := make([]TermsRequest, 0, len(req.Terms))
+	for _, t := range req.Terms {
+		field, ok := facetField(t.Field)
+		if !ok {
+			return nil, fmt.Errorf("field %s does not support aggregation", t.Field)
+		}
+		if t.Size <= 0 {
+			t.Size = DefaultTermsSize
+		}
+		terms = append(terms, TermsRequest{Field: field, Size: t.Size})
+	}
+
+	var indexes Indexes
+	for _, i := range e.indexes {
+		if i.Overlaps(req.Start, req.End) {
+			indexes = append(indexes, i)
+		}
+	}
+
+	facets := make(bleve.FacetsRequest)
+	for _, t := range terms {
+		// Ask each index for more terms than requested, so that a term just outside
+		// the top of one index is still counted when the indexes are merged.
+		facets[t.Field] = bleve.NewFacetRequest(t.Field, 2*t.Size+10)
+	}
+
+	var buckets []HistogramBucket
+	if req.Interval > 0 && len(indexes) > 0 {
+		buckets, err = histogramBuckets(req.Start, req.End, req.Interval, indexes)
+		if err != nil {
+			return nil, err
+		}
+		fr := bleve.NewFacetRequest("ReferenceTime", len(buckets))
+		for n, b := range buckets {
+			fr.AddDateTimeRange(strconv.Itoa(n), b.Start, b.Start.Add(req.Interval))
+		}
+		facets[histogramFacetName] = fr
+	}
+
+	result := &AggregateResult{Histogram: buckets}
+	merged := make(map[string]*TermsResult)
+	counts := make(map[string]map[string]int)
+	for _, t := range terms {
+		merged[t.Field] = &TermsResult{Field: t.Field}
+		counts[t.Field] = make(map[string]int)
+	}
+
+	q := restrict(ctx, newRangeQuery(req.Query, req.Start, req.End))
+	for _, i := range indexes {
+		r, err := i.Aggregate(ctx, q, facets)
+		if err != nil {
+			if ctx.Err() != nil {
+				e.queryCancelled(ctx.Err())
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		result.Total += r.Total
+
+		for field, tr := range merged {
+			fr, ok := r.Facets[field]
+			if !ok {
+				continue
+			}
+			tr.Total += fr.Total
+			tr.Missing += fr.Missing
+			for _, tf := range fr.Terms {
+				counts[field][tf.Term] += tf.Count
+			}
+		}
+
+		if fr, ok := r.Facets[histogramFacetName]; ok {
+			for _, dr := range fr.DateRanges {
+				n, err := strconv.Atoi(dr.Name)
+				if err != nil || n < 0 || n >= len(buckets) {
+					continue
+				}
+				buckets[n].Count += dr.Count
+			}
+		}
+	}
+
+	for _, t := range terms {
+		tr := merged[t.Field]
+		tr.Terms = topTerms(counts[t.Field], t.Size)
+		tr.Other = tr.Total
+		for _, tc := range tr.Terms {
+			tr.Other -= tc.Count
+		}
+		result.Terms = append(result.Terms, tr)
+	}
+	return result, nil
+}
+
+// facetField returns the canonical name of the given facet field, and whether
+// the field supports term facets.
+func facetField(name string) (string, bool) {
+	name = strings.ToLower(name)
+	for _, f := range facetFields {
+		if f == name {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// histogramBuckets returns the empty buckets of width interval covering the range from
+// start to end. A zero start or end is taken from the given indexes' time range.
+func histogramBuckets(start, end time.Time, interval time.Duration, indexes Indexes) ([]HistogramBucket, error) {
+	if start.IsZero() || end.IsZero() {
+		first, last := indexes[0].StartTime(), indexes[0].EndTime()
+		for _, i := range indexes {
+			if i.StartTime().Before(first) {
+				first = i.StartTime()
+			}
+			if i.EndTime().After(last) {
+				last = i.EndTime()
+			}
+		}
+		if start.IsZero() {
+			start = first
+		}
+		if end.IsZero() {
+			end = last
+		}
+	}
+
+	start = start.Truncate(interval).UTC()
+	if !end.After(start) {
+		return nil, fmt.Errorf("histogram end time %s is not after start time %s", end, start)
+	}
+	n := int((end.Sub(start) + interval - 1) / interval)
+	if n > MaxHistogramBuckets {
+		return nil, fmt.Errorf("histogram would have %d buckets, maximum is %d", n, MaxHistogramBuckets)
+	}
+
+	buckets := make([]HistogramBucket, n)
+	for b := range buckets {
+		buckets[b].Start = start.Add(time.Duration(b) * interval)
+	}
+	return buckets, nil
+}
+
+// topTerms returns the size most frequent terms in counts, most frequent first. Terms
+// with equal counts are ordered alphabetically.
+func topTerms(counts map[string]int, size int) []TermCount {
+	tcs := make([]TermCount, 0, len(counts))
+	for t, c := range counts {
+		tcs = append(tcs, TermCount{Term: t, Count: c})
+	}
+	sort.Slice(tcs, func(i, j int) bool {
+		if tcs[i].Count == tcs[j].Count {
+			return tcs[i].Term < tcs[j].Term
+		}
+		return tcs[i].Count > tcs[j].Count
+	})
+	if len(tcs) > size {
+		tcs = tcs[:size]
+	}
+	return tcs
+}
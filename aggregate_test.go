@@ -0,0 +1,141 @@
+package ekanite
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+func TestEngine_Aggregate(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newEngine(dataDir, 2, time.Hour)
+	defer e.Close()
+
+	// Events are spread across two indexes.
+	events := []*Event{
+		newParsedEvent("router1", "%LINK-3-UPDOWN", 187, "link down", parseTime("1982-02-05T04:10:00Z")),
+		newParsedEvent("router1", "%LINK-3-UPDOWN", 187, "link up", parseTime("1982-02-05T04:20:00Z")),
+		newParsedEvent("router2", "%LINK-3-UPDOWN", 187, "link down", parseTime("1982-02-05T04:50:00Z")),
+		newParsedEvent("router1", "%SYS-5-CONFIG_I", 189, "configured", parseTime("1982-02-05T05:10:00Z")),
+		newParsedEvent("router3", "%LINK-3-UPDOWN", 187, "link down", parseTime("1982-02-05T05:40:00Z")),
+		newParsedEvent("router1", "%LINK-3-UPDOWN", 187, "link up", parseTime("1982-02-05T05:45:00Z")),
+	}
+	if err := e.Index(events); err != nil {
+		t.Fatalf("failed to index events: %s", err.Error())
+	}
+	if len(e.indexes) != 2 {
+		t.Fatalf("wrong number of indexes, exp 2, got %d", len(e.indexes))
+	}
+
+	r, err := e.Aggregate(context.Background(), &AggregateRequest{
+		Query:    "link",
+		Terms:    []TermsRequest{{Field: "Host", Size: 2}, {Field: "severity"}},
+		Interval: 30 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("failed to aggregate: %s", err.Error())
+	}
+	if r.Total != 5 {
+		t.Fatalf("wrong aggregation total, exp 5, got %d", r.Total)
+	}
+
+	hosts := r.Terms[0]
+	if hosts.Field != "host" {
+		t.Fatalf("wrong terms field, exp host, got %s", hosts.Field)
+	}
+	expTerms := []TermCount{{"router1", 3}, {"router2", 1}}
+	if !reflect.DeepEqual(hosts.Terms, expTerms) {
+		t.Fatalf("wrong host terms, exp %v, got %v", expTerms, hosts.Terms)
+	}
+	if hosts.Total != 5 || hosts.Other != 1 {
+		t.Fatalf("wrong host totals, exp 5 total and 1 other, got %d and %d", hosts.Total, hosts.Other)
+	}
+	expTerms = []TermCount{{"err", 5}}
+	if !reflect.DeepEqual(r.Terms[1].Terms, expTerms) {
+		t.Fatalf("wrong severity terms, exp %v, got %v", expTerms, r.Terms[1].Terms)
+	}
+
+	expBuckets := []HistogramBucket{
+		{parseTime("1982-02-05T04:00:00Z"), 2},
+		{parseTime("1982-02-05T04:30:00Z"), 1},
+		{parseTime("1982-02-05T05:00:00Z"), 0},
+		{parseTime("1982-02-05T05:30:00Z"), 2},
+	}
+	if !reflect.DeepEqual(r.Histogram, expBuckets) {
+		t.Fatalf("wrong histogram, exp %v, got %v", expBuckets, r.Histogram)
+	}
+
+	// Restrict the time range to the first index.
+	r, err = e.Aggregate(context.Background(), &AggregateRequest{
+		Start: parseTime("1982-02-05T04:15:00Z"),
+		End:   parseTime("1982-02-05T05:00:00Z"),
+		Terms: []TermsRequest{{Field: "host"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to aggregate time range: %s", err.Error())
+	}
+	expTerms = []TermCount{{"router1", 1}, {"router2", 1}}
+	if r.Total != 2 || !reflect.DeepEqual(r.Terms[0].Terms, expTerms) {
+		t.Fatalf("wrong time range aggregation, exp 2 events %v, got %d events %v", expTerms, r.Total, r.Terms[0].Terms)
+	}
+
+	if _, err := e.Aggregate(context.Background(), &AggregateRequest{Terms: []TermsRequest{{Field: "Message"}}}); err == nil {
+		t.Fatalf("aggregating an unsupported field did not fail")
+	}
+	if _, err := e.Aggregate(context.Background(), &AggregateRequest{Query: "host:", Terms: []TermsRequest{{Field: "host"}}}); err == nil {
+		t.Fatalf("aggregating an invalid query did not fail")
+	}
+}
+
+func TestIndex_Overlaps(t *testing.T) {
+	i := &Index{
+		startTime: parseTime("1982-02-05T04:00:00Z"),
+		endTime:   parseTime("1982-02-05T05:00:00Z"),
+	}
+
+	tests := []struct {
+		start, end string
+		overlaps   bool
+	}{
+		{"", "", true},
+		{"1982-02-05T04:30:00Z", "", true},
+		{"1982-02-05T05:00:00Z", "", false},
+		{"", "1982-02-05T04:00:00Z", false},
+		{"", "1982-02-05T04:00:01Z", true},
+		{"1982-02-05T03:00:00Z", "1982-02-05T06:00:00Z", true},
+		{"1982-02-05T06:00:00Z", "1982-02-05T07:00:00Z", false},
+	}
+	for n, tt := range tests {
+		var start, end time.Time
+		if tt.start != "" {
+			start = parseTime(tt.start)
+		}
+		if tt.end != "" {
+			end = parseTime(tt.end)
+		}
+		if i.Overlaps(start, end) != tt.overlaps {
+			t.Errorf("test %d: wrong overlap for %s to %s, exp %v", n, tt.start, tt.end, tt.overlaps)
+		}
+	}
+}
+
+func newParsedEvent(host, app string, priority int, message string, refTime time.Time) *Event {
+	return &Event{
+		&input.Event{
+			Text: message,
+			Parsed: map[string]interface{}{
+				"priority":  priority,
+				"timestamp": refTime.Format(time.RFC3339),
+				"host":      host,
+				"app":       app,
+				"message":   message,
+			},
+			ReceptionTime: refTime,
+		},
+	}
+}
@@ -0,0 +1,549 @@
+package ekanite
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+// Saved search defaults
+const (
+	MinAlertInterval         = 10 * time.Second
+	MaxAlertGroups           = 100
+	DefaultAlertHistoryLimit = 100
+
+	alertCheckInterval   = time.Second
+	savedSearchesFile    = "searches.json"
+	alertHistoryFile     = "alerts.log"
+	alertFilePermissions = 0600
+)
+
+// ErrSearchNotFound is returned when a saved search does not exist.
+var ErrSearchNotFound = errors.New("saved search not found")
+
+// savedSearchName is the form of saved search names, which are used in URLs.
+var savedSearchName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// SavedSearch is a query evaluated on a schedule, which fires an alert whenever the
+// number of events it matches meets its condition.
+type SavedSearch struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+
+	// Interval is how often the search is evaluated, such as "1m".
+	Interval string `json:"interval"`
+
+	// Window is how far before each evaluation events are counted, such as "5m".
+	// It defaults to Interval.
+	Window string `json:"window,omitempty"`
+
+	// GroupBy, if set, is a field supporting aggregation, such as host. Events are
+	// then counted, and the condition checked, for each value of the field.
+	GroupBy string `json:"groupBy,omitempty"`
+
+	Condition Condition `json:"condition"`
+	Disabled  bool      `json:"disabled,omitempty"`
+
+	// Owner is the user who saved the search, if authentication is enabled. The
+	// search only counts events the owner may access.
+	Owner string `json:"owner,omitempty"`
+
+	// LastRun is the result of the latest evaluation, if any.
+	LastRun *SearchRun `json:"lastRun,omitempty"`
+
+	interval time.Duration
+	window   time.Duration
+}
+
+// Condition compares the number of events counted by a saved search with a threshold.
+type Condition struct {
+	Op        string `json:"op"` // One of >, >=, <, <=, == or !=.
+	Threshold uint64 `json:"threshold"`
+}
+
+// met returns whether the count meets the condition.
+func (c Condition) met(n uint64) bool {
+	switch c.Op {
+	case ">":
+		return n > c.Threshold
+	case ">=":
+		return n >= c.Threshold
+	case "<":
+		return n < c.Threshold
+	case "<=":
+		return n <= c.Threshold
+	case "==":
+		return n == c.Threshold
+	case "!=":
+		return n != c.Threshold
+	}
+	return false
+}
+
+func (c Condition) String() string {
+	return fmt.Sprintf("%s %d", c.Op, c.Threshold)
+}
+
+// validate checks the saved search, and parses its durations.
+func (s *SavedSearch) validate() error {
+	if !savedSearchName.MatchString(s.Name) {
+		return fmt.Errorf("invalid name '%s': must be letters, digits, '_', '.' or '-'", s.Name)
+	}
+	if err := validateQuery(s.Query); err != nil {
+		return err
+	}
+	var err error
+	if s.interval, err = time.ParseDuration(s.Interval); err != nil || s.interval < MinAlertInterval {
+		return fmt.Errorf("invalid interval '%s': must be at least %s", s.Interval, MinAlertInterval)
+	}
+	s.window = s.interval
+	if s.Window != "" {
+		if s.window, err = time.ParseDuration(s.Window); err != nil || s.window <= 0 {
+			return fmt.Errorf("invalid window '%s'", s.Window)
+		}
+	}
+	if s.GroupBy != "" {
+		if _, ok := facetField(s.GroupBy); !ok {
+			return fmt.Errorf("field %s does not support aggregation", s.GroupBy)
+		}
+	}
+	switch s.Condition.Op {
+	case ">", ">=", "<", "<=", "==", "!=":
+	default:
+		return fmt.Errorf("invalid condition operator '%s'", s.Condition.Op)
+	}
+	return nil
+}
+
+// copy returns a copy of the saved search.
+func (s *SavedSearch) copy() *SavedSearch {
+	c := *s
+	if s.LastRun != nil {
+		r := *s.LastRun
+		c.LastRun = &r
+	}
+	return &c
+}
+
+// SearchRun is the result of evaluating a saved search.
+type SearchRun struct {
+	Time   time.Time   `json:"time"`
+	Start  time.Time   `json:"start"`
+	End    time.Time   `json:"end"`
+	Total  uint64      `json:"total"`            // Events counted.
+	Groups []TermCount `json:"groups,omitempty"` // Events counted per group, if grouped.
+	Fired  int         `json:"fired"`            // Alerts fired.
+	Error  string      `json:"error,omitempty"`
+}
+
+// Alert records that the count of a saved search met its condition.
+type Alert struct {
+	Search    string    `json:"search"`
+	Time      time.Time `json:"time"`
+	Query     string    `json:"query"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Field     string    `json:"field,omitempty"` // The group, if the search is grouped.
+	Value     string    `json:"value,omitempty"`
+	Count     uint64    `json:"count"`
+	Condition Condition `json:"condition"`
+}
+
+// Message describes the alert.
+func (a *Alert) Message() string {
+	group := ""
+	if a.Field != "" {
+		group = fmt.Sprintf(" for %s %s", a.Field, a.Value)
+	}
+	return fmt.Sprintf("saved search '%s' counted %d events%s in %s, condition %s",
+		a.Search, a.Count, group, a.End.Sub(a.Start), a.Condition)
+}
+
+// Event returns the alert as an event, for dispatchers.
+func (a *Alert) Event() *input.Event {
+	parsed := map[string]interface{}{
+		"timestamp": a.Time.Format(time.RFC3339),
+		"app":       "ekanite",
+		"message":   a.Message(),
+		"alert":     a.Search,
+		"query":     a.Query,
+		"count":     a.Count,
+	}
+	if a.Field != "" {
+		parsed[a.Field] = a.Value
+	}
+	return &input.Event{Text: a.Message(), Parsed: parsed, ReceptionTime: a.Time}
+}
+
+// Evaluate counts the events matching the saved search in the window ending at now,
+// for each group if the search is grouped, and returns an alert for every count
+// meeting its condition. Groups are only counted if they contain at least one event.
+func (e *Engine) Evaluate(ctx context.Context, s *SavedSearch, now time.Time) (*SearchRun, []*Alert, error) {
+	run := &SearchRun{Time: now, Start: now.Add(-s.window), End: now}
+	counts := []TermCount{{Count: 0}}
+	if s.GroupBy == "" {
+		n, err := e.Count(ctx, &SearchRequest{Query: s.Query, Start: run.Start, End: run.End})
+		if err != nil {
+			return nil, nil, err
+		}
+		run.Total = n
+		counts[0].Count = int(n)
+	} else {
+		if err := validateQuery(s.Query); err != nil {
+			return nil, nil, err
+		}
+		r, err := e.Aggregate(ctx, &AggregateRequest{
+			Query: s.Query,
+			Start: run.Start,
+			End:   run.End,
+			Terms: []TermsRequest{{Field: s.GroupBy, Size: MaxAlertGroups}},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		run.Total = r.Total
+		run.Groups = r.Terms[0].Terms
+		counts = run.Groups
+	}
+
+	var alerts []*Alert
+	for _, c := range counts {
+		if !s.Condition.met(uint64(c.Count)) {
+			continue
+		}
+		a := &Alert{
+			Search:    s.Name,
+			Time:      now,
+			Query:     s.Query,
+			Start:     run.Start,
+			End:       run.End,
+			Count:     uint64(c.Count),
+			Condition: s.Condition,
+		}
+		if s.GroupBy != "" {
+			a.Field, a.Value = s.GroupBy, c.Term
+		}
+		alerts = append(alerts, a)
+	}
+	run.Fired = len(alerts)
+	return run, alerts, nil
+}
+
+// SearchEvaluator is the interface a system that can evaluate saved searches must
+// implement.
+type SearchEvaluator interface {
+	Evaluate(ctx context.Context, s *SavedSearch, now time.Time) (*SearchRun, []*Alert, error)
+}
+
+// Alerter stores saved searches in a directory, evaluates each on its schedule, and
+// records the alerts fired.
+type Alerter struct {
+	dir       string
+	evaluator SearchEvaluator
+
+	mu       sync.Mutex
+	searches map[string]*SavedSearch
+	next     map[string]time.Time // When each search is next evaluated.
+	history  *os.File
+
+	// Auth, if set, is used to evaluate each saved search with the access of its owner.
+	Auth *Authenticator
+
+	// Dispatch, if set, is passed an event for every alert fired.
+	Dispatch func(events []*input.Event)
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	Logger *log.Logger
+}
+
+// NewAlerter returns an Alerter storing saved searches in dir, and evaluating them
+// with ev.
+func NewAlerter(dir string, ev SearchEvaluator) *Alerter {
+	return &Alerter{
+		dir:       dir,
+		evaluator: ev,
+		searches:  make(map[string]*SavedSearch),
+		next:      make(map[string]time.Time),
+		done:      make(chan struct{}),
+		Logger:    log.New(os.Stderr, "[alerter] ", log.LstdFlags),
+	}
+}
+
+// Open loads the saved searches, and starts evaluating them.
+func (a *Alerter) Open() error {
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(filepath.Join(a.dir, savedSearchesFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read saved searches: %s", err.Error())
+	}
+	if err == nil {
+		var searches []*SavedSearch
+		if err := json.Unmarshal(b, &searches); err != nil {
+			return fmt.Errorf("failed to parse saved searches: %s", err.Error())
+		}
+		now := time.Now().UTC()
+		for _, s := range searches {
+			if err := s.validate(); err != nil {
+				return fmt.Errorf("saved search %s: %s", s.Name, err.Error())
+			}
+			a.searches[s.Name] = s
+			a.next[s.Name] = now.Add(s.interval)
+		}
+	}
+
+	a.history, err = os.OpenFile(filepath.Join(a.dir, alertHistoryFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, alertFilePermissions)
+	if err != nil {
+		return fmt.Errorf("failed to open alert history: %s", err.Error())
+	}
+
+	a.wg.Add(1)
+	go a.run()
+	a.Logger.Printf("alerter opened with %d saved searches", len(a.searches))
+	return nil
+}
+
+// Close stops evaluating saved searches.
+func (a *Alerter) Close() error {
+	close(a.done)
+	a.wg.Wait()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.history.Close()
+}
+
+// Searches returns every saved search owned by owner, sorted by name. If owner is
+// empty, every saved search is returned.
+func (a *Alerter) Searches(owner string) []*SavedSearch {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	searches := make([]*SavedSearch, 0, len(a.searches))
+	for _, s := range a.searches {
+		if owner == "" || s.Owner == owner {
+			searches = append(searches, s.copy())
+		}
+	}
+	sort.Slice(searches, func(i, j int) bool { return searches[i].Name < searches[j].Name })
+	return searches
+}
+
+// Search returns the named saved search.
+func (a *Alerter) Search(name string) (*SavedSearch, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.searches[name]
+	if !ok {
+		return nil, ErrSearchNotFound
+	}
+	return s.copy(), nil
+}
+
+// Save creates or replaces a saved search, which is first evaluated after its interval.
+// If the saved searches cannot be written to disk, nothing is changed.
+func (a *Alerter) Save(s *SavedSearch) error {
+	s = s.copy()
+	if err := s.validate(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	old, exists := a.searches[s.Name]
+	if exists {
+		s.LastRun = old.LastRun
+	} else {
+		s.LastRun = nil
+	}
+	a.searches[s.Name] = s
+	if err := a.persist(); err != nil {
+		if exists {
+			a.searches[s.Name] = old
+		} else {
+			delete(a.searches, s.Name)
+		}
+		return err
+	}
+	a.next[s.Name] = time.Now().UTC().Add(s.interval)
+	return nil
+}
+
+// Delete deletes the named saved search. Its history is kept. If the saved searches
+// cannot be written to disk, nothing is changed.
+func (a *Alerter) Delete(name string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	old, ok := a.searches[name]
+	if !ok {
+		return ErrSearchNotFound
+	}
+	delete(a.searches, name)
+	if err := a.persist(); err != nil {
+		a.searches[name] = old
+		return err
+	}
+	delete(a.next, name)
+	return nil
+}
+
+// History returns the latest alerts fired by the named saved search, latest first.
+// If name is empty, alerts fired by every saved search are returned. Zero limit
+// means DefaultAlertHistoryLimit.
+func (a *Alerter) History(name string, limit int) ([]*Alert, error) {
+	if limit <= 0 {
+		limit = DefaultAlertHistoryLimit
+	}
+	f, err := os.Open(filepath.Join(a.dir, alertHistoryFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	alerts := make([]*Alert, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		al := &Alert{}
+		if err := json.Unmarshal(scanner.Bytes(), al); err != nil {
+			// An alert may be part way through being written.
+			continue
+		}
+		if name != "" && al.Search != name {
+			continue
+		}
+		alerts = append(alerts, al)
+		if len(alerts) > limit {
+			alerts = alerts[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(alerts)-1; i < j; i, j = i+1, j-1 {
+		alerts[i], alerts[j] = alerts[j], alerts[i]
+	}
+	return alerts, nil
+}
+
+// persist writes the saved searches to disk. It must be called under lock.
+func (a *Alerter) persist() error {
+	searches := make([]*SavedSearch, 0, len(a.searches))
+	for _, s := range a.searches {
+		searches = append(searches, s)
+	}
+	sort.Slice(searches, func(i, j int) bool { return searches[i].Name < searches[j].Name })
+	if err := writeFileAtomic(filepath.Join(a.dir, savedSearchesFile), searches, alertFilePermissions); err != nil {
+		return fmt.Errorf("failed to write saved searches: %s", err.Error())
+	}
+	return nil
+}
+
+// writeFileAtomic writes v as indented JSON to the file at path, replacing the file
+// atomically so that it is never left part written.
+func writeFileAtomic(path string, v interface{}, perm os.FileMode) error {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", b, perm); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// run periodically evaluates the saved searches which are due.
+func (a *Alerter) run() {
+	defer a.wg.Done()
+	ticker := time.NewTicker(alertCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			a.evaluateDue(time.Now().UTC())
+		}
+	}
+}
+
+// evaluateDue evaluates every enabled saved search due by now.
+func (a *Alerter) evaluateDue(now time.Time) {
+	a.mu.Lock()
+	var due []*SavedSearch
+	for name, s := range a.searches {
+		if !s.Disabled && !now.Before(a.next[name]) {
+			due = append(due, s.copy())
+			a.next[name] = now.Add(s.interval)
+		}
+	}
+	a.mu.Unlock()
+
+	for _, s := range due {
+		a.evaluate(s, now)
+	}
+}
+
+// evaluate evaluates a saved search, records its result and any alerts fired, and
+// dispatches the alerts once the lock is released.
+func (a *Alerter) evaluate(s *SavedSearch, now time.Time) {
+	stats.Add("savedSearchesRun", 1)
+	ctx := context.Background()
+	var run *SearchRun
+	var alerts []*Alert
+	var err error
+	if a.Auth != nil && s.Owner != "" {
+		u, ok := a.Auth.User(s.Owner)
+		if !ok {
+			err = fmt.Errorf("owner %s no longer exists", s.Owner)
+		}
+		ctx = WithUser(ctx, u)
+	}
+	if err == nil {
+		run, alerts, err = a.evaluator.Evaluate(ctx, s, now)
+	}
+	if err != nil {
+		a.Logger.Printf("failed to evaluate saved search %s: %s", s.Name, err.Error())
+		stats.Add("savedSearchErrors", 1)
+		run = &SearchRun{Time: now, Error: err.Error()}
+	}
+
+	a.mu.Lock()
+	if cur, ok := a.searches[s.Name]; ok {
+		cur.LastRun = run
+		if err := a.persist(); err != nil {
+			a.Logger.Printf("failed to record run of saved search %s: %s", s.Name, err.Error())
+		}
+	}
+
+	events := make([]*input.Event, 0, len(alerts))
+	for _, al := range alerts {
+		a.Logger.Print(al.Message())
+		stats.Add("alertsFired", 1)
+		b, err := json.Marshal(al)
+		if err == nil {
+			_, err = a.history.Write(append(b, '\n'))
+		}
+		if err != nil {
+			a.Logger.Printf("failed to record alert of saved search %s: %s", s.Name, err.Error())
+		}
+		events = append(events, al.Event())
+	}
+	a.mu.Unlock()
+
+	if len(events) > 0 && a.Dispatch != nil {
+		a.Dispatch(events)
+	}
+}
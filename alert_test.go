@@ -0,0 +1,320 @@
+package ekanite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+// newAlertEngine returns an engine holding failed logins from two hosts.
+func newAlertEngine(t *testing.T, path string) *Engine {
+	e := newEngine(path, 2, time.Hour)
+	var events []*Event
+	for i := 0; i < 5; i++ {
+		events = append(events, newParsedEvent("router1", "%SEC_LOGIN-4-LOGIN_FAILED", 187, "login failed", parseTime("1982-02-05T04:10:00Z").Add(time.Duration(i)*time.Second)))
+	}
+	events = append(events,
+		newParsedEvent("router2", "%SEC_LOGIN-4-LOGIN_FAILED", 187, "login failed", parseTime("1982-02-05T04:12:00Z")),
+		newParsedEvent("router2", "%SEC_LOGIN-4-LOGIN_FAILED", 187, "login failed", parseTime("1982-02-05T03:00:00Z")),
+	)
+	if err := e.Index(events); err != nil {
+		t.Fatalf("failed to index events: %s", err.Error())
+	}
+	return e
+}
+
+func TestEngine_Evaluate(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newAlertEngine(t, dataDir)
+	defer e.Close()
+	now := parseTime("1982-02-05T04:15:00Z")
+
+	tests := []struct {
+		search *SavedSearch
+		total  uint64
+		exp    []string // Values of the alerts fired, "" if not grouped.
+	}{
+		{
+			search: &SavedSearch{Name: "a", Query: "login", Interval: "1m", Window: "10m", GroupBy: "host", Condition: Condition{">", 2}},
+			total:  6,
+			exp:    []string{"router1"},
+		},
+		{
+			search: &SavedSearch{Name: "b", Query: "login", Interval: "1m", Window: "10m", GroupBy: "host", Condition: Condition{">=", 1}},
+			total:  6,
+			exp:    []string{"router1", "router2"},
+		},
+		{
+			search: &SavedSearch{Name: "c", Query: "login", Interval: "1m", Window: "2h", Condition: Condition{"==", 7}},
+			total:  7,
+			exp:    []string{""},
+		},
+		{
+			search: &SavedSearch{Name: "d", Query: "login", Interval: "1m", Condition: Condition{">", 0}},
+			total:  0,
+		},
+	}
+	for _, tt := range tests {
+		if err := tt.search.validate(); err != nil {
+			t.Fatalf("%s: invalid search: %s", tt.search.Name, err.Error())
+		}
+		run, alerts, err := e.Evaluate(context.Background(), tt.search, now)
+		if err != nil {
+			t.Fatalf("%s: failed to evaluate: %s", tt.search.Name, err.Error())
+		}
+		if run.Total != tt.total || run.Fired != len(tt.exp) {
+			t.Errorf("%s: wrong run, exp total %d and %d fired, got %+v", tt.search.Name, tt.total, len(tt.exp), run)
+		}
+		var values []string
+		for _, a := range alerts {
+			values = append(values, a.Value)
+		}
+		if !equalStrings(values, tt.exp) {
+			t.Errorf("%s: wrong alerts, exp %v, got %v", tt.search.Name, tt.exp, values)
+		}
+	}
+}
+
+func TestSavedSearch_Validate(t *testing.T) {
+	for _, s := range []*SavedSearch{
+		{Name: "bad name", Query: "x", Interval: "1m", Condition: Condition{">", 1}},
+		{Name: "a", Query: "host:", Interval: "1m", Condition: Condition{">", 1}},
+		{Name: "a", Query: "x", Interval: "1s", Condition: Condition{">", 1}},
+		{Name: "a", Query: "x", Interval: "1m", Window: "soon", Condition: Condition{">", 1}},
+		{Name: "a", Query: "x", Interval: "1m", GroupBy: "message", Condition: Condition{">", 1}},
+		{Name: "a", Query: "x", Interval: "1m", Condition: Condition{"=>", 1}},
+	} {
+		if err := s.validate(); err == nil {
+			t.Errorf("invalid saved search %+v passed validation", s)
+		}
+	}
+}
+
+func TestAlerter(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newAlertEngine(t, dataDir)
+	defer e.Close()
+
+	auth, err := NewAuthenticator(&Credentials{
+		Users: []*User{{Name: "alice", Tokens: []string{tokenHash("a")}, Roles: []string{"r2"}}},
+		Roles: []*Role{{Name: "r2", Hosts: []string{"router2"}}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %s", err.Error())
+	}
+
+	a := NewAlerter(dataDir, e)
+	a.Auth = auth
+	if err := a.Open(); err != nil {
+		t.Fatalf("failed to open alerter: %s", err.Error())
+	}
+	for _, s := range []*SavedSearch{
+		{Name: "failed-logins", Query: "login", Interval: "5m", GroupBy: "host", Condition: Condition{">", 2}},
+		{Name: "alice", Query: "login", Interval: "5m", GroupBy: "host", Condition: Condition{">", 0}, Owner: "alice"},
+		{Name: "gone", Query: "login", Interval: "5m", Condition: Condition{">", 0}, Owner: "bob"},
+	} {
+		if err := a.Save(s); err != nil {
+			t.Fatalf("failed to save search %s: %s", s.Name, err.Error())
+		}
+	}
+	if err := a.Save(&SavedSearch{Name: "bad", Query: "x", Interval: "1m"}); err == nil {
+		t.Fatalf("invalid search saved")
+	}
+	a.Close()
+
+	// Saved searches are loaded when the alerter is reopened.
+	a = NewAlerter(dataDir, e)
+	a.Auth = auth
+	var dispatched []*input.Event
+	a.Dispatch = func(events []*input.Event) {
+		// Alerts are dispatched without holding the alerter's lock.
+		a.Searches("")
+		dispatched = append(dispatched, events...)
+	}
+	if err := a.Open(); err != nil {
+		t.Fatalf("failed to reopen alerter: %s", err.Error())
+	}
+	defer a.Close()
+	if searches := a.Searches(""); len(searches) != 3 || searches[0].Name != "alice" {
+		t.Fatalf("wrong saved searches after reopening: %v", searches)
+	}
+	if searches := a.Searches("alice"); len(searches) != 1 {
+		t.Fatalf("wrong saved searches for alice: %v", searches)
+	}
+
+	// Searches are evaluated once due.
+	now := parseTime("1982-02-05T04:15:00Z")
+	a.evaluateDue(now)
+	if len(dispatched) != 0 {
+		t.Fatalf("searches evaluated before they were due")
+	}
+	a.mu.Lock()
+	for name := range a.next {
+		a.next[name] = time.Time{}
+	}
+	a.mu.Unlock()
+	a.evaluateDue(now)
+
+	if len(dispatched) != 2 {
+		t.Fatalf("wrong number of alerts dispatched, exp 2, got %d", len(dispatched))
+	}
+	for _, ev := range dispatched {
+		if ev.Parsed["alert"] == "failed-logins" && ev.Parsed["host"] != "router1" {
+			t.Errorf("wrong alert event: %v", ev.Parsed)
+		}
+		if ev.Parsed["alert"] == "alice" && ev.Parsed["host"] != "router2" {
+			t.Errorf("search evaluated without its owner's access: %v", ev.Parsed)
+		}
+	}
+
+	s, err := a.Search("failed-logins")
+	if err != nil || s.LastRun == nil || s.LastRun.Fired != 1 || s.LastRun.Total != 6 {
+		t.Fatalf("wrong last run: %+v (%v)", s.LastRun, err)
+	}
+	if s, _ := a.Search("gone"); s.LastRun == nil || !strings.Contains(s.LastRun.Error, "bob") {
+		t.Fatalf("search of a missing owner did not fail: %+v", s.LastRun)
+	}
+
+	history, err := a.History("failed-logins", 0)
+	if err != nil || len(history) != 1 || history[0].Value != "router1" || history[0].Count != 5 {
+		t.Fatalf("wrong history: %v (%v)", history, err)
+	}
+	if history, _ := a.History("", 0); len(history) != 2 {
+		t.Fatalf("wrong number of alerts in history, exp 2, got %d", len(history))
+	}
+
+	if err := a.Delete("gone"); err != nil {
+		t.Fatalf("failed to delete saved search: %s", err.Error())
+	}
+	if _, err := a.Search("gone"); err != ErrSearchNotFound {
+		t.Fatalf("deleted search found: %v", err)
+	}
+
+	// Changes which cannot be written to disk fail, and are not made.
+	tmp := filepath.Join(dataDir, savedSearchesFile+".tmp")
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		t.Fatalf("failed to block saved searches file: %s", err.Error())
+	}
+	if err := a.Save(&SavedSearch{Name: "new", Query: "login", Interval: "5m", Condition: Condition{">", 0}}); err == nil {
+		t.Fatalf("unwritten search saved")
+	}
+	if _, err := a.Search("new"); err != ErrSearchNotFound {
+		t.Fatalf("unwritten search found: %v", err)
+	}
+	if err := a.Delete("alice"); err == nil {
+		t.Fatalf("unwritten deletion succeeded")
+	}
+	if _, err := a.Search("alice"); err != nil {
+		t.Fatalf("search deleted without being written: %v", err)
+	}
+	os.Remove(tmp)
+}
+
+// TestHTTPServer_SavedSearches tests managing saved searches through the API, where
+// users only see their own searches.
+func TestHTTPServer_SavedSearches(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newAlertEngine(t, dataDir)
+	defer e.Close()
+	a := NewAlerter(dataDir, e)
+	if err := a.Open(); err != nil {
+		t.Fatalf("failed to open alerter: %s", err.Error())
+	}
+	defer a.Close()
+
+	auth, err := NewAuthenticator(&Credentials{Users: []*User{
+		{Name: "alice", Tokens: []string{tokenHash("a")}},
+		{Name: "bob", Tokens: []string{tokenHash("b")}},
+	}})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %s", err.Error())
+	}
+	s := NewHTTPServer("", e)
+	s.Auth = auth
+	s.Alerts = a
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	search := `{"name": "failed-logins", "query": "login", "interval": "1m", "window": "5m", "groupBy": "host", "condition": {"op": ">", "threshold": 20}}`
+	if w := do("POST", "/api/v1/searches", "a", search); w.Code != http.StatusCreated {
+		t.Fatalf("failed to create saved search: %d %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/api/v1/searches", "a", search); w.Code != http.StatusConflict {
+		t.Fatalf("duplicate saved search created: %d", w.Code)
+	}
+	if w := do("POST", "/api/v1/searches", "a", `{"name": "x", "query": "login", "interval": "1m"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid saved search created: %d", w.Code)
+	}
+
+	w := do("GET", "/api/v1/searches/failed-logins", "a", "")
+	var ss SavedSearch
+	if err := json.Unmarshal(w.Body.Bytes(), &ss); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("failed to get saved search: %d %s", w.Code, w.Body.String())
+	}
+	if ss.Owner != "alice" || ss.GroupBy != "host" || ss.Condition.Threshold != 20 {
+		t.Fatalf("wrong saved search: %+v", ss)
+	}
+
+	// Other users can neither see, replace nor delete the search.
+	// Nor learn that it exists, by creating or replacing a search of the same name.
+	for _, w := range []*httptest.ResponseRecorder{
+		do("GET", "/api/v1/searches/failed-logins", "b", ""),
+		do("POST", "/api/v1/searches", "b", search),
+		do("PUT", "/api/v1/searches/failed-logins", "b", search),
+		do("DELETE", "/api/v1/searches/failed-logins", "b", ""),
+	} {
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), ErrSearchNotFound.Error()) {
+			t.Fatalf("other user's saved search revealed: %d %s", w.Code, w.Body.String())
+		}
+	}
+	var list apiSavedSearchesResponse
+	w = do("GET", "/api/v1/searches", "b", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Searches) != 0 {
+		t.Fatalf("other user listed saved searches: %s", w.Body.String())
+	}
+
+	w = do("PUT", "/api/v1/searches/failed-logins", "a", strings.Replace(search, "20", "2", 1))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"threshold":2}`) {
+		t.Fatalf("failed to replace saved search: %d %s", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/api/v1/searches/other", "a", search); w.Code != http.StatusBadRequest {
+		t.Fatalf("saved search with mismatched name saved: %d", w.Code)
+	}
+
+	a.mu.Lock()
+	a.next["failed-logins"] = time.Time{}
+	a.mu.Unlock()
+	a.evaluateDue(parseTime("1982-02-05T04:15:00Z"))
+	var alerts apiAlertsResponse
+	w = do("GET", "/api/v1/searches/failed-logins/history", "a", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &alerts); err != nil || len(alerts.Alerts) != 1 || alerts.Alerts[0].Value != "router1" {
+		t.Fatalf("wrong alert history: %d %s", w.Code, w.Body.String())
+	}
+
+	if w := do("DELETE", "/api/v1/searches/failed-logins", "b", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("other user deleted saved search: %d", w.Code)
+	}
+	if w := do("DELETE", "/api/v1/searches/failed-logins", "a", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("failed to delete saved search: %d %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/api/v1/searches/failed-logins", "a", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("deleted saved search found: %d", w.Code)
+	}
+}
@@ -0,0 +1,184 @@
+package ekanite
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit defaults
+const (
+	DefaultAuditLimit = 100
+
+	auditFilePermissions = 0600
+)
+
+// AuditRecord describes a query made by a client of a query server.
+type AuditRecord struct {
+	Time     time.Time  `json:"time"`
+	User     string     `json:"user,omitempty"` // Empty if authentication is not enabled.
+	Client   string     `json:"client"`
+	Protocol string     `json:"protocol"` // tcp or http.
+	Command  string     `json:"command"`  // Such as search, pipeline, count, export, context or tail.
+	Query    string     `json:"query"`
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	Results  int        `json:"results"`
+	Duration float64    `json:"durationMs"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// newAuditRecord returns a record of a query beginning now, made by the user carried
+// by ctx, if any.
+func newAuditRecord(ctx context.Context, protocol, client, command, query string) *AuditRecord {
+	r := &AuditRecord{
+		Time:     time.Now().UTC(),
+		Client:   client,
+		Protocol: protocol,
+		Command:  command,
+		Query:    query,
+	}
+	if u, ok := UserFromContext(ctx); ok {
+		r.User = u.Name
+	}
+	return r
+}
+
+// setRange records the time range of the query.
+func (r *AuditRecord) setRange(start, end time.Time) {
+	if !start.IsZero() {
+		r.Start = &start
+	}
+	if !end.IsZero() {
+		r.End = &end
+	}
+}
+
+// fail records that the query failed.
+func (r *AuditRecord) fail(err error) {
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// AuditLog is an append-only file recording every query made by clients of the query
+// servers, one JSON object per line.
+type AuditLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+
+	Logger *log.Logger
+}
+
+// OpenAuditLog opens the audit log at path, creating it if necessary. Records are
+// only ever appended to an existing log.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, auditFilePermissions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %s", err.Error())
+	}
+	return &AuditLog{
+		path:   path,
+		f:      f,
+		Logger: log.New(os.Stderr, "[audit] ", log.LstdFlags),
+	}, nil
+}
+
+// Record completes the record with the time since its query began, and appends it to
+// the log. Record does nothing if a is nil, so that servers need not check whether
+// auditing is enabled.
+func (a *AuditLog) Record(r *AuditRecord) {
+	if a == nil {
+		return
+	}
+	r.Duration = millis(time.Since(r.Time))
+	b, err := json.Marshal(r)
+	if err != nil {
+		a.Logger.Printf("failed to encode audit record: %s", err.Error())
+		stats.Add("auditErrors", 1)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(append(b, '\n')); err != nil {
+		a.Logger.Printf("failed to write audit record: %s", err.Error())
+		stats.Add("auditErrors", 1)
+		return
+	}
+	stats.Add("auditRecords", 1)
+}
+
+// AuditSearchRequest selects audit records. Empty fields select every record.
+type AuditSearchRequest struct {
+	User   string    // User who made the query.
+	Client string    // Client address, or its prefix.
+	Query  string    // Text contained in the query.
+	Start  time.Time // Inclusive start of the time range.
+	End    time.Time // Exclusive end of the time range.
+	Limit  int       // Maximum number of records. Zero means DefaultAuditLimit.
+}
+
+// match returns whether the record is selected by the request.
+func (req *AuditSearchRequest) match(r *AuditRecord) bool {
+	return (req.User == "" || r.User == req.User) &&
+		(req.Client == "" || strings.HasPrefix(r.Client, req.Client)) &&
+		(req.Query == "" || strings.Contains(r.Query, req.Query)) &&
+		(req.Start.IsZero() || !r.Time.Before(req.Start)) &&
+		(req.End.IsZero() || r.Time.Before(req.End))
+}
+
+// Search returns the latest records selected by the request, latest first.
+func (a *AuditLog) Search(req *AuditSearchRequest) ([]*AuditRecord, error) {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = DefaultAuditLimit
+	}
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Keep only the latest matching records while reading the log from the start.
+	records := make([]*AuditRecord, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		r := &AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			// A record may be part way through being written.
+			continue
+		}
+		if !req.match(r) {
+			continue
+		}
+		records = append(records, r)
+		if len(records) > limit {
+			records = records[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+// Close closes the audit log.
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
@@ -0,0 +1,151 @@
+package ekanite
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLog_Search(t *testing.T) {
+	dir := tempPath()
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("failed to create directory: %s", err.Error())
+	}
+	path := filepath.Join(dir, "audit.log")
+
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("failed to open audit log: %s", err.Error())
+	}
+	for _, r := range []*AuditRecord{
+		{Time: parseTime("1982-02-05T04:00:00Z"), User: "alice", Client: "10.0.0.1:1234", Query: "link down"},
+		{Time: parseTime("1982-02-05T05:00:00Z"), User: "bob", Client: "10.0.0.2:1234", Query: "password"},
+		{Time: parseTime("1982-02-05T06:00:00Z"), User: "alice", Client: "10.0.0.1:1234", Query: "password"},
+	} {
+		a.Record(r)
+	}
+	a.Close()
+
+	// Records are appended to an existing log.
+	a, err = OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("failed to reopen audit log: %s", err.Error())
+	}
+	defer a.Close()
+	a.Record(&AuditRecord{Time: parseTime("1982-02-05T07:00:00Z"), User: "carol", Client: "10.0.1.1:1234", Query: "link"})
+
+	tests := []struct {
+		req *AuditSearchRequest
+		exp []string // Users, latest first.
+	}{
+		{req: &AuditSearchRequest{}, exp: []string{"carol", "alice", "bob", "alice"}},
+		{req: &AuditSearchRequest{Limit: 2}, exp: []string{"carol", "alice"}},
+		{req: &AuditSearchRequest{User: "alice"}, exp: []string{"alice", "alice"}},
+		{req: &AuditSearchRequest{Query: "password"}, exp: []string{"alice", "bob"}},
+		{req: &AuditSearchRequest{Client: "10.0.0."}, exp: []string{"alice", "bob", "alice"}},
+		{req: &AuditSearchRequest{Start: parseTime("1982-02-05T05:00:00Z"), End: parseTime("1982-02-05T07:00:00Z")}, exp: []string{"alice", "bob"}},
+	}
+	for _, tt := range tests {
+		records, err := a.Search(tt.req)
+		if err != nil {
+			t.Fatalf("failed to search audit log: %s", err.Error())
+		}
+		var users []string
+		for _, r := range records {
+			users = append(users, r.User)
+		}
+		if !equalStrings(users, tt.exp) {
+			t.Errorf("%+v: wrong records, exp %v, got %v", tt.req, tt.exp, users)
+		}
+	}
+}
+
+// TestHTTPServer_Audit tests that API queries are audited, and that only auditors
+// may search the audit log.
+func TestHTTPServer_Audit(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newEngine(dataDir, 2, time.Hour)
+	defer e.Close()
+	events := []*Event{
+		newParsedEvent("router1", "%LINK-3-UPDOWN", 187, "link down", parseTime("1982-02-05T04:10:00Z")),
+		newParsedEvent("router2", "%LINK-3-UPDOWN", 187, "link down", parseTime("1982-02-05T04:50:00Z")),
+	}
+	if err := e.Index(events); err != nil {
+		t.Fatalf("failed to index events: %s", err.Error())
+	}
+
+	a, err := OpenAuditLog(filepath.Join(dataDir, "audit.log"))
+	if err != nil {
+		t.Fatalf("failed to open audit log: %s", err.Error())
+	}
+	defer a.Close()
+
+	auth, err := NewAuthenticator(&Credentials{Users: []*User{
+		{Name: "alice", Tokens: []string{tokenHash("a")}},
+		{Name: "sec", Tokens: []string{tokenHash("s")}, Auditor: true},
+	}})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %s", err.Error())
+	}
+
+	s := NewHTTPServer("", e)
+	s.Auth = auth
+	s.Audit = a
+	get := func(path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.RemoteAddr = "192.0.2.1:4321"
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get("/api/v1/search?q=link&start=1982-02-05T04:00:00Z", "a"); w.Code != http.StatusOK {
+		t.Fatalf("search failed: %s", w.Body.String())
+	}
+	if w := get("/api/v1/count?q=down", "a"); w.Code != http.StatusOK {
+		t.Fatalf("count failed: %s", w.Body.String())
+	}
+	if w := get("/api/v1/audit", "a"); w.Code != http.StatusForbidden {
+		t.Fatalf("non-auditor searched the audit log, status %d", w.Code)
+	}
+
+	w := get("/api/v1/audit?user=alice", "s")
+	if w.Code != http.StatusOK {
+		t.Fatalf("audit search failed: %s", w.Body.String())
+	}
+	var ar apiAuditResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &ar); err != nil {
+		t.Fatalf("failed to decode audit response: %s", err.Error())
+	}
+	if len(ar.Records) != 2 {
+		t.Fatalf("wrong number of audit records, exp 2, got %d: %s", len(ar.Records), w.Body.String())
+	}
+	count, search := ar.Records[0], ar.Records[1]
+	if count.Command != "count" || count.Query != "down" || count.Results != 2 || count.Client != "192.0.2.1:4321" {
+		t.Fatalf("wrong count audit record: %+v", count)
+	}
+	if search.Command != "search" || search.User != "alice" || search.Results != 2 || search.Protocol != "http" ||
+		search.Start == nil || !search.Start.Equal(parseTime("1982-02-05T04:00:00Z")) || search.End != nil {
+		t.Fatalf("wrong search audit record: %+v", search)
+	}
+
+	// The audit search was itself audited.
+	records, err := a.Search(&AuditSearchRequest{User: "sec"})
+	if err != nil || len(records) != 1 || records[0].Command != "audit" {
+		t.Fatalf("audit search not audited: %v", records)
+	}
+
+	// Records are attributed to the user carried by the context.
+	rec := newAuditRecord(WithUser(context.Background(), &User{Name: "bob"}), "tcp", "", "search", "")
+	if rec.User != "bob" {
+		t.Fatalf("wrong audit record user: %s", rec.User)
+	}
+}
@@ -0,0 +1,188 @@
+package ekanite
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrAuthFailed is returned when credentials are not valid.
+var ErrAuthFailed = errors.New("authentication failed")
+
+// User is a query client identity, loaded from a credentials file.
+type User struct {
+	Name     string   `json:"name"`
+	Password string   `json:"password,omitempty"` // bcrypt hash, as generated by htpasswd -B.
+	Tokens   []string `json:"tokens,omitempty"`   // Hex-encoded SHA-256 hashes of API tokens.
+
+	// Roles are the names of the roles granting the user access to events. A user
+	// without roles may access every event.
+	Roles []string `json:"roles,omitempty"`
+
+	// Auditor is set if the user may search the audit log.
+	Auditor bool `json:"auditor,omitempty"`
+
+	// Admin is set if the user may reload the configuration.
+	Admin bool `json:"admin,omitempty"`
+
+	access *accessFilter // nil if the user may access every event.
+}
+
+// Credentials is the content of a credentials file.
+type Credentials struct {
+	Users   []*User   `json:"users"`
+	Roles   []*Role   `json:"roles,omitempty"`
+	Tenants []*Tenant `json:"tenants,omitempty"`
+}
+
+// Authenticator authenticates query clients against a set of credentials.
+type Authenticator struct {
+	users  map[string]*User
+	tokens map[string]*User // Keyed by token hash.
+}
+
+// NewAuthenticator returns an Authenticator for the given credentials.
+func NewAuthenticator(c *Credentials) (*Authenticator, error) {
+	tenants := make(map[string]*Tenant)
+	for _, t := range c.Tenants {
+		if t.Name == "" {
+			return nil, fmt.Errorf("tenant without a name")
+		}
+		if _, ok := tenants[t.Name]; ok {
+			return nil, fmt.Errorf("duplicate tenant %s", t.Name)
+		}
+		if len(t.Hosts) == 0 && len(t.Sources) == 0 {
+			return nil, fmt.Errorf("tenant %s has neither hosts nor sources", t.Name)
+		}
+		tenants[t.Name] = t
+	}
+	roles := make(map[string]*Role)
+	for _, r := range c.Roles {
+		if r.Name == "" {
+			return nil, fmt.Errorf("role without a name")
+		}
+		if _, ok := roles[r.Name]; ok {
+			return nil, fmt.Errorf("duplicate role %s", r.Name)
+		}
+		if len(r.Hosts) == 0 && len(r.Sources) == 0 && len(r.Tenants) == 0 {
+			return nil, fmt.Errorf("role %s has no hosts, sources or tenants", r.Name)
+		}
+		roles[r.Name] = r
+	}
+
+	a := &Authenticator{
+		users:  make(map[string]*User),
+		tokens: make(map[string]*User),
+	}
+	for _, u := range c.Users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("user without a name")
+		}
+		if _, ok := a.users[u.Name]; ok {
+			return nil, fmt.Errorf("duplicate user %s", u.Name)
+		}
+		if u.Password == "" && len(u.Tokens) == 0 {
+			return nil, fmt.Errorf("user %s has neither a password nor tokens", u.Name)
+		}
+		if u.Password != "" {
+			if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+				return nil, fmt.Errorf("user %s password is not a bcrypt hash: %s", u.Name, err.Error())
+			}
+		}
+		if len(u.Roles) > 0 {
+			var granted []*Role
+			for _, name := range u.Roles {
+				r, ok := roles[name]
+				if !ok {
+					return nil, fmt.Errorf("user %s has unknown role %s", u.Name, name)
+				}
+				granted = append(granted, r)
+			}
+			f, err := newAccessFilter(granted, tenants)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %s", u.Name, err.Error())
+			}
+			u.access = f
+		}
+		a.users[u.Name] = u
+		for _, t := range u.Tokens {
+			t = strings.ToLower(t)
+			if b, err := hex.DecodeString(t); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("user %s token is not a hex-encoded SHA-256 hash", u.Name)
+			}
+			a.tokens[t] = u
+		}
+	}
+	return a, nil
+}
+
+// LoadAuthenticator returns an Authenticator for the credentials in the JSON file
+// at path.
+func LoadAuthenticator(path string) (*Authenticator, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Credentials{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials file %s: %s", path, err.Error())
+	}
+	return NewAuthenticator(c)
+}
+
+// Password returns the named user, if the password is correct.
+func (a *Authenticator) Password(name, password string) (*User, error) {
+	u, ok := a.users[name]
+	if !ok || u.Password == "" {
+		return nil, authFailed()
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err != nil {
+		return nil, authFailed()
+	}
+	stats.Add("authSucceeded", 1)
+	return u, nil
+}
+
+// Token returns the user to whom the API token was issued.
+func (a *Authenticator) Token(token string) (*User, error) {
+	h := sha256.Sum256([]byte(token))
+	u, ok := a.tokens[hex.EncodeToString(h[:])]
+	if !ok {
+		return nil, authFailed()
+	}
+	stats.Add("authSucceeded", 1)
+	return u, nil
+}
+
+// User returns the named user.
+func (a *Authenticator) User(name string) (*User, bool) {
+	u, ok := a.users[name]
+	return u, ok
+}
+
+// authFailed counts a failed authentication attempt, and returns ErrAuthFailed.
+func authFailed() error {
+	stats.Add("authFailed", 1)
+	return ErrAuthFailed
+}
+
+// userKey is the context key for the authenticated user.
+type userKey struct{}
+
+// WithUser returns a copy of ctx carrying the authenticated user.
+func WithUser(ctx context.Context, u *User) context.Context {
+	return context.WithValue(ctx, userKey{}, u)
+}
+
+// UserFromContext returns the authenticated user carried by ctx, if any.
+func UserFromContext(ctx context.Context) (*User, bool) {
+	u, ok := ctx.Value(userKey{}).(*User)
+	return u, ok
+}
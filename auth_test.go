@@ -0,0 +1,170 @@
+package ekanite
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestAuthenticator returns an Authenticator with a user "alice", whose password
+// is "secret" and whose API token is "tok3n".
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %s", err.Error())
+	}
+	token := sha256.Sum256([]byte("tok3n"))
+	a, err := NewAuthenticator(&Credentials{Users: []*User{
+		{Name: "alice", Password: string(hash), Tokens: []string{hex.EncodeToString(token[:])}},
+	}})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %s", err.Error())
+	}
+	return a
+}
+
+func TestAuthenticator(t *testing.T) {
+	a := newTestAuthenticator(t)
+
+	failed := statValue("authFailed")
+	if u, err := a.Password("alice", "secret"); err != nil || u.Name != "alice" {
+		t.Fatalf("valid password rejected: %v", err)
+	}
+	if u, err := a.Token("tok3n"); err != nil || u.Name != "alice" {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+	if _, err := a.Password("alice", "wrong"); err != ErrAuthFailed {
+		t.Fatalf("wrong password accepted")
+	}
+	if _, err := a.Password("bob", "secret"); err != ErrAuthFailed {
+		t.Fatalf("unknown user accepted")
+	}
+	if _, err := a.Token("secret"); err != ErrAuthFailed {
+		t.Fatalf("wrong token accepted")
+	}
+	if n := statValue("authFailed") - failed; n != 3 {
+		t.Fatalf("wrong number of failures counted, exp 3, got %d", n)
+	}
+
+	ctx := WithUser(context.Background(), &User{Name: "alice"})
+	if u, ok := UserFromContext(ctx); !ok || u.Name != "alice" {
+		t.Fatalf("user not carried by context")
+	}
+	if _, ok := UserFromContext(context.Background()); ok {
+		t.Fatalf("user found in empty context")
+	}
+}
+
+func TestNewAuthenticator_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		users []*User
+	}{
+		{name: "no name", users: []*User{{Tokens: []string{strings.Repeat("0", 64)}}}},
+		{name: "no secrets", users: []*User{{Name: "alice"}}},
+		{name: "plaintext password", users: []*User{{Name: "alice", Password: "secret"}}},
+		{name: "plaintext token", users: []*User{{Name: "alice", Tokens: []string{"tok3n"}}}},
+		{name: "duplicate", users: []*User{
+			{Name: "alice", Tokens: []string{strings.Repeat("0", 64)}},
+			{Name: "alice", Tokens: []string{strings.Repeat("1", 64)}},
+		}},
+	}
+	for _, tt := range tests {
+		if _, err := NewAuthenticator(&Credentials{Users: tt.users}); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestServer_Auth(t *testing.T) {
+	s := NewServer("127.0.0.1:0", &testSearcher{results: []string{"link down"}})
+	s.Auth = newTestAuthenticator(t)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start server: %s", err.Error())
+	}
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err.Error())
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	send := func(line string) string {
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			t.Fatalf("failed to write %q: %s", line, err.Error())
+		}
+		resp, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read response to %q: %s", line, err.Error())
+		}
+		return strings.TrimSpace(resp)
+	}
+
+	if resp := send("link"); resp != "401 authentication required" {
+		t.Fatalf("query accepted before authentication: %q", resp)
+	}
+	if resp := send("AUTH alice wrong"); resp != "401 authentication failed" {
+		t.Fatalf("wrong password accepted: %q", resp)
+	}
+	if resp := send("AUTH TOKEN tok3n"); resp != "200 authenticated as alice" {
+		t.Fatalf("valid token rejected: %q", resp)
+	}
+	if resp := send("link"); resp != "link down" {
+		t.Fatalf("wrong query response: %q", resp)
+	}
+}
+
+func TestHTTPServer_Auth(t *testing.T) {
+	// The test searcher does not support the REST API, so authenticated requests
+	// are refused as not implemented.
+	s := NewHTTPServer("", &testSearcher{})
+	s.Auth = newTestAuthenticator(t)
+
+	tests := []struct {
+		name   string
+		method string
+		header func(r *http.Request)
+		code   int
+	}{
+		{name: "none", method: "GET", header: func(r *http.Request) {}, code: http.StatusUnauthorized},
+		{name: "basic", method: "GET", header: func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, code: http.StatusNotImplemented},
+		{name: "basic wrong", method: "GET", header: func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }, code: http.StatusUnauthorized},
+		{name: "token", method: "GET", header: func(r *http.Request) { r.Header.Set("Authorization", "Bearer tok3n") }, code: http.StatusNotImplemented},
+		{name: "token wrong", method: "GET", header: func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, code: http.StatusUnauthorized},
+		{name: "preflight", method: "OPTIONS", header: func(r *http.Request) {}, code: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/api/v1/indexes", nil)
+		tt.header(r)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s: wrong status, exp %d, got %d: %s", tt.name, tt.code, w.Code, w.Body.String())
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no authentication challenge", tt.name)
+		}
+	}
+}
+
+// testSearcher returns fixed results for every query.
+type testSearcher struct {
+	results []string
+}
+
+func (s *testSearcher) Search(ctx context.Context, query string) (<-chan string, error) {
+	c := make(chan string, len(s.results))
+	for _, r := range s.results {
+		c <- r
+	}
+	close(c)
+	return c, nil
+}
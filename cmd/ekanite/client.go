@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/ekanite/ekanite"
+)
+
+// searchRequest describes a search made by the client. Start and End are given as
+// the query servers accept them: RFC3339, now, or a duration before now such as -2h.
+type searchRequest struct {
+	Query     string
+	Start     string
+	End       string
+	Limit     int  // Zero is unlimited.
+	Highlight bool // Highlight matches with ANSI escapes, if the server supports it.
+}
+
+// output receives the results of a search, which are either events or, for a
+// pipeline, the columns of a table followed by its rows.
+type output interface {
+	Event(r *ekanite.Result) error
+	Columns(columns []string) error
+	Row(values []string) error
+}
+
+// client is a connection to a query server.
+type client interface {
+	// Search writes the results of the search to out.
+	Search(req *searchRequest, out output) error
+
+	// Count returns the number of events matching the search.
+	Count(req *searchRequest) (uint64, error)
+
+	// Tail writes each new event matching the query to out, until stop is closed.
+	Tail(q string, stop <-chan struct{}, out output) error
+
+	Close() error
+}
+
+// hit is an event as returned by the query servers.
+type hit struct {
+	ID         ekanite.DocID     `json:"id"`
+	Source     string            `json:"source"`
+	Fields     map[string]string `json:"fields"`
+	Highlights []string          `json:"highlights"`
+}
+
+func (h *hit) result() *ekanite.Result {
+	return &ekanite.Result{ID: h.ID, Source: h.Source, Fields: h.Fields, Highlights: h.Highlights}
+}
+
+// dial connects to the query server described by the profile.
+func dial(p *profile) (client, error) {
+	scheme, addr := p.scheme()
+	switch scheme {
+	case "http", "https":
+		return newHTTPClient(p)
+	case "tcp", "tls":
+		return dialTCP(addr, scheme == "tls", p)
+	}
+	return nil, fmt.Errorf("unsupported scheme '%s' in address %s", scheme, p.Addr)
+}
+
+// protocolError is an error status returned by a query server.
+type protocolError struct {
+	Code    int
+	Message string
+}
+
+func (e *protocolError) Error() string {
+	return strconv.Itoa(e.Code) + " " + e.Message
+}
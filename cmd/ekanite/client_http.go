@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ekanite/ekanite"
+	"github.com/ekanite/ekanite/query"
+)
+
+// httpClient is a client of the HTTP query server's REST API.
+type httpClient struct {
+	base string
+	p    *profile
+	hc   *http.Client
+}
+
+// newHTTPClient returns a client of the HTTP query server described by the profile.
+func newHTTPClient(p *profile) (*httpClient, error) {
+	tlsConfig, err := p.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &httpClient{
+		base: strings.TrimSuffix(p.Addr, "/"),
+		p:    p,
+		hc:   &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}},
+	}, nil
+}
+
+// get makes an authenticated request, and returns the response if it was successful.
+func (c *httpClient) get(ctx context.Context, path string, params url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("GET", c.base+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.p.Token)
+	} else if c.p.User != "" {
+		req.SetBasicAuth(c.p.User, c.p.Password)
+	}
+	resp, err := c.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+// params returns the parameters of a search request.
+func (req *searchRequest) params() url.Values {
+	params := url.Values{}
+	params.Set("q", req.Query)
+	for k, v := range map[string]string{"start": req.Start, "end": req.End} {
+		if v != "" {
+			params.Set(k, v)
+		}
+	}
+	return params
+}
+
+// Search implements client. Searches with a limit the search API accepts, and
+// pipelines, use the search API. Other searches stream every event from the export
+// API.
+func (c *httpClient) Search(req *searchRequest, out output) error {
+	params := req.params()
+	pipeline := query.IsPipeline(req.Query)
+	if !pipeline && (req.Limit <= 0 || req.Limit > ekanite.MaxAPILimit) {
+		return c.export(req, out)
+	}
+	if !pipeline {
+		params.Set("limit", strconv.Itoa(req.Limit))
+	}
+	if req.Highlight {
+		params.Set("highlight", ekanite.HighlightANSI)
+	}
+
+	resp, err := c.get(context.Background(), "/api/v1/search", params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var sr struct {
+		Hits    []*hit     `json:"hits"`
+		Columns []string   `json:"columns"`
+		Rows    [][]string `json:"rows"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		return err
+	}
+
+	if pipeline {
+		if err := out.Columns(sr.Columns); err != nil {
+			return err
+		}
+		for _, row := range sr.Rows {
+			if err := out.Row(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, h := range sr.Hits {
+		if err := out.Event(h.result()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// export writes the events streamed by the export API to out, stopping once the
+// request's limit, if any, is reached.
+func (c *httpClient) export(req *searchRequest, out output) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	params := req.params()
+	params.Set("format", ekanite.ExportNDJSON)
+	resp, err := c.get(ctx, "/api/v1/export", params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for n := 0; req.Limit <= 0 || n < req.Limit; n++ {
+		var h hit
+		if err := dec.Decode(&h); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := out.Event(h.result()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Count implements client.
+func (c *httpClient) Count(req *searchRequest) (uint64, error) {
+	resp, err := c.get(context.Background(), "/api/v1/count", req.params())
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var cr struct {
+		Count uint64 `json:"count"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&cr)
+	return cr.Count, err
+}
+
+// Tail implements client, reading the server-sent events of the tail endpoint.
+// Tailed events carry their source but not their fields.
+func (c *httpClient) Tail(q string, stop <-chan struct{}, out output) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	resp, err := c.get(ctx, "/tail", url.Values{"query": {q}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var id string
+	var data []string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		l := scanner.Text()
+		switch {
+		case l == "":
+			if data != nil {
+				r := &ekanite.Result{ID: ekanite.DocID(id), Source: strings.Join(data, "\n")}
+				if err := out.Event(r); err != nil {
+					return err
+				}
+			}
+			id, data = "", nil
+		case strings.HasPrefix(l, "id: "):
+			id = strings.TrimPrefix(l, "id: ")
+		case strings.HasPrefix(l, "data: "):
+			data = append(data, strings.TrimPrefix(l, "data: "))
+		}
+	}
+	if ctx.Err() != nil {
+		// Stopped by the caller.
+		return nil
+	}
+	return scanner.Err()
+}
+
+// Close implements client.
+func (c *httpClient) Close() error {
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tcpClient is a connection to the TCP query server, speaking its framed protocol.
+type tcpClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialTCP connects to the TCP query server at addr, and authenticates with the
+// credentials of the profile, if any.
+func dialTCP(addr string, useTLS bool, p *profile) (*tcpClient, error) {
+	var conn net.Conn
+	var err error
+	if useTLS {
+		var tlsConfig *tls.Config
+		if tlsConfig, err = p.tlsConfig(); err != nil {
+			return nil, err
+		}
+		conn, err = tls.Dial("tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &tcpClient{conn: conn, r: bufio.NewReader(conn)}
+
+	var auth string
+	if p.Token != "" {
+		auth = "AUTH TOKEN " + p.Token
+	} else if p.User != "" {
+		auth = "AUTH " + p.User + " " + p.Password
+	}
+	if auth != "" {
+		if _, err := c.command(auth, nil); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// command sends a command, passes each data line of the response to data, and
+// returns the message of the successful status line ending the response.
+func (c *tcpClient) command(line string, data func([]byte) error) (string, error) {
+	if _, err := fmt.Fprintf(c.conn, "%s\n", line); err != nil {
+		return "", err
+	}
+	return c.response(data)
+}
+
+// response reads the response to a command.
+func (c *tcpClient) response(data func([]byte) error) (string, error) {
+	var dataErr error
+	for {
+		l, err := c.r.ReadBytes('\n')
+		if err != nil {
+			return "", err
+		}
+		l = l[:len(l)-1]
+
+		// Data lines are JSON objects or arrays. Status lines begin with their code.
+		if len(l) > 0 && (l[0] == '{' || l[0] == '[') {
+			if data != nil && dataErr == nil {
+				dataErr = data(l)
+			}
+			continue
+		}
+		code, msg := splitCommand(string(l))
+		n, err := strconv.Atoi(code)
+		if err != nil {
+			return "", fmt.Errorf("unexpected response from server: %s", l)
+		}
+		if n >= 300 {
+			return "", &protocolError{Code: n, Message: msg}
+		}
+		return msg, dataErr
+	}
+}
+
+// scope sets the session's limit, and the time range of the request.
+func (c *tcpClient) scope(limit int, req *searchRequest) error {
+	if _, err := c.command("LIMIT "+strconv.Itoa(limit), nil); err != nil {
+		return err
+	}
+	start, end := req.Start, req.End
+	if start == "" {
+		start = "*"
+	}
+	if end == "" {
+		end = "*"
+	}
+	_, err := c.command("RANGE "+start+" "+end, nil)
+	return err
+}
+
+// Search implements client.
+func (c *tcpClient) Search(req *searchRequest, out output) error {
+	if err := c.scope(req.Limit, req); err != nil {
+		return err
+	}
+
+	// Pipelines return a columns array, followed by an array for each row.
+	columns := false
+	_, err := c.command("SEARCH "+req.Query, func(b []byte) error {
+		if b[0] == '[' {
+			var values []string
+			if err := json.Unmarshal(b, &values); err != nil {
+				return err
+			}
+			if !columns {
+				columns = true
+				return out.Columns(values)
+			}
+			return out.Row(values)
+		}
+		return writeHit(b, out)
+	})
+	return err
+}
+
+// Count implements client.
+func (c *tcpClient) Count(req *searchRequest) (uint64, error) {
+	if err := c.scope(0, req); err != nil {
+		return 0, err
+	}
+	var resp struct {
+		Count uint64 `json:"count"`
+	}
+	_, err := c.command("COUNT "+req.Query, func(b []byte) error {
+		return json.Unmarshal(b, &resp)
+	})
+	return resp.Count, err
+}
+
+// Tail implements client.
+func (c *tcpClient) Tail(q string, stop <-chan struct{}, out output) error {
+	if _, err := fmt.Fprintf(c.conn, "TAIL %s\n", q); err != nil {
+		return err
+	}
+
+	// Any line sent by the client ends the tail, which the server acknowledges
+	// with a status line.
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-stop:
+			fmt.Fprint(c.conn, "STOP\n")
+		case <-done:
+		}
+	}()
+
+	_, err := c.response(func(b []byte) error {
+		return writeHit(b, out)
+	})
+	return err
+}
+
+// Close implements client.
+func (c *tcpClient) Close() error {
+	c.command("QUIT", nil)
+	return c.conn.Close()
+}
+
+// writeHit decodes a hit, and writes it to out.
+func writeHit(b []byte, out output) error {
+	var h hit
+	if err := json.Unmarshal(b, &h); err != nil {
+		return err
+	}
+	return out.Event(h.result())
+}
+
+// splitCommand returns the first word of the line, and the remainder of the line.
+func splitCommand(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if n := strings.IndexAny(line, " \t"); n >= 0 {
+		return line[:n], strings.TrimSpace(line[n:])
+	}
+	return line, ""
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ekanite/ekanite"
+	"github.com/ekanite/ekanite/input"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testOutput records the results of searches.
+type testOutput struct {
+	mu      sync.Mutex
+	events  []*ekanite.Result
+	columns []string
+	rows    [][]string
+}
+
+func (o *testOutput) Event(r *ekanite.Result) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, r)
+	return nil
+}
+
+func (o *testOutput) Columns(columns []string) error {
+	o.columns = columns
+	return nil
+}
+
+func (o *testOutput) Row(values []string) error {
+	o.rows = append(o.rows, values)
+	return nil
+}
+
+func (o *testOutput) sources() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var s []string
+	for _, r := range o.events {
+		s = append(s, r.Source)
+	}
+	return s
+}
+
+// testServers are TCP and HTTP query servers, requiring authentication, of an engine
+// holding a few events.
+type testServers struct {
+	e      *ekanite.Engine
+	tailer *ekanite.Tailer
+	tcp    *ekanite.Server
+	http   *ekanite.HTTPServer
+	events []*ekanite.Event
+}
+
+func newTestServers(t *testing.T, path string) *testServers {
+	password, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %s", err.Error())
+	}
+	token := sha256.Sum256([]byte("tok3n"))
+	auth, err := ekanite.NewAuthenticator(&ekanite.Credentials{Users: []*ekanite.User{
+		{Name: "alice", Password: string(password), Tokens: []string{hex.EncodeToString(token[:])}},
+	}})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %s", err.Error())
+	}
+
+	e := ekanite.NewEngine(path)
+	if err := e.Open(); err != nil {
+		t.Fatalf("failed to open engine: %s", err.Error())
+	}
+	events := []*ekanite.Event{
+		newTestEvent("router1", "link down", "1982-02-05T04:10:00Z"),
+		newTestEvent("router2", "link down", "1982-02-05T04:50:00Z"),
+		newTestEvent("router1", "link up", "1982-02-05T05:45:00Z"),
+	}
+	if err := e.Index(events); err != nil {
+		t.Fatalf("failed to index events: %s", err.Error())
+	}
+
+	s := &testServers{e: e, tailer: ekanite.NewTailer(), events: events}
+	s.tcp = ekanite.NewServer("127.0.0.1:0", e)
+	s.tcp.Tailer = s.tailer
+	s.tcp.Auth = auth
+	if err := s.tcp.Start(); err != nil {
+		t.Fatalf("failed to start TCP query server: %s", err.Error())
+	}
+	s.http = ekanite.NewHTTPServer("127.0.0.1:0", e)
+	s.http.Tailer = s.tailer
+	s.http.Auth = auth
+	if err := s.http.Start(); err != nil {
+		t.Fatalf("failed to start HTTP query server: %s", err.Error())
+	}
+	return s
+}
+
+func newTestEvent(host, message, refTime string) *ekanite.Event {
+	ts, _ := time.Parse(time.RFC3339, refTime)
+	return &ekanite.Event{
+		Event: &input.Event{
+			Text: message,
+			Parsed: map[string]interface{}{
+				"priority":  187,
+				"timestamp": refTime,
+				"host":      host,
+				"app":       "%LINK-3-UPDOWN",
+				"message":   message,
+			},
+			ReceptionTime: ts,
+		},
+	}
+}
+
+// Test_Clients tests the TCP and HTTP clients against real query servers.
+func Test_Clients(t *testing.T) {
+	path := tempPath()
+	defer os.RemoveAll(path)
+	s := newTestServers(t, path)
+	defer s.e.Close()
+
+	profiles := map[string]*profile{
+		"tcp":  {Addr: "tcp://" + s.tcp.Addr().String(), User: "alice", Password: "secret"},
+		"http": {Addr: "http://" + s.http.Addr().String(), Token: "tok3n"},
+	}
+	for name, p := range profiles {
+		c, err := dial(p)
+		if err != nil {
+			t.Fatalf("%s: failed to connect: %s", name, err.Error())
+		}
+
+		for _, tt := range []struct {
+			req *searchRequest
+			exp []string
+		}{
+			{&searchRequest{Query: "link"}, []string{"link down", "link down", "link up"}},
+			{&searchRequest{Query: "link", Limit: 2}, []string{"link down", "link down"}},
+			{&searchRequest{Query: "down", Start: "1982-02-05T04:30:00Z"}, []string{"link down"}},
+		} {
+			out := &testOutput{}
+			if err := c.Search(tt.req, out); err != nil {
+				t.Fatalf("%s: failed to search %+v: %s", name, tt.req, err.Error())
+			}
+			if !equalStrings(out.sources(), tt.exp) {
+				t.Errorf("%s: wrong results for %+v, exp %v, got %v", name, tt.req, tt.exp, out.sources())
+			}
+			if out.events[0].Fields["host"] != "router1" && out.events[0].Fields["host"] != "router2" {
+				t.Errorf("%s: wrong fields: %v", name, out.events[0].Fields)
+			}
+		}
+
+		out := &testOutput{}
+		if err := c.Search(&searchRequest{Query: "link | stats count by host | sort host"}, out); err != nil {
+			t.Fatalf("%s: failed to run pipeline: %s", name, err.Error())
+		}
+		if !equalStrings(out.columns, []string{"host", "count"}) || len(out.rows) != 2 || !equalStrings(out.rows[0], []string{"router1", "2"}) {
+			t.Errorf("%s: wrong pipeline output: %v %v", name, out.columns, out.rows)
+		}
+
+		if n, err := c.Count(&searchRequest{Query: "down"}); err != nil || n != 2 {
+			t.Errorf("%s: wrong count, exp 2, got %d (%v)", name, n, err)
+		}
+		if err := c.Search(&searchRequest{Query: "host:"}, &testOutput{}); err == nil {
+			t.Errorf("%s: invalid query did not fail", name)
+		}
+
+		// Events published while tailing are received until the tail is stopped.
+		out = &testOutput{}
+		stop := make(chan struct{})
+		done := make(chan error)
+		go func() {
+			done <- c.Tail("up", stop, out)
+		}()
+		for len(out.sources()) == 0 {
+			s.tailer.Publish(s.events)
+			time.Sleep(20 * time.Millisecond)
+		}
+		close(stop)
+		if err := <-done; err != nil {
+			t.Fatalf("%s: tail failed: %s", name, err.Error())
+		}
+		if src := out.sources(); src[0] != "link up" {
+			t.Errorf("%s: wrong tailed events: %v", name, src)
+		}
+
+		// The connection is usable after a tail.
+		if n, err := c.Count(&searchRequest{Query: "up"}); err != nil || n != 1 {
+			t.Errorf("%s: wrong count after tail, exp 1, got %d (%v)", name, n, err)
+		}
+		c.Close()
+	}
+
+	for name, p := range map[string]*profile{
+		"tcp":  {Addr: s.tcp.Addr().String(), User: "alice", Password: "wrong"},
+		"http": {Addr: "http://" + s.http.Addr().String()},
+	} {
+		c, err := dial(p)
+		if err == nil {
+			err = c.Search(&searchRequest{Query: "link"}, &testOutput{})
+		}
+		if err == nil {
+			t.Errorf("%s: unauthenticated search succeeded", name)
+		}
+	}
+}
+
+// Test_REPL tests an interactive session against the TCP query server.
+func Test_REPL(t *testing.T) {
+	path := tempPath()
+	defer os.RemoveAll(path)
+	s := newTestServers(t, path)
+	defer s.e.Close()
+
+	c, err := dial(&profile{Addr: "tcp://" + s.tcp.Addr().String(), Token: "tok3n"})
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err.Error())
+	}
+	defer c.Close()
+
+	var out bytes.Buffer
+	p, _ := newPrinter(&out, FormatRaw, false, nil)
+	input := strings.Join([]string{
+		".limit 1",
+		"+link \\",
+		"  +up",
+		"!!",
+		".count link",
+		"link |",
+		"  stats count",
+		".bogus",
+		".history",
+		".quit",
+		"link",
+	}, "\n")
+	r := newREPL(c, p, strings.NewReader(input), &out)
+	r.historyPath = filepath.Join(path, historyFile)
+	if err := r.run(); err != nil {
+		t.Fatalf("REPL failed: %s", err.Error())
+	}
+
+	exp := []string{
+		"limit 1",
+		"link up",
+		"+link +up",
+		"link up",
+		"3",
+		"count",
+		"3",
+		"error: unknown command .bogus, enter .help for help",
+		"    1  .limit 1",
+		"    2  +link +up",
+		"    3  .count link",
+		"    4  link | stats count",
+		"    5  .bogus",
+		"    6  .history",
+	}
+	if got := strings.Split(strings.TrimSpace(out.String()), "\n"); !equalStrings(got, exp) {
+		t.Fatalf("wrong REPL output, exp:\n%s\ngot:\n%s", strings.Join(exp, "\n"), out.String())
+	}
+
+	// The history is saved.
+	b, err := ioutil.ReadFile(r.historyPath)
+	if err != nil || !strings.HasPrefix(string(b), ".limit 1\n+link +up\n") {
+		t.Fatalf("wrong saved history: %q (%v)", b, err)
+	}
+}
+
+// Test_Profiles tests selecting a connection profile, and overriding it with flags.
+func Test_Profiles(t *testing.T) {
+	path := tempPath()
+	defer os.RemoveAll(path)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatalf("failed to create directory: %s", err.Error())
+	}
+	cfg := filepath.Join(path, "ekanite.json")
+	if err := ioutil.WriteFile(cfg, []byte(`{
+		"default": "prod",
+		"profiles": {
+			"prod": {"addr": "https://logs:8080", "token": "t"},
+			"lab": {"addr": "lab:9950", "user": "alice"}
+		}
+	}`), 0600); err != nil {
+		t.Fatalf("failed to write config: %s", err.Error())
+	}
+	os.Setenv("EKANITE_CONFIG", cfg)
+	defer os.Unsetenv("EKANITE_CONFIG")
+
+	resolve := func(args ...string) (*profile, error) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		f := addConnectionFlags(fs)
+		if err := fs.Parse(args); err != nil {
+			t.Fatalf("failed to parse flags: %s", err.Error())
+		}
+		return f.resolve()
+	}
+
+	p, err := resolve()
+	if err != nil || p.Addr != "https://logs:8080" || p.Token != "t" {
+		t.Fatalf("wrong default profile: %+v (%v)", p, err)
+	}
+	p, err = resolve("-profile", "lab", "-addr", "tls://lab:9951")
+	if err != nil || p.Addr != "tls://lab:9951" || p.User != "alice" {
+		t.Fatalf("wrong overridden profile: %+v (%v)", p, err)
+	}
+	if scheme, addr := p.scheme(); scheme != "tls" || addr != "lab:9951" {
+		t.Fatalf("wrong scheme and address: %s %s", scheme, addr)
+	}
+	if _, err := resolve("-profile", "missing"); err == nil {
+		t.Fatalf("missing profile resolved")
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// tempPath provides a path for temporary use.
+func tempPath() string {
+	f, _ := ioutil.TempFile("", "ekanite_")
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+	return path
+}
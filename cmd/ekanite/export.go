@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ekanite/ekanite"
+)
+
+// Export defaults
+const (
+	progressInterval      = 500 * time.Millisecond
+	exportFilePermissions = 0644
+)
+
+// runExport streams the events matching a query to standard output or a file. The
+// HTTP query server formats the export itself. Events from the TCP query server are
+// formatted by the client.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	var (
+		format   = fs.String("format", DefaultExportFormat, "Export format: ndjson, csv or raw")
+		fields   = fs.String("fields", "", "Comma-separated fields to export as CSV columns. Defaults to _time,host,_raw")
+		start    = fs.String("start", "", "Inclusive start of the time range, as RFC3339, now, or a duration before now such as -2h")
+		end      = fs.String("end", "", "Exclusive end of the time range, as RFC3339, now, or a duration before now")
+		limit    = fs.Int("limit", 0, "Maximum number of events to export. Zero is unlimited")
+		output   = fs.String("o", "", "File to write to. Standard output if not set")
+		compress = fs.Bool("gzip", false, "Compress the output with gzip")
+		progress = fs.Bool("progress", true, "Report progress on standard error, when writing to a file")
+	)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("a query is required, use * to export every event")
+	}
+	req := &searchRequest{Query: strings.Join(fs.Args(), " "), Start: *start, End: *end, Limit: *limit}
+
+	c, err := connect(conn)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, exportFilePermissions)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	if *compress {
+		gz := gzip.NewWriter(out)
+		defer gz.Close()
+		out = gz
+	}
+	lc := &lineCounter{w: out}
+
+	var columns []string
+	if *fields != "" {
+		columns = strings.Split(*fields, ",")
+	}
+	header := int64(0)
+	if *format == "csv" {
+		header = 1
+	}
+
+	if hc, ok := c.(*httpClient); ok {
+		params := req.params()
+		params.Set("format", *format)
+		if *fields != "" {
+			params.Set("fields", *fields)
+		}
+		if *limit > 0 {
+			params.Set("limit", strconv.Itoa(*limit))
+		}
+		// The transport requests, and transparently decompresses, a gzip-encoded response.
+		resp, err := hc.get(context.Background(), "/api/v1/export", params)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if *progress && *output != "" {
+			total, _ := strconv.Atoi(resp.Header.Get("X-Total-Count"))
+			stop := reportProgress(lc, header, total)
+			defer stop()
+		}
+		_, err = io.Copy(lc, resp.Body)
+		return err
+	}
+
+	rw, err := ekanite.NewResultWriter(lc, *format, columns)
+	if err != nil {
+		return err
+	}
+	if *progress && *output != "" {
+		total, err := c.Count(req)
+		if err != nil {
+			return err
+		}
+		if *limit > 0 && uint64(*limit) < total {
+			total = uint64(*limit)
+		}
+		stop := reportProgress(lc, header, int(total))
+		defer stop()
+	}
+	if err := c.Search(req, &exportOutput{rw}); err != nil {
+		return err
+	}
+	return rw.Flush()
+}
+
+// exportOutput writes the events of a search with a result writer.
+type exportOutput struct {
+	rw ekanite.ResultWriter
+}
+
+func (o *exportOutput) Event(r *ekanite.Result) error {
+	return o.rw.WriteResult(r)
+}
+
+func (o *exportOutput) Columns(columns []string) error {
+	return fmt.Errorf("pipelines cannot be exported, use search")
+}
+
+func (o *exportOutput) Row(values []string) error {
+	return nil
+}
+
+// reportProgress periodically writes the number of events exported so far to
+// standard error, until the returned function is called.
+func reportProgress(lc *lineCounter, header int64, total int) func() {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	report := func() {
+		n := lc.Lines() - header
+		if n < 0 {
+			n = 0
+		}
+		fmt.Fprintf(os.Stderr, "\rexported %d of %d events", n, total)
+	}
+
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-done:
+				report()
+				fmt.Fprintln(os.Stderr)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// lineCounter counts the lines written through it.
+type lineCounter struct {
+	lines int64 // First, for 64-bit alignment of atomic operations.
+	w     io.Writer
+}
+
+func (lc *lineCounter) Write(p []byte) (int, error) {
+	n, err := lc.w.Write(p)
+	atomic.AddInt64(&lc.lines, int64(bytes.Count(p[:n], []byte("\n"))))
+	return n, err
+}
+
+// Lines returns the number of lines written so far.
+func (lc *lineCounter) Lines() int64 {
+	return atomic.LoadInt64(&lc.lines)
+}
+
+// responseError returns the error described by an unsuccessful API response.
+func responseError(resp *http.Response) error {
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(b, &e); err != nil || e.Error.Message == "" {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return fmt.Errorf("%s", e.Error.Message)
+}
@@ -0,0 +1,203 @@
+// Command ekanite is a client for the Ekanite query servers.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// Defaults
+const (
+	DefaultHTTPAddr     = "http://localhost:8080"
+	DefaultSearchLimit  = 100
+	DefaultOutputFormat = FormatPretty
+	DefaultExportFormat = "ndjson"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"repl", "[options]            Start an interactive session. The default command", runREPL},
+	{"search", "[options] QUERY    Print the events matching QUERY, or the output of a pipeline", runSearch},
+	{"count", "[options] QUERY     Print the number of events matching QUERY", runCount},
+	{"tail", "[options] [QUERY]    Print new events matching QUERY as they arrive, until interrupted", runTail},
+	{"export", "[options] QUERY    Stream every event matching QUERY", runExport},
+}
+
+func main() {
+	// Without a command, or with only options, an interactive session is started.
+	name, args := "repl", os.Args[1:]
+	if len(args) > 0 && (args[0] == "-h" || args[0] == "--help") {
+		printHelp()
+		os.Exit(2)
+	}
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == name {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		if name != "help" {
+			fmt.Fprintf(os.Stderr, "unknown command '%s'\n", name)
+		}
+		printHelp()
+		os.Exit(2)
+	}
+	if err := cmd.run(args); err != nil {
+		fmt.Fprintf(os.Stderr, "ekanite %s: %s\n", name, err.Error())
+		os.Exit(1)
+	}
+}
+
+func printHelp() {
+	fmt.Fprintln(os.Stderr, "ekanite [<command>] [options]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun 'ekanite <command> -h' for the options of a command.")
+}
+
+// outputFlags are the flags, common to commands printing events, selecting how
+// they are printed.
+type outputFlags struct {
+	format *string
+	fields *string
+	color  *bool
+}
+
+func addOutputFlags(fs *flag.FlagSet) *outputFlags {
+	return &outputFlags{
+		format: fs.String("format", DefaultOutputFormat, "Output format: pretty, raw or json"),
+		fields: fs.String("fields", "", "Comma-separated fields shown after each event, in the pretty format"),
+		color:  fs.Bool("color", isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == "", "Color the pretty format. Defaults to true on a terminal"),
+	}
+}
+
+// printer returns a printer to standard output.
+func (f *outputFlags) printer() (*printer, error) {
+	var fields []string
+	if *f.fields != "" {
+		fields = strings.Split(*f.fields, ",")
+	}
+	return newPrinter(os.Stdout, *f.format, *f.color, fields)
+}
+
+// runSearch prints the results of a search.
+func runSearch(args []string) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	out := addOutputFlags(fs)
+	var (
+		start     = fs.String("start", "", "Inclusive start of the time range, as RFC3339, now, or a duration before now such as -2h")
+		end       = fs.String("end", "", "Exclusive end of the time range, as RFC3339, now, or a duration before now")
+		limit     = fs.Int("limit", DefaultSearchLimit, "Maximum number of events. Zero is unlimited")
+		highlight = fs.Bool("highlight", false, "Show highlighted matches rather than whole events, if the server supports it")
+	)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("a query is required, use * to match every event")
+	}
+
+	p, err := out.printer()
+	if err != nil {
+		return err
+	}
+	c, err := connect(conn)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	req := &searchRequest{Query: strings.Join(fs.Args(), " "), Start: *start, End: *end, Limit: *limit, Highlight: *highlight}
+	if err := c.Search(req, p); err != nil {
+		return err
+	}
+	return p.Flush()
+}
+
+// runCount prints the number of events matching a query.
+func runCount(args []string) error {
+	fs := flag.NewFlagSet("count", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	var (
+		start = fs.String("start", "", "Inclusive start of the time range, as RFC3339, now, or a duration before now such as -2h")
+		end   = fs.String("end", "", "Exclusive end of the time range, as RFC3339, now, or a duration before now")
+	)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("a query is required, use * to count every event")
+	}
+
+	c, err := connect(conn)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	n, err := c.Count(&searchRequest{Query: strings.Join(fs.Args(), " "), Start: *start, End: *end})
+	if err != nil {
+		return err
+	}
+	fmt.Println(n)
+	return nil
+}
+
+// runTail prints new events matching a query, until interrupted.
+func runTail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	out := addOutputFlags(fs)
+	fs.Parse(args)
+
+	p, err := out.printer()
+	if err != nil {
+		return err
+	}
+	c, err := connect(conn)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return tail(c, strings.Join(fs.Args(), " "), p)
+}
+
+// tail prints new events matching q until interrupted.
+func tail(c client, q string, p *printer) error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-sig:
+			close(stop)
+		case <-done:
+		}
+	}()
+	return c.Tail(q, stop, p)
+}
+
+// connect connects to the query server selected by the flags.
+func connect(f *connectionFlags) (client, error) {
+	p, err := f.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return dial(p)
+}
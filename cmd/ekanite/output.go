@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ekanite/ekanite"
+)
+
+// Output formats
+const (
+	FormatPretty = "pretty"
+	FormatRaw    = "raw"
+	FormatJSON   = "json"
+)
+
+// ANSI escapes used by the pretty format.
+const (
+	ansiReset  = "\x1b[0m"
+	ansiDim    = "\x1b[2m"
+	ansiCyan   = "\x1b[36m"
+	ansiYellow = "\x1b[33m"
+)
+
+// printer writes search results to a terminal or a file.
+type printer struct {
+	w      io.Writer
+	format string
+	color  bool
+	fields []string // Fields shown after each event, in the pretty format.
+
+	events int // Events written.
+	rows   int // Table rows written, or -1 if no table was begun.
+	table  *tabwriter.Writer
+}
+
+// newPrinter returns a printer writing to w in the given format.
+func newPrinter(w io.Writer, format string, color bool, fields []string) (*printer, error) {
+	switch format {
+	case FormatPretty, FormatRaw, FormatJSON:
+	default:
+		return nil, fmt.Errorf("unsupported output format '%s'", format)
+	}
+	return &printer{w: w, format: format, color: color, fields: fields, rows: -1}, nil
+}
+
+// Event implements output.
+func (p *printer) Event(r *ekanite.Result) error {
+	p.events++
+	switch p.format {
+	case FormatRaw:
+		_, err := fmt.Fprintln(p.w, r.Source)
+		return err
+	case FormatJSON:
+		b, err := json.Marshal(&hit{ID: r.ID, Source: r.Source, Fields: r.Fields, Highlights: r.Highlights})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(p.w, "%s\n", b)
+		return err
+	}
+
+	// The pretty format shows the time, host and app of the event, and then its
+	// source, or the highlighted fragments of its message if there are any.
+	msg := r.Source
+	if len(r.Highlights) > 0 {
+		msg = strings.Join(r.Highlights, " … ")
+	}
+	host, app := r.Fields["host"], r.Fields["app"]
+	if host == "" {
+		host = "-"
+	}
+	if app == "" {
+		app = "-"
+	}
+	line := fmt.Sprintf("%s %s %s %s",
+		p.paint(ansiDim, r.Time().Local().Format(time.RFC3339)),
+		p.paint(ansiCyan, host), p.paint(ansiYellow, app), msg)
+	row := r.Row()
+	for _, f := range p.fields {
+		if v, ok := row[f]; ok {
+			line += " " + p.paint(ansiDim, f+"=") + v
+		}
+	}
+	_, err := fmt.Fprintln(p.w, line)
+	return err
+}
+
+// Columns implements output.
+func (p *printer) Columns(columns []string) error {
+	p.rows = 0
+	if p.format == FormatJSON {
+		return p.json(columns)
+	}
+	p.table = tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	_, err := fmt.Fprintln(p.table, strings.Join(columns, "\t"))
+	return err
+}
+
+// Row implements output.
+func (p *printer) Row(values []string) error {
+	p.rows++
+	if p.format == FormatJSON {
+		return p.json(values)
+	}
+	_, err := fmt.Fprintln(p.table, strings.Join(values, "\t"))
+	return err
+}
+
+// Flush writes any buffered table, and must be called once a search is complete.
+func (p *printer) Flush() error {
+	if p.table == nil {
+		return nil
+	}
+	t := p.table
+	p.table = nil
+	return t.Flush()
+}
+
+func (p *printer) json(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(p.w, "%s\n", b)
+	return err
+}
+
+// paint returns s in the given style, if the printer is writing in color.
+func (p *printer) paint(style, s string) string {
+	if !p.color {
+		return s
+	}
+	return style + s + ansiReset
+}
+
+// isTerminal returns whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
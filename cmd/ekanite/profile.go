@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// profile describes how to connect to a query server.
+type profile struct {
+	// Addr is the address of the query server, such as http://localhost:8080 or
+	// https://logs:8080 for the HTTP query server, and tcp://localhost:9950 or
+	// tls://logs:9950 for the TCP query server. An address without a scheme is
+	// a TCP query server.
+	Addr string `json:"addr"`
+
+	Token    string `json:"token,omitempty"`    // API token.
+	User     string `json:"user,omitempty"`     // User, if authenticating with a password.
+	Password string `json:"password,omitempty"` // Password, if authenticating with a password.
+	CA       string `json:"ca,omitempty"`       // PEM file of CA certificates trusted for TLS.
+	Insecure bool   `json:"insecure,omitempty"` // Set to skip verification of the server's certificate.
+}
+
+// config is the content of the client's configuration file.
+type config struct {
+	Default  string              `json:"default,omitempty"` // Profile used if none is given.
+	Profiles map[string]*profile `json:"profiles"`
+}
+
+// configPath returns the path of the client's configuration file.
+func configPath() string {
+	if p := os.Getenv("EKANITE_CONFIG"); p != "" {
+		return p
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".ekanite.json")
+}
+
+// loadConfig loads the configuration file at path. A missing file is an empty
+// configuration.
+func loadConfig(path string) (*config, error) {
+	c := &config{Profiles: make(map[string]*profile)}
+	if path == "" {
+		return c, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err.Error())
+	}
+	return c, nil
+}
+
+// connectionFlags are the flags, common to every command, selecting a query server.
+type connectionFlags struct {
+	profile  *string
+	addr     *string
+	token    *string
+	user     *string
+	ca       *string
+	insecure *bool
+}
+
+// addConnectionFlags registers the connection flags with fs.
+func addConnectionFlags(fs *flag.FlagSet) *connectionFlags {
+	return &connectionFlags{
+		profile:  fs.String("profile", "", "Connection profile from $EKANITE_CONFIG or ~/.ekanite.json"),
+		addr:     fs.String("addr", "", "Query server address, such as http://localhost:8080 or tcp://localhost:9950. Default "+DefaultHTTPAddr),
+		token:    fs.String("token", "", "API token. Defaults to $EKANITE_TOKEN"),
+		user:     fs.String("user", "", "User to authenticate as, with the password from $EKANITE_PASSWORD"),
+		ca:       fs.String("ca", "", "PEM file of CA certificates trusted for TLS"),
+		insecure: fs.Bool("insecure", false, "Skip verification of the server's TLS certificate"),
+	}
+}
+
+// resolve returns the profile selected by the flags, with any other flags, and the
+// environment, overriding its settings.
+func (f *connectionFlags) resolve() (*profile, error) {
+	c, err := loadConfig(configPath())
+	if err != nil {
+		return nil, err
+	}
+	name := *f.profile
+	if name == "" {
+		name = c.Default
+	}
+	p := &profile{}
+	if name != "" {
+		cp, ok := c.Profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("no such profile '%s'", name)
+		}
+		*p = *cp
+	}
+
+	for _, o := range []struct {
+		dst *string
+		v   string
+	}{
+		{&p.Addr, *f.addr},
+		{&p.Token, os.Getenv("EKANITE_TOKEN")},
+		{&p.Token, *f.token},
+		{&p.User, *f.user},
+		{&p.Password, os.Getenv("EKANITE_PASSWORD")},
+		{&p.CA, *f.ca},
+	} {
+		if o.v != "" {
+			*o.dst = o.v
+		}
+	}
+	if *f.insecure {
+		p.Insecure = true
+	}
+	if p.Addr == "" {
+		p.Addr = DefaultHTTPAddr
+	}
+	return p, nil
+}
+
+// scheme returns the scheme of the profile's address, and the address without it.
+func (p *profile) scheme() (string, string) {
+	if n := strings.Index(p.Addr, "://"); n >= 0 {
+		return strings.ToLower(p.Addr[:n]), p.Addr[n+3:]
+	}
+	return "tcp", p.Addr
+}
+
+// tlsConfig returns the TLS configuration for connecting to the server.
+func (p *profile) tlsConfig() (*tls.Config, error) {
+	c := &tls.Config{InsecureSkipVerify: p.Insecure}
+	if p.CA != "" {
+		b, err := ioutil.ReadFile(p.CA)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", p.CA)
+		}
+	}
+	return c, nil
+}
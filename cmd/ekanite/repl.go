@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// REPL defaults
+const (
+	historyFile        = ".ekanite_history"
+	historyPermissions = 0600
+	maxHistory         = 1000
+
+	prompt             = "ekanite> "
+	continuationPrompt = "     ... "
+)
+
+// repl is an interactive session with a query server.
+type repl struct {
+	c   client
+	p   *printer
+	in  *bufio.Scanner
+	out io.Writer
+
+	interactive bool // Whether prompts are shown.
+	history     []string
+	historyPath string // Empty if history is not saved.
+
+	limit      int
+	start, end string
+	highlight  bool
+}
+
+// replCommand is a command of the REPL.
+type replCommand struct {
+	name        string
+	usage       string
+	description string
+	run         func(r *repl, args string) error // Nil for .quit, which the REPL handles.
+}
+
+// replCommands are the commands of the REPL. Any other input is a query.
+var replCommands []*replCommand
+
+func init() {
+	replCommands = []*replCommand{
+		{".help", ".help", "Show this help", (*repl).cmdHelp},
+		{".limit", ".limit [N]", "Show or set the maximum number of events shown. Zero is unlimited", (*repl).cmdLimit},
+		{".range", ".range [START [END]]", "Show or set the time range searched. * is unbounded", (*repl).cmdRange},
+		{".count", ".count QUERY", "Show the number of events matching QUERY", (*repl).cmdCount},
+		{".tail", ".tail [QUERY]", "Show new events matching QUERY as they arrive, until interrupted", (*repl).cmdTail},
+		{".format", ".format [pretty|raw|json]", "Show or set the output format", (*repl).cmdFormat},
+		{".fields", ".fields [FIELD,...]", "Show or set the fields shown after each event", (*repl).cmdFields},
+		{".highlight", ".highlight [on|off]", "Show highlighted matches rather than whole events", (*repl).cmdHighlight},
+		{".history", ".history", "Show the history. !! repeats the last entry, and !N entry N", (*repl).cmdHistory},
+		{".quit", ".quit", "End the session", nil},
+	}
+}
+
+// runREPL starts an interactive session.
+func runREPL(args []string) error {
+	fs := flag.NewFlagSet("repl", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	out := addOutputFlags(fs)
+	limit := fs.Int("limit", DefaultSearchLimit, "Maximum number of events shown. Zero is unlimited")
+	fs.Parse(args)
+
+	p, err := out.printer()
+	if err != nil {
+		return err
+	}
+	prof, err := conn.resolve()
+	if err != nil {
+		return err
+	}
+	c, err := dial(prof)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	r := newREPL(c, p, os.Stdin, os.Stdout)
+	r.limit = *limit
+	r.interactive = isTerminal(os.Stdin)
+	if home := os.Getenv("HOME"); home != "" && r.interactive {
+		r.loadHistory(filepath.Join(home, historyFile))
+	}
+	if r.interactive {
+		fmt.Fprintf(r.out, "Connected to %s. Enter a query, or .help for help.\n", prof.Addr)
+	}
+	return r.run()
+}
+
+// newREPL returns a session with the client, reading input from in.
+func newREPL(c client, p *printer, in io.Reader, out io.Writer) *repl {
+	return &repl{c: c, p: p, in: bufio.NewScanner(in), out: out, limit: DefaultSearchLimit}
+}
+
+// run reads and executes input until the end of the input, or .quit.
+func (r *repl) run() error {
+	for {
+		line, ok := r.read()
+		if !ok {
+			if r.interactive {
+				fmt.Fprintln(r.out)
+			}
+			return r.in.Err()
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "!") {
+			entry, err := r.recall(line)
+			if err != nil {
+				fmt.Fprintf(r.out, "error: %s\n", err.Error())
+				continue
+			}
+			fmt.Fprintln(r.out, entry)
+			line = entry
+		}
+		r.record(line)
+
+		name, args := splitCommand(line)
+		if name == ".quit" || name == ".exit" {
+			return nil
+		}
+		if err := r.execute(name, args, line); err != nil {
+			fmt.Fprintf(r.out, "error: %s\n", err.Error())
+		}
+	}
+}
+
+// read returns the next entry, which continues over several lines while each
+// ends with a backslash or a pipe.
+func (r *repl) read() (string, bool) {
+	var lines []string
+	p := prompt
+	for {
+		if r.interactive {
+			fmt.Fprint(r.out, p)
+		}
+		if !r.in.Scan() {
+			return strings.Join(lines, " "), len(lines) > 0
+		}
+		l := strings.TrimSpace(r.in.Text())
+		switch {
+		case strings.HasSuffix(l, "\\"):
+			lines = append(lines, strings.TrimSpace(strings.TrimSuffix(l, "\\")))
+		case strings.HasSuffix(l, "|"):
+			lines = append(lines, l)
+		default:
+			return strings.Join(append(lines, l), " "), true
+		}
+		p = continuationPrompt
+	}
+}
+
+// execute executes an entry, which is either a command or a query.
+func (r *repl) execute(name, args, line string) error {
+	if !strings.HasPrefix(name, ".") {
+		return r.search(line)
+	}
+	for _, c := range replCommands {
+		if c.name == name && c.run != nil {
+			return c.run(r, args)
+		}
+	}
+	return fmt.Errorf("unknown command %s, enter .help for help", name)
+}
+
+// search shows the results of a query.
+func (r *repl) search(q string) error {
+	req := &searchRequest{Query: q, Start: r.start, End: r.end, Limit: r.limit, Highlight: r.highlight}
+	r.p.events, r.p.rows = 0, -1
+	err := r.c.Search(req, r.p)
+	if ferr := r.p.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil || !r.interactive {
+		return err
+	}
+	if r.p.rows >= 0 {
+		fmt.Fprintf(r.out, "(%d rows)\n", r.p.rows)
+	} else {
+		fmt.Fprintf(r.out, "(%d events)\n", r.p.events)
+	}
+	return nil
+}
+
+func (r *repl) cmdHelp(args string) error {
+	for _, c := range replCommands {
+		fmt.Fprintf(r.out, "  %-28s %s\n", c.usage, c.description)
+	}
+	fmt.Fprintln(r.out, "Any other input is a query. End a line with \\ or | to continue it on the next.")
+	return nil
+}
+
+func (r *repl) cmdLimit(args string) error {
+	if args != "" {
+		n, err := strconv.Atoi(args)
+		if err != nil || n < 0 {
+			return fmt.Errorf("limit must be a non-negative integer")
+		}
+		r.limit = n
+	}
+	fmt.Fprintf(r.out, "limit %d\n", r.limit)
+	return nil
+}
+
+func (r *repl) cmdRange(args string) error {
+	if args != "" {
+		start, end := splitCommand(args)
+		if start == "*" {
+			start = ""
+		}
+		if end == "*" {
+			end = ""
+		}
+		r.start, r.end = start, end
+	}
+	show := func(s string) string {
+		if s == "" {
+			return "*"
+		}
+		return s
+	}
+	fmt.Fprintf(r.out, "range %s %s\n", show(r.start), show(r.end))
+	return nil
+}
+
+func (r *repl) cmdCount(args string) error {
+	n, err := r.c.Count(&searchRequest{Query: args, Start: r.start, End: r.end})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(r.out, n)
+	return nil
+}
+
+func (r *repl) cmdTail(args string) error {
+	if r.interactive {
+		fmt.Fprintln(r.out, "Tailing, press Ctrl-C to stop.")
+	}
+	return tail(r.c, args, r.p)
+}
+
+func (r *repl) cmdFormat(args string) error {
+	if args != "" {
+		if _, err := newPrinter(r.out, args, false, nil); err != nil {
+			return err
+		}
+		r.p.format = args
+	}
+	fmt.Fprintf(r.out, "format %s\n", r.p.format)
+	return nil
+}
+
+func (r *repl) cmdFields(args string) error {
+	if args != "" {
+		r.p.fields = strings.Split(args, ",")
+	}
+	fmt.Fprintf(r.out, "fields %s\n", strings.Join(r.p.fields, ","))
+	return nil
+}
+
+func (r *repl) cmdHighlight(args string) error {
+	switch args {
+	case "on":
+		r.highlight = true
+	case "off":
+		r.highlight = false
+	case "":
+	default:
+		return fmt.Errorf("expected on or off")
+	}
+	fmt.Fprintf(r.out, "highlight %t\n", r.highlight)
+	return nil
+}
+
+func (r *repl) cmdHistory(args string) error {
+	for i, h := range r.history {
+		fmt.Fprintf(r.out, "%5d  %s\n", i+1, h)
+	}
+	return nil
+}
+
+// recall returns the history entry referred to by !! or !N.
+func (r *repl) recall(ref string) (string, error) {
+	if len(r.history) == 0 {
+		return "", fmt.Errorf("history is empty")
+	}
+	if ref == "!!" {
+		return r.history[len(r.history)-1], nil
+	}
+	n, err := strconv.Atoi(ref[1:])
+	if err != nil || n < 1 || n > len(r.history) {
+		return "", fmt.Errorf("no such history entry %s", ref)
+	}
+	return r.history[n-1], nil
+}
+
+// record adds an entry to the history, and saves it if the history is saved.
+func (r *repl) record(entry string) {
+	if len(r.history) > 0 && r.history[len(r.history)-1] == entry {
+		return
+	}
+	r.history = append(r.history, entry)
+	if len(r.history) > maxHistory {
+		r.history = r.history[len(r.history)-maxHistory:]
+	}
+	if r.historyPath == "" {
+		return
+	}
+	f, err := os.OpenFile(r.historyPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, historyPermissions)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, entry)
+}
+
+// loadHistory loads the latest entries of the history saved at path, and saves
+// further entries there.
+func (r *repl) loadHistory(path string) {
+	r.historyPath = path
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if l != "" {
+			r.history = append(r.history, l)
+		}
+	}
+	if len(r.history) > maxHistory {
+		r.history = r.history[len(r.history)-maxHistory:]
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
@@ -15,6 +16,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"syscall"
 	"time"
 
@@ -62,6 +64,9 @@ const (
 	DefaultTCPServer       = "0.0.0.0:5514"
 	DefaultInputFormat     = "syslog"
 	DefaultDispatcherConf  = "dispatcher.json"
+	DefaultCORSOrigins     = ""
+	DefaultQueryTimeout    = "1m"
+	DefaultMaxQueries      = 8
 )
 
 func main() {
@@ -84,6 +89,13 @@ func main() {
 		memProfile      = fs.String("memprof", "", "Where to write memory profiling data. Not written if not set")
 		inputFormat     = fs.String("input", DefaultInputFormat, "Message format of input (only syslog supported)")
 		dispatcher      = fs.String("dispatcher", DefaultDispatcherConf, "specify dispatcher json configuration file path")
+		corsOrigins     = fs.String("corsorigins", DefaultCORSOrigins, "Comma-separated origins allowed to make cross-origin HTTP API requests, or * for any. Disabled if not set")
+		queryTimeout    = fs.String("querytimeout", DefaultQueryTimeout, "Maximum duration of a query, including time spent queued. Zero is unlimited")
+		maxQueries      = fs.Int("maxqueries", DefaultMaxQueries, "Maximum number of concurrent queries. Further queries are queued. Zero is unlimited")
+		queryCertPath   = fs.String("querytlscert", "", "path to PEM certificate file for the query servers. If not set, TLS not activated")
+		queryKeyPath    = fs.String("querytlskey", "", "path to PEM key file for the query servers. If not set, TLS not activated")
+		credentials     = fs.String("querycredentials", "", "path to JSON credentials file for the query servers. If not set, authentication not required")
+		auditPath       = fs.String("auditlog", "", "path to append-only audit log of every query. If not set, queries not audited")
 	)
 	fs.Usage = printHelp
 	fs.Parse(os.Args[1:])
@@ -99,6 +111,12 @@ func main() {
 		log.Fatalf("failed to parse retention period '%s'", *retentionPeriod)
 	}
 
+	// Get the query timeout.
+	timeout, err := time.ParseDuration(*queryTimeout)
+	if err != nil {
+		log.Fatalf("failed to parse query timeout '%s'", *queryTimeout)
+	}
+
 	log.SetFlags(log.LstdFlags)
 	log.SetPrefix("[ekanite] ")
 	log.Printf("ekanite started using %s for index storage", absDataDir)
@@ -115,26 +133,51 @@ func main() {
 	engine := ekanite.NewEngine(absDataDir)
 	engine.NumShards = *numShards
 	engine.RetentionPeriod = retention
+	engine.QueryTimeout = timeout
+	engine.MaxConcurrentQueries = *maxQueries
 
 	if err := engine.Open(); err != nil {
 		log.Fatalf("failed to open engine: %s", err.Error())
 	}
-	log.Printf("engine opened with shard number of %d, retention period of %s",
-		engine.NumShards, engine.RetentionPeriod)
+	log.Printf("engine opened with shard number of %d, retention period of %s, query timeout of %s, max concurrent queries of %d",
+		engine.NumShards, engine.RetentionPeriod, engine.QueryTimeout, engine.MaxConcurrentQueries)
 
-	// Start the simple query server if requested.
-	if *queryIface != "" {
-		startQueryServer(*queryIface, engine)
+	// Newly indexed events are made available to tailing query clients.
+	tailer := ekanite.NewTailer()
+
+	// Secure the query servers if requested.
+	var queryTLS *tls.Config
+	if *queryCertPath != "" && *queryKeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(*queryCertPath, *queryKeyPath)
+		if err != nil {
+			log.Fatalf("failed to configure query server TLS: %s", err.Error())
+		}
+		queryTLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		log.Printf("query server TLS successfully configured")
+	}
+	var auth *ekanite.Authenticator
+	if *credentials != "" {
+		auth, err = ekanite.LoadAuthenticator(*credentials)
+		if err != nil {
+			log.Fatalf("failed to load query credentials: %s", err.Error())
+		}
+		log.Printf("query server authentication enabled using %s", *credentials)
 	}
 
-	// Start the http query server if requested.
-	if *queryIfaceHttp != "" {
-		startHTTPQueryServer(*queryIfaceHttp, engine)
+	// Open the audit log if requested.
+	var audit *ekanite.AuditLog
+	if *auditPath != "" {
+		audit, err = ekanite.OpenAuditLog(*auditPath)
+		if err != nil {
+			log.Fatalf("failed to open audit log: %s", err.Error())
+		}
+		log.Printf("auditing queries to %s", *auditPath)
 	}
 
 	// Create and start the batcher.
 	batcherTimeout := time.Duration(*batchTimeout) * time.Millisecond
 	batcher := ekanite.NewBatcher(engine, *batchSize, batcherTimeout, *indexMaxPending)
+	batcher.Tail(tailer)
 
 	errChan := make(chan error)
 	if err := batcher.Start(errChan); err != nil {
@@ -143,15 +186,43 @@ func main() {
 	log.Printf("batching configured with size %d, timeout %s, max pending %d",
 		*batchSize, batcherTimeout, *indexMaxPending)
 
+	dispatchCtx, stopDispatch := context.WithCancel(context.Background())
+	var dispatchers *dispatch.Manager
 	if *dispatcher != "" {
-		dispatchers, err := dispatch.NewDispatcher(*dispatcher)
+		dispatchers, err = dispatch.NewManager(*dispatcher)
 		if err != nil {
 			log.Fatalf("failed to create dispatcher from configuration file, %s", err)
 			return
 		}
-		for _, v := range dispatchers {
-			batcher.Add(v)
+		if err := dispatchers.Start(dispatchCtx); err != nil {
+			log.Fatalf("failed to start dispatcher: %s", err.Error())
 		}
+		batcher.Add(dispatchers)
+	}
+
+	// Suppress, or tag, the triggers of events within maintenance windows.
+	maintenance := ekanite.NewMaintenance(absDataDir)
+	if err := maintenance.Open(); err != nil {
+		log.Fatalf("failed to open maintenance windows: %s", err.Error())
+	}
+	dispatch.SetMaintenance(maintenance)
+
+	// Evaluate saved searches, dispatching the alerts they fire.
+	alerter := ekanite.NewAlerter(absDataDir, engine)
+	alerter.Auth = auth
+	alerter.Dispatch = batcher.Dispatch
+	if err := alerter.Open(); err != nil {
+		log.Fatalf("failed to open alerter: %s", err.Error())
+	}
+
+	// Start the simple query server if requested.
+	if *queryIface != "" {
+		startQueryServer(*queryIface, engine, tailer, auth, queryTLS, audit)
+	}
+
+	// Start the http query server if requested.
+	if *queryIfaceHttp != "" {
+		startHTTPQueryServer(*queryIfaceHttp, engine, tailer, auth, queryTLS, audit, alerter, maintenance, dispatchers, *corsOrigins)
 	}
 
 	// Start draining batcher errors.
@@ -186,9 +257,19 @@ func main() {
 	startProfile(*cpuProfile, *memProfile)
 
 	// Wait forever for signals.
-	waitForSignals()
+	waitForSignals(dispatchers)
 
+	alerter.Close()
+	stopDispatch()
+	if dispatchers != nil {
+		if err := dispatchers.Close(); err != nil {
+			log.Printf("failed to close dispatcher: %s", err.Error())
+		}
+	}
 	engine.Close()
+	if audit != nil {
+		audit.Close()
+	}
 
 	stopProfile()
 }
@@ -217,22 +298,38 @@ func startUDPCollector(iface, format string, batcher *ekanite.Batcher) error {
 	return nil
 }
 
-func startQueryServer(iface string, engine *ekanite.Engine) {
+func startQueryServer(iface string, engine *ekanite.Engine, tailer *ekanite.Tailer, auth *ekanite.Authenticator, tlsConfig *tls.Config, audit *ekanite.AuditLog) {
 	server := ekanite.NewServer(iface, engine)
 	if server == nil {
 		log.Fatal("failed to create query server")
 	}
+	server.Tailer = tailer
+	server.Auth = auth
+	server.TLS = tlsConfig
+	server.Audit = audit
 	if err := server.Start(); err != nil {
 		log.Fatalf("failed to start query server: %s", err.Error())
 	}
 	log.Printf("query server listening on %s", iface)
 }
 
-func startHTTPQueryServer(iface string, engine *ekanite.Engine) {
+func startHTTPQueryServer(iface string, engine *ekanite.Engine, tailer *ekanite.Tailer, auth *ekanite.Authenticator, tlsConfig *tls.Config, audit *ekanite.AuditLog, alerter *ekanite.Alerter, maintenance *ekanite.Maintenance, dispatchers *dispatch.Manager, corsOrigins string) {
 	server := ekanite.NewHTTPServer(iface, engine)
 	if server == nil {
 		log.Fatal("failed to create HTTP query server")
 	}
+	server.Tailer = tailer
+	server.Auth = auth
+	server.TLS = tlsConfig
+	server.Audit = audit
+	server.Alerts = alerter
+	server.Maintenance = maintenance
+	if dispatchers != nil {
+		server.Reload = dispatchers.Reload
+	}
+	if corsOrigins != "" {
+		server.CORSOrigins = strings.Split(corsOrigins, ",")
+	}
 	if err := server.Start(); err != nil {
 		log.Fatalf("failed to start HTTP query server: %s", err.Error())
 	}
@@ -298,16 +395,27 @@ func drainLog(msg string, errChan <-chan error) {
 	}
 }
 
-// waitForSignals blocks until a signal is received.
-func waitForSignals() {
+// waitForSignals blocks until a signal to shut down is received, reloading the
+// dispatcher configuration on SIGHUP.
+func waitForSignals(dispatchers *dispatch.Manager) {
 	// Set up signal handling.
 	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
 	// Block until one of the signals above is received
-	select {
-	case <-signalCh:
-		log.Println("signal received, shutting down...")
+	for sig := range signalCh {
+		if sig != syscall.SIGHUP {
+			log.Println("signal received, shutting down...")
+			return
+		}
+		if dispatchers == nil {
+			log.Println("SIGHUP received, but no dispatcher configuration to reload")
+			continue
+		}
+		log.Println("SIGHUP received, reloading dispatcher configuration...")
+		if _, err := dispatchers.Reload(); err != nil {
+			log.Printf("failed to reload dispatcher configuration, keeping the current one: %s", err.Error())
+		}
 	}
 }
 
@@ -1,6 +1,10 @@
 package main_test
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -31,6 +35,10 @@ func NewSystem(path string) *testSystem {
 	s := NewServer("127.0.0.1:0", e)
 	c := NewCollector("127.0.0.1:0")
 
+	t := ekanite.NewTailer()
+	b.Tail(t)
+	s.Tailer = t
+
 	b.Start(nil)
 	c.Start(b.C())
 	s.Start()
@@ -83,6 +91,49 @@ func Test_SingleLineClose(t *testing.T) {
 	sys.e.waitForCount(1)
 }
 
+// Test_Tail ensures a query client receives matching events as they are ingested.
+func Test_Tail(t *testing.T) {
+	path := tempPath()
+	defer os.RemoveAll(path)
+	sys := NewSystem(path)
+
+	queryConn, err := net.Dial("tcp", sys.s.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to query server: %s", err.Error())
+	}
+	defer queryConn.Close()
+	if _, err := queryConn.Write([]byte("TAIL rejected\n")); err != nil {
+		t.Fatalf("failed to send tail command: %s", err.Error())
+	}
+	waitForTailers(1)
+
+	lines := []string{
+		"<33>5 1985-04-12T23:20:50.52Z test.com cron 304 - password accepted",
+		"<33>5 1985-04-12T23:20:51.52Z test.com cron 304 - password rejected",
+	}
+	ingestConn := sys.IngestConn()
+	for _, l := range lines {
+		if _, err := ingestConn.Write([]byte(l + "\n")); err != nil {
+			t.Fatalf("failed to write '%s' to Collector: %s", l, err.Error())
+		}
+	}
+
+	queryConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := bufio.NewReader(queryConn).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("failed to read tailed event: %s", err.Error())
+	}
+	var event struct {
+		Source string `json:"source"`
+	}
+	if err := json.Unmarshal(got, &event); err != nil {
+		t.Fatalf("failed to decode tailed event %q: %s", got, err.Error())
+	}
+	if event.Source != lines[1] {
+		t.Fatalf("wrong tailed event, exp: '%s', got: '%s'", lines[1], event.Source)
+	}
+}
+
 // Test_EndToEnd ensures a complete system operates as expected.
 func Test_EndToEnd(t *testing.T) {
 	path := tempPath()
@@ -346,6 +397,16 @@ outer:
 	}
 }
 
+// waitForTailers blocks until the number of tail subscribers matches 'count'.
+func waitForTailers(count int64) {
+	for {
+		if v, ok := expvar.Get("engine").(*expvar.Map).Get("tailSubscribers").(*expvar.Int); ok && v.Value() == count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 type testServer struct {
 	*ekanite.Server
 }
@@ -357,7 +418,7 @@ func NewServer(addr string, e *testEngine) *testServer {
 
 // Search performs the given search and returns the log lines in a slice.
 func (s *testServer) Search(query string) (resultSlice []string, err error) {
-	resultSet, err := s.Searcher.Search(query)
+	resultSet, err := s.Searcher.Search(context.Background(), query)
 
 	if err != nil {
 		return
@@ -1,18 +1,114 @@
 package dispatch
 
+import "encoding/json"
+
+// DispatcherConfig is a configuration file, with a section for each dispatcher
+// decoded by the factory registered for its type.
 type DispatcherConfig struct {
-	Dispatcher []DispatcherInstance `json:"dispatcher"`
+	Dispatcher []json.RawMessage `json:"dispatcher"`
 }
 
+// DispatcherInstance is the section configuring a built-in dispatcher.
 type DispatcherInstance struct {
 	Type         string             `json:"type"`
 	URI          string             `json:"uri,omitempty"`
 	Exchange     string             `json:"exchange,omitempty"`
 	ExchangeType string             `json:"exchangeType,omitempty"`
 	Triggers     map[string]Trigger `json:"triggers,omitempty"`
+	OutboxSize   int                `json:"outboxSize,omitempty"` // messages queued while the destination is unavailable
+
+	// elasticsearch: index name, in which text between braces is a time layout
+	// formatted with the event's time, such as ekanite-{2006.01.02}
+	Index         string  `json:"index,omitempty"`
+	BatchSize     int     `json:"batchSize,omitempty"`
+	FlushInterval string  `json:"flushInterval,omitempty"`
+	Filter        *Filter `json:"filter,omitempty"` // events shipped, all if not set
+
+	// webhook: URLs events are posted to, with a payload rendered from a text/template
+	// or a JSON mapping whose strings may refer to fields as $name or ${name}
+	URLs     []string               `json:"urls,omitempty"`
+	Template string                 `json:"template,omitempty"`
+	Payload  map[string]interface{} `json:"payload,omitempty"`
+	Headers  map[string]string      `json:"headers,omitempty"`
+	Secret   string                 `json:"secret,omitempty"` // signs requests with HMAC-SHA256
+	Timeout  string                 `json:"timeout,omitempty"`
+	Retries  int                    `json:"retries,omitempty"` // -1 disables retries
+
+	// syslog: events are forwarded to the uri, such as udp://host:514, tcp://host:514
+	// or tls://host:6514, formatted as rfc5424 or rfc3164. Framing over TCP and TLS
+	// is octet-counting or newline. Hostname and AppName, which may refer to fields
+	// as $name or ${name}, replace those of the events.
+	Format   string `json:"format,omitempty"`
+	Framing  string `json:"framing,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	AppName  string `json:"appName,omitempty"`
+	CA       string `json:"ca,omitempty"` // PEM file of CAs verifying TLS destinations
+	Insecure bool   `json:"insecure,omitempty"`
+
+	// file: events are archived under Dir in the Format ndjson or raw, compressed
+	// with gzip or zstd, in files rotated every RotateInterval or once MaxSize
+	// bytes of events have been written
+	Dir            string `json:"dir,omitempty"`
+	Compression    string `json:"compression,omitempty"`
+	MaxSize        int64  `json:"maxSize,omitempty"`
+	RotateInterval string `json:"rotateInterval,omitempty"`
+
+	// rules routing events to triggers, tried in order
+	Rules []NapRule `json:"rules,omitempty"`
+
+	// correlation rules applied to events before they are dispatched
+	Correlation []CorrelationRule `json:"correlation,omitempty"`
 }
 
 type Trigger struct {
 	Queue      string `json:"queue"`
 	RoutingKey string `json:"routingKey"`
 }
+
+// CorrelationRule describes a rule which tracks events across time, and emits a
+// synthetic event to a trigger when it matches.
+type CorrelationRule struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // sequence, threshold or absence
+
+	// Match maps fields to regular expressions every event counted by a threshold
+	// or absence rule must match. Steps are the matches of a sequence, in order.
+	Match map[string]string   `json:"match,omitempty"`
+	Steps []map[string]string `json:"steps,omitempty"`
+
+	// KeyBy are the fields keying correlation state, such as host. Events missing
+	// any of them are ignored by the rule.
+	KeyBy []string `json:"keyBy,omitempty"`
+
+	// Window is the time within which a sequence must complete, or threshold
+	// events be counted, and after which a key without events is absent.
+	Window string `json:"window"`
+	Count  int    `json:"count,omitempty"` // threshold only
+
+	// Trigger names the trigger of the dispatcher the synthetic events are sent to.
+	Trigger string `json:"trigger"`
+}
+
+// Filter selects the events satisfying every one of its conditions.
+type Filter struct {
+	// Equals maps fields to the values they must equal. Regex maps fields to
+	// regular expressions they must match. Query is a query-language expression,
+	// searching message by default.
+	Equals map[string]string `json:"equals,omitempty"`
+	Regex  map[string]string `json:"regex,omitempty"`
+	Query  string            `json:"query,omitempty"`
+}
+
+// NapRule routes the events matching its filter to a trigger. Named captures of
+// the filter's regular expressions are added to the event.
+type NapRule struct {
+	Name string `json:"name"`
+	Filter
+
+	// Fields are added to matching events. Values may refer to captures and
+	// fields as $name or ${name}.
+	Fields map[string]string `json:"fields,omitempty"`
+
+	Trigger string `json:"trigger"`
+	TypeID  string `json:"typeId,omitempty"` // defaults to DefaultTypeID
+}
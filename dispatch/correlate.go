@@ -0,0 +1,373 @@
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+// how often absence rules are checked, and expired correlation state dropped
+const correlationTick = time.Second
+
+// number of windows after which absence rules forget keys no longer seen, such as
+// decommissioned devices
+const absenceForget = 10
+
+// correlator applies correlation rules to the events passing through it to
+// another dispatcher, and dispatches the synthetic events the rules emit.
+type correlator struct {
+	next  Dispatcher
+	rules []rule
+
+	mu sync.Mutex // serializes events and ticks
+}
+
+// rule is a correlation rule, holding state for each key.
+type rule interface {
+	// event processes an event, returning any synthetic events emitted
+	event(e *input.Event) []*input.Event
+	// tick checks the rule at the given time, and drops expired state
+	tick(now time.Time) []*input.Event
+}
+
+func newCorrelator(next Dispatcher, rules []CorrelationRule, triggers map[string]Trigger) (*correlator, error) {
+	c := &correlator{next: next}
+	for _, v := range rules {
+		r, err := newRule(v, triggers)
+		if err != nil {
+			return nil, fmt.Errorf("correlation rule %s: %s", v.Name, err)
+		}
+		c.rules = append(c.rules, r)
+	}
+	return c, nil
+}
+
+func (c *correlator) Start(ctx context.Context) error {
+	if err := c.next.Start(ctx); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(correlationTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				c.mu.Lock()
+				c.tick(ctx, now)
+				c.mu.Unlock()
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *correlator) Dispatch(ctx context.Context, events []*input.Event) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for _, v := range events {
+		if e := c.do(ctx, v); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// do dispatches the event, then applies the rules to it. Rules therefore see any
+// fields the dispatcher extracted, such as interface and state.
+func (c *correlator) do(ctx context.Context, event *input.Event) error {
+	err := c.next.Dispatch(ctx, []*input.Event{event})
+	for _, r := range c.rules {
+		if emitted := r.event(event); len(emitted) > 0 {
+			c.next.Dispatch(ctx, emitted)
+		}
+	}
+	return err
+}
+
+func (c *correlator) tick(ctx context.Context, now time.Time) {
+	for _, r := range c.rules {
+		if emitted := r.tick(now); len(emitted) > 0 {
+			c.next.Dispatch(ctx, emitted)
+		}
+	}
+}
+
+func (c *correlator) Close() error {
+	return c.next.Close()
+}
+
+func newRule(cfg CorrelationRule, triggers map[string]Trigger) (rule, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("name required")
+	}
+	if _, ok := triggers[cfg.Trigger]; !ok {
+		return nil, fmt.Errorf("trigger '%s' not configured", cfg.Trigger)
+	}
+	window, err := time.ParseDuration(cfg.Window)
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("invalid window '%s'", cfg.Window)
+	}
+	base := ruleBase{
+		name:    cfg.Name,
+		typ:     strings.ToLower(cfg.Type),
+		trigger: cfg.Trigger,
+		keyBy:   cfg.KeyBy,
+		window:  window,
+	}
+
+	switch base.typ {
+	case "sequence":
+		if len(cfg.Steps) < 2 {
+			return nil, fmt.Errorf("a sequence requires at least 2 steps")
+		}
+		r := &sequenceRule{ruleBase: base, state: make(map[string]*sequenceState)}
+		for _, v := range cfg.Steps {
+			m, err := newMatcher(v)
+			if err != nil {
+				return nil, err
+			}
+			r.steps = append(r.steps, m)
+		}
+		return r, nil
+	case "threshold":
+		if cfg.Count < 1 {
+			return nil, fmt.Errorf("count must be at least 1")
+		}
+		m, err := newMatcher(cfg.Match)
+		if err != nil {
+			return nil, err
+		}
+		return &thresholdRule{ruleBase: base, match: m, count: cfg.Count, seen: make(map[string][]time.Time)}, nil
+	case "absence":
+		m, err := newMatcher(cfg.Match)
+		if err != nil {
+			return nil, err
+		}
+		return &absenceRule{ruleBase: base, match: m, seen: make(map[string]time.Time), absent: make(map[string]bool)}, nil
+	default:
+		return nil, fmt.Errorf("type %s not valid", cfg.Type)
+	}
+}
+
+// matcher matches events whose fields match regular expressions. An empty matcher
+// matches every event.
+type matcher map[string]*regexp.Regexp
+
+func newMatcher(fields map[string]string) (matcher, error) {
+	m := make(matcher)
+	for k, v := range fields {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match for %s: %s", k, err)
+		}
+		m[k] = re
+	}
+	return m, nil
+}
+
+func (m matcher) match(event *input.Event) bool {
+	for k, re := range m {
+		v, ok := event.Parsed[k]
+		if !ok || !re.MatchString(fmt.Sprint(v)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ruleBase holds the configuration common to every rule.
+type ruleBase struct {
+	name    string
+	typ     string
+	trigger string
+	keyBy   []string
+	window  time.Duration
+}
+
+// key returns the correlation key of the event, which is false if the event is
+// missing a key field.
+func (r *ruleBase) key(event *input.Event) (string, bool) {
+	values := make([]string, len(r.keyBy))
+	for i, k := range r.keyBy {
+		v, ok := event.Parsed[k]
+		if !ok {
+			return "", false
+		}
+		values[i] = fmt.Sprint(v)
+	}
+	return strings.Join(values, "\x00"), true
+}
+
+// emit returns the synthetic event of the rule matching for the key. Its trigger
+// field names the trigger it is sent to.
+func (r *ruleBase) emit(t time.Time, key string, message string, fields map[string]interface{}) []*input.Event {
+	parsed := map[string]interface{}{
+		"timestamp":   t.Format(time.RFC3339),
+		"app":         "ekanite",
+		"correlation": r.name,
+		"rule":        r.typ,
+		"trigger":     r.trigger,
+	}
+	message = fmt.Sprintf("correlation rule '%s' %s", r.name, message)
+	if len(r.keyBy) > 0 {
+		var group []string
+		for i, v := range strings.Split(key, "\x00") {
+			parsed[r.keyBy[i]] = v
+			group = append(group, r.keyBy[i]+" "+v)
+		}
+		message += " for " + strings.Join(group, ", ")
+	}
+	parsed["message"] = message
+	for k, v := range fields {
+		parsed[k] = v
+	}
+	log.Println("[correlation]", message)
+	return []*input.Event{{Text: message, Parsed: parsed, ReceptionTime: t}}
+}
+
+// sequenceRule matches events matching each of its steps in order, for the same
+// key, within the window of the first.
+type sequenceRule struct {
+	ruleBase
+	steps []matcher
+	state map[string]*sequenceState
+}
+
+type sequenceState struct {
+	step  int // the next step expected
+	start time.Time
+}
+
+func (r *sequenceRule) event(event *input.Event) []*input.Event {
+	key, ok := r.key(event)
+	if !ok {
+		return nil
+	}
+	t := event.ReceptionTime
+	s, ok := r.state[key]
+	if ok && t.Sub(s.start) > r.window {
+		delete(r.state, key)
+		ok = false
+	}
+	if ok && r.steps[s.step].match(event) {
+		s.step++
+		if s.step < len(r.steps) {
+			return nil
+		}
+		delete(r.state, key)
+		return r.emit(t, key, fmt.Sprintf("matched a sequence of %d events in %s", len(r.steps), t.Sub(s.start)), nil)
+	}
+	// a repeated first step restarts the sequence
+	if r.steps[0].match(event) {
+		r.state[key] = &sequenceState{step: 1, start: t}
+	}
+	return nil
+}
+
+func (r *sequenceRule) tick(now time.Time) []*input.Event {
+	for k, v := range r.state {
+		if now.Sub(v.start) > r.window {
+			delete(r.state, k)
+		}
+	}
+	return nil
+}
+
+// thresholdRule matches when count events for the same key fall within the window.
+// Counting then restarts for the key.
+type thresholdRule struct {
+	ruleBase
+	match matcher
+	count int
+	seen  map[string][]time.Time
+}
+
+func (r *thresholdRule) event(event *input.Event) []*input.Event {
+	if !r.match.match(event) {
+		return nil
+	}
+	key, ok := r.key(event)
+	if !ok {
+		return nil
+	}
+	t := event.ReceptionTime
+	seen := append(r.expire(r.seen[key], t), t)
+	if len(seen) < r.count {
+		r.seen[key] = seen
+		return nil
+	}
+	delete(r.seen, key)
+	return r.emit(t, key, fmt.Sprintf("counted %d events within %s", len(seen), r.window), map[string]interface{}{"count": len(seen)})
+}
+
+// expire returns the times within the window before t.
+func (r *thresholdRule) expire(seen []time.Time, t time.Time) []time.Time {
+	i := 0
+	for i < len(seen) && t.Sub(seen[i]) >= r.window {
+		i++
+	}
+	return seen[i:]
+}
+
+func (r *thresholdRule) tick(now time.Time) []*input.Event {
+	for k, v := range r.seen {
+		if v = r.expire(v, now); len(v) == 0 {
+			delete(r.seen, k)
+		} else {
+			r.seen[k] = v
+		}
+	}
+	return nil
+}
+
+// absenceRule matches when no events have been seen for a key within the window.
+// Keys are learned from the events seen, and match once until seen again. Keys not
+// seen for absenceForget windows are forgotten.
+type absenceRule struct {
+	ruleBase
+	match  matcher
+	seen   map[string]time.Time
+	absent map[string]bool
+}
+
+func (r *absenceRule) event(event *input.Event) []*input.Event {
+	if !r.match.match(event) {
+		return nil
+	}
+	key, ok := r.key(event)
+	if !ok {
+		return nil
+	}
+	r.seen[key] = event.ReceptionTime
+	delete(r.absent, key)
+	return nil
+}
+
+func (r *absenceRule) tick(now time.Time) []*input.Event {
+	var events []*input.Event
+	for k, v := range r.seen {
+		if r.absent[k] {
+			if now.Sub(v) >= absenceForget*r.window {
+				delete(r.seen, k)
+				delete(r.absent, k)
+			}
+			continue
+		}
+		if now.Sub(v) < r.window {
+			continue
+		}
+		r.absent[k] = true
+		events = append(events, r.emit(now, k, fmt.Sprintf("saw no events within %s", r.window),
+			map[string]interface{}{"lastSeen": v.Format(time.RFC3339)})...)
+	}
+	return events
+}
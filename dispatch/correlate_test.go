@@ -0,0 +1,227 @@
+package dispatch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+// recorder is a dispatcher recording the events it is given.
+type recorder struct {
+	events []*input.Event
+}
+
+func (r *recorder) Start(ctx context.Context) error { return nil }
+func (r *recorder) Close() error                    { return nil }
+
+func (r *recorder) Dispatch(ctx context.Context, events []*input.Event) error {
+	r.events = append(r.events, events...)
+	return nil
+}
+
+// synthetic returns the messages of the synthetic events recorded.
+func (r *recorder) synthetic() []string {
+	var m []string
+	for _, v := range r.events {
+		if _, ok := v.Parsed["correlation"]; ok {
+			m = append(m, v.Parsed["message"].(string))
+		}
+	}
+	r.events = nil
+	return m
+}
+
+// newEvent returns an event with the fields, given as pairs of names and values,
+// received offset after refTime.
+func newEvent(offset time.Duration, fields ...interface{}) *input.Event {
+	e := newTestEvent("", fields...)
+	e.ReceptionTime = refTime.Add(offset)
+	return e
+}
+
+func newTestCorrelator(t *testing.T, rules ...CorrelationRule) (*correlator, *recorder) {
+	r := &recorder{}
+	c, err := newCorrelator(r, rules, map[string]Trigger{"t": {Queue: "q", RoutingKey: "k"}})
+	if err != nil {
+		t.Fatalf("failed to create correlator: %s", err)
+	}
+	return c, r
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func Test_SequenceRule(t *testing.T) {
+	c, r := newTestCorrelator(t, CorrelationRule{
+		Name:    "flap",
+		Type:    "sequence",
+		Steps:   []map[string]string{{"state": "^down$"}, {"state": "^up$"}},
+		KeyBy:   []string{"host", "interface"},
+		Window:  "30s",
+		Trigger: "t",
+	})
+
+	c.do(context.Background(), newEvent(0, "host", "router1", "interface", "Gi0/1", "state", "down"))
+	c.do(context.Background(), newEvent(time.Second, "host", "router1", "interface", "Gi0/2", "state", "up"))
+	c.do(context.Background(), newEvent(10*time.Second, "host", "router1", "interface", "Gi0/1", "state", "up"))
+	exp := []string{"correlation rule 'flap' matched a sequence of 2 events in 10s for host router1, interface Gi0/1"}
+	if m := r.synthetic(); !equalStrings(m, exp) {
+		t.Fatalf("wrong synthetic events, exp %v, got %v", exp, m)
+	}
+	if len(c.rules[0].(*sequenceRule).state) != 0 {
+		t.Fatalf("state not cleared after sequence matched")
+	}
+
+	// Sequences not completed within the window do not match.
+	c.do(context.Background(), newEvent(time.Minute, "host", "router1", "interface", "Gi0/1", "state", "down"))
+	c.do(context.Background(), newEvent(2*time.Minute, "host", "router1", "interface", "Gi0/1", "state", "up"))
+	if m := r.synthetic(); len(m) != 0 {
+		t.Fatalf("sequence outside window matched: %v", m)
+	}
+
+	// Events missing a key field are ignored.
+	c.do(context.Background(), newEvent(3*time.Minute, "host", "router1", "state", "down"))
+	c.do(context.Background(), newEvent(3*time.Minute, "host", "router1", "state", "up"))
+	if m := r.synthetic(); len(m) != 0 {
+		t.Fatalf("events without key matched: %v", m)
+	}
+
+	c.do(context.Background(), newEvent(4*time.Minute, "host", "router1", "interface", "Gi0/1", "state", "down"))
+	c.tick(context.Background(), refTime.Add(5*time.Minute))
+	if len(c.rules[0].(*sequenceRule).state) != 0 {
+		t.Fatalf("expired state not dropped")
+	}
+}
+
+func Test_ThresholdRule(t *testing.T) {
+	c, r := newTestCorrelator(t, CorrelationRule{
+		Name:    "logins",
+		Type:    "threshold",
+		Match:   map[string]string{"app": "LOGIN_FAILED"},
+		KeyBy:   []string{"host"},
+		Window:  "1m",
+		Count:   3,
+		Trigger: "t",
+	})
+
+	for _, e := range []*input.Event{
+		newEvent(0, "host", "a", "app", "%SEC_LOGIN-4-LOGIN_FAILED"),
+		newEvent(10*time.Second, "host", "a", "app", "%SEC_LOGIN-4-LOGIN_FAILED"),
+		newEvent(20*time.Second, "host", "b", "app", "%SEC_LOGIN-4-LOGIN_FAILED"),
+		newEvent(30*time.Second, "host", "a", "app", "%LINK-3-UPDOWN"),
+		newEvent(65*time.Second, "host", "a", "app", "%SEC_LOGIN-4-LOGIN_FAILED"),
+		newEvent(69*time.Second, "host", "a", "app", "%SEC_LOGIN-4-LOGIN_FAILED"),
+	} {
+		c.do(context.Background(), e)
+	}
+	exp := []string{"correlation rule 'logins' counted 3 events within 1m0s for host a"}
+	if m := r.synthetic(); !equalStrings(m, exp) {
+		t.Fatalf("wrong synthetic events, exp %v, got %v", exp, m)
+	}
+
+	// Counting restarts once the rule matches.
+	c.do(context.Background(), newEvent(81*time.Second, "host", "a", "app", "%SEC_LOGIN-4-LOGIN_FAILED"))
+	if m := r.synthetic(); len(m) != 0 {
+		t.Fatalf("threshold matched again without restarting: %v", m)
+	}
+	c.tick(context.Background(), refTime.Add(time.Hour))
+	if len(c.rules[0].(*thresholdRule).seen) != 0 {
+		t.Fatalf("expired state not dropped")
+	}
+}
+
+func Test_AbsenceRule(t *testing.T) {
+	c, r := newTestCorrelator(t, CorrelationRule{
+		Name:    "heartbeat",
+		Type:    "absence",
+		Match:   map[string]string{"message": "heartbeat"},
+		KeyBy:   []string{"host"},
+		Window:  "10m",
+		Trigger: "t",
+	})
+
+	c.do(context.Background(), newEvent(0, "host", "a", "message", "heartbeat"))
+	c.do(context.Background(), newEvent(0, "host", "b", "message", "heartbeat"))
+	c.do(context.Background(), newEvent(5*time.Minute, "host", "b", "message", "heartbeat"))
+	c.tick(context.Background(), refTime.Add(9*time.Minute))
+	if m := r.synthetic(); len(m) != 0 {
+		t.Fatalf("absence matched early: %v", m)
+	}
+
+	c.tick(context.Background(), refTime.Add(10*time.Minute))
+	exp := []string{"correlation rule 'heartbeat' saw no events within 10m0s for host a"}
+	if m := r.synthetic(); !equalStrings(m, exp) {
+		t.Fatalf("wrong synthetic events, exp %v, got %v", exp, m)
+	}
+
+	// An absent key matches once until seen again.
+	c.tick(context.Background(), refTime.Add(11*time.Minute))
+	if m := r.synthetic(); len(m) != 0 {
+		t.Fatalf("absent key matched again: %v", m)
+	}
+	c.tick(context.Background(), refTime.Add(15*time.Minute))
+	if m := r.synthetic(); len(m) != 1 || m[0] != "correlation rule 'heartbeat' saw no events within 10m0s for host b" {
+		t.Fatalf("wrong synthetic events: %v", m)
+	}
+	c.do(context.Background(), newEvent(12*time.Minute, "host", "a", "message", "heartbeat"))
+	c.tick(context.Background(), refTime.Add(22*time.Minute))
+	if m := r.synthetic(); len(m) != 1 {
+		t.Fatalf("absent key seen again did not match again: %v", m)
+	}
+
+	// Keys absent for long enough are forgotten.
+	c.tick(context.Background(), refTime.Add(5*time.Minute+absenceForget*10*time.Minute))
+	if a := c.rules[0].(*absenceRule); len(a.seen) != 1 || len(a.absent) != 1 {
+		t.Fatalf("wrong keys remembered, got %v", a.seen)
+	}
+	c.tick(context.Background(), refTime.Add(12*time.Minute+absenceForget*10*time.Minute))
+	if a := c.rules[0].(*absenceRule); len(a.seen) != 0 || len(a.absent) != 0 || len(r.synthetic()) != 0 {
+		t.Fatalf("absent keys not forgotten, got %v", a.seen)
+	}
+}
+
+func Test_SyntheticEvent(t *testing.T) {
+	c, r := newTestCorrelator(t, CorrelationRule{
+		Name:    "any",
+		Type:    "threshold",
+		KeyBy:   []string{"host"},
+		Window:  "1m",
+		Count:   1,
+		Trigger: "t",
+	})
+	c.do(context.Background(), newEvent(0, "host", "a"))
+	if len(r.events) != 2 {
+		t.Fatalf("wrong number of events dispatched, exp 2, got %d", len(r.events))
+	}
+	p := r.events[1].Parsed
+	if p["correlation"] != "any" || p["rule"] != "threshold" || p["trigger"] != "t" || p["host"] != "a" || p["count"] != 1 {
+		t.Fatalf("wrong synthetic event: %v", p)
+	}
+}
+
+func Test_CorrelationRuleInvalid(t *testing.T) {
+	for _, rule := range []CorrelationRule{
+		{Type: "threshold", Window: "1m", Count: 1, Trigger: "t"},
+		{Name: "a", Type: "threshold", Window: "1m", Count: 1, Trigger: "missing"},
+		{Name: "a", Type: "threshold", Window: "soon", Count: 1, Trigger: "t"},
+		{Name: "a", Type: "threshold", Window: "1m", Trigger: "t"},
+		{Name: "a", Type: "threshold", Window: "1m", Count: 1, Match: map[string]string{"host": "("}, Trigger: "t"},
+		{Name: "a", Type: "sequence", Window: "1m", Steps: []map[string]string{{}}, Trigger: "t"},
+		{Name: "a", Type: "other", Window: "1m", Trigger: "t"},
+	} {
+		if _, err := newCorrelator(&recorder{}, []CorrelationRule{rule}, map[string]Trigger{"t": {}}); err == nil {
+			t.Errorf("invalid rule %+v accepted", rule)
+		}
+	}
+}
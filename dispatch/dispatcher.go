@@ -1,52 +1,216 @@
 package dispatch
 
 import (
+	"context"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ekanite/ekanite/input"
 	"github.com/songtianyi/rrframework/config"
 )
 
-// dispatch events
+var stats = expvar.NewMap("dispatch")
+
+// Dispatcher sends events to an output. Dispatch is only called after Start, and
+// never concurrently with itself. Each dispatcher is handed its own copy of every
+// event by its queue, so it may add fields to the events.
 type Dispatcher interface {
-	Listen(chan []*input.Event)
-	beforeDispatch()
-	do(*input.Event) error
-	afterDispatch()
+	// Start starts any background work, such as flushing batches, which stops
+	// once ctx is done.
+	Start(ctx context.Context) error
+	// Dispatch sends events to the output, or queues them to be sent. An error
+	// means the events may not have been sent, and their queue dispatches them
+	// again after backing off, so it should only be returned for failures which
+	// may be temporary, such as the output being unavailable.
+	Dispatch(ctx context.Context, events []*input.Event) error
+	// Close sends any events held by the dispatcher, and releases its resources.
+	Close() error
+}
+
+// Factory creates a dispatcher from its section of the configuration file, the
+// JSON object with its type.
+type Factory func(config json.RawMessage) (Dispatcher, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a type of dispatcher available to configuration files. Types are
+// not case-sensitive. It panics if the type is already registered.
+func Register(typ string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	typ = strings.ToLower(typ)
+	if factory == nil {
+		panic("dispatch: Register factory is nil")
+	}
+	if _, ok := factories[typ]; ok {
+		panic("dispatch: Register called twice for type " + typ)
+	}
+	factories[typ] = factory
+}
+
+func init() {
+	Register("nap", instanceFactory(func(v DispatcherInstance) (Dispatcher, error) {
+		d, err := NewNapDispatcher(v)
+		if err != nil || len(v.Correlation) == 0 {
+			return d, err
+		}
+		return newCorrelator(d, v.Correlation, v.Triggers)
+	}))
+	Register("elasticsearch", instanceFactory(NewElasticsearchDispatcher))
+	Register("webhook", instanceFactory(NewWebhookDispatcher))
+	Register("syslog", instanceFactory(NewSyslogDispatcher))
+	Register("file", instanceFactory(NewFileDispatcher))
+}
+
+// instanceFactory returns a factory decoding the configuration shared by the
+// built-in dispatchers.
+func instanceFactory(f func(DispatcherInstance) (Dispatcher, error)) Factory {
+	return func(config json.RawMessage) (Dispatcher, error) {
+		var v DispatcherInstance
+		if err := json.Unmarshal(config, &v); err != nil {
+			return nil, err
+		}
+		return f(v)
+	}
 }
 
-// create dispatcher from json configuration file
+// create dispatcher from json configuration file, each with its own queue
 func NewDispatcher(path string) ([]Dispatcher, error) {
-	//
-	jc, err := rrconfig.LoadJsonConfigFromFile(path)
+	_, sections, err := loadConfig(path)
 	if err != nil {
 		return nil, err
 	}
-	// dump config
-	du, _ := jc.Dump()
-	log.Println(du)
+	dispatchers := make([]Dispatcher, 0)
+	for _, v := range sections {
+		q, err := v.newQueue()
+		if err != nil {
+			closeAll(dispatchers)
+			return nil, err
+		}
+		dispatchers = append(dispatchers, q)
+	}
+	return dispatchers, nil
+}
+
+// section is the section of the configuration file describing a dispatcher.
+type section struct {
+	Type  string      `json:"type"`
+	Name  string      `json:"name"` // of the queue's metrics, defaults to the type
+	Queue QueueConfig `json:"queue"`
+
+	raw json.RawMessage
+}
+
+// loadConfig loads the configuration file, returning its content and the sections
+// of its dispatchers, named and of registered types.
+func loadConfig(path string) ([]byte, []*section, error) {
+	// The file is not logged, as it holds secrets such as webhook secrets and
+	// broker credentials.
+	jc, err := rrconfig.LoadJsonConfigFromFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
 	var cfg DispatcherConfig
 	if err := json.Unmarshal(jc.GetBytes(), &cfg); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	dispatchers := make([]Dispatcher, 0)
+	sections := make([]*section, 0, len(cfg.Dispatcher))
+	names := make(map[string]bool)
 	for _, v := range cfg.Dispatcher {
-		switch strings.ToLower(v.Type) {
-		case "nap":
-			d, err := NewNapDispatcher(v)
-			if err != nil {
-				return nil, fmt.Errorf("new nap dispatcher failed, %s", err)
+		s := &section{raw: v}
+		if err := json.Unmarshal(v, s); err != nil {
+			return nil, nil, err
+		}
+		s.Type = strings.ToLower(s.Type)
+		factoriesMu.RLock()
+		_, ok := factories[s.Type]
+		factoriesMu.RUnlock()
+		if !ok {
+			return nil, nil, fmt.Errorf("dispatcher type %s not valid or not support yet", s.Type)
+		}
+		if err := s.Queue.validate(); err != nil {
+			return nil, nil, fmt.Errorf("new %s dispatcher failed, %s", s.Type, err)
+		}
+
+		if s.Name == "" {
+			s.Name = s.Type
+			for i := 2; names[s.Name]; i++ {
+				s.Name = fmt.Sprintf("%s-%d", s.Type, i)
 			}
-			dispatchers = append(dispatchers, d)
-			break
-		case "elasticsearch":
-			break
-		default:
-			return nil, fmt.Errorf("dispatcher type %s not valid or not support yet", v.Type)
 		}
+		if names[s.Name] {
+			return nil, nil, fmt.Errorf("dispatcher name %s used more than once", s.Name)
+		}
+		names[s.Name] = true
+		sections = append(sections, s)
 	}
-	return dispatchers, nil
+	return jc.GetBytes(), sections, nil
+}
+
+// create creates the section's dispatcher.
+func (s *section) create() (Dispatcher, error) {
+	factoriesMu.RLock()
+	factory := factories[s.Type]
+	factoriesMu.RUnlock()
+	d, err := factory(s.raw)
+	if err != nil {
+		return nil, fmt.Errorf("new %s dispatcher failed, %s", s.Type, err)
+	}
+	return d, nil
+}
+
+// newQueue creates the section's dispatcher, behind its queue.
+func (s *section) newQueue() (*Queue, error) {
+	d, err := s.create()
+	if err != nil {
+		return nil, err
+	}
+	q, err := NewQueue(d, s.Name, s.Queue)
+	if err != nil {
+		d.Close()
+		return nil, fmt.Errorf("new %s dispatcher failed, %s", s.Type, err)
+	}
+	return q, nil
+}
+
+// closeAll closes dispatchers, logging any errors.
+func closeAll(dispatchers []Dispatcher) {
+	for _, v := range dispatchers {
+		if err := v.Close(); err != nil {
+			log.Printf("failed to close dispatcher: %s", err)
+		}
+	}
+}
+
+// document returns the fields of an event shipped to external systems, its parsed
+// fields with @timestamp, raw and sourceIP, along with the event's time.
+func document(event *input.Event) (map[string]interface{}, time.Time) {
+	t := eventTime(event)
+	doc := make(map[string]interface{}, len(event.Parsed)+3)
+	for k, v := range event.Parsed {
+		doc[k] = v
+	}
+	doc["@timestamp"] = t.UTC().Format(time.RFC3339Nano)
+	doc["raw"] = event.Text
+	if event.SourceIP != "" {
+		doc["sourceIP"] = event.SourceIP
+	}
+	return doc, t
+}
+
+// eventTime returns the time of an event, as sent by the device if it has a
+// timestamp, or else when it was received.
+func eventTime(event *input.Event) time.Time {
+	if _, ok := event.Parsed["timestamp"].(string); ok {
+		return event.ReferenceTime()
+	}
+	return event.ReceptionTime
 }
@@ -0,0 +1,160 @@
+package dispatch
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+// custom is a dispatcher registered from outside the built-in types, with its own
+// configuration section.
+type custom struct {
+	Prefix string `json:"prefix"`
+}
+
+func (c *custom) Start(ctx context.Context) error                           { return nil }
+func (c *custom) Dispatch(ctx context.Context, events []*input.Event) error { return nil }
+func (c *custom) Close() error                                              { return nil }
+
+func init() {
+	Register("Test-Custom", func(config json.RawMessage) (Dispatcher, error) {
+		c := &custom{}
+		return c, json.Unmarshal(config, c)
+	})
+}
+
+func writeConfig(t *testing.T, config string) string {
+	f, err := ioutil.TempFile("", "ekanite-dispatcher-")
+	if err != nil {
+		t.Fatalf("failed to create config: %s", err)
+	}
+	defer f.Close()
+	f.WriteString(config)
+	return f.Name()
+}
+
+func Test_NewDispatcherRegistered(t *testing.T) {
+	path := writeConfig(t, `{"dispatcher": [
+		{"type": "test-custom", "prefix": "acme"},
+		{"type": "webhook", "urls": ["http://localhost/hook"]}
+	]}`)
+	defer os.Remove(path)
+
+	dispatchers, err := NewDispatcher(path)
+	if err != nil {
+		t.Fatalf("failed to create dispatchers: %s", err)
+	}
+	if len(dispatchers) != 2 {
+		t.Fatalf("wrong number of dispatchers, exp 2, got %d", len(dispatchers))
+	}
+	if c, ok := dispatchers[0].(*Queue).next.(*custom); !ok || c.Prefix != "acme" {
+		t.Fatalf("custom dispatcher not created from its section: %#v", dispatchers[0])
+	}
+	if _, ok := dispatchers[1].(*Queue).next.(*webhook); !ok {
+		t.Fatalf("built-in dispatcher not created: %#v", dispatchers[1])
+	}
+}
+
+func Test_NewDispatcherInvalid(t *testing.T) {
+	for _, config := range []string{
+		`{"dispatcher": [{"type": "carrier-pigeon"}]}`,
+		`{"dispatcher": [{"type": "webhook"}]}`,
+		`{"dispatcher": [{"type": "test-custom", "prefix": 1}]}`,
+		`{"dispatcher": [{"type": "test-custom", "queue": {"overflow": "spill"}}]}`,
+		`{"dispatcher": [{"type": "test-custom", "name": "a"}, {"type": "test-custom", "name": "a"}]}`,
+	} {
+		path := writeConfig(t, config)
+		if _, err := NewDispatcher(path); err == nil {
+			t.Errorf("invalid config %s accepted", config)
+		}
+		os.Remove(path)
+	}
+}
+
+func Test_RegisterTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("registering a type twice did not panic")
+		}
+	}()
+	Register("TEST-CUSTOM", func(json.RawMessage) (Dispatcher, error) { return nil, nil })
+}
+
+// refTime is the time of test events.
+var refTime = time.Date(1982, 2, 5, 4, 0, 0, 0, time.UTC)
+
+// newTestEvent returns an event from router1 with the message, timestamped refTime,
+// along with any other fields given as pairs of names and values, which may replace
+// these. Its text is its message.
+func newTestEvent(message string, fields ...interface{}) *input.Event {
+	e := &input.Event{Parsed: map[string]interface{}{
+		"host":      "router1",
+		"message":   message,
+		"timestamp": refTime.Format(time.RFC3339),
+	}}
+	for i := 0; i+1 < len(fields); i += 2 {
+		e.Parsed[fields[i].(string)] = fields[i+1]
+	}
+	e.Text, _ = e.Parsed["message"].(string)
+	return e
+}
+
+// newTestDispatcher creates a dispatcher with the factory of its type, failing the
+// test if it cannot be created.
+func newTestDispatcher(t *testing.T, factory func(DispatcherInstance) (Dispatcher, error), config DispatcherInstance) Dispatcher {
+	d, err := factory(config)
+	if err != nil {
+		t.Fatalf("failed to create dispatcher: %s", err)
+	}
+	return d
+}
+
+// testServer is a stand-in for an HTTP service, recording the requests made to it.
+// Responses are taken in turn from statuses, and then written by handle, if set,
+// which is called under lock.
+type testServer struct {
+	mu       sync.Mutex
+	statuses []int
+	requests int
+	bodies   []string
+	headers  []http.Header
+	handle   func(w http.ResponseWriter, r *http.Request, body []byte)
+
+	url string
+}
+
+// newTestServer starts a testServer, returning it along with a function stopping it.
+func newTestServer(statuses ...int) (*testServer, func()) {
+	s := &testServer{statuses: statuses}
+	ts := httptest.NewServer(s)
+	s.url = ts.URL
+	return s, ts.Close
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	b, _ := ioutil.ReadAll(r.Body)
+	s.bodies = append(s.bodies, string(b))
+	s.headers = append(s.headers, r.Header)
+	if len(s.statuses) > 0 {
+		status := s.statuses[0]
+		s.statuses = s.statuses[1:]
+		if status != http.StatusOK {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+	}
+	if s.handle != nil {
+		s.handle(w, r, b)
+	}
+}
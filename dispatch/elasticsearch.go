@@ -0,0 +1,281 @@
+package dispatch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+// elasticsearch defaults
+const (
+	DefaultIndexTemplate = "ekanite-{2006.01.02}"
+	DefaultBatchSize     = 500
+	DefaultFlushInterval = 5 * time.Second
+
+	bulkTimeout    = 30 * time.Second
+	maxBulkRetries = 5
+)
+
+// time layouts in index templates
+var indexLayout = regexp.MustCompile(`\{([^}]*)\}`)
+
+// Elasticsearch dispatcher, shipping events to Elasticsearch or OpenSearch with the
+// bulk API. Requests failing with 429 or 5xx responses, and documents rejected with
+// 429, are retried with backoff.
+type elasticsearch struct {
+	url           string // of the bulk endpoint
+	index         string
+	filter        *filter
+	batchSize     int
+	flushInterval time.Duration
+	backoff       time.Duration // before the first retry, doubling with each
+
+	client  *http.Client
+	mu      sync.Mutex // guards batch
+	batch   []*bulkDocument
+	flushMu sync.Mutex    // serializes flushes, so that batches are indexed in order
+	done    chan struct{} // closed when closing, abandoning retries
+}
+
+// bulkDocument is an event to index.
+type bulkDocument struct {
+	index string
+	body  []byte
+}
+
+func NewElasticsearchDispatcher(config DispatcherInstance) (Dispatcher, error) {
+	u, err := url.Parse(config.URI)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("uri must be an http or https URL")
+	}
+	s := &elasticsearch{
+		url:           strings.TrimSuffix(config.URI, "/") + "/_bulk",
+		index:         config.Index,
+		batchSize:     config.BatchSize,
+		flushInterval: DefaultFlushInterval,
+		backoff:       minBackoff,
+		client:        &http.Client{Timeout: bulkTimeout},
+		done:          make(chan struct{}),
+	}
+	if s.index == "" {
+		s.index = DefaultIndexTemplate
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = DefaultBatchSize
+	}
+	if config.FlushInterval != "" {
+		if s.flushInterval, err = time.ParseDuration(config.FlushInterval); err != nil || s.flushInterval <= 0 {
+			return nil, fmt.Errorf("invalid flush interval '%s'", config.FlushInterval)
+		}
+	}
+	if config.Filter != nil {
+		if s.filter, err = compileFilter(*config.Filter); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *elasticsearch) Start(ctx context.Context) error {
+	go func() {
+		ticker := time.NewTicker(s.flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.flush(ctx)
+			}
+		}
+	}()
+	return nil
+}
+
+// Dispatch adds the events to the batch, flushing it whenever it is full. It fails
+// if a flush fails after its retries, so that the queue retries the events.
+func (s *elasticsearch) Dispatch(ctx context.Context, events []*input.Event) error {
+	for _, v := range events {
+		s.mu.Lock()
+		s.do(v)
+		full := len(s.batch) >= s.batchSize
+		s.mu.Unlock()
+		if full {
+			if err := s.flush(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// do adds the event to the batch if it matches the filter. Events which cannot be
+// encoded are logged and dropped, as retrying them would not help.
+func (s *elasticsearch) do(event *input.Event) {
+	if _, ok := s.filter.match(event); !ok {
+		return
+	}
+	doc, t := document(event)
+	b, err := json.Marshal(doc)
+	if err != nil {
+		log.Printf("[elasticsearch] failed to encode event: %s", err)
+		stats.Add("elasticsearchDocumentsFailed", 1)
+		return
+	}
+
+	s.batch = append(s.batch, &bulkDocument{index: indexName(s.index, t), body: b})
+}
+
+// indexName returns the name of the index holding events at time t.
+func indexName(template string, t time.Time) string {
+	return indexLayout.ReplaceAllStringFunc(template, func(layout string) string {
+		return t.UTC().Format(layout[1 : len(layout)-1])
+	})
+}
+
+// flush indexes the batch, retrying with backoff. Events are still added to the
+// batch while flushing. If ctx is done while backing off, the documents left are
+// returned to the batch, to be flushed by Close. Otherwise documents left after the
+// retries, or once closing, are dropped and an error returned.
+func (s *elasticsearch) flush(ctx context.Context) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	docs := s.batch
+	s.batch = nil
+	s.mu.Unlock()
+	backoff := s.backoff
+	for attempt := 0; len(docs) > 0; attempt++ {
+		retry, err := s.bulk(docs)
+		if err != nil {
+			log.Printf("[elasticsearch] bulk request failed: %s", err)
+		}
+		if len(retry) == 0 {
+			return nil
+		}
+		if attempt == maxBulkRetries {
+			log.Printf("[elasticsearch] dropping %d documents after %d retries", len(retry), attempt)
+			stats.Add("elasticsearchDocumentsDropped", int64(len(retry)))
+			return fmt.Errorf("failed to index %d documents after %d retries", len(retry), attempt)
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			s.mu.Lock()
+			s.batch = append(retry, s.batch...)
+			s.mu.Unlock()
+			return nil
+		case <-s.done:
+			timer.Stop()
+			log.Printf("[elasticsearch] dropping %d documents on close", len(retry))
+			stats.Add("elasticsearchDocumentsDropped", int64(len(retry)))
+			return fmt.Errorf("failed to index %d documents on close", len(retry))
+		}
+		stats.Add("elasticsearchBulkRetries", 1)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		docs = retry
+	}
+	return nil
+}
+
+// bulkResponse is the response to a bulk request.
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Index  string `json:"_index"`
+		Status int    `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// bulk sends a bulk request indexing the documents, returning those which should
+// be retried. Documents rejected for any other reason are reported and dropped.
+func (s *elasticsearch) bulk(docs []*bulkDocument) ([]*bulkDocument, error) {
+	var body bytes.Buffer
+	for _, d := range docs {
+		action, _ := json.Marshal(map[string]interface{}{"index": map[string]string{"_index": d.index}})
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(d.body)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest("POST", s.url, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return docs, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return docs, fmt.Errorf("%s", resp.Status)
+	}
+	if resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		stats.Add("elasticsearchDocumentsFailed", int64(len(docs)))
+		return nil, fmt.Errorf("%s, dropping %d documents: %s", resp.Status, len(docs), strings.TrimSpace(string(b)))
+	}
+
+	var r bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("invalid response: %s", err)
+	}
+	if !r.Errors {
+		stats.Add("elasticsearchDocumentsIndexed", int64(len(docs)))
+		return nil, nil
+	}
+
+	var retry []*bulkDocument
+	for i, item := range r.Items {
+		if i >= len(docs) {
+			break
+		}
+		for _, result := range item {
+			switch {
+			case result.Status < 300:
+				stats.Add("elasticsearchDocumentsIndexed", 1)
+			case result.Status == http.StatusTooManyRequests:
+				retry = append(retry, docs[i])
+			default:
+				reason := http.StatusText(result.Status)
+				if result.Error != nil {
+					reason = result.Error.Type + ": " + result.Error.Reason
+				}
+				log.Printf("[elasticsearch] failed to index document into %s: %s: %s", result.Index, reason, docs[i].body)
+				stats.Add("elasticsearchDocumentsFailed", 1)
+			}
+		}
+	}
+	return retry, nil
+}
+
+// Close indexes the batch, without retrying, and abandons the retries of any flush
+// in progress.
+func (s *elasticsearch) Close() error {
+	close(s.done)
+	return s.flush(context.Background())
+}
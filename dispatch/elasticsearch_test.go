@@ -0,0 +1,223 @@
+package dispatch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+// bulkServer is a stand-in for Elasticsearch, indexing the documents of bulk
+// requests. Documents containing "reject" fail, and those containing "busy" are
+// rejected with 429 once.
+type bulkServer struct {
+	*testServer
+	indexed map[string][]string // Messages indexed, by index.
+	busy    map[string]bool
+}
+
+func (s *bulkServer) bulk(w http.ResponseWriter, r *http.Request, body []byte) {
+	if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	var items []string
+	errors := false
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		var action map[string]map[string]string
+		json.Unmarshal(scanner.Bytes(), &action)
+		scanner.Scan()
+		var doc map[string]interface{}
+		json.Unmarshal(scanner.Bytes(), &doc)
+		index := action["index"]["_index"]
+		msg, _ := doc["message"].(string)
+
+		switch {
+		case strings.Contains(msg, "reject"):
+			errors = true
+			items = append(items, fmt.Sprintf(`{"index":{"_index":%q,"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}`, index))
+		case strings.Contains(msg, "busy") && !s.busy[msg]:
+			errors = true
+			s.busy[msg] = true
+			items = append(items, fmt.Sprintf(`{"index":{"_index":%q,"status":429}}`, index))
+		default:
+			s.indexed[index] = append(s.indexed[index], msg)
+			items = append(items, fmt.Sprintf(`{"index":{"_index":%q,"status":201}}`, index))
+		}
+	}
+	fmt.Fprintf(w, `{"took":1,"errors":%t,"items":[%s]}`, errors, strings.Join(items, ","))
+}
+
+func newTestElasticsearch(t *testing.T, config DispatcherInstance, statuses ...int) (*elasticsearch, *bulkServer, func()) {
+	ts, stop := newTestServer(statuses...)
+	bs := &bulkServer{testServer: ts, indexed: make(map[string][]string), busy: make(map[string]bool)}
+	ts.handle = bs.bulk
+	config.URI = ts.url
+	s := newTestDispatcher(t, NewElasticsearchDispatcher, config).(*elasticsearch)
+	s.backoff = time.Millisecond
+	return s, bs, stop
+}
+
+func Test_ElasticsearchBulk(t *testing.T) {
+	s, bs, stop := newTestElasticsearch(t, DispatcherInstance{BatchSize: 4},
+		http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK, http.StatusOK)
+	defer stop()
+
+	s.Dispatch(context.Background(), []*input.Event{
+		newTestEvent("link down", "timestamp", "1982-02-05T23:59:00Z"),
+		newTestEvent("reject me", "timestamp", "1982-02-05T23:59:30Z"),
+		newTestEvent("busy", "timestamp", "1982-02-06T00:00:10Z"),
+		newTestEvent("link up", "timestamp", "1982-02-06T00:01:00Z"),
+	})
+
+	// The full batch is flushed, retried after 503 and 429 responses, and the document
+	// rejected with 429 retried on its own.
+	if bs.requests != 4 {
+		t.Fatalf("wrong number of bulk requests, exp 4, got %d", bs.requests)
+	}
+	exp := map[string][]string{
+		"ekanite-1982.02.05": {"link down"},
+		"ekanite-1982.02.06": {"link up", "busy"},
+	}
+	for index, msgs := range exp {
+		if !equalStrings(bs.indexed[index], msgs) {
+			t.Errorf("wrong documents in %s, exp %v, got %v", index, msgs, bs.indexed[index])
+		}
+	}
+	if len(s.batch) != 0 {
+		t.Fatalf("batch not emptied after flush")
+	}
+}
+
+func Test_ElasticsearchDropsAfterRetries(t *testing.T) {
+	var statuses []int
+	for i := 0; i <= maxBulkRetries; i++ {
+		statuses = append(statuses, http.StatusBadGateway)
+	}
+	s, bs, stop := newTestElasticsearch(t, DispatcherInstance{}, statuses...)
+	defer stop()
+
+	// Documents left after the retries are reported, so that the queue retries the
+	// events.
+	if err := s.Dispatch(context.Background(), []*input.Event{newTestEvent("link down")}); err != nil {
+		t.Fatalf("failed to batch event: %s", err)
+	}
+	if err := s.flush(context.Background()); err == nil {
+		t.Fatalf("failure after retries not reported")
+	}
+	if bs.requests != maxBulkRetries+1 || len(bs.indexed) != 0 {
+		t.Fatalf("wrong requests, exp %d, got %d indexing %v", maxBulkRetries+1, bs.requests, bs.indexed)
+	}
+	s.do(newTestEvent("link up"))
+	if err := s.flush(context.Background()); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	if len(bs.indexed["ekanite-1982.02.05"]) != 1 {
+		t.Fatalf("document not indexed after failures: %v", bs.indexed)
+	}
+}
+
+func Test_ElasticsearchBackoffInterrupted(t *testing.T) {
+	s, bs, stop := newTestElasticsearch(t, DispatcherInstance{BatchSize: 1},
+		http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	defer stop()
+	s.backoff = time.Hour
+
+	// Cancelling the context stops backing off, keeping the documents for Close, and
+	// events are still added to the batch meanwhile.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Dispatch(ctx, []*input.Event{newTestEvent("link down")})
+		close(done)
+	}()
+	for i := 0; ; i++ {
+		bs.mu.Lock()
+		n := bs.requests
+		bs.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if i == 500 {
+			t.Fatalf("timed out waiting for bulk request")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.mu.Lock()
+	s.do(newTestEvent("link up", "timestamp", "1982-02-05T04:01:00Z"))
+	s.mu.Unlock()
+	cancel()
+	<-done
+	if len(s.batch) != 2 {
+		t.Fatalf("wrong number of documents kept, exp 2, got %d", len(s.batch))
+	}
+
+	// Close tries once, without backing off.
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("close blocked by backoff")
+	}
+	if bs.requests != 2 || len(bs.indexed) != 0 {
+		t.Fatalf("wrong requests on close, got %d indexing %v", bs.requests, bs.indexed)
+	}
+}
+
+func Test_ElasticsearchFilterAndFlushInterval(t *testing.T) {
+	s, bs, stop := newTestElasticsearch(t, DispatcherInstance{
+		Index:         "logs-{2006.01}-{02}",
+		FlushInterval: "10ms",
+		Filter:        &Filter{Query: "link"},
+	})
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+	s.Dispatch(ctx, []*input.Event{
+		newTestEvent("link down"),
+		newTestEvent("login failed"),
+	})
+	for i := 0; ; i++ {
+		bs.mu.Lock()
+		indexed := bs.indexed["logs-1982.02-05"]
+		bs.mu.Unlock()
+		if len(indexed) > 0 {
+			if !equalStrings(indexed, []string{"link down"}) {
+				t.Fatalf("wrong documents indexed: %v", indexed)
+			}
+			break
+		}
+		if i == 500 {
+			t.Fatalf("timed out waiting for flush")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_ElasticsearchInvalidConfig(t *testing.T) {
+	for _, config := range []DispatcherInstance{
+		{},
+		{URI: "amqp://localhost"},
+		{URI: "http://localhost:9200", FlushInterval: "soon"},
+		{URI: "http://localhost:9200", Filter: &Filter{Regex: map[string]string{"host": "("}}},
+	} {
+		if _, err := NewElasticsearchDispatcher(config); err == nil {
+			t.Errorf("invalid config %+v accepted", config)
+		}
+	}
+}
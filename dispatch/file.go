@@ -0,0 +1,384 @@
+package dispatch
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+	"github.com/klauspost/compress/zstd"
+)
+
+// file archive defaults
+const (
+	DefaultArchiveFormat      = "ndjson"
+	DefaultArchiveCompression = "gzip"
+	DefaultMaxSize            = 256 * 1024 * 1024
+	DefaultRotateInterval     = time.Hour
+
+	// ManifestFile lists the archived files, one JSON object per line.
+	ManifestFile = "manifest.ndjson"
+
+	// suffix of files being written
+	partSuffix = ".part"
+)
+
+// File dispatcher, archiving the events matching its filter into compressed files
+// under a directory, partitioned by day. Files are written with the suffix .part,
+// and renamed once rotated, synced and added to the manifest.
+type fileArchive struct {
+	dir            string
+	format         string
+	compression    string
+	maxSize        int64
+	rotateInterval time.Duration
+	flushInterval  time.Duration
+	filter         *filter
+
+	now     func() time.Time
+	mu      sync.Mutex // guards current
+	current *archiveFile
+}
+
+// archiveFile is the file being written.
+type archiveFile struct {
+	name      string // relative to the archive directory, without partSuffix
+	partition time.Time
+	f         *os.File
+	hash      hash.Hash
+	out       *countingWriter // compressed
+	w         compressor
+	written   int64 // uncompressed
+	events    int64
+	first     time.Time
+	last      time.Time
+}
+
+// compressor is implemented by gzip and zstd writers.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ManifestEntry describes an archived file.
+type ManifestEntry struct {
+	File   string    `json:"file"` // relative to the archive directory
+	Events int64     `json:"events"`
+	Bytes  int64     `json:"bytes"`
+	SHA256 string    `json:"sha256"`
+	First  time.Time `json:"first"` // time of the first event, and of the last
+	Last   time.Time `json:"last"`
+}
+
+func NewFileDispatcher(config DispatcherInstance) (Dispatcher, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("dir required")
+	}
+	s := &fileArchive{
+		dir:            config.Dir,
+		format:         strings.ToLower(config.Format),
+		compression:    strings.ToLower(config.Compression),
+		maxSize:        config.MaxSize,
+		rotateInterval: DefaultRotateInterval,
+		flushInterval:  DefaultFlushInterval,
+		now:            time.Now,
+	}
+	if s.format == "" {
+		s.format = DefaultArchiveFormat
+	}
+	if s.format != "ndjson" && s.format != "raw" {
+		return nil, fmt.Errorf("format %s not valid", config.Format)
+	}
+	if s.compression == "" {
+		s.compression = DefaultArchiveCompression
+	}
+	if s.compression != "gzip" && s.compression != "zstd" {
+		return nil, fmt.Errorf("compression %s not valid", config.Compression)
+	}
+	if s.maxSize <= 0 {
+		s.maxSize = DefaultMaxSize
+	}
+	var err error
+	if config.RotateInterval != "" {
+		if s.rotateInterval, err = time.ParseDuration(config.RotateInterval); err != nil || s.rotateInterval <= 0 {
+			return nil, fmt.Errorf("invalid rotate interval '%s'", config.RotateInterval)
+		}
+	}
+	if config.FlushInterval != "" {
+		if s.flushInterval, err = time.ParseDuration(config.FlushInterval); err != nil || s.flushInterval <= 0 {
+			return nil, fmt.Errorf("invalid flush interval '%s'", config.FlushInterval)
+		}
+	}
+	if config.Filter != nil {
+		if s.filter, err = compileFilter(*config.Filter); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileArchive) Start(ctx context.Context) error {
+	go func() {
+		ticker := time.NewTicker(s.flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.mu.Lock()
+				s.tick()
+				s.mu.Unlock()
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *fileArchive) Dispatch(ctx context.Context, events []*input.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, v := range events {
+		if e := s.do(v); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// do writes the event to the current file if it matches the filter, rotating the
+// file when its partition has ended or it is full.
+func (s *fileArchive) do(event *input.Event) error {
+	if _, ok := s.filter.match(event); !ok {
+		return nil
+	}
+	doc, t := document(event)
+	var line []byte
+	if s.format == "raw" {
+		line = []byte(strings.Replace(event.Text, "\n", " ", -1) + "\n")
+	} else {
+		b, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		line = append(b, '\n')
+	}
+
+	now := s.now()
+	if s.current != nil && !s.partition(now).Equal(s.current.partition) {
+		s.rotate()
+	}
+	if s.current == nil {
+		f, err := s.create(now)
+		if err != nil {
+			log.Printf("[file] failed to create archive file: %s", err)
+			stats.Add("fileEventsFailed", 1)
+			return err
+		}
+		s.current = f
+	}
+
+	f := s.current
+	if _, err := f.w.Write(line); err != nil {
+		log.Printf("[file] failed to write to %s: %s", f.name, err)
+		stats.Add("fileEventsFailed", 1)
+		s.abandon()
+		return err
+	}
+	f.written += int64(len(line))
+	f.events++
+	if f.first.IsZero() {
+		f.first = t
+	}
+	f.last = t
+	stats.Add("fileEventsArchived", 1)
+
+	if f.written >= s.maxSize {
+		s.rotate()
+	}
+	return nil
+}
+
+// tick flushes the current file to disk, or rotates it if its partition has ended.
+func (s *fileArchive) tick() {
+	if s.current == nil {
+		return
+	}
+	if !s.partition(s.now()).Equal(s.current.partition) {
+		s.rotate()
+		return
+	}
+	if err := s.current.w.Flush(); err != nil {
+		log.Printf("[file] failed to flush %s: %s", s.current.name, err)
+	}
+}
+
+// partition returns the start of the rotation interval containing t.
+func (s *fileArchive) partition(t time.Time) time.Time {
+	return t.UTC().Truncate(s.rotateInterval)
+}
+
+// create creates a file for events written from now, in the directory of the day.
+func (s *fileArchive) create(now time.Time) (*archiveFile, error) {
+	partition := s.partition(now)
+	dir := partition.Format("2006/01/02")
+	if err := os.MkdirAll(filepath.Join(s.dir, dir), 0755); err != nil {
+		return nil, err
+	}
+
+	ext := ".ndjson"
+	if s.format == "raw" {
+		ext = ".log"
+	}
+	if s.compression == "zstd" {
+		ext += ".zst"
+	} else {
+		ext += ".gz"
+	}
+	base := "ekanite-" + now.UTC().Format("20060102T150405Z")
+
+	// Files are never overwritten, those rotated within a second are numbered.
+	for i := 0; ; i++ {
+		name := filepath.Join(dir, base+ext)
+		if i > 0 {
+			name = filepath.Join(dir, fmt.Sprintf("%s-%d%s", base, i, ext))
+		}
+		path := filepath.Join(s.dir, name)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		f, err := os.OpenFile(path+partSuffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		a := &archiveFile{name: name, partition: partition, f: f, hash: sha256.New()}
+		a.out = &countingWriter{w: io.MultiWriter(f, a.hash)}
+		if s.compression == "zstd" {
+			if a.w, err = zstd.NewWriter(a.out); err != nil {
+				f.Close()
+				return nil, err
+			}
+		} else {
+			a.w = gzip.NewWriter(a.out)
+		}
+		return a, nil
+	}
+}
+
+// rotate completes the current file, syncing it to disk before renaming it and
+// adding it to the manifest.
+func (s *fileArchive) rotate() {
+	f := s.current
+	s.current = nil
+
+	path := filepath.Join(s.dir, f.name)
+	err := f.w.Close()
+	if err == nil {
+		err = f.f.Sync()
+	}
+	if cerr := f.f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+partSuffix, path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		log.Printf("[file] failed to complete %s: %s", f.name, err)
+		stats.Add("fileRotationsFailed", 1)
+		return
+	}
+
+	entry := ManifestEntry{
+		File:   filepath.ToSlash(f.name),
+		Events: f.events,
+		Bytes:  f.out.n,
+		SHA256: hex.EncodeToString(f.hash.Sum(nil)),
+		First:  f.first,
+		Last:   f.last,
+	}
+	if err := s.appendManifest(entry); err != nil {
+		log.Printf("[file] failed to add %s to the manifest: %s", f.name, err)
+		stats.Add("fileRotationsFailed", 1)
+		return
+	}
+	stats.Add("fileRotations", 1)
+}
+
+// abandon closes the current file after a failure, leaving it with its suffix.
+func (s *fileArchive) abandon() {
+	s.current.w.Close()
+	s.current.f.Close()
+	s.current = nil
+}
+
+// appendManifest appends the entry to the manifest, and syncs it to disk.
+func (s *fileArchive) appendManifest(entry ManifestEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, ManifestFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(b, '\n')); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncDir syncs a directory, so that renames within it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Close completes the current file.
+func (s *fileArchive) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != nil {
+		s.rotate()
+	}
+	return nil
+}
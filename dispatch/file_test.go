@@ -0,0 +1,211 @@
+package dispatch
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+	"github.com/klauspost/compress/zstd"
+)
+
+func newTestArchive(t *testing.T, config DispatcherInstance) (*fileArchive, *time.Time, func()) {
+	dir, err := ioutil.TempDir("", "ekanite-archive-")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	config.Dir = dir
+	s := newTestDispatcher(t, NewFileDispatcher, config).(*fileArchive)
+	now := time.Date(1982, 2, 5, 4, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	return s, &now, func() { os.RemoveAll(dir) }
+}
+
+// readManifest returns the manifest entries, checking each file's size and checksum.
+func readManifest(t *testing.T, dir string) []ManifestEntry {
+	f, err := os.Open(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		t.Fatalf("failed to open manifest: %s", err)
+	}
+	defer f.Close()
+	var entries []ManifestEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e ManifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid manifest entry %s: %s", scanner.Text(), err)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, e.File))
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", e.File, err)
+		}
+		sum := sha256.Sum256(b)
+		if int64(len(b)) != e.Bytes || hex.EncodeToString(sum[:]) != e.SHA256 {
+			t.Fatalf("wrong size or checksum in manifest entry %+v", e)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// readArchive returns the lines of an archived file.
+func readArchive(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", path, err)
+	}
+	defer f.Close()
+	var r io.Reader
+	if strings.HasSuffix(path, ".zst") {
+		d, err := zstd.NewReader(f)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", path, err)
+		}
+		defer d.Close()
+		r = d
+	} else {
+		if r, err = gzip.NewReader(f); err != nil {
+			t.Fatalf("failed to read %s: %s", path, err)
+		}
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to decompress %s: %s", path, err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func Test_FileArchiveRotatesBySize(t *testing.T) {
+	s, _, cleanup := newTestArchive(t, DispatcherInstance{MaxSize: 200})
+	defer cleanup()
+
+	for _, msg := range []string{"link down", "link up", "login failed"} {
+		s.do(newTestEvent(msg))
+	}
+	if matches, _ := filepath.Glob(filepath.Join(s.dir, "1982/02/05/*"+partSuffix)); len(matches) != 1 {
+		t.Fatalf("wrong files being written: %v", matches)
+	}
+	s.rotate()
+
+	entries := readManifest(t, s.dir)
+	if len(entries) != 2 || entries[0].Events != 2 || entries[1].Events != 1 {
+		t.Fatalf("wrong manifest entries: %+v", entries)
+	}
+	if entries[0].File != "1982/02/05/ekanite-19820205T040000Z.ndjson.gz" || entries[1].File != "1982/02/05/ekanite-19820205T040000Z-1.ndjson.gz" {
+		t.Fatalf("wrong file names: %s, %s", entries[0].File, entries[1].File)
+	}
+
+	var msgs []string
+	for _, e := range entries {
+		for _, line := range readArchive(t, filepath.Join(s.dir, e.File)) {
+			var doc map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &doc); err != nil {
+				t.Fatalf("invalid line %s: %s", line, err)
+			}
+			msgs = append(msgs, doc["message"].(string))
+		}
+	}
+	if exp := []string{"link down", "link up", "login failed"}; !equalStrings(msgs, exp) {
+		t.Fatalf("wrong events archived, exp %v, got %v", exp, msgs)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(s.dir, "*/*/*/*"+partSuffix)); len(matches) != 0 {
+		t.Fatalf("files left incomplete: %v", matches)
+	}
+}
+
+func Test_FileArchiveRotatesByTime(t *testing.T) {
+	s, now, cleanup := newTestArchive(t, DispatcherInstance{
+		Format:         "raw",
+		Compression:    "zstd",
+		RotateInterval: "24h",
+		Filter:         &Filter{Query: "link"},
+	})
+	defer cleanup()
+
+	s.do(newTestEvent("link down"))
+	s.do(newTestEvent("login failed"))
+	s.tick()
+	if _, err := os.Stat(filepath.Join(s.dir, ManifestFile)); err == nil {
+		t.Fatalf("file rotated before the end of its partition")
+	}
+
+	*now = now.Add(20 * time.Hour)
+	s.tick()
+	s.do(newTestEvent("link up", "timestamp", "1982-02-06T00:00:00Z"))
+	*now = now.Add(24 * time.Hour)
+	s.tick()
+
+	entries := readManifest(t, s.dir)
+	if len(entries) != 2 {
+		t.Fatalf("wrong number of files, exp 2, got %+v", entries)
+	}
+	exp := []struct {
+		file  string
+		lines []string
+	}{
+		{"1982/02/05/ekanite-19820205T040000Z.log.zst", []string{"link down"}},
+		{"1982/02/06/ekanite-19820206T000000Z.log.zst", []string{"link up"}},
+	}
+	for i, e := range exp {
+		if entries[i].File != e.file {
+			t.Fatalf("wrong file name, exp %s, got %s", e.file, entries[i].File)
+		}
+		if lines := readArchive(t, filepath.Join(s.dir, e.file)); !equalStrings(lines, e.lines) {
+			t.Fatalf("wrong lines in %s, exp %v, got %v", e.file, e.lines, lines)
+		}
+	}
+	if !entries[1].First.Equal(time.Date(1982, 2, 6, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("wrong time of first event: %s", entries[1].First)
+	}
+}
+
+func Test_FileArchiveStartClose(t *testing.T) {
+	s, _, cleanup := newTestArchive(t, DispatcherInstance{FlushInterval: "10ms"})
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+	s.Dispatch(ctx, []*input.Event{newTestEvent("link down")})
+
+	// Events are flushed to the file being written.
+	path := filepath.Join(s.dir, "1982/02/05/ekanite-19820205T040000Z.ndjson.gz"+partSuffix)
+	for i := 0; ; i++ {
+		if fi, err := os.Stat(path); err == nil && fi.Size() > 20 {
+			break
+		}
+		if i == 500 {
+			t.Fatalf("timed out waiting for flush")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Closing completes the file.
+	s.Close()
+	if entries := readManifest(t, s.dir); len(entries) != 1 || entries[0].Events != 1 {
+		t.Fatalf("wrong manifest entries after close: %+v", entries)
+	}
+}
+
+func Test_FileArchiveInvalidConfig(t *testing.T) {
+	for _, config := range []DispatcherInstance{
+		{},
+		{Dir: os.TempDir(), Format: "xml"},
+		{Dir: os.TempDir(), Compression: "lz4"},
+		{Dir: os.TempDir(), RotateInterval: "daily"},
+	} {
+		if _, err := NewFileDispatcher(config); err == nil {
+			t.Errorf("invalid config %+v accepted", config)
+		}
+	}
+}
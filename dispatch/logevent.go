@@ -0,0 +1,139 @@
+package dispatch
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+// LogEventVersion is the version of the LogEvent schema, described by
+// logevent.schema.json. Optional fields may be added within a version, any other
+// change requires a new version.
+const LogEventVersion = 1
+
+// layout of LogEvent timestamps, ISO 8601 in UTC with milliseconds
+const logEventTime = "2006-01-02T15:04:05.000Z07:00"
+
+// parsed fields normalized into each field of a LogEvent, the first present wins
+var (
+	hostFields      = []string{"host", "identifier"}
+	interfaceFields = []string{"interface", "ifname", "port"}
+	stateFields     = []string{"state", "status"}
+	userFields      = []string{"user", "username", "login"}
+	commandFields   = []string{"command", "cmd"}
+)
+
+// parsed fields carried by LogEvent fields, which are not repeated in Fields
+var logEventFields = map[string]bool{
+	"timestamp": true, "app": true, "priority": true, "message": true,
+	"alert": true, "correlation": true, "maintenance": true,
+}
+
+func init() {
+	for _, v := range [][]string{hostFields, interfaceFields, stateFields, userFields, commandFields} {
+		for _, f := range v {
+			logEventFields[f] = true
+		}
+	}
+}
+
+// newEventID returns a unique event ID, a random UUID.
+var newEventID = func() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %s", err))
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// LogEvent is the message sent to NAP triggers.
+type LogEvent struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	ID            string `json:"id"`
+	Timestamp     string `json:"timestamp"`            // time of the event
+	ReceivedAt    string `json:"receivedAt,omitempty"` // time ekanite received the event
+
+	Device   LogDevice `json:"device"`
+	App      string    `json:"app,omitempty"`
+	Priority *int      `json:"priority,omitempty"`
+	Severity string    `json:"severity,omitempty"`
+	Message  string    `json:"message"`
+	Raw      string    `json:"raw"`
+
+	// normalized fields, extracted by dispatch rules
+	Interface string `json:"interface,omitempty"`
+	State     string `json:"state,omitempty"` // lower case, such as up or down
+	User      string `json:"user,omitempty"`
+	Command   string `json:"command,omitempty"`
+
+	Alert       string `json:"alert,omitempty"`       // saved search firing the alert
+	Correlation string `json:"correlation,omitempty"` // correlation rule emitting the event
+	Maintenance string `json:"maintenance,omitempty"` // maintenance window the event fell in
+
+	// Fields are the other fields of the event, such as pid, or those added by rules.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// LogDevice is the device which sent an event.
+type LogDevice struct {
+	Host    string `json:"host,omitempty"`
+	Address string `json:"address,omitempty"` // IP address of the sender
+}
+
+// NewLogEvent returns the LogEvent for an event, with a new ID.
+func NewLogEvent(event *input.Event) *LogEvent {
+	e := &LogEvent{
+		SchemaVersion: LogEventVersion,
+		ID:            newEventID(),
+		Timestamp:     eventTime(event).UTC().Format(logEventTime),
+		Device: LogDevice{
+			Host:    parsedField(event, hostFields...),
+			Address: event.SenderIP(),
+		},
+		App:         event.App(),
+		Message:     event.Message(),
+		Raw:         event.Text,
+		Interface:   parsedField(event, interfaceFields...),
+		State:       strings.ToLower(parsedField(event, stateFields...)),
+		User:        parsedField(event, userFields...),
+		Command:     parsedField(event, commandFields...),
+		Alert:       parsedField(event, "alert"),
+		Correlation: parsedField(event, "correlation"),
+	}
+	if !event.ReceptionTime.IsZero() {
+		e.ReceivedAt = event.ReceptionTime.UTC().Format(logEventTime)
+	}
+	if pri, ok := event.Priority(); ok {
+		e.Priority = &pri
+		e.Severity = event.Severity()
+	}
+	for k, v := range event.Parsed {
+		if logEventFields[k] || v == nil {
+			continue
+		}
+		// - is the syslog nil value
+		if f := fmt.Sprint(v); f != "-" {
+			if e.Fields == nil {
+				e.Fields = make(map[string]string)
+			}
+			e.Fields[k] = f
+		}
+	}
+	return e
+}
+
+// parsedField returns the first of the named fields the event has, trimmed.
+func parsedField(event *input.Event, names ...string) string {
+	for _, n := range names {
+		if v, ok := event.Parsed[n]; ok && v != nil {
+			if s := strings.TrimSpace(fmt.Sprint(v)); s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,253 @@
+package dispatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// testEventIDs makes event IDs predictable, until the returned function is called.
+func testEventIDs() func() {
+	n := 0
+	old := newEventID
+	newEventID = func() string {
+		n++
+		return fmt.Sprintf("00000000-0000-4000-8000-%012d", n)
+	}
+	return func() { newEventID = old }
+}
+
+// logEvents returns the events of the golden files, by name.
+func logEvents(t *testing.T) map[string]*input.Event {
+	received := time.Date(2017, 3, 12, 10, 18, 51, 250000000, time.UTC)
+	s := newTestNap(t)
+	commands, err := compileNapRule(NapRule{
+		Name:    "ios-commands",
+		Filter:  Filter{Regex: map[string]string{"message": `User:(?P<user>\S+) logged command:(?P<command>.+)`}},
+		Fields:  map[string]string{"tags": "core"},
+		Trigger: "config-updated",
+	}, s.triggers)
+	if err != nil {
+		t.Fatalf("failed to compile rule: %s", err)
+	}
+
+	events := map[string]*input.Event{
+		"interface-down": parseLine(t, `<187>1 2017-03-12T10:18:50.123+01:00 router1 %LINEPROTO-5-UPDOWN - - Line protocol on Interface GigabitEthernet0/1, changed state to down`),
+		"config-command": parseLine(t, `<189>1 2017-03-12T10:18:50Z router1 %PARSER-5-CFGLOG_LOGGEDCMD 412 - User:admin logged command:!exec: enable`),
+		"rfc3164-status": {
+			Text:   `<30>Mar 12 10:18:50 sw1 ifmgr: port 7 link Down`,
+			Parsed: map[string]interface{}{"priority": 30, "timestamp": "Mar 12 10:18:50", "identifier": "sw1", "message": "port 7 link Down", "port": 7, "status": "Down"},
+		},
+		"alert": {
+			Text:   "saved search 'failed-logins' counted 25 events in 5m0s, condition > 20",
+			Parsed: map[string]interface{}{"timestamp": "2017-03-12T10:18:50Z", "app": "ekanite", "message": "saved search 'failed-logins' counted 25 events in 5m0s, condition > 20", "alert": "failed-logins", "query": "login", "count": uint64(25)},
+		},
+		"correlation": {
+			Text:   "correlation rule 'interface-flap' matched for host router1, interface Gi0/1",
+			Parsed: map[string]interface{}{"timestamp": "2017-03-12T10:18:50Z", "app": "ekanite", "message": "correlation rule 'interface-flap' matched for host router1, interface Gi0/1", "correlation": "interface-flap", "rule": "sequence", "trigger": "interface-flap", "host": "router1", "interface": "Gi0/1"},
+		},
+		"unparsed": {Text: "kernel: oops"},
+	}
+	for _, v := range events {
+		v.ReceptionTime = received
+		v.SourceIP = "10.0.0.1:514"
+	}
+	if _, _, ok := s.route(events["interface-down"]); !ok {
+		t.Fatalf("interface event not routed")
+	}
+	if !commands.apply(events["config-command"]) {
+		t.Fatalf("command rule did not match")
+	}
+	return events
+}
+
+func Test_LogEventGolden(t *testing.T) {
+	defer testEventIDs()()
+	events := logEvents(t)
+	names := make([]string, 0, len(events))
+	for k := range events {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		got, err := json.MarshalIndent(NewLogEvent(events[name]), "", "    ")
+		if err != nil {
+			t.Fatalf("%s: failed to marshal: %s", name, err)
+		}
+		got = append(got, '\n')
+		path := filepath.Join("testdata", "logevent", name+".json")
+		if *update {
+			if err := ioutil.WriteFile(path, got, 0644); err != nil {
+				t.Fatalf("%s: failed to update golden file: %s", name, err)
+			}
+		}
+		want, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%s: failed to read golden file: %s", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: LogEvent differs from %s, run go test -update if the change is intended:\n%s", name, path, got)
+		}
+	}
+}
+
+// readSchema returns the LogEvent schema.
+func readSchema(t *testing.T) map[string]interface{} {
+	b, err := ioutil.ReadFile("logevent.schema.json")
+	if err != nil {
+		t.Fatalf("failed to read schema: %s", err)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(b, &schema); err != nil {
+		t.Fatalf("failed to parse schema: %s", err)
+	}
+	return schema
+}
+
+// validate checks v against the subset of JSON Schema used by the LogEvent schema,
+// returning the errors found.
+func validate(schema map[string]interface{}, v interface{}, path string) []string {
+	var errs []string
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return []string{path + ": not an object"}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		if req, ok := schema["required"].([]interface{}); ok {
+			for _, r := range req {
+				if _, ok := obj[r.(string)]; !ok {
+					errs = append(errs, fmt.Sprintf("%s: missing %s", path, r))
+				}
+			}
+		}
+		for k, e := range obj {
+			if p, ok := props[k].(map[string]interface{}); ok {
+				errs = append(errs, validate(p, e, path+"."+k)...)
+			} else if a, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+				errs = append(errs, validate(a, e, path+"."+k)...)
+			} else if schema["additionalProperties"] == false {
+				errs = append(errs, fmt.Sprintf("%s: unexpected %s", path, k))
+			}
+		}
+		return errs
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return []string{path + ": not a string"}
+		}
+		if p, ok := schema["pattern"].(string); ok && !regexp.MustCompile(p).MatchString(s) {
+			errs = append(errs, fmt.Sprintf("%s: %q does not match %s", path, s, p))
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not a date-time", path, s))
+			}
+		}
+	case "integer":
+		if n, ok := v.(float64); !ok || n != float64(int64(n)) {
+			return []string{path + ": not an integer"}
+		}
+	}
+	if c, ok := schema["const"]; ok && c != v {
+		errs = append(errs, fmt.Sprintf("%s: %v is not %v", path, v, c))
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == v
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: %v not in %v", path, v, enum))
+		}
+	}
+	return errs
+}
+
+func Test_LogEventGoldenFilesMatchSchema(t *testing.T) {
+	schema := readSchema(t)
+	paths, err := filepath.Glob(filepath.Join("testdata", "logevent", "*.json"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no golden files: %v", err)
+	}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", path, err)
+		}
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			t.Fatalf("failed to parse %s: %s", path, err)
+		}
+		for _, e := range validate(schema, v, filepath.Base(path)) {
+			t.Error(e)
+		}
+	}
+
+	// IDs generated outside tests are valid too.
+	v := map[string]interface{}{}
+	b, _ := json.Marshal(NewLogEvent(&input.Event{Text: "x", ReceptionTime: time.Now()}))
+	json.Unmarshal(b, &v)
+	for _, e := range validate(schema, v, "generated") {
+		t.Error(e)
+	}
+	if newEventID() == newEventID() {
+		t.Errorf("event IDs are not unique")
+	}
+}
+
+// Test_LogEventSchemaMatchesType checks that the schema documents exactly the fields
+// of LogEvent, and requires those always present.
+func Test_LogEventSchemaMatchesType(t *testing.T) {
+	schema := readSchema(t)
+	props := schema["properties"].(map[string]interface{})
+	for typ, s := range map[reflect.Type]map[string]interface{}{
+		reflect.TypeOf(LogEvent{}):  schema,
+		reflect.TypeOf(LogDevice{}): props["device"].(map[string]interface{}),
+	} {
+		props := s["properties"].(map[string]interface{})
+		var required []string
+		if req, ok := s["required"].([]interface{}); ok {
+			for _, r := range req {
+				required = append(required, r.(string))
+			}
+		}
+		var fields, always []string
+		for i := 0; i < typ.NumField(); i++ {
+			tag := strings.Split(typ.Field(i).Tag.Get("json"), ",")
+			fields = append(fields, tag[0])
+			if len(tag) == 1 {
+				always = append(always, tag[0])
+			}
+		}
+		var documented []string
+		for k := range props {
+			documented = append(documented, k)
+		}
+		sort.Strings(fields)
+		sort.Strings(documented)
+		sort.Strings(always)
+		sort.Strings(required)
+		if !equalStrings(fields, documented) {
+			t.Errorf("%s has fields %v, the schema documents %v", typ, fields, documented)
+		}
+		if !equalStrings(always, required) {
+			t.Errorf("%s always has fields %v, the schema requires %v", typ, always, required)
+		}
+	}
+}
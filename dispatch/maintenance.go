@@ -0,0 +1,51 @@
+package dispatch
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+// maintenance window actions
+const (
+	MaintenanceSuppress = "suppress" // triggers are not sent
+	MaintenanceTag      = "tag"      // triggers are sent with a maintenance field
+)
+
+// Maintenance is the interface a system of maintenance windows must implement, for
+// the triggers of the events within them to be suppressed or tagged.
+type Maintenance interface {
+	// Match returns the name and action of the window the event falls in at t,
+	// if any.
+	Match(event *input.Event, t time.Time) (name string, action string, ok bool)
+}
+
+var maintenance struct {
+	sync.RWMutex
+	m Maintenance
+}
+
+// SetMaintenance sets the maintenance windows checked before triggers are sent.
+// Nil disables the check.
+func SetMaintenance(m Maintenance) {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	maintenance.m = m
+}
+
+// inMaintenance returns the name and action of the maintenance window the event
+// fell in when it was received, if any.
+func inMaintenance(event *input.Event) (string, string, bool) {
+	maintenance.RLock()
+	m := maintenance.m
+	maintenance.RUnlock()
+	if m == nil {
+		return "", "", false
+	}
+	t := event.ReceptionTime
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return m.Match(event, t)
+}
@@ -0,0 +1,295 @@
+package dispatch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+// Manager runs the dispatchers of a configuration file, and reloads it on request.
+// Dispatchers keep their queues across reloads, so queued events are not lost.
+type Manager struct {
+	path string
+
+	reloadMu sync.Mutex      // serializes reloads, starting and closing
+	mu       sync.Mutex      // serializes dispatch and changes to the dispatchers
+	ctx      context.Context // dispatchers are started with
+	sections []*section
+	queues   []*Queue
+}
+
+// NewManager returns a manager of the dispatchers configured in the file at path.
+func NewManager(path string) (*Manager, error) {
+	_, sections, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manager{path: path, sections: sections}
+	for _, v := range sections {
+		q, err := v.newQueue()
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.queues = append(m.queues, q)
+	}
+	return m, nil
+}
+
+// Start starts the dispatchers, and those created by later reloads, with ctx.
+func (m *Manager) Start(ctx context.Context) error {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ctx = ctx
+	for _, q := range m.queues {
+		if err := q.Start(ctx); err != nil {
+			return fmt.Errorf("%s: %s", q.name, err)
+		}
+	}
+	return nil
+}
+
+// Dispatch queues the events for every dispatcher.
+func (m *Manager) Dispatch(ctx context.Context, events []*input.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var err error
+	for _, q := range m.queues {
+		if e := q.Dispatch(ctx, events); e != nil {
+			err = fmt.Errorf("%s: %s", q.name, e)
+		}
+	}
+	return err
+}
+
+// Close closes the dispatchers.
+func (m *Manager) Close() error {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var err error
+	for _, q := range m.queues {
+		if e := q.Close(); e != nil {
+			err = fmt.Errorf("%s: %s", q.name, e)
+		}
+	}
+	m.sections, m.queues = nil, nil
+	return err
+}
+
+// Reload reloads the configuration file, returning the changes made. Only the
+// dispatchers whose settings changed are replaced. Every new dispatcher and queue is
+// created and started before any is replaced, so if the file is not valid, or any
+// of them fails, nothing is changed and an error is returned.
+func (m *Manager) Reload() ([]string, error) {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+	_, sections, err := loadConfig(m.path)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	ctx, prev, current := m.ctx, m.sections, m.queues
+	m.mu.Unlock()
+	byName := make(map[string]int, len(prev))
+	for i, v := range prev {
+		byName[v.Name] = i
+	}
+
+	plans := make([]*reload, 0, len(sections))
+	for _, v := range sections {
+		p := &reload{section: v}
+		var dir string // of the current queue
+		if i, ok := byName[v.Name]; ok {
+			p.current, dir = current[i], prev[i].Queue.Dir
+			if !dispatcherChanged(prev[i], v) {
+				plans = append(plans, p)
+				continue
+			}
+		}
+		if err := p.create(ctx, dir); err != nil {
+			p.abandon()
+			for _, v := range plans {
+				v.abandon()
+			}
+			return nil, fmt.Errorf("%s: %s", v.Name, err)
+		}
+		plans = append(plans, p)
+	}
+
+	// Dispatchers keeping their queue are replaced, and queues reconfigured, without
+	// holding m.mu, as a queue first waits for the batch being dispatched.
+	var replaced []Dispatcher
+	for _, p := range plans {
+		if p.queue != nil {
+			continue
+		}
+		if p.next != nil {
+			// Hand the queued events to the new dispatcher.
+			replaced = append(replaced, p.current.replace(p.next))
+		}
+		p.current.reconfigure(p.section.Queue)
+	}
+
+	m.mu.Lock()
+	queues := make([]*Queue, 0, len(plans))
+	kept := make(map[*Queue]bool, len(plans)) // current queues not to close
+	for _, p := range plans {
+		if p.current != nil {
+			kept[p.current] = true
+		}
+		if p.queue != nil {
+			queues = append(queues, p.queue)
+		} else {
+			queues = append(queues, p.current)
+		}
+	}
+	var removed []*Queue // of dispatchers no longer configured
+	for _, q := range current {
+		if !kept[q] {
+			removed = append(removed, q)
+		}
+	}
+	changes := diffSections(prev, sections)
+	m.sections = sections
+	m.queues = queues
+	m.mu.Unlock()
+
+	// New queues are started once they hold the events of the queues they replace,
+	// which no longer receive events.
+	for _, p := range plans {
+		if p.queue == nil {
+			continue
+		}
+		if p.current != nil {
+			// The queue's directory changed, so its events are moved to the new
+			// queue.
+			items, d := p.current.drain()
+			p.queue.adopt(items)
+			replaced = append(replaced, d)
+		}
+		if ctx != nil {
+			p.queue.start(ctx)
+		}
+	}
+	for _, q := range removed {
+		if err := q.Close(); err != nil {
+			log.Printf("[dispatch] failed to close %s: %s", q.name, err)
+		}
+	}
+
+	// Replaced dispatchers send any events they hold.
+	closeAll(replaced)
+	if len(changes) == 0 {
+		log.Printf("[dispatch] reloaded %s, without changes", m.path)
+	} else {
+		log.Printf("[dispatch] reloaded %s:\n  %s", m.path, strings.Join(changes, "\n  "))
+	}
+	return changes, nil
+}
+
+// reload is the change made to a dispatcher by a reload.
+type reload struct {
+	section *section
+	current *Queue // nil if the dispatcher is added
+
+	next  Dispatcher // replacing the current dispatcher, if it changed
+	queue *Queue     // replacing the current queue, if it is added or its directory changed
+}
+
+// create creates the new dispatcher, starting it with ctx if the manager has been
+// started, and its queue if it is added or the queue's directory changed from dir.
+func (p *reload) create(ctx context.Context, dir string) error {
+	d, err := p.section.create()
+	if err != nil {
+		return err
+	}
+	p.next = d
+	if ctx != nil {
+		if err := d.Start(ctx); err != nil {
+			return err
+		}
+	}
+	if p.current != nil && dir == p.section.Queue.Dir {
+		return nil
+	}
+	p.queue, err = NewQueue(d, p.section.Name, p.section.Queue)
+	return err
+}
+
+// abandon closes the dispatcher and queue created.
+func (p *reload) abandon() {
+	if p.queue != nil {
+		p.queue.Close()
+	} else if p.next != nil {
+		p.next.Close()
+	}
+}
+
+// dispatcherChanged returns whether the settings of a dispatcher changed, other
+// than those of its queue whose directory is unchanged.
+func dispatcherChanged(prev, next *section) bool {
+	for _, k := range changedKeys(prev.raw, next.raw) {
+		if k != "queue" || prev.Queue.Dir != next.Queue.Dir {
+			return true
+		}
+	}
+	return false
+}
+
+// diffSections describes the dispatchers added, removed and changed, with the
+// settings changed.
+func diffSections(prev, next []*section) []string {
+	var changes []string
+	byName := make(map[string]*section, len(prev))
+	for _, v := range prev {
+		byName[v.Name] = v
+	}
+	for _, v := range next {
+		p, ok := byName[v.Name]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("+ %s (%s)", v.Name, v.Type))
+			continue
+		}
+		delete(byName, v.Name)
+		if keys := changedKeys(p.raw, v.raw); len(keys) > 0 {
+			changes = append(changes, fmt.Sprintf("~ %s: %s", v.Name, strings.Join(keys, ", ")))
+		}
+	}
+	for _, v := range prev {
+		if _, ok := byName[v.Name]; ok {
+			changes = append(changes, fmt.Sprintf("- %s (%s)", v.Name, v.Type))
+		}
+	}
+	return changes
+}
+
+// changedKeys returns the keys whose values differ between two JSON objects.
+func changedKeys(a, b json.RawMessage) []string {
+	var ma, mb map[string]interface{}
+	json.Unmarshal(a, &ma)
+	json.Unmarshal(b, &mb)
+	var keys []string
+	for k, v := range ma {
+		if !reflect.DeepEqual(v, mb[k]) {
+			keys = append(keys, k)
+		}
+	}
+	for k := range mb {
+		if _, ok := ma[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,258 @@
+package dispatch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sinks created by the test-sink type, by tag
+var (
+	sinksMu sync.Mutex
+	sinks   = make(map[string]*sink)
+)
+
+func init() {
+	Register("test-sink", func(config json.RawMessage) (Dispatcher, error) {
+		var c struct {
+			Tag  string `json:"tag"`
+			Slow bool   `json:"slow"` // waits for release before each batch
+		}
+		if err := json.Unmarshal(config, &c); err != nil {
+			return nil, err
+		}
+		if c.Tag == "fail" {
+			return nil, fmt.Errorf("tag fail")
+		}
+		s := &sink{}
+		if c.Slow {
+			s.release = make(chan struct{})
+		}
+		sinksMu.Lock()
+		sinks[c.Tag] = s
+		sinksMu.Unlock()
+		return s, nil
+	})
+}
+
+func testSink(tag string) *sink {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	return sinks[tag]
+}
+
+func Test_ManagerReload(t *testing.T) {
+	path := writeConfig(t, `{"dispatcher": [{"type": "test-sink", "tag": "v1"}]}`)
+	defer os.Remove(path)
+	m, err := NewManager(path)
+	if err != nil {
+		t.Fatalf("failed to create manager: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := m.Start(ctx); err != nil {
+		t.Fatalf("failed to start manager: %s", err)
+	}
+	defer m.Close()
+	m.Dispatch(ctx, newQueueEvents("a"))
+	testSink("v1").waitMessages(t, 1)
+
+	// Dispatchers are replaced, added and reported.
+	ioutil.WriteFile(path, []byte(`{"dispatcher": [
+		{"type": "test-sink", "tag": "v2"},
+		{"type": "test-sink", "name": "other", "tag": "o1"}
+	]}`), 0644)
+	changes, err := m.Reload()
+	if err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+	if exp := []string{"~ test-sink: tag", "+ other (test-sink)"}; !equalStrings(changes, exp) {
+		t.Fatalf("wrong changes, exp %v, got %v", exp, changes)
+	}
+	m.Dispatch(ctx, newQueueEvents("b"))
+	if got := testSink("v2").waitMessages(t, 1); !equalStrings(got, []string{"b"}) {
+		t.Fatalf("wrong events dispatched after reload: %v", got)
+	}
+	testSink("o1").waitMessages(t, 1)
+	if v1 := testSink("v1"); !v1.closed || len(v1.events) != 1 {
+		t.Fatalf("replaced dispatcher not closed, or given events after reload")
+	}
+
+	// Unchanged dispatchers are kept, and queues changed in place.
+	ioutil.WriteFile(path, []byte(`{"dispatcher": [
+		{"type": "test-sink", "tag": "v2", "queue": {"size": 10}},
+		{"type": "test-sink", "name": "other", "tag": "o1"}
+	]}`), 0644)
+	o1 := testSink("o1")
+	changes, err = m.Reload()
+	if err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+	if exp := []string{"~ test-sink: queue"}; !equalStrings(changes, exp) {
+		t.Fatalf("wrong changes, exp %v, got %v", exp, changes)
+	}
+	if testSink("v2").closed || testSink("o1") != o1 || o1.closed {
+		t.Fatalf("unchanged dispatcher replaced")
+	}
+	if m.queues[0].size != 10 {
+		t.Fatalf("queue not reconfigured, size %d", m.queues[0].size)
+	}
+
+	// Invalid configurations, or dispatchers or queues failing to be created, leave
+	// the dispatchers running.
+	file := writeConfig(t, "")
+	defer os.Remove(file)
+	for _, cfg := range []string{
+		`{"dispatcher": [{"type": "test-sink", "tag": "fail"}]}`,
+		`{"dispatcher": [{"type": "test-sink", "name": "other", "tag": "o2"}, {"type": "test-sink", "tag": "v3", "queue": {"dir": "` + file + `"}}]}`,
+	} {
+		ioutil.WriteFile(path, []byte(cfg), 0644)
+		if _, err := m.Reload(); err == nil {
+			t.Fatalf("invalid configuration reloaded: %s", cfg)
+		}
+	}
+	if testSink("v2").closed || o1.closed || !testSink("o2").closed {
+		t.Fatalf("failed reload changed the dispatchers")
+	}
+	m.Dispatch(ctx, newQueueEvents("c"))
+	if got := testSink("v2").waitMessages(t, 2); !equalStrings(got, []string{"b", "c"}) {
+		t.Fatalf("wrong events dispatched after failed reload: %v", got)
+	}
+
+	ioutil.WriteFile(path, []byte(`{"dispatcher": []}`), 0644)
+	changes, err = m.Reload()
+	if err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+	if exp := []string{"- test-sink (test-sink)", "- other (test-sink)"}; !equalStrings(changes, exp) {
+		t.Fatalf("wrong changes, exp %v, got %v", exp, changes)
+	}
+	if !testSink("o1").closed {
+		t.Fatalf("removed dispatcher not closed")
+	}
+}
+
+func Test_ManagerReloadMovesQueue(t *testing.T) {
+	dirA, _ := ioutil.TempDir("", "ekanite-queue-")
+	dirB, _ := ioutil.TempDir("", "ekanite-queue-")
+	defer os.RemoveAll(dirA)
+	defer os.RemoveAll(dirB)
+	path := writeConfig(t, `{"dispatcher": [{"type": "test-sink", "tag": "slow", "slow": true, "queue": {"dir": "`+dirA+`"}}]}`)
+	defer os.Remove(path)
+	m, err := NewManager(path)
+	if err != nil {
+		t.Fatalf("failed to create manager: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.Start(ctx)
+	defer m.Close()
+
+	// The first event is being dispatched, the others are queued.
+	slow, old := testSink("slow"), m.queues[0]
+	m.Dispatch(ctx, newQueueEvents("a"))
+	waitFor(t, old, func() bool { return old.dispatching != nil })
+	m.Dispatch(ctx, newQueueEvents("b", "c"))
+
+	ioutil.WriteFile(path, []byte(`{"dispatcher": [{"type": "test-sink", "tag": "fast", "queue": {"dir": "`+dirB+`"}}]}`), 0644)
+	done := make(chan error)
+	go func() {
+		_, err := m.Reload()
+		done <- err
+	}()
+	waitFor(t, old, func() bool { return old.stopped })
+
+	// Events are still dispatched while the reload waits for the batch, and follow
+	// those moved.
+	dispatched := make(chan struct{})
+	go func() {
+		m.Dispatch(ctx, newQueueEvents("d"))
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("dispatch blocked by reload")
+	}
+	slow.release <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+
+	if got := testSink("fast").waitMessages(t, 3); !equalStrings(got, []string{"b", "c", "d"}) {
+		t.Fatalf("wrong events moved to the new queue: %v", got)
+	}
+	if got := slow.waitMessages(t, 1); !equalStrings(got, []string{"a"}) || !slow.closed {
+		t.Fatalf("replaced dispatcher not closed, or given wrong events: %v", got)
+	}
+}
+
+func Test_ManagerReloadReplacesDispatcher(t *testing.T) {
+	path := writeConfig(t, `{"dispatcher": [{"type": "test-sink", "tag": "slow-1", "slow": true}]}`)
+	defer os.Remove(path)
+	m, err := NewManager(path)
+	if err != nil {
+		t.Fatalf("failed to create manager: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.Start(ctx)
+	defer m.Close()
+
+	slow, q := testSink("slow-1"), m.queues[0]
+	m.Dispatch(ctx, newQueueEvents("a"))
+	waitFor(t, q, func() bool { return q.dispatching != nil })
+
+	ioutil.WriteFile(path, []byte(`{"dispatcher": [{"type": "test-sink", "tag": "fast-1"}]}`), 0644)
+	done := make(chan error)
+	go func() {
+		_, err := m.Reload()
+		done <- err
+	}()
+
+	// The reload waits for the batch being dispatched, without holding up dispatch.
+	waitFor(t, q, func() bool { return q.next != Dispatcher(slow) })
+	for i := 0; i < 10; i++ {
+		dispatched := make(chan struct{})
+		go func() {
+			m.Dispatch(ctx, newQueueEvents("b"))
+			close(dispatched)
+		}()
+		select {
+		case <-dispatched:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("dispatch blocked by reload")
+		}
+	}
+	slow.release <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+	if got := testSink("fast-1").waitMessages(t, 10); len(got) != 10 {
+		t.Fatalf("wrong events given to the new dispatcher: %v", got)
+	}
+	if got := slow.waitMessages(t, 1); !equalStrings(got, []string{"a"}) || !slow.closed {
+		t.Fatalf("replaced dispatcher not closed, or given wrong events: %v", got)
+	}
+}
+
+// waitFor waits for cond, checked under the lock of q.
+func waitFor(t *testing.T, q *Queue, cond func() bool) {
+	for i := 0; ; i++ {
+		q.mu.Lock()
+		ok := cond()
+		q.mu.Unlock()
+		if ok {
+			return
+		}
+		if i == 500 {
+			t.Fatalf("timed out waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,9 +1,7 @@
 package dispatch
 
 import (
-	"log"
-	"regexp"
-	"strings"
+	"context"
 
 	"github.com/ekanite/ekanite/input"
 )
@@ -12,9 +10,14 @@ import (
 type nap struct {
 	responser *Responser
 	triggers  map[string]Trigger
+	rules     []*napRule
 }
 
 func NewNapDispatcher(config DispatcherInstance) (Dispatcher, error) {
+	rules, err := compileNapRules(config.Rules, config.Triggers)
+	if err != nil {
+		return nil, err
+	}
 	responser, err := NewResponser(config)
 	if err != nil {
 		return nil, err
@@ -22,57 +25,67 @@ func NewNapDispatcher(config DispatcherInstance) (Dispatcher, error) {
 	return &nap{
 		responser: responser,
 		triggers:  config.Triggers,
+		rules:     rules,
 	}, nil
 }
 
-func (s *nap) Listen(c chan []*input.Event) {
-	for {
-		select {
-		case e := <-c:
-			for _, v := range e {
-				s.do(v)
-			}
-			break
-		}
+func (s *nap) Start(ctx context.Context) error {
+	return nil
+}
+
+func (s *nap) Dispatch(ctx context.Context, events []*input.Event) error {
+	for _, v := range events {
+		s.do(v)
 	}
+	return nil
 }
 
+// do sends the event as a LogEvent to the trigger it is routed to, unless it falls
+// in a maintenance window suppressing triggers.
 func (s *nap) do(event *input.Event) error {
-	// filter
-	// commandPattern := regexp.MustCompile(`(executed the '(.+)' command?`)
-	if strings.Contains(event.Parsed["message"].(string), "'write memory' command") || // cisco
-		strings.Contains(event.Parsed["message"].(string), "commit complete") || // juniper
-		strings.Contains(strings.ToLower(event.Parsed["message"].(string)), "attribute configured") /*fortinet*/ ||
-		strings.Contains(strings.ToLower(event.Parsed["message"].(string)), "Configured from") /*NX-OS || IOS*/ {
-		//config updated
-		log.Println("[nap]", event)
-		s.responser.Send(*event, s.triggers["config-updated"], "net.skycloud.nap.messaging.model.LogEvent")
+	trigger, typeID, ok := s.route(event)
+	if !ok {
 		return nil
 	}
-	nexusUpDownPattern := `Interface ([\w\d\/]+) is (up|down)`
-	m := regexp.MustCompile(nexusUpDownPattern).FindStringSubmatch(event.Parsed["message"].(string))
-	if len(m) > 0 {
-		event.Parsed["interface"] = m[1]
-		event.Parsed["state"] = m[2]
-		s.responser.Send(*event, s.triggers["interface-up-down"], "net.skycloud.nap.messaging.model.LogEvent")
-		return nil
-	}
-	iosUpDownPattern := `Line protocol on Interface ([\w\d\/]+), changed state to (up|down)`
-	n := regexp.MustCompile(iosUpDownPattern).FindStringSubmatch(event.Parsed["message"].(string))
-	if len(n) > 0 {
-		event.Parsed["interface"] = m[1]
-		event.Parsed["state"] = m[2]
-		s.responser.Send(*event, s.triggers["interface-up-down"], "net.skycloud.nap.messaging.model.LogEvent")
-		return nil
+	msg := NewLogEvent(event)
+	if name, action, ok := inMaintenance(event); ok {
+		if action != MaintenanceTag {
+			stats.Add("napSuppressed", 1)
+			return nil
+		}
+		stats.Add("napTagged", 1)
+		msg.Maintenance = name
 	}
-	// ignore
+	s.responser.Send(msg, trigger, typeID)
 	return nil
 }
 
-func (s *nap) beforeDispatch() {
-
+// route returns the trigger and message type the event is sent with, if any.
+func (s *nap) route(event *input.Event) (Trigger, string, bool) {
+	// alerts fired by saved searches
+	if _, ok := event.Parsed["alert"]; ok {
+		trigger, ok := s.triggers["alert"]
+		return trigger, DefaultTypeID, ok
+	}
+	// synthetic events of correlation rules
+	if _, ok := event.Parsed["correlation"]; ok {
+		name, _ := event.Parsed["trigger"].(string)
+		trigger, ok := s.triggers[name]
+		return trigger, DefaultTypeID, ok
+	}
+	// first matching rule
+	for _, r := range s.rules {
+		if r.apply(event) {
+			return r.trigger, r.typeID, true
+		}
+	}
+	// ignore
+	return Trigger{}, "", false
 }
 
-func (s *nap) afterDispatch() {
-
+// Close stops publishing, once the messages sent are confirmed, or the close timeout
+// of the responser passes.
+func (s *nap) Close() error {
+	s.responser.Close()
+	return nil
 }
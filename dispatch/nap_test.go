@@ -0,0 +1,227 @@
+package dispatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+// newTestNap returns a NAP dispatcher, without a broker, using the rules of the
+// example configuration.
+func newTestNap(t *testing.T) *nap {
+	b, err := ioutil.ReadFile("../dispatcher.json")
+	if err != nil {
+		t.Fatalf("failed to read configuration: %s", err)
+	}
+	var cfg DispatcherConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		t.Fatalf("failed to parse configuration: %s", err)
+	}
+	var v DispatcherInstance
+	if err := json.Unmarshal(cfg.Dispatcher[0], &v); err != nil {
+		t.Fatalf("failed to parse configuration: %s", err)
+	}
+	rules, err := compileNapRules(v.Rules, v.Triggers)
+	if err != nil {
+		t.Fatalf("failed to compile rules: %s", err)
+	}
+	return &nap{triggers: v.Triggers, rules: rules}
+}
+
+func parseLine(t *testing.T, line string) *input.Event {
+	p, err := input.NewParser("rfc5424")
+	if err != nil {
+		t.Fatalf("failed to create parser: %s", err)
+	}
+	if !p.Parse([]byte(line)) {
+		t.Fatalf("failed to parse %s", line)
+	}
+	return &input.Event{Text: line, Parsed: p.Result}
+}
+
+func Test_NapRules(t *testing.T) {
+	s := newTestNap(t)
+	tests := []struct {
+		line    string
+		trigger string
+		fields  map[string]string
+	}{
+		{
+			line:    `<189>1 2017-03-12T10:18:50Z router1 %SYS-5-CONFIG_I - - Configured from console by admin on vty0 (10.0.0.1)`,
+			trigger: "triggers.config.updated",
+		},
+		{
+			line:    `<189>1 2017-03-12T10:18:50Z router1 %PARSER-5-CFGLOG_LOGGEDCMD - - User:admin logged command:!exec: enable executed the 'write memory' command`,
+			trigger: "triggers.config.updated",
+		},
+		{
+			line:    `<189>1 2017-03-12T10:18:50Z mx1 mgd 123 UI_COMMIT_COMPLETED commit complete`,
+			trigger: "triggers.config.updated",
+		},
+		{
+			line:    `<187>1 2017-03-12T10:18:50Z nexus1 %ETHPORT-5-IF_UP - - Interface Ethernet1/2 is up in mode access`,
+			trigger: "triggers.interface.up-down",
+			fields:  map[string]string{"interface": "Ethernet1/2", "state": "up"},
+		},
+		{
+			line:    `<187>1 2017-03-12T10:18:50Z router1 %LINEPROTO-5-UPDOWN - - Line protocol on Interface GigabitEthernet0/1, changed state to down`,
+			trigger: "triggers.interface.up-down",
+			fields:  map[string]string{"interface": "GigabitEthernet0/1", "state": "down"},
+		},
+		{
+			line: `<190>1 2017-03-12T10:18:50Z router1 %SEC-6-IPACCESSLOGP - - list 101 denied tcp 10.0.0.1(1234) -> 10.0.0.2(22), 1 packet`,
+		},
+	}
+	for _, tt := range tests {
+		e := parseLine(t, tt.line)
+		trigger, typeID, ok := s.route(e)
+		if ok != (tt.trigger != "") || trigger.RoutingKey != tt.trigger {
+			t.Errorf("%s: wrong trigger, exp %q, got %q", tt.line, tt.trigger, trigger.RoutingKey)
+			continue
+		}
+		if ok && typeID != DefaultTypeID {
+			t.Errorf("%s: wrong type, got %s", tt.line, typeID)
+		}
+		for k, v := range tt.fields {
+			if e.Parsed[k] != v {
+				t.Errorf("%s: wrong %s, exp %s, got %v", tt.line, k, v, e.Parsed[k])
+			}
+		}
+	}
+}
+
+func Test_NapRuleConditions(t *testing.T) {
+	triggers := map[string]Trigger{"t": {RoutingKey: "k"}}
+	rules, err := compileNapRules([]NapRule{
+		{
+			Name:    "equals",
+			Filter:  Filter{Equals: map[string]string{"app": "sshd", "priority": "37"}},
+			Fields:  map[string]string{"summary": "login on ${host}"},
+			Trigger: "t",
+			TypeID:  "login",
+		},
+		{
+			Name:    "regex",
+			Filter:  Filter{Regex: map[string]string{"message": `^user (?P<user>\w+) logged in`}},
+			Fields:  map[string]string{"who": "$user@$host"},
+			Trigger: "t",
+			TypeID:  "user",
+		},
+		{
+			Name:    "query",
+			Filter:  Filter{Query: "host:fw AND (denied OR dropped)"},
+			Trigger: "t",
+			TypeID:  "firewall",
+		},
+	}, triggers)
+	if err != nil {
+		t.Fatalf("failed to compile rules: %s", err)
+	}
+	s := &nap{triggers: triggers, rules: rules}
+
+	tests := []struct {
+		fields map[string]interface{}
+		typeID string
+		exp    map[string]interface{}
+	}{
+		{
+			fields: map[string]interface{}{"app": "sshd", "priority": 37, "host": "a", "message": "x"},
+			typeID: "login",
+			exp:    map[string]interface{}{"summary": "login on a"},
+		},
+		{
+			fields: map[string]interface{}{"app": "sshd", "priority": 38, "host": "a", "message": "user bob logged in"},
+			typeID: "user",
+			exp:    map[string]interface{}{"user": "bob", "who": "bob@a"},
+		},
+		{
+			fields: map[string]interface{}{"host": "fw1", "message": "packet Dropped"},
+			typeID: "firewall",
+		},
+		{
+			fields: map[string]interface{}{"host": "fw1", "message": "packet accepted"},
+		},
+		{
+			fields: map[string]interface{}{"host": "fw1"},
+		},
+	}
+	for i, tt := range tests {
+		e := &input.Event{Parsed: tt.fields}
+		_, typeID, ok := s.route(e)
+		if ok != (tt.typeID != "") || typeID != tt.typeID {
+			t.Errorf("test %d: wrong rule matched, exp %q, got %q", i, tt.typeID, typeID)
+		}
+		for k, v := range tt.exp {
+			if e.Parsed[k] != v {
+				t.Errorf("test %d: wrong %s, exp %v, got %v", i, k, v, e.Parsed[k])
+			}
+		}
+	}
+
+	for _, rule := range []NapRule{
+		{Filter: Filter{Regex: map[string]string{"message": "x"}}, Trigger: "t"},
+		{Name: "a", Filter: Filter{Regex: map[string]string{"message": "x"}}, Trigger: "missing"},
+		{Name: "a", Trigger: "t"},
+		{Name: "a", Filter: Filter{Regex: map[string]string{"message": "("}}, Trigger: "t"},
+		{Name: "a", Filter: Filter{Query: "host:"}, Trigger: "t"},
+	} {
+		if _, err := compileNapRules([]NapRule{rule}, triggers); err == nil {
+			t.Errorf("invalid rule %+v compiled", rule)
+		}
+	}
+}
+
+func Test_NapRoutesSyntheticEvents(t *testing.T) {
+	s := newTestNap(t)
+	if trigger, _, ok := s.route(&input.Event{Parsed: map[string]interface{}{"alert": "x", "message": "Interface Gi0/1 is up"}}); !ok || trigger.RoutingKey != "triggers.alert" {
+		t.Errorf("alert not routed to its trigger: %+v", trigger)
+	}
+	if _, _, ok := s.route(&input.Event{Parsed: map[string]interface{}{"correlation": "x", "trigger": "missing"}}); ok {
+		t.Errorf("correlation with missing trigger routed")
+	}
+	if trigger, _, ok := s.route(&input.Event{Parsed: map[string]interface{}{"correlation": "x", "trigger": "config-updated"}}); !ok || trigger.RoutingKey != "triggers.config.updated" {
+		t.Errorf("correlation not routed to its trigger: %+v", trigger)
+	}
+}
+
+// hostMaintenance puts a host in a maintenance window with an action.
+type hostMaintenance struct {
+	host, action string
+}
+
+func (m hostMaintenance) Match(event *input.Event, t time.Time) (string, string, bool) {
+	return "upgrade", m.action, event.Host() == m.host
+}
+
+func Test_NapMaintenance(t *testing.T) {
+	s := newTestNap(t)
+	s.responser = &Responser{outbox: make(chan *message, 10)}
+	defer SetMaintenance(nil)
+	line := `<189>1 2017-03-12T10:18:50Z router1 %SYS-5-CONFIG_I - - Configured from console by admin on vty0 (10.0.0.1)`
+
+	SetMaintenance(hostMaintenance{host: "router2", action: MaintenanceSuppress})
+	s.do(parseLine(t, line))
+	if m := <-s.responser.outbox; m.routingKey != "triggers.config.updated" || bytes.Contains(m.body, []byte("maintenance")) {
+		t.Fatalf("wrong message outside maintenance: %s %s", m.routingKey, m.body)
+	}
+
+	SetMaintenance(hostMaintenance{host: "router1", action: MaintenanceSuppress})
+	s.do(parseLine(t, line))
+	if n := len(s.responser.outbox); n != 0 {
+		t.Fatalf("trigger sent during maintenance, %d messages queued", n)
+	}
+
+	SetMaintenance(hostMaintenance{host: "router1", action: MaintenanceTag})
+	e := parseLine(t, line)
+	s.do(e)
+	if m := <-s.responser.outbox; !bytes.Contains(m.body, []byte(`"maintenance":"upgrade"`)) {
+		t.Fatalf("trigger not tagged during maintenance: %s", m.body)
+	}
+	if _, ok := e.Parsed["maintenance"]; ok {
+		t.Fatalf("tagging changed the dispatched event")
+	}
+}
@@ -0,0 +1,695 @@
+package dispatch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+// queue defaults
+const (
+	DefaultQueueSize     = 10000
+	DefaultQueueOverflow = "drop-oldest"
+	DefaultQueueDiskSize = 1024 * 1024 * 1024
+
+	queueBatchSize    = 500              // most events handed to a dispatcher at once
+	queueCloseTimeout = 10 * time.Second // to hand the events in memory to the dispatcher on close
+)
+
+// metrics of the queue of each dispatcher, by name
+var queueStats = expvar.NewMap("dispatchQueues")
+
+// QueueConfig configures the queue in front of a dispatcher, the queue section of
+// its configuration.
+type QueueConfig struct {
+	Size     int    `json:"size,omitempty"`     // events held in memory
+	Overflow string `json:"overflow,omitempty"` // block, drop-oldest or drop-newest
+
+	// Dir is the directory events beyond Size are spilled to, up to DiskSize bytes.
+	// Events are only kept in memory if it is not set.
+	Dir      string `json:"dir,omitempty"`
+	DiskSize int64  `json:"diskSize,omitempty"`
+}
+
+func (c QueueConfig) validate() error {
+	switch strings.ToLower(c.Overflow) {
+	case "", "block", "drop-oldest", "drop-newest":
+		return nil
+	}
+	return fmt.Errorf("queue overflow %s not valid", c.Overflow)
+}
+
+// Queue holds events for a dispatcher, so that a slow dispatcher holds up neither
+// the others nor indexing. Once the queue is full, its overflow policy blocks
+// senders, or drops the newest or oldest events. Batches the dispatcher fails are
+// held in the queue, and retried with backoff.
+type Queue struct {
+	next     Dispatcher
+	name     string
+	size     int
+	overflow string
+	diskSize int64
+	backoff  time.Duration // before retrying a failed batch, doubling with each
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	mem         []*queued  // oldest events
+	spill       *spillFile // newer events, nil if not spilling to disk
+	started     bool
+	stopped     bool
+	dispatching Dispatcher // being given a batch, if any
+	stopping    chan struct{}
+	finished    chan struct{}
+
+	enqueued   int64
+	dispatched int64 // events the dispatcher accepted
+	dropped    int64
+	failed     int64 // batches the dispatcher failed
+}
+
+// queued is a queued event.
+type queued struct {
+	Time  time.Time    `json:"time"` // when it was queued
+	Event *input.Event `json:"event"`
+}
+
+// NewQueue returns a queue in front of the dispatcher, publishing its metrics
+// under name. Events spilled to disk by a previous queue of the same name are
+// dispatched first.
+func NewQueue(next Dispatcher, name string, config QueueConfig) (*Queue, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		next:     next,
+		name:     name,
+		backoff:  minBackoff,
+		stopping: make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	q.configure(config)
+	if config.Dir != "" {
+		if err := os.MkdirAll(config.Dir, 0755); err != nil {
+			return nil, err
+		}
+		s, err := openSpill(filepath.Join(config.Dir, name+".queue"))
+		if err != nil {
+			return nil, fmt.Errorf("queue: %s", err)
+		}
+		q.spill = s
+		q.refill()
+	}
+	return q, nil
+}
+
+// configure applies the limits and overflow policy of the configuration, with
+// their defaults.
+func (q *Queue) configure(config QueueConfig) {
+	q.size = config.Size
+	q.overflow = strings.ToLower(config.Overflow)
+	q.diskSize = config.DiskSize
+	if q.size <= 0 {
+		q.size = DefaultQueueSize
+	}
+	if q.overflow == "" {
+		q.overflow = DefaultQueueOverflow
+	}
+	if q.diskSize <= 0 {
+		q.diskSize = DefaultQueueDiskSize
+	}
+}
+
+// Start starts the dispatcher, and dispatching queued events.
+func (q *Queue) Start(ctx context.Context) error {
+	if err := q.next.Start(ctx); err != nil {
+		return err
+	}
+	q.start(ctx)
+	return nil
+}
+
+// start starts dispatching queued events to the dispatcher, which has been started,
+// and publishes the queue's metrics.
+func (q *Queue) start(ctx context.Context) {
+	q.mu.Lock()
+	q.started = true
+	q.mu.Unlock()
+	queueStats.Set(q.name, expvar.Func(q.metrics))
+
+	// Wake the dispatching goroutine once ctx is done.
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-q.finished:
+		}
+		q.mu.Lock()
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}()
+	go q.run(ctx)
+}
+
+// Dispatch queues events, applying the overflow policy while the queue is full.
+// Blocked senders return once ctx is done.
+func (q *Queue) Dispatch(ctx context.Context, events []*input.Event) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for _, e := range events {
+		item := &queued{Time: now, Event: copyEvent(e)}
+		for !q.push(item) {
+			if q.overflow == "block" {
+				if err := q.wait(ctx); err != nil {
+					return err
+				}
+				continue
+			}
+			if q.overflow == "drop-newest" || !q.dropOldest() {
+				q.dropped++
+				item = nil
+				break
+			}
+		}
+		if item != nil {
+			q.enqueued++
+		}
+	}
+	q.cond.Broadcast()
+	return nil
+}
+
+// copyEvent returns a copy of the event with its own parsed fields. The dispatcher
+// may then add fields, such as those extracted by rules, while the event itself is
+// indexed and read by other dispatchers.
+func copyEvent(e *input.Event) *input.Event {
+	c := *e
+	if e.Parsed != nil {
+		c.Parsed = make(map[string]interface{}, len(e.Parsed))
+		for k, v := range e.Parsed {
+			c.Parsed[k] = v
+		}
+	}
+	return &c
+}
+
+// Close stops dispatching and closes the dispatcher. Queued events are kept on
+// disk if the queue spills to disk, and are otherwise handed to the dispatcher, for
+// up to queueCloseTimeout.
+func (q *Queue) Close() error {
+	q.stop()
+	q.mu.Lock()
+	var mem []*queued
+	if q.spill != nil {
+		if err := q.spill.save(q.mem); err != nil {
+			log.Printf("[queue] %s: failed to save %d queued events: %s", q.name, len(q.mem), err)
+		}
+		q.spill = nil
+	} else {
+		mem = q.mem
+	}
+	q.mem = nil
+	next := q.next
+	q.mu.Unlock()
+	if len(mem) > 0 {
+		q.flush(next, mem)
+	}
+	return next.Close()
+}
+
+// flush hands the events to the dispatcher in batches, for up to
+// queueCloseTimeout, dropping those it fails or is not given in time.
+func (q *Queue) flush(next Dispatcher, items []*queued) {
+	ctx, cancel := context.WithTimeout(context.Background(), queueCloseTimeout)
+	defer cancel()
+	for len(items) > 0 && ctx.Err() == nil {
+		batch := items
+		if len(batch) > queueBatchSize {
+			batch = batch[:queueBatchSize]
+		}
+		err := next.Dispatch(ctx, events(batch))
+		q.mu.Lock()
+		if err != nil {
+			q.failed++
+			q.dropped += int64(len(batch))
+		} else {
+			q.dispatched += int64(len(batch))
+		}
+		q.mu.Unlock()
+		if err != nil {
+			log.Printf("[queue] %s: dropping %d events the dispatcher failed on close: %s", q.name, len(batch), err)
+		}
+		items = items[len(batch):]
+	}
+	if len(items) > 0 {
+		log.Printf("[queue] %s: dropping %d queued events not dispatched within %s", q.name, len(items), queueCloseTimeout)
+		q.mu.Lock()
+		q.dropped += int64(len(items))
+		q.mu.Unlock()
+	}
+}
+
+// events returns the events of the queued items.
+func events(items []*queued) []*input.Event {
+	events := make([]*input.Event, len(items))
+	for i, v := range items {
+		events[i] = v.Event
+	}
+	return events
+}
+
+// stop stops dispatching, waiting for the current batch to be dispatched.
+func (q *Queue) stop() {
+	q.mu.Lock()
+	if !q.stopped {
+		q.stopped = true
+		close(q.stopping)
+	}
+	started := q.started
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	if started {
+		<-q.finished
+	}
+}
+
+// reconfigure applies new limits and overflow policy to the queue. The spill
+// directory must not have changed.
+func (q *Queue) reconfigure(config QueueConfig) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.configure(config)
+	q.refill()
+	q.cond.Broadcast()
+}
+
+// drain stops the queue, returning its queued events, oldest first, and its
+// dispatcher, which is not closed. The events are removed from any spill file.
+func (q *Queue) drain() ([]*queued, Dispatcher) {
+	q.stop()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := q.mem
+	q.mem = nil
+	if q.spill != nil {
+		for q.spill.count > 0 {
+			item, err := q.spill.pop()
+			if err != nil {
+				log.Printf("[queue] %s: dropping spilled event: %s", q.name, err)
+				continue
+			}
+			items = append(items, item)
+		}
+		q.spill.close()
+		q.spill = nil
+	}
+	return items, q.next
+}
+
+// adopt queues the events drained from another queue, ahead of those queued since
+// unless they were spilled. Events beyond the queue's capacity are dropped.
+func (q *Queue) adopt(items []*queued) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.spill == nil || q.spill.count == 0 {
+		items = append(items, q.mem...)
+		q.enqueued -= int64(len(q.mem))
+		q.mem = nil
+	}
+	var dropped int64
+	for _, v := range items {
+		if !q.push(v) {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		log.Printf("[queue] %s: dropping %d events of the previous queue", q.name, dropped)
+		q.dropped += dropped
+	}
+	q.enqueued += int64(len(items)) - dropped
+	q.cond.Broadcast()
+}
+
+// replace replaces the dispatcher the queue's events are given to, returning the
+// previous dispatcher once it has been given its current batch.
+func (q *Queue) replace(next Dispatcher) Dispatcher {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	prev := q.next
+	q.next = next
+	for q.dispatching == prev {
+		q.cond.Wait()
+	}
+	return prev
+}
+
+// push adds the event to the queue, returning false if the queue is full. Once
+// events are spilled, newer events are spilled too until they have been read back.
+func (q *Queue) push(item *queued) bool {
+	if (q.spill == nil || q.spill.count == 0) && len(q.mem) < q.size {
+		q.mem = append(q.mem, item)
+		return true
+	}
+	if q.spill == nil || q.spill.live >= q.diskSize {
+		return false
+	}
+	// Reclaim the space of the events read back once it reaches the limit, so that
+	// the file is no larger than twice the limit.
+	if q.spill.size-q.spill.live >= q.diskSize {
+		if err := q.spill.compact(); err != nil {
+			log.Printf("[queue] %s: failed to compact spill file: %s", q.name, err)
+			return false
+		}
+	}
+	if err := q.spill.push(item); err != nil {
+		log.Printf("[queue] %s: failed to spill event: %s", q.name, err)
+		return false
+	}
+	return true
+}
+
+// dropOldest drops the oldest event in the queue, returning false if it is empty.
+func (q *Queue) dropOldest() bool {
+	if len(q.mem) > 0 {
+		q.mem = q.mem[1:]
+		q.refill()
+	} else if q.spill != nil && q.spill.count > 0 {
+		q.spill.pop()
+	} else {
+		return false
+	}
+	q.dropped++
+	return true
+}
+
+// refill moves spilled events back into memory, while there is room.
+func (q *Queue) refill() {
+	for q.spill != nil && q.spill.count > 0 && len(q.mem) < q.size {
+		item, err := q.spill.pop()
+		if err != nil {
+			log.Printf("[queue] %s: dropping spilled event: %s", q.name, err)
+			q.dropped++
+			continue
+		}
+		q.mem = append(q.mem, item)
+	}
+}
+
+// wait waits for events to be taken from the queue, or ctx to be done.
+func (q *Queue) wait(ctx context.Context) error {
+	if q.stopped {
+		return fmt.Errorf("queue %s closed", q.name)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			q.mu.Lock()
+			q.cond.Broadcast()
+			q.mu.Unlock()
+		case <-done:
+		}
+	}()
+	q.cond.Wait()
+	return ctx.Err()
+}
+
+// run hands queued events to the dispatcher in batches, until ctx is done or the
+// queue is closed. A failed batch is put back at the front of the queue, and
+// retried after a backoff.
+func (q *Queue) run(ctx context.Context) {
+	defer close(q.finished)
+	backoff := q.backoff
+	for {
+		q.mu.Lock()
+		for len(q.mem) == 0 && !q.stopped && ctx.Err() == nil {
+			q.cond.Wait()
+		}
+		if q.stopped || ctx.Err() != nil {
+			q.mu.Unlock()
+			return
+		}
+		n := len(q.mem)
+		if n > queueBatchSize {
+			n = queueBatchSize
+		}
+		batch := q.mem[:n:n]
+		q.mem = q.mem[n:]
+		q.refill()
+		next := q.next
+		q.dispatching = next
+		q.cond.Broadcast() // room for blocked senders
+		q.mu.Unlock()
+
+		err := next.Dispatch(ctx, events(batch))
+
+		q.mu.Lock()
+		q.dispatching = nil
+		if err != nil {
+			q.failed++
+			q.mem = append(batch, q.mem...)
+		} else {
+			q.dispatched += int64(n)
+		}
+		q.cond.Broadcast()
+		q.mu.Unlock()
+		if err == nil {
+			backoff = q.backoff
+			continue
+		}
+		log.Printf("[queue] %s: failed to dispatch %d events, retrying in %s: %s", q.name, n, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		case <-q.stopping:
+		}
+		timer.Stop()
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// metrics returns the depth of the queue, how long its oldest event has been
+// queued, and counts of events through it.
+func (q *Queue) metrics() interface{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m := map[string]interface{}{
+		"depth":      len(q.mem),
+		"spilled":    0,
+		"lagSeconds": 0.0,
+		"enqueued":   q.enqueued,
+		"dispatched": q.dispatched,
+		"dropped":    q.dropped,
+		"failed":     q.failed,
+	}
+	if q.spill != nil {
+		m["depth"] = len(q.mem) + q.spill.count
+		m["spilled"] = q.spill.count
+	}
+	if len(q.mem) > 0 {
+		m["lagSeconds"] = time.Since(q.mem[0].Time).Seconds()
+	}
+	return m
+}
+
+// spillFile holds queued events on disk in order, one JSON object per line. It
+// is emptied once every event has been read, or compacted.
+type spillFile struct {
+	path  string
+	w     *os.File
+	f     *os.File // read
+	r     *bufio.Reader
+	count int   // events not yet read
+	size  int64 // bytes written
+	live  int64 // bytes of the events not yet read
+}
+
+// openSpill opens a spill file, holding any events it already contains.
+func openSpill(path string) (*spillFile, error) {
+	w, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	s := &spillFile{path: path, w: w, f: f, r: bufio.NewReader(f)}
+
+	// Count the events left by a previous queue, dropping any partly written.
+	for {
+		line, err := s.r.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		s.size += int64(len(line))
+		s.count++
+	}
+	s.live = s.size
+	if err := w.Truncate(s.size); err != nil {
+		s.close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		s.close()
+		return nil, err
+	}
+	s.r.Reset(f)
+	return s, nil
+}
+
+func (s *spillFile) push(item *queued) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	n, err := s.w.Write(append(b, '\n'))
+	s.size += int64(n)
+	s.live += int64(n)
+	if err != nil {
+		return err
+	}
+	s.count++
+	return nil
+}
+
+// pop reads the oldest event, emptying the file once every event has been read.
+func (s *spillFile) pop() (*queued, error) {
+	line, err := s.r.ReadBytes('\n')
+	s.count--
+	s.live -= int64(len(line))
+	if s.count == 0 {
+		if terr := s.truncate(); terr != nil && err == nil {
+			err = terr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var item queued
+	d := json.NewDecoder(bytes.NewReader(line))
+	d.UseNumber()
+	if err := d.Decode(&item); err != nil || item.Event == nil {
+		return nil, fmt.Errorf("invalid spilled event %s", bytes.TrimSpace(line))
+	}
+	restoreNumbers(item.Event.Parsed)
+	return &item, nil
+}
+
+func (s *spillFile) truncate() error {
+	s.size, s.live = 0, 0
+	if err := s.w.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.r.Reset(s.f)
+	return nil
+}
+
+// save replaces the file with the events in memory, followed by the events not
+// yet read, and closes it.
+func (s *spillFile) save(mem []*queued) error {
+	defer s.close()
+	tmp, err := os.Create(s.path + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, v := range mem {
+		b, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		w.Write(append(b, '\n'))
+	}
+	if s.count > 0 {
+		io.Copy(w, s.r)
+	}
+	if err = w.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(s.path + ".tmp")
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+// compact replaces the file with the events not yet read.
+func (s *spillFile) compact() error {
+	tmp, err := os.Create(s.path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, s.r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(s.path+".tmp", s.path)
+	}
+	if err != nil {
+		// Resume reading where the copy started.
+		os.Remove(s.path + ".tmp")
+		if _, serr := s.f.Seek(s.size-s.live, io.SeekStart); serr == nil {
+			s.r.Reset(s.f)
+		}
+		return err
+	}
+
+	// The events not yet read were consumed by the copy, so the file is reopened.
+	s.close()
+	if s.w, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	if s.f, err = os.Open(s.path); err != nil {
+		return err
+	}
+	s.r.Reset(s.f)
+	s.size = s.live
+	return nil
+}
+
+func (s *spillFile) close() {
+	s.w.Close()
+	s.f.Close()
+}
+
+// restoreNumbers converts the numbers of fields decoded from JSON back to ints,
+// or float64 if they are not integers, as parsers produce them.
+func restoreNumbers(fields map[string]interface{}) {
+	for k, v := range fields {
+		n, ok := v.(json.Number)
+		if !ok {
+			continue
+		}
+		if i, err := n.Int64(); err == nil {
+			fields[k] = int(i)
+		} else if f, err := n.Float64(); err == nil {
+			fields[k] = f
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+// sink is a dispatcher recording events, which waits for release before each
+// batch if release is set, and fails the first failures batches.
+type sink struct {
+	mu       sync.Mutex
+	events   []*input.Event
+	release  chan struct{}
+	failures int
+	closed   bool
+}
+
+func (s *sink) Start(ctx context.Context) error { return nil }
+
+func (s *sink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *sink) Dispatch(ctx context.Context, events []*input.Event) error {
+	if s.release != nil {
+		<-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return fmt.Errorf("unavailable")
+	}
+	s.events = append(s.events, events...)
+	return nil
+}
+
+// waitMessages waits for n events, returning their messages.
+func (s *sink) waitMessages(t *testing.T, n int) []string {
+	for i := 0; ; i++ {
+		s.mu.Lock()
+		if len(s.events) >= n {
+			var m []string
+			for _, v := range s.events {
+				m = append(m, v.Message())
+			}
+			s.mu.Unlock()
+			return m
+		}
+		s.mu.Unlock()
+		if i == 500 {
+			t.Fatalf("timed out waiting for %d events", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newQueueEvents(messages ...string) []*input.Event {
+	var events []*input.Event
+	for _, m := range messages {
+		events = append(events, &input.Event{
+			Text:   m,
+			Parsed: map[string]interface{}{"message": m, "priority": 189},
+		})
+	}
+	return events
+}
+
+// queuedMessages returns the messages of the events in the queue's memory.
+func queuedMessages(q *Queue) []string {
+	var m []string
+	for _, v := range q.mem {
+		m = append(m, v.Event.Message())
+	}
+	return m
+}
+
+func Test_QueueOverflowDrop(t *testing.T) {
+	tests := []struct {
+		overflow string
+		exp      []string
+	}{
+		{"drop-newest", []string{"a", "b"}},
+		{"drop-oldest", []string{"b", "c"}},
+	}
+	for _, tt := range tests {
+		q, err := NewQueue(&sink{}, "test-"+tt.overflow, QueueConfig{Size: 2, Overflow: tt.overflow})
+		if err != nil {
+			t.Fatalf("failed to create queue: %s", err)
+		}
+		if err := q.Dispatch(context.Background(), newQueueEvents("a", "b", "c")); err != nil {
+			t.Fatalf("%s: failed to queue events: %s", tt.overflow, err)
+		}
+		if got := queuedMessages(q); !equalStrings(got, tt.exp) {
+			t.Errorf("%s: wrong events queued, exp %v, got %v", tt.overflow, tt.exp, got)
+		}
+		if m := q.metrics().(map[string]interface{}); m["depth"] != 2 || m["dropped"] != int64(1) {
+			t.Errorf("%s: wrong metrics: %v", tt.overflow, m)
+		}
+	}
+}
+
+func Test_QueueOverflowBlock(t *testing.T) {
+	s := &sink{release: make(chan struct{})}
+	q, err := NewQueue(s, "test-block", QueueConfig{Size: 1, Overflow: "block"})
+	if err != nil {
+		t.Fatalf("failed to create queue: %s", err)
+	}
+	q.Start(context.Background())
+	defer q.Close()
+
+	// The first event is taken by the blocked dispatcher, the second fills the queue.
+	q.Dispatch(context.Background(), newQueueEvents("a"))
+	for {
+		q.mu.Lock()
+		empty := len(q.mem) == 0
+		q.mu.Unlock()
+		if empty {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	q.Dispatch(context.Background(), newQueueEvents("b"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := q.Dispatch(ctx, newQueueEvents("c")); err != context.DeadlineExceeded {
+		t.Fatalf("sending to a full queue did not block until the deadline, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- q.Dispatch(context.Background(), newQueueEvents("d")) }()
+	close(s.release)
+	if err := <-done; err != nil {
+		t.Fatalf("failed to queue event: %s", err)
+	}
+	if got := s.waitMessages(t, 3); !equalStrings(got, []string{"a", "b", "d"}) {
+		t.Fatalf("wrong events dispatched: %v", got)
+	}
+}
+
+func Test_QueueSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ekanite-queue-")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	config := QueueConfig{Size: 2, Overflow: "drop-newest", Dir: dir}
+
+	q, err := NewQueue(&sink{}, "test-spill", config)
+	if err != nil {
+		t.Fatalf("failed to create queue: %s", err)
+	}
+	q.Dispatch(context.Background(), newQueueEvents("a", "b", "c", "d", "e"))
+	if m := q.metrics().(map[string]interface{}); m["depth"] != 5 || m["spilled"] != 3 || m["dropped"] != int64(0) {
+		t.Fatalf("wrong metrics: %v", m)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatalf("failed to close queue: %s", err)
+	}
+
+	// Queued events are dispatched, in order, by a new queue.
+	s := &sink{}
+	q, err = NewQueue(s, "test-spill", config)
+	if err != nil {
+		t.Fatalf("failed to reopen queue: %s", err)
+	}
+	q.Start(context.Background())
+	defer q.Close()
+	if got := s.waitMessages(t, 5); !equalStrings(got, []string{"a", "b", "c", "d", "e"}) {
+		t.Fatalf("wrong events dispatched: %v", got)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pri, ok := s.events[4].Priority(); !ok || pri != 189 {
+		t.Fatalf("priority of spilled event not restored: %v", s.events[4].Parsed["priority"])
+	}
+}
+
+func Test_QueueSpillDropOldest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ekanite-queue-")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := NewQueue(&sink{}, "test-spill-oldest", QueueConfig{Size: 2, Overflow: "drop-oldest", Dir: dir, DiskSize: 5000})
+	if err != nil {
+		t.Fatalf("failed to create queue: %s", err)
+	}
+	defer q.Close()
+
+	// Fill the spill file.
+	for i := 0; ; i++ {
+		q.Dispatch(context.Background(), newQueueEvents(fmt.Sprintf("event %d", i)))
+		if m := q.metrics().(map[string]interface{}); m["dropped"] != int64(0) {
+			break
+		}
+	}
+	full := q.metrics().(map[string]interface{})
+
+	// Each further event drops only the oldest, and the file stays bounded.
+	for i := 0; i < 1000; i++ {
+		q.Dispatch(context.Background(), newQueueEvents(fmt.Sprintf("event %d", i)))
+	}
+	m := q.metrics().(map[string]interface{})
+	if m["dropped"] != full["dropped"].(int64)+1000 || m["depth"] != full["depth"] {
+		t.Fatalf("wrong events dropped, full %v, then %v", full, m)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "test-spill-oldest.queue"))
+	if err != nil {
+		t.Fatalf("failed to stat spill file: %s", err)
+	}
+	if fi.Size() > 2*5000+200 {
+		t.Fatalf("spill file not bounded, %d bytes", fi.Size())
+	}
+}
+
+func Test_QueueRetriesFailedBatches(t *testing.T) {
+	s := &sink{failures: 2}
+	q, err := NewQueue(s, "test-retry", QueueConfig{})
+	if err != nil {
+		t.Fatalf("failed to create queue: %s", err)
+	}
+	q.backoff = time.Millisecond
+	q.Start(context.Background())
+	defer q.Close()
+
+	q.Dispatch(context.Background(), newQueueEvents("a", "b"))
+	if got := s.waitMessages(t, 2); !equalStrings(got, []string{"a", "b"}) {
+		t.Fatalf("wrong events dispatched: %v", got)
+	}
+	if m := q.metrics().(map[string]interface{}); m["dispatched"] != int64(2) || m["failed"] != int64(2) {
+		t.Fatalf("wrong metrics: %v", m)
+	}
+}
+
+func Test_QueueCloseDispatchesQueued(t *testing.T) {
+	s := &sink{}
+	q, err := NewQueue(s, "test-close", QueueConfig{})
+	if err != nil {
+		t.Fatalf("failed to create queue: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Start(ctx)
+
+	// Events queued once dispatching stopped are given to the dispatcher on close.
+	cancel()
+	<-q.finished
+	q.Dispatch(context.Background(), newQueueEvents("a", "b"))
+	if err := q.Close(); err != nil {
+		t.Fatalf("failed to close queue: %s", err)
+	}
+	if got := s.waitMessages(t, 2); !equalStrings(got, []string{"a", "b"}) || !s.closed {
+		t.Fatalf("queued events not dispatched on close: %v", got)
+	}
+}
+
+func Test_QueueCopiesEvents(t *testing.T) {
+	a, b := &sink{}, &sink{}
+	qa, err := NewQueue(a, "a", QueueConfig{})
+	if err != nil {
+		t.Fatalf("failed to create queue: %s", err)
+	}
+	qb, err := NewQueue(b, "b", QueueConfig{})
+	if err != nil {
+		t.Fatalf("failed to create queue: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	qa.Start(ctx)
+	qb.Start(ctx)
+	defer qa.Close()
+	defer qb.Close()
+
+	events := newQueueEvents("Interface Gi0/1 is down")
+	qa.Dispatch(ctx, events)
+	qb.Dispatch(ctx, events)
+	a.waitMessages(t, 1)
+	b.waitMessages(t, 1)
+
+	// Each dispatcher may add fields while the event is read elsewhere.
+	a.mu.Lock()
+	a.events[0].Parsed["state"] = "down"
+	a.mu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := events[0].Parsed["state"]; ok {
+		t.Fatalf("field added by a dispatcher changed the event")
+	}
+	if _, ok := b.events[0].Parsed["state"]; ok {
+		t.Fatalf("field added by a dispatcher changed the event of another")
+	}
+}
@@ -4,46 +4,108 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
+	"time"
 
 	"github.com/streadway/amqp"
 )
 
-type Responser struct {
-	conn    *amqp.Connection
-	channel *amqp.Channel
+// publishing defaults
+const (
+	DefaultOutboxSize = 10000 // messages waiting to be published
+	maxInFlight       = 256   // messages published but not yet confirmed
+	minBackoff        = time.Second
+	maxBackoff        = 30 * time.Second
+	closeTimeout      = 10 * time.Second // to publish and confirm messages on close
+)
+
+// publisher publishes messages to a broker in confirm mode.
+type publisher interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	NotifyPublish(c chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
 
+// Responser publishes messages to an exchange. Messages are queued in a bounded
+// outbox, and published persistently by a goroutine which reconnects, with backoff,
+// whenever the connection fails. Messages not confirmed by the broker are published
+// again after reconnecting. When closed, the messages left are published and
+// confirmed, for up to a timeout.
+type Responser struct {
 	uri          string
 	exchangeName string
 	exchangeType string
+	triggers     map[string]Trigger
+
+	dial         func() (publisher, error)
+	outbox       chan *message
+	closeTimeout time.Duration
+
+	done     chan struct{} // closed to publish the messages left, and stop
+	expired  chan struct{} // closed when the close timeout passes
+	finished chan struct{}
 }
 
-func NewResponser(d DispatcherInstance) (*Responser, error) {
+// message is a message waiting to be published, or confirmed.
+type message struct {
+	routingKey string
+	typeID     string
+	body       []byte
+}
 
+func NewResponser(d DispatcherInstance) (*Responser, error) {
+	if _, err := amqp.ParseURI(d.URI); err != nil {
+		return nil, fmt.Errorf("uri: %s", err)
+	}
+	size := d.OutboxSize
+	if size <= 0 {
+		size = DefaultOutboxSize
+	}
 	r := &Responser{
-		conn:    nil,
-		channel: nil,
-
+		uri:          d.URI,
 		exchangeName: d.Exchange,
 		exchangeType: d.ExchangeType,
-		uri:          d.URI,
+		triggers:     d.Triggers,
+
+		outbox:       make(chan *message, size),
+		closeTimeout: closeTimeout,
+
+		done:     make(chan struct{}),
+		expired:  make(chan struct{}),
+		finished: make(chan struct{}),
 	}
+	r.dial = r.dialAMQP
+	go r.run()
+	return r, nil
+}
 
-	var err error
-	log.Printf("Dialing %q\n", r.uri)
-	r.conn, err = amqp.Dial(r.uri)
+// dialAMQP connects to the broker, declares the exchange and trigger queues, and
+// puts a channel in confirm mode.
+func (s *Responser) dialAMQP() (publisher, error) {
+	log.Printf("Dialing %q\n", s.uri)
+	conn, err := amqp.Dial(s.uri)
 	if err != nil {
 		return nil, fmt.Errorf("dial: %s", err)
 	}
+	p, err := s.declare(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return p, nil
+}
 
-	r.channel, err = r.conn.Channel()
+func (s *Responser) declare(conn *amqp.Connection) (publisher, error) {
+	channel, err := conn.Channel()
 	if err != nil {
 		return nil, fmt.Errorf("channel: %s", err)
 	}
 
-	log.Printf("got Channel, declaring %q Exchange (%q)\n", r.exchangeType, r.exchangeName)
-	if err := r.channel.ExchangeDeclare(
-		r.exchangeName, // name
-		r.exchangeType, // type
+	log.Printf("got Channel, declaring %q Exchange (%q)\n", s.exchangeType, s.exchangeName)
+	if err := channel.ExchangeDeclare(
+		s.exchangeName, // name
+		s.exchangeType, // type
 		true,           // durable
 		false,          // auto-deleted
 		false,          // internal
@@ -54,8 +116,8 @@ func NewResponser(d DispatcherInstance) (*Responser, error) {
 	}
 
 	// declare trigger queues
-	for _, v := range d.Triggers {
-		queue, err := r.channel.QueueDeclare(
+	for _, v := range s.triggers {
+		queue, err := channel.QueueDeclare(
 			v.Queue,
 			true,
 			false,
@@ -67,11 +129,11 @@ func NewResponser(d DispatcherInstance) (*Responser, error) {
 			return nil, fmt.Errorf("queue declare: %s", err)
 		}
 
-		log.Printf("Queue %s bound to Exchange %s\n", queue.Name, r.exchangeName)
-		if err = r.channel.QueueBind(
+		log.Printf("Queue %s bound to Exchange %s\n", queue.Name, s.exchangeName)
+		if err = channel.QueueBind(
 			v.Queue,        // name of the queue
 			v.RoutingKey,   // bindingKey
-			r.exchangeName, // sourceExchange
+			s.exchangeName, // sourceExchange
 			false,          // noWait
 			nil,            // arguments
 		); err != nil {
@@ -79,9 +141,23 @@ func NewResponser(d DispatcherInstance) (*Responser, error) {
 		}
 	}
 
-	return r, nil
+	if err := channel.Confirm(false); err != nil {
+		return nil, fmt.Errorf("confirm: %s", err)
+	}
+	return &amqpPublisher{Channel: channel, conn: conn}, nil
 }
 
+// amqpPublisher is a channel, closing its connection when closed.
+type amqpPublisher struct {
+	*amqp.Channel
+	conn *amqp.Connection
+}
+
+func (p *amqpPublisher) Close() error {
+	return p.conn.Close()
+}
+
+// Send queues a message for publishing. The message is dropped if the outbox is full.
 func (s *Responser) Send(response interface{}, trigger Trigger, typeId string) {
 	b, err := json.Marshal(response)
 	if err != nil {
@@ -90,23 +166,187 @@ func (s *Responser) Send(response interface{}, trigger Trigger, typeId string) {
 	}
 	log.Printf("sending message %s", string(b))
 
-	if err = s.channel.Publish(
-		s.exchangeName,     // publish to an exchange
-		trigger.RoutingKey, // routing to 0 or more queues
-		false,              // mandatory
-		false,              // immediate
-		amqp.Publishing{
-			Headers: map[string]interface{}{
-				"__TypeId__": typeId,
+	select {
+	case s.outbox <- &message{routingKey: trigger.RoutingKey, typeID: typeId, body: b}:
+	default:
+		log.Printf("outbox full, dropping message %s", string(b))
+	}
+}
+
+// Close stops publishing, once the messages in the outbox are published and
+// confirmed by the broker. Messages still not confirmed after the close timeout are
+// lost.
+func (s *Responser) Close() {
+	close(s.done)
+	select {
+	case <-s.finished:
+	case <-time.After(s.closeTimeout):
+		close(s.expired)
+		<-s.finished
+	}
+}
+
+// closing returns whether the responser is being closed.
+func (s *Responser) closing() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// lost logs the messages lost on close.
+func (s *Responser) lost(n int) {
+	if n > 0 {
+		log.Printf("closed after %s, %d messages not confirmed are lost", s.closeTimeout, n)
+	}
+}
+
+// run connects to the broker and publishes messages, until closed.
+func (s *Responser) run() {
+	defer close(s.finished)
+	var unconfirmed []*message
+	backoff := minBackoff
+	for {
+		if s.closing() && len(unconfirmed) == 0 && len(s.outbox) == 0 {
+			return
+		}
+		p, err := s.dial()
+		if err != nil {
+			log.Printf("failed to connect, retrying in %s: %s", backoff, err)
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-s.done:
+				if len(unconfirmed) > 0 || len(s.outbox) > 0 {
+					// keep trying to publish them until the close timeout
+					select {
+					case <-timer.C:
+					case <-s.expired:
+					}
+				}
+			}
+			timer.Stop()
+			select {
+			case <-s.expired:
+				s.lost(len(unconfirmed) + len(s.outbox))
+				return
+			default:
+			}
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = minBackoff
+
+		var closed bool
+		unconfirmed, closed = s.publish(p, unconfirmed)
+		p.Close()
+		if closed {
+			return
+		}
+		if len(unconfirmed) > 0 {
+			log.Printf("connection lost, %d messages will be published again", len(unconfirmed))
+		}
+	}
+}
+
+// publish publishes the unconfirmed messages of a previous connection, and then
+// those in the outbox, until the connection fails or the responser is closed and
+// every message is confirmed, or the close timeout passes. It returns the messages
+// the broker did not confirm, in order.
+func (s *Responser) publish(p publisher, retry []*message) ([]*message, bool) {
+	confirms := p.NotifyPublish(make(chan amqp.Confirmation, maxInFlight))
+	closes := p.NotifyClose(make(chan *amqp.Error, 1))
+
+	pending := make(map[uint64]*message)
+	var tag uint64
+	unconfirmed := func() []*message {
+		tags := make([]uint64, 0, len(pending))
+		for t := range pending {
+			tags = append(tags, t)
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+		msgs := make([]*message, 0, len(pending)+len(retry))
+		for _, t := range tags {
+			msgs = append(msgs, pending[t])
+		}
+		return append(msgs, retry...)
+	}
+	send := func(m *message) error {
+		tag++
+		pending[tag] = m
+		return p.Publish(
+			s.exchangeName, // publish to an exchange
+			m.routingKey,   // routing to 0 or more queues
+			false,          // mandatory
+			false,          // immediate
+			amqp.Publishing{
+				Headers: map[string]interface{}{
+					"__TypeId__": m.typeID,
+				},
+				ContentType:     "application/json",
+				ContentEncoding: "utf8",
+				Body:            m.body,
+				DeliveryMode:    amqp.Persistent, // 1=non-persistent, 2=persistent
+				Priority:        0,               // 0-9
 			},
-			ContentType:     "application/json",
-			ContentEncoding: "utf8",
-			Body:            b,
-			DeliveryMode:    amqp.Transient, // 1=non-persistent, 2=persistent
-			Priority:        0,              // 0-9
-			// a bunch of application/implementation-specific fields
-		},
-	); err != nil {
-		log.Printf("exchange publish: %s", err)
+		)
+	}
+
+	done := s.done
+	for {
+		if done == nil && len(pending) == 0 && len(retry) == 0 && len(s.outbox) == 0 {
+			return nil, true
+		}
+		// replay unconfirmed messages before taking new ones from the outbox
+		var next *message
+		var outbox chan *message
+		if len(pending) < maxInFlight {
+			if len(retry) > 0 {
+				next, retry = retry[0], retry[1:]
+			} else {
+				outbox = s.outbox
+			}
+		}
+		if next != nil {
+			if err := send(next); err != nil {
+				log.Printf("exchange publish: %s", err)
+				return unconfirmed(), false
+			}
+			continue
+		}
+
+		select {
+		case m := <-outbox:
+			if err := send(m); err != nil {
+				log.Printf("exchange publish: %s", err)
+				return unconfirmed(), false
+			}
+		case c, ok := <-confirms:
+			if !ok {
+				return unconfirmed(), false
+			}
+			m, ok := pending[c.DeliveryTag]
+			if !ok {
+				continue
+			}
+			delete(pending, c.DeliveryTag)
+			if !c.Ack {
+				log.Printf("message %d not acknowledged by broker, publishing again", c.DeliveryTag)
+				retry = append(retry, m)
+			}
+		case err := <-closes:
+			log.Printf("connection closed: %s", err)
+			return unconfirmed(), false
+		case <-done:
+			// publish the messages left before stopping
+			done = nil
+		case <-s.expired:
+			s.lost(len(pending) + len(retry) + len(s.outbox))
+			return nil, true
+		}
 	}
 }
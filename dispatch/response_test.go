@@ -0,0 +1,173 @@
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// fakePublisher is a connection to a fake broker. Its notification channels are
+// unbuffered, so that a confirmation or close has been received once sent.
+type fakePublisher struct {
+	published chan amqp.Publishing
+	confirms  chan amqp.Confirmation
+	closes    chan *amqp.Error
+}
+
+func newFakePublisher() *fakePublisher {
+	return &fakePublisher{
+		published: make(chan amqp.Publishing, 10),
+		confirms:  make(chan amqp.Confirmation),
+		closes:    make(chan *amqp.Error),
+	}
+}
+
+func (p *fakePublisher) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	p.published <- msg
+	return nil
+}
+
+func (p *fakePublisher) NotifyPublish(c chan amqp.Confirmation) chan amqp.Confirmation {
+	return p.confirms
+}
+
+func (p *fakePublisher) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	return p.closes
+}
+
+func (p *fakePublisher) Close() error {
+	return nil
+}
+
+// next returns the body of the next message published.
+func (p *fakePublisher) next(t *testing.T) string {
+	select {
+	case m := <-p.published:
+		if m.DeliveryMode != amqp.Persistent || m.Headers["__TypeId__"] != "type" {
+			t.Fatalf("wrong publishing: %+v", m)
+		}
+		return string(m.Body)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for message")
+	}
+	return ""
+}
+
+func newTestResponser(size int, conns chan *fakePublisher) *Responser {
+	r := &Responser{
+		exchangeName: "messaging",
+		outbox:       make(chan *message, size),
+		closeTimeout: 100 * time.Millisecond,
+		done:         make(chan struct{}),
+		expired:      make(chan struct{}),
+		finished:     make(chan struct{}),
+	}
+	r.dial = func() (publisher, error) {
+		return <-conns, nil
+	}
+	return r
+}
+
+func Test_ResponserReplaysUnconfirmed(t *testing.T) {
+	conns := make(chan *fakePublisher, 1)
+	r := newTestResponser(10, conns)
+	go r.run()
+	trigger := Trigger{RoutingKey: "k"}
+
+	p1 := newFakePublisher()
+	conns <- p1
+	r.Send("a", trigger, "type")
+	r.Send("b", trigger, "type")
+	r.Send("c", trigger, "type")
+	for _, exp := range []string{`"a"`, `"b"`, `"c"`} {
+		if m := p1.next(t); m != exp {
+			t.Fatalf("wrong message published, exp %s, got %s", exp, m)
+		}
+	}
+	p1.confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+	p1.closes <- amqp.ErrClosed
+
+	// Messages not confirmed are published again, in order, after reconnecting.
+	p2 := newFakePublisher()
+	conns <- p2
+	r.Send("d", trigger, "type")
+	for _, exp := range []string{`"a"`, `"c"`, `"d"`} {
+		if m := p2.next(t); m != exp {
+			t.Fatalf("wrong message published after reconnecting, exp %s, got %s", exp, m)
+		}
+	}
+
+	// Messages not acknowledged are published again.
+	p2.confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: false}
+	if m := p2.next(t); m != `"c"` {
+		t.Fatalf("wrong message published after nack, got %s", m)
+	}
+	r.Close()
+}
+
+func Test_ResponserOutboxBounded(t *testing.T) {
+	r := newTestResponser(2, nil)
+	for _, v := range []string{"a", "b", "c"} {
+		r.Send(v, Trigger{}, "type")
+	}
+	if len(r.outbox) != 2 {
+		t.Fatalf("wrong number of messages in outbox, exp 2, got %d", len(r.outbox))
+	}
+}
+
+func Test_ResponserCloseDrains(t *testing.T) {
+	conns := make(chan *fakePublisher, 1)
+	r := newTestResponser(10, conns)
+	r.closeTimeout = 5 * time.Second
+	go r.run()
+	trigger := Trigger{RoutingKey: "k"}
+
+	p := newFakePublisher()
+	conns <- p
+	r.Send("a", trigger, "type")
+	if m := p.next(t); m != `"a"` {
+		t.Fatalf("wrong message published, got %s", m)
+	}
+	r.Send("b", trigger, "type")
+
+	// Messages in the outbox are published, and waited for, when closing.
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+	if m := p.next(t); m != `"b"` {
+		t.Fatalf("outbox not published on close, got %s", m)
+	}
+	p.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	select {
+	case <-closed:
+		t.Fatalf("closed before every message was confirmed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	p.confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("not closed once every message was confirmed")
+	}
+}
+
+func Test_ResponserCloseTimeout(t *testing.T) {
+	conns := make(chan *fakePublisher, 1)
+	r := newTestResponser(10, conns)
+	go r.run()
+
+	p := newFakePublisher()
+	conns <- p
+	r.Send("a", Trigger{}, "type")
+	p.next(t)
+
+	// Messages never confirmed do not hold up closing beyond the timeout.
+	start := time.Now()
+	r.Close()
+	if d := time.Since(start); d < r.closeTimeout || d > 5*time.Second {
+		t.Fatalf("wrong time to close, %s", d)
+	}
+}
@@ -0,0 +1,163 @@
+package dispatch
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/ekanite/ekanite/input"
+	"github.com/ekanite/ekanite/query"
+)
+
+// type of the messages sent to triggers, unless a rule sets another
+const DefaultTypeID = "net.skycloud.nap.messaging.model.LogEvent"
+
+// field searched by terms of rule queries which name no field
+const ruleQueryField = "message"
+
+// filter is a compiled Filter. A nil filter matches every event.
+type filter struct {
+	equals map[string]string
+	regex  map[string]*regexp.Regexp
+	query  query.Expr
+}
+
+func compileFilter(cfg Filter) (*filter, error) {
+	f := &filter{
+		equals: cfg.Equals,
+		regex:  make(map[string]*regexp.Regexp),
+	}
+	for k, v := range cfg.Regex {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex for %s: %s", k, err)
+		}
+		f.regex[k] = re
+	}
+	if cfg.Query != "" {
+		expr, err := query.NewParser(strings.NewReader(cfg.Query), ruleQueryField).Parse()
+		if err != nil {
+			return nil, fmt.Errorf("invalid query: %s", err)
+		}
+		f.query = expr
+	}
+	return f, nil
+}
+
+// match returns whether the event matches the filter, and the named captures of
+// its regular expressions.
+func (f *filter) match(event *input.Event) (map[string]string, bool) {
+	captures := make(map[string]string)
+	if f == nil {
+		return captures, true
+	}
+	for k, v := range f.equals {
+		if p, ok := event.Parsed[k]; !ok || fmt.Sprint(p) != v {
+			return nil, false
+		}
+	}
+
+	for k, re := range f.regex {
+		p, ok := event.Parsed[k]
+		if !ok {
+			return nil, false
+		}
+		m := re.FindStringSubmatch(fmt.Sprint(p))
+		if m == nil {
+			return nil, false
+		}
+		for i, name := range re.SubexpNames() {
+			if name != "" {
+				captures[name] = m[i]
+			}
+		}
+	}
+
+	if f.query != nil {
+		row := query.Row{query.RawField: event.Text}
+		for k, v := range event.Parsed {
+			row[k] = fmt.Sprint(v)
+		}
+		if !query.Match(f.query, row) {
+			return nil, false
+		}
+	}
+	return captures, true
+}
+
+// napRule is a NapRule, compiled once.
+type napRule struct {
+	*filter
+	name    string
+	fields  map[string]string
+	trigger Trigger
+	typeID  string
+}
+
+func compileNapRules(rules []NapRule, triggers map[string]Trigger) ([]*napRule, error) {
+	compiled := make([]*napRule, 0, len(rules))
+	for _, v := range rules {
+		r, err := compileNapRule(v, triggers)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %s", v.Name, err)
+		}
+		compiled = append(compiled, r)
+	}
+	return compiled, nil
+}
+
+func compileNapRule(cfg NapRule, triggers map[string]Trigger) (*napRule, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("name required")
+	}
+	trigger, ok := triggers[cfg.Trigger]
+	if !ok {
+		return nil, fmt.Errorf("trigger '%s' not configured", cfg.Trigger)
+	}
+	if len(cfg.Equals) == 0 && len(cfg.Regex) == 0 && cfg.Query == "" {
+		return nil, fmt.Errorf("a match condition is required")
+	}
+	f, err := compileFilter(cfg.Filter)
+	if err != nil {
+		return nil, err
+	}
+	r := &napRule{
+		filter:  f,
+		name:    cfg.Name,
+		fields:  cfg.Fields,
+		trigger: trigger,
+		typeID:  cfg.TypeID,
+	}
+	if r.typeID == "" {
+		r.typeID = DefaultTypeID
+	}
+	return r, nil
+}
+
+// apply returns whether the event matches the rule, adding the captured and
+// configured fields to it if so.
+func (r *napRule) apply(event *input.Event) bool {
+	captures, ok := r.match(event)
+	if !ok {
+		return false
+	}
+	if event.Parsed == nil {
+		event.Parsed = make(map[string]interface{})
+	}
+	for k, v := range captures {
+		event.Parsed[k] = v
+	}
+	for k, v := range r.fields {
+		event.Parsed[k] = os.Expand(v, func(name string) string {
+			if c, ok := captures[name]; ok {
+				return c
+			}
+			if f, ok := event.Parsed[name]; ok {
+				return fmt.Sprint(f)
+			}
+			return ""
+		})
+	}
+	return true
+}
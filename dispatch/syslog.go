@@ -0,0 +1,292 @@
+package dispatch
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+// syslog defaults
+const (
+	DefaultSyslogFormat = "rfc5424"
+	defaultPriority     = 13 // user.notice
+	syslogTimeout       = 10 * time.Second
+
+	rfc5424Time = "2006-01-02T15:04:05.999999Z07:00"
+)
+
+// Syslog dispatcher, forwarding the events matching its filter to a downstream
+// collector. Messages are queued, and sent by a goroutine reconnecting with backoff,
+// so a slow destination does not hold up other dispatchers. When closed, the
+// messages left are sent for up to a timeout.
+type syslog struct {
+	network       string // udp, tcp or tls
+	addr          string
+	tlsConfig     *tls.Config
+	format        string
+	octetCounting bool
+	hostname      string
+	appName       string
+	filter        *filter
+
+	queue        chan []byte
+	pending      []byte   // message being sent when sending stopped
+	conn         net.Conn // used by run, then by Close once run has returned
+	closeTimeout time.Duration
+	cancel       context.CancelFunc // stops run
+	finished     chan struct{}      // closed when run returns
+}
+
+func NewSyslogDispatcher(config DispatcherInstance) (Dispatcher, error) {
+	u, err := url.Parse(config.URI)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("uri must be udp://, tcp:// or tls:// and an address")
+	}
+	s := &syslog{
+		network:  u.Scheme,
+		addr:     u.Host,
+		format:   strings.ToLower(config.Format),
+		hostname: config.Hostname,
+		appName:  config.AppName,
+	}
+	if s.format == "" {
+		s.format = DefaultSyslogFormat
+	}
+	if s.format != "rfc5424" && s.format != "rfc3164" {
+		return nil, fmt.Errorf("format %s not valid", config.Format)
+	}
+
+	switch s.network {
+	case "udp":
+	case "tcp", "tls":
+		switch strings.ToLower(config.Framing) {
+		case "octet-counting":
+			s.octetCounting = true
+		case "", "newline":
+		default:
+			return nil, fmt.Errorf("framing %s not valid", config.Framing)
+		}
+	default:
+		return nil, fmt.Errorf("uri must be udp://, tcp:// or tls:// and an address")
+	}
+
+	if s.network == "tls" {
+		s.tlsConfig = &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: config.Insecure}
+		if config.CA != "" {
+			pem, err := ioutil.ReadFile(config.CA)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA: %s", err)
+			}
+			s.tlsConfig.RootCAs = x509.NewCertPool()
+			if !s.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in CA %s", config.CA)
+			}
+		}
+	}
+	if config.Filter != nil {
+		if s.filter, err = compileFilter(*config.Filter); err != nil {
+			return nil, err
+		}
+	}
+
+	size := config.OutboxSize
+	if size <= 0 {
+		size = DefaultOutboxSize
+	}
+	s.queue = make(chan []byte, size)
+	s.closeTimeout = closeTimeout
+	s.finished = make(chan struct{})
+	return s, nil
+}
+
+// Start starts sending queued messages.
+func (s *syslog) Start(ctx context.Context) error {
+	ctx, s.cancel = context.WithCancel(ctx)
+	go s.run(ctx)
+	return nil
+}
+
+func (s *syslog) Dispatch(ctx context.Context, events []*input.Event) error {
+	for _, v := range events {
+		s.do(v)
+	}
+	return nil
+}
+
+// do queues the event for forwarding if it matches the filter. The event is dropped
+// if the queue is full.
+func (s *syslog) do(event *input.Event) error {
+	if _, ok := s.filter.match(event); !ok {
+		return nil
+	}
+	select {
+	case s.queue <- s.frame(s.line(event)):
+	default:
+		stats.Add("syslogDropped", 1)
+	}
+	return nil
+}
+
+// line returns the event formatted as a syslog message.
+func (s *syslog) line(event *input.Event) string {
+	fields, t := document(event)
+	pri, ok := event.Priority()
+	if !ok {
+		pri = defaultPriority
+	}
+	host, app := event.Host(), event.App()
+	if s.hostname != "" {
+		host = expandFields(s.hostname, fields)
+	}
+	if s.appName != "" {
+		app = expandFields(s.appName, fields)
+	}
+	msg := event.Message()
+
+	if s.format == "rfc3164" {
+		if app == "" {
+			return fmt.Sprintf("<%d>%s %s %s", pri, t.Format(time.Stamp), headerField(host, "-"), msg)
+		}
+		return fmt.Sprintf("<%d>%s %s %s: %s", pri, t.Format(time.Stamp), headerField(host, "-"), headerField(app, "-"), msg)
+	}
+
+	procID := ""
+	if pid, ok := event.Parsed["pid"]; ok {
+		procID = fmt.Sprint(pid)
+	}
+	msgID, _ := event.Parsed["message_id"].(string)
+	return fmt.Sprintf("<%d>1 %s %s %s %s %s - %s", pri, t.Format(rfc5424Time),
+		headerField(host, "-"), headerField(app, "-"), headerField(procID, "-"), headerField(msgID, "-"), msg)
+}
+
+// headerField returns a field of a syslog header, without spaces, or nilValue if empty.
+func headerField(v, nilValue string) string {
+	if v == "" {
+		return nilValue
+	}
+	return strings.Replace(v, " ", "_", -1)
+}
+
+// frame returns the message framed for the transport. Messages sent over TCP or TLS
+// are prefixed with their length, or terminated by a newline, replacing any within.
+func (s *syslog) frame(line string) []byte {
+	switch {
+	case s.network == "udp":
+		return []byte(line)
+	case s.octetCounting:
+		return []byte(strconv.Itoa(len(line)) + " " + line)
+	default:
+		return []byte(strings.Replace(line, "\n", " ", -1) + "\n")
+	}
+}
+
+// run sends queued messages to the destination until ctx is done, keeping the
+// message it was sending for Close.
+func (s *syslog) run(ctx context.Context) {
+	defer close(s.finished)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-s.queue:
+			if !s.send(ctx, msg) {
+				s.pending = msg
+				return
+			}
+		}
+	}
+}
+
+// send sends the message, reconnecting with backoff whenever sending fails, until it
+// is sent or ctx is done. It returns whether the message was sent.
+func (s *syslog) send(ctx context.Context, msg []byte) bool {
+	backoff := minBackoff
+	for {
+		if s.conn == nil {
+			c, err := s.dial(ctx)
+			if err != nil {
+				log.Printf("[syslog] failed to connect to %s, retrying in %s: %s", s.addr, backoff, err)
+				timer := time.NewTimer(backoff)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return false
+				}
+				if backoff *= 2; backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+				continue
+			}
+			s.conn, backoff = c, minBackoff
+		}
+		deadline := time.Now().Add(syslogTimeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		s.conn.SetWriteDeadline(deadline)
+		if _, err := s.conn.Write(msg); err != nil {
+			log.Printf("[syslog] failed to send to %s: %s", s.addr, err)
+			s.conn.Close()
+			s.conn = nil
+			if ctx.Err() != nil {
+				return false
+			}
+			continue
+		}
+		stats.Add("syslogForwarded", 1)
+		return true
+	}
+}
+
+func (s *syslog) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogTimeout}
+	if s.network == "tls" {
+		return (&tls.Dialer{NetDialer: dialer, Config: s.tlsConfig}).DialContext(ctx, "tcp", s.addr)
+	}
+	return dialer.DialContext(ctx, s.network, s.addr)
+}
+
+// Close stops sending, then sends the messages still queued, for up to a timeout.
+// Messages left after the timeout are lost.
+func (s *syslog) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+		<-s.finished
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.closeTimeout)
+	defer cancel()
+	if s.pending != nil && s.send(ctx, s.pending) {
+		s.pending = nil
+	}
+	for s.pending == nil && len(s.queue) > 0 {
+		if msg := <-s.queue; !s.send(ctx, msg) {
+			s.pending = msg
+		}
+	}
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	n := len(s.queue)
+	if s.pending != nil {
+		n++
+	}
+	if n > 0 {
+		log.Printf("[syslog] closed after %s, %d messages not sent are lost", s.closeTimeout, n)
+		stats.Add("syslogDropped", int64(n))
+		return fmt.Errorf("%d messages not sent to %s", n, s.addr)
+	}
+	return nil
+}
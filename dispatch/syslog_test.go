@@ -0,0 +1,187 @@
+package dispatch
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+// syslogFields are the fields of the events forwarded, besides those of every test
+// event.
+var syslogFields = []interface{}{"priority", 189, "app", "link", "pid", 42, "message_id", "UPDOWN", "interface", "Gi0/1"}
+
+func Test_SyslogTCPOctetCounting(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer ln.Close()
+
+	d := newTestDispatcher(t, NewSyslogDispatcher, DispatcherInstance{
+		URI:     "tcp://" + ln.Addr().String(),
+		Framing: "octet-counting",
+		Filter:  &Filter{Query: "down"},
+	})
+	d.Start(context.Background())
+	defer d.Close()
+	d.Dispatch(context.Background(), []*input.Event{newTestEvent("link up", syslogFields...), newTestEvent("link down", syslogFields...)})
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	prefix, err := r.ReadString(' ')
+	if err != nil {
+		t.Fatalf("failed to read frame: %s", err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(prefix))
+	if err != nil {
+		t.Fatalf("invalid frame length %q", prefix)
+	}
+	msg := make([]byte, n)
+	if _, err := r.Read(msg); err != nil {
+		t.Fatalf("failed to read message: %s", err)
+	}
+	if exp := "<189>1 1982-02-05T04:00:00Z router1 link 42 UPDOWN - link down"; string(msg) != exp {
+		t.Fatalf("wrong message, exp %q, got %q", exp, msg)
+	}
+}
+
+func Test_SyslogUDPRewrite(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer pc.Close()
+
+	d := newTestDispatcher(t, NewSyslogDispatcher, DispatcherInstance{
+		URI:      "udp://" + pc.LocalAddr().String(),
+		Format:   "rfc3164",
+		Hostname: "nap-${host}",
+		AppName:  "$interface",
+	})
+	d.Start(context.Background())
+	defer d.Close()
+	d.Dispatch(context.Background(), []*input.Event{newTestEvent("link down", syslogFields...)})
+
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1024)
+	n, _, err := pc.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("failed to read message: %s", err)
+	}
+	if exp := "<189>Feb  5 04:00:00 nap-router1 Gi0/1: link down"; string(b[:n]) != exp {
+		t.Fatalf("wrong message, exp %q, got %q", exp, b[:n])
+	}
+}
+
+func Test_SyslogFraming(t *testing.T) {
+	s := &syslog{network: "tcp"}
+	if got := string(s.frame("a\nb")); got != "a b\n" {
+		t.Fatalf("wrong newline framing, got %q", got)
+	}
+	s.octetCounting = true
+	if got := string(s.frame("a\nb")); got != "3 a\nb" {
+		t.Fatalf("wrong octet-counting framing, got %q", got)
+	}
+}
+
+func Test_SyslogQueueFull(t *testing.T) {
+	// Nothing listens on the address, so the sender holds the first message.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	d := newTestDispatcher(t, NewSyslogDispatcher, DispatcherInstance{URI: "tcp://" + addr, OutboxSize: 1})
+	d.(*syslog).closeTimeout = 10 * time.Millisecond
+	d.Start(context.Background())
+	defer d.Close()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			d.Dispatch(context.Background(), []*input.Event{newTestEvent("link down", syslogFields...)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("dispatch blocked on an unavailable destination")
+	}
+}
+
+func Test_SyslogCloseSendsQueued(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer ln.Close()
+
+	// Messages queued once sending has stopped are sent on close.
+	d := newTestDispatcher(t, NewSyslogDispatcher, DispatcherInstance{URI: "tcp://" + ln.Addr().String()})
+	ctx, cancel := context.WithCancel(context.Background())
+	d.Start(ctx)
+	cancel()
+	<-d.(*syslog).finished
+	d.Dispatch(context.Background(), []*input.Event{newTestEvent("link down", syslogFields...), newTestEvent("link up", syslogFields...)})
+	if err := d.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, exp := range []string{"link down", "link up"} {
+		l, err := r.ReadString('\n')
+		if err != nil || !strings.HasSuffix(l, " - "+exp+"\n") {
+			t.Fatalf("wrong message sent on close, exp %q, got %q (%v)", exp, l, err)
+		}
+	}
+}
+
+func Test_SyslogCloseTimeout(t *testing.T) {
+	// Nothing listens on the address, so the messages cannot be sent.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	d := newTestDispatcher(t, NewSyslogDispatcher, DispatcherInstance{URI: "tcp://" + addr})
+	d.(*syslog).closeTimeout = 50 * time.Millisecond
+	d.Dispatch(context.Background(), []*input.Event{newTestEvent("link down", syslogFields...), newTestEvent("link up", syslogFields...)})
+	if err := d.Close(); err == nil || !strings.Contains(err.Error(), "2 messages not sent") {
+		t.Fatalf("lost messages not reported: %v", err)
+	}
+}
+
+func Test_SyslogInvalidConfig(t *testing.T) {
+	for _, config := range []DispatcherInstance{
+		{},
+		{URI: "http://localhost:514"},
+		{URI: "udp://localhost:514", Format: "rfc9999"},
+		{URI: "tcp://localhost:514", Framing: "nul"},
+		{URI: "tls://localhost:6514", CA: "/nonexistent/ca.pem"},
+	} {
+		if _, err := NewSyslogDispatcher(config); err == nil {
+			t.Errorf("invalid config %+v accepted", config)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package dispatch
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+// webhook defaults
+const (
+	DefaultWebhookTimeout = 10 * time.Second
+	DefaultWebhookRetries = 3
+
+	// header holding the HMAC-SHA256 of the request body, as sha256=HEX
+	SignatureHeader = "X-Ekanite-Signature"
+)
+
+// functions available to payload templates
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// Webhook dispatcher, posting the events matching its filter to URLs. Payloads are
+// rendered for each event, or for each batch of events if the batch size is more
+// than 1.
+type webhook struct {
+	urls          []string
+	filter        *filter
+	template      *template.Template
+	payload       map[string]interface{}
+	headers       map[string]string
+	secret        []byte
+	retries       int
+	batchSize     int
+	flushInterval time.Duration
+	backoff       time.Duration // before the first retry, doubling with each
+
+	client  *http.Client
+	mu      sync.Mutex // guards batch
+	batch   []map[string]interface{}
+	flushMu sync.Mutex    // serializes flushes, so that batches are posted in order
+	done    chan struct{} // closed when closing, abandoning retries
+}
+
+func NewWebhookDispatcher(config DispatcherInstance) (Dispatcher, error) {
+	if len(config.URLs) == 0 {
+		return nil, fmt.Errorf("urls required")
+	}
+	for _, v := range config.URLs {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("url %s must be an http or https URL", v)
+		}
+	}
+	if config.Template != "" && config.Payload != nil {
+		return nil, fmt.Errorf("only one of template and payload may be set")
+	}
+
+	s := &webhook{
+		urls:          config.URLs,
+		payload:       config.Payload,
+		headers:       config.Headers,
+		secret:        []byte(config.Secret),
+		retries:       config.Retries,
+		batchSize:     config.BatchSize,
+		flushInterval: DefaultFlushInterval,
+		backoff:       minBackoff,
+		client:        &http.Client{Timeout: DefaultWebhookTimeout},
+		done:          make(chan struct{}),
+	}
+	if s.retries == 0 {
+		s.retries = DefaultWebhookRetries
+	} else if s.retries < 0 {
+		s.retries = 0
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = 1
+	}
+	var err error
+	if config.Template != "" {
+		if s.template, err = template.New("payload").Funcs(templateFuncs).Parse(config.Template); err != nil {
+			return nil, fmt.Errorf("invalid template: %s", err)
+		}
+	}
+	if config.Timeout != "" {
+		if s.client.Timeout, err = time.ParseDuration(config.Timeout); err != nil || s.client.Timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout '%s'", config.Timeout)
+		}
+	}
+	if config.FlushInterval != "" {
+		if s.flushInterval, err = time.ParseDuration(config.FlushInterval); err != nil || s.flushInterval <= 0 {
+			return nil, fmt.Errorf("invalid flush interval '%s'", config.FlushInterval)
+		}
+	}
+	if config.Filter != nil {
+		if s.filter, err = compileFilter(*config.Filter); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *webhook) Start(ctx context.Context) error {
+	go func() {
+		ticker := time.NewTicker(s.flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.flush(ctx)
+			}
+		}
+	}()
+	return nil
+}
+
+// Dispatch adds the events to the batch, flushing it whenever it is full. It fails
+// if a flush fails after its retries, so that the queue retries the events.
+func (s *webhook) Dispatch(ctx context.Context, events []*input.Event) error {
+	for _, v := range events {
+		s.mu.Lock()
+		s.do(v)
+		full := len(s.batch) >= s.batchSize
+		s.mu.Unlock()
+		if full {
+			if err := s.flush(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// do adds the event to the batch if it matches the filter.
+func (s *webhook) do(event *input.Event) {
+	if _, ok := s.filter.match(event); !ok {
+		return
+	}
+	doc, _ := document(event)
+	s.batch = append(s.batch, doc)
+}
+
+// flush posts the batch to every URL, in payloads of up to the batch size. Events
+// are still added to the batch while flushing. If ctx is done while backing off,
+// the events left are returned to the batch, to be posted by Close. Otherwise
+// payloads which fail are dropped, and the last failure which may be temporary is
+// returned.
+func (s *webhook) flush(ctx context.Context) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	docs := s.batch
+	s.batch = nil
+	s.mu.Unlock()
+
+	var err error
+	for len(docs) > 0 {
+		n := s.batchSize
+		if n > len(docs) {
+			n = len(docs)
+		}
+		var data interface{} = docs[:n]
+		if s.batchSize == 1 {
+			data = docs[0]
+		}
+		body, e := s.render(data)
+		if e != nil {
+			log.Printf("[webhook] failed to render payload: %s", e)
+			stats.Add("webhookFailed", 1)
+			docs = docs[n:]
+			continue
+		}
+		for _, v := range s.urls {
+			temporary, e := s.post(ctx, v, body)
+			if e == nil {
+				continue
+			}
+			if ctx.Err() != nil && !s.closing() {
+				s.mu.Lock()
+				s.batch = append(docs, s.batch...)
+				s.mu.Unlock()
+				return nil
+			}
+			log.Printf("[webhook] failed to post to %s: %s", v, e)
+			stats.Add("webhookFailed", 1)
+			if temporary {
+				err = fmt.Errorf("failed to post to %s: %s", v, e)
+			}
+		}
+		docs = docs[n:]
+	}
+	return err
+}
+
+// closing returns whether the dispatcher is closing.
+func (s *webhook) closing() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// render returns the payload for an event, or a batch of events.
+func (s *webhook) render(data interface{}) ([]byte, error) {
+	if s.template != nil {
+		var b bytes.Buffer
+		if err := s.template.Execute(&b, data); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+	if s.payload == nil {
+		return json.Marshal(data)
+	}
+	if batch, ok := data.([]map[string]interface{}); ok {
+		payloads := make([]interface{}, len(batch))
+		for i, v := range batch {
+			payloads[i] = expandPayload(s.payload, v)
+		}
+		return json.Marshal(payloads)
+	}
+	return json.Marshal(expandPayload(s.payload, data.(map[string]interface{})))
+}
+
+// expandPayload returns the payload mapping with fields, referred to as $name or
+// ${name}, expanded in every string.
+func expandPayload(v interface{}, fields map[string]interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return expandFields(v, fields)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = expandPayload(e, fields)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = expandPayload(e, fields)
+		}
+		return a
+	}
+	return v
+}
+
+// expandFields returns s with fields, referred to as $name or ${name}, expanded.
+func expandFields(s string, fields map[string]interface{}) string {
+	return os.Expand(s, func(name string) string {
+		if f, ok := fields[name]; ok {
+			return fmt.Sprint(f)
+		}
+		return ""
+	})
+}
+
+// post posts the body to the URL, retrying with backoff after failures which may
+// be temporary. Retries are abandoned if ctx is done or the dispatcher is closing.
+// It returns whether a failure may be temporary.
+func (s *webhook) post(ctx context.Context, u string, body []byte) (bool, error) {
+	backoff := s.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.request(ctx, u, body)
+		if err == nil {
+			stats.Add("webhookPosted", 1)
+			return false, nil
+		}
+		if !retry || attempt == s.retries {
+			return retry, err
+		}
+		log.Printf("[webhook] post to %s failed, retrying in %s: %s", u, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return true, err
+		case <-s.done:
+			timer.Stop()
+			return true, err
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// request posts the body once, returning whether a failure may be temporary.
+func (s *webhook) request(ctx context.Context, u string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	if len(s.secret) > 0 {
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(b))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+// Close posts the batch, without retrying, and abandons the retries of any flush in
+// progress.
+func (s *webhook) Close() error {
+	close(s.done)
+	return s.flush(context.Background())
+}
@@ -0,0 +1,187 @@
+package dispatch
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+func newTestWebhook(t *testing.T, config DispatcherInstance, statuses ...int) (*webhook, *testServer, func()) {
+	ws, stop := newTestServer(statuses...)
+	config.URLs = []string{ws.url + "/hook"}
+	s := newTestDispatcher(t, NewWebhookDispatcher, config).(*webhook)
+	s.backoff = time.Millisecond
+	return s, ws, stop
+}
+
+func Test_WebhookTemplate(t *testing.T) {
+	s, ws, stop := newTestWebhook(t, DispatcherInstance{
+		Template: `{"text": {{json (printf "%s: %s" .host .message)}}}`,
+		Headers:  map[string]string{"Authorization": "Bearer t"},
+		Secret:   "s3cret",
+		Filter:   &Filter{Query: "down"},
+	})
+	defer stop()
+
+	s.Dispatch(context.Background(), []*input.Event{newTestEvent(`link "Gi0/1" down`)})
+	s.Dispatch(context.Background(), []*input.Event{newTestEvent("link up")})
+
+	if len(ws.bodies) != 1 {
+		t.Fatalf("wrong number of requests, exp 1, got %d", len(ws.bodies))
+	}
+	if exp := `{"text": "router1: link \"Gi0/1\" down"}`; ws.bodies[0] != exp {
+		t.Fatalf("wrong payload, exp %s, got %s", exp, ws.bodies[0])
+	}
+	h := ws.headers[0]
+	if h.Get("Authorization") != "Bearer t" || h.Get("Content-Type") != "application/json" {
+		t.Fatalf("wrong headers: %v", h)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(ws.bodies[0]))
+	if exp := "sha256=" + hex.EncodeToString(mac.Sum(nil)); h.Get(SignatureHeader) != exp {
+		t.Fatalf("wrong signature, exp %s, got %s", exp, h.Get(SignatureHeader))
+	}
+}
+
+func Test_WebhookPayloadBatch(t *testing.T) {
+	s, ws, stop := newTestWebhook(t, DispatcherInstance{
+		BatchSize: 2,
+		Payload: map[string]interface{}{
+			"routing_key":  "key",
+			"event_action": "trigger",
+			"payload": map[string]interface{}{
+				"summary": "${message} on ${host}",
+				"source":  "$host",
+			},
+		},
+	})
+	defer stop()
+
+	s.Dispatch(context.Background(), []*input.Event{newTestEvent("link down")})
+	if len(ws.bodies) != 0 {
+		t.Fatalf("partial batch posted")
+	}
+	s.Dispatch(context.Background(), []*input.Event{newTestEvent("link up", "host", "router2")})
+	if len(ws.bodies) != 1 {
+		t.Fatalf("wrong number of requests, exp 1, got %d", len(ws.bodies))
+	}
+
+	var payloads []struct {
+		RoutingKey string            `json:"routing_key"`
+		Payload    map[string]string `json:"payload"`
+	}
+	if err := json.Unmarshal([]byte(ws.bodies[0]), &payloads); err != nil {
+		t.Fatalf("invalid payload %s: %s", ws.bodies[0], err)
+	}
+	if len(payloads) != 2 || payloads[0].RoutingKey != "key" || payloads[1].Payload["summary"] != "link up on router2" || payloads[1].Payload["source"] != "router2" {
+		t.Fatalf("wrong payload: %s", ws.bodies[0])
+	}
+}
+
+func Test_WebhookRetries(t *testing.T) {
+	s, ws, stop := newTestWebhook(t, DispatcherInstance{Retries: 2},
+		http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK, http.StatusBadRequest)
+	defer stop()
+
+	// Temporary failures are retried.
+	if err := s.Dispatch(context.Background(), []*input.Event{newTestEvent("link down")}); err != nil {
+		t.Fatalf("failed to dispatch after retries: %s", err)
+	}
+	if len(ws.bodies) != 3 {
+		t.Fatalf("wrong number of requests, exp 3, got %d", len(ws.bodies))
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(ws.bodies[2]), &doc); err != nil || doc["raw"] != "link down" || doc["@timestamp"] != "1982-02-05T04:00:00Z" {
+		t.Fatalf("wrong default payload: %s", ws.bodies[2])
+	}
+
+	// Other failures are not, nor are they retried by the queue.
+	if err := s.Dispatch(context.Background(), []*input.Event{newTestEvent("link up")}); err != nil {
+		t.Fatalf("permanent failure reported to the queue: %s", err)
+	}
+	if len(ws.bodies) != 4 {
+		t.Fatalf("wrong number of requests, exp 4, got %d", len(ws.bodies))
+	}
+
+	// Temporary failures left after the retries are reported, so that the queue
+	// retries the events.
+	ws.statuses = []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable}
+	if err := s.Dispatch(context.Background(), []*input.Event{newTestEvent("link down")}); err == nil {
+		t.Fatalf("failure after retries not reported")
+	}
+	if len(ws.bodies) != 7 {
+		t.Fatalf("wrong number of requests, exp 7, got %d", len(ws.bodies))
+	}
+}
+
+func Test_WebhookBackoffInterrupted(t *testing.T) {
+	s, ws, stop := newTestWebhook(t, DispatcherInstance{},
+		http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	defer stop()
+	s.backoff = time.Hour
+
+	// Cancelling the context stops backing off, keeping the events for Close, and
+	// events are still added to the batch meanwhile.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Dispatch(ctx, []*input.Event{newTestEvent("link down")})
+		close(done)
+	}()
+	for i := 0; ; i++ {
+		ws.mu.Lock()
+		n := ws.requests
+		ws.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if i == 500 {
+			t.Fatalf("timed out waiting for post")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.mu.Lock()
+	s.do(newTestEvent("link up"))
+	s.mu.Unlock()
+	cancel()
+	<-done
+	if len(s.batch) != 2 {
+		t.Fatalf("wrong number of events kept, exp 2, got %d", len(s.batch))
+	}
+
+	// Close tries each payload once, without backing off.
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("close blocked by backoff")
+	}
+	if ws.requests != 3 {
+		t.Fatalf("wrong number of requests on close, exp 3, got %d", ws.requests)
+	}
+}
+
+func Test_WebhookInvalidConfig(t *testing.T) {
+	for _, config := range []DispatcherInstance{
+		{},
+		{URLs: []string{"ftp://hooks"}},
+		{URLs: []string{"http://hooks"}, Template: "{{.host", Payload: nil},
+		{URLs: []string{"http://hooks"}, Template: "x", Payload: map[string]interface{}{"a": "b"}},
+		{URLs: []string{"http://hooks"}, Timeout: "soon"},
+	} {
+		if _, err := NewWebhookDispatcher(config); err == nil {
+			t.Errorf("invalid config %+v accepted", config)
+		}
+	}
+}
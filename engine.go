@@ -1,6 +1,7 @@
 package ekanite
 
 import (
+	"context"
 	"expvar"
 	"fmt"
 	"log"
@@ -23,6 +24,9 @@ const (
 
 	RetentionCheckInterval = time.Hour
 	DefaultMaxNextChanSize = 1000000
+
+	DefaultQueryTimeout         = time.Minute
+	DefaultMaxConcurrentQueries = 8
 )
 
 // Engine stats
@@ -46,7 +50,9 @@ type Batcher struct {
 
 	c chan *input.Event
 
-	pipes []chan []*input.Event
+	dispatchMu  sync.Mutex // serializes dispatch
+	dispatchers []dispatch.Dispatcher
+	tailer      *Tailer
 
 	e chan<- error
 }
@@ -59,16 +65,9 @@ func NewBatcher(e EventIndexer, sz int, dur time.Duration, max int) *Batcher {
 		size:     sz,
 		duration: dur,
 		c:        make(chan *input.Event, max),
-		pipes:    make([]chan []*input.Event, 0),
 	}
 }
 
-func (b *Batcher) pipe(next chan []*input.Event) chan []*input.Event {
-	// next should be made
-	b.pipes = append(b.pipes, next)
-	return next
-}
-
 // Start starts the batching process.
 func (b *Batcher) Start(errChan chan<- error) error {
 	b.e = errChan
@@ -77,7 +76,16 @@ func (b *Batcher) Start(errChan chan<- error) error {
 		timer := time.NewTimer(b.duration)
 		timer.Stop() // Stop any first firing.
 
+		dispatched := 0 // events of the batch dispatched, if indexing it failed
 		send := func() {
+			// dispatch, whether or not the batch is indexed
+			events := make([]*input.Event, 0, len(batch)-dispatched)
+			for _, event := range batch[dispatched:] {
+				events = append(events, event.Event)
+			}
+			b.Dispatch(events)
+			dispatched = len(batch)
+
 			err := b.indexer.Index(batch)
 			if err != nil {
 				stats.Add("batchIndexedError", 1)
@@ -88,21 +96,9 @@ func (b *Batcher) Start(errChan chan<- error) error {
 			if errChan != nil {
 				errChan <- err
 			}
-			// dispatch
-			events := make([]*input.Event, 0)
-			for _, event := range batch {
-				events = append(events, event.Event)
-			}
-			for _, pipe := range b.pipes {
-				go func(p chan []*input.Event) {
-					select {
-					case p <- events:
-						break
-					default:
-						// ignore
-						stats.Add("dispatchEventFailed", int64(len(batch)))
-					}
-				}(pipe)
+			dispatched = 0
+			if b.tailer != nil {
+				b.tailer.Publish(batch)
 			}
 			batch = make([]*Event, 0, b.size)
 		}
@@ -131,6 +127,19 @@ func (b *Batcher) Start(errChan chan<- error) error {
 	return nil
 }
 
+// Dispatch sends events to every dispatcher, without indexing them. Dispatchers
+// created from a configuration file queue the events, so Dispatch only waits for
+// those whose queue is full with the block overflow policy.
+func (b *Batcher) Dispatch(events []*input.Event) {
+	b.dispatchMu.Lock()
+	defer b.dispatchMu.Unlock()
+	for _, d := range b.dispatchers {
+		if err := d.Dispatch(context.Background(), events); err != nil {
+			stats.Add("dispatchEventFailed", int64(len(events)))
+		}
+	}
+}
+
 // C returns the channel on the batcher to which events should be sent.
 func (b *Batcher) C() chan<- *input.Event {
 	return b.c
@@ -140,11 +149,16 @@ func (b *Batcher) E() chan<- error {
 	return b.e
 }
 
-// add dispatcher
+// Tail sends every indexed event to the given Tailer. It must be called before Start.
+func (b *Batcher) Tail(t *Tailer) {
+	b.tailer = t
+}
+
+// Add sends events to a started dispatcher.
 func (b *Batcher) Add(d dispatch.Dispatcher) {
-	go func() {
-		d.Listen(b.pipe(make(chan []*input.Event)))
-	}()
+	b.dispatchMu.Lock()
+	defer b.dispatchMu.Unlock()
+	b.dispatchers = append(b.dispatchers, d)
 }
 
 // Engine is the component that performs all indexing.
@@ -154,9 +168,15 @@ type Engine struct {
 	IndexDuration   time.Duration // Duration of created indexes.
 	RetentionPeriod time.Duration // How long after Index end-time to hang onto data.
 
+	QueryTimeout         time.Duration // Maximum duration of a query, including time queued. Zero is unlimited.
+	MaxConcurrentQueries int           // Maximum number of queries run at once. Zero is unlimited.
+
 	mu      sync.RWMutex
 	indexes Indexes
 
+	semOnce  sync.Once
+	querySem chan struct{} // Holds a token for every running query.
+
 	open bool
 	done chan struct{}
 	wg   sync.WaitGroup
@@ -171,8 +191,12 @@ func NewEngine(path string) *Engine {
 		NumShards:       DefaultNumShards,
 		IndexDuration:   DefaultIndexDuration,
 		RetentionPeriod: DefaultRetentionPeriod,
-		done:            make(chan struct{}),
-		Logger:          log.New(os.Stderr, "[engine] ", log.LstdFlags),
+
+		QueryTimeout:         DefaultQueryTimeout,
+		MaxConcurrentQueries: DefaultMaxConcurrentQueries,
+
+		done:   make(chan struct{}),
+		Logger: log.New(os.Stderr, "[engine] ", log.LstdFlags),
 	}
 }
 
@@ -384,39 +408,294 @@ func (e *Engine) Index(events []*Event) error {
 	return nil
 }
 
-// Search performs a search.
-func (e *Engine) Search(query string) (<-chan string, error) {
+// Result is an event returned by a search, along with its indexed fields.
+type Result struct {
+	ID         DocID
+	Source     string
+	Fields     map[string]string
+	Highlights []string // Fragments of the message with matches highlighted, if requested.
+}
+
+// Time returns the reference time of the result's event.
+func (r *Result) Time() time.Time {
+	return r.ID.Time()
+}
+
+// SearchRequest describes a search.
+type SearchRequest struct {
+	Query string    // Query selecting events. Empty selects all events.
+	Start time.Time // Inclusive start of the reference time range. Zero is unbounded.
+	End   time.Time // Exclusive end of the reference time range. Zero is unbounded.
+	Limit int       // Maximum number of results. Zero is unlimited.
+
+	// Highlight is the style, "html" or "ansi", in which matches in each result's
+	// message are highlighted. Empty disables highlighting.
+	Highlight string
+}
+
+// Highlight styles
+const (
+	HighlightHTML = "html"
+	HighlightANSI = "ansi"
+)
+
+// Search performs a search. The search is abandoned if ctx is cancelled.
+func (e *Engine) Search(ctx context.Context, query string) (<-chan string, error) {
+	results, err := e.SearchResults(ctx, &SearchRequest{Query: query})
+	if err != nil {
+		return nil, err
+	}
+
+	// Buffer channel to control how many docs are sent back.
+	c := make(chan string, 1)
+	go func() {
+		defer close(c)
+		for r := range results.C {
+			select {
+			case c <- r.Source:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+// Results are the results of a search, sent on C in reference time order.
+type Results struct {
+	C <-chan *Result
+
+	err error // set before C is closed
+}
+
+// Err returns the error which ended the search before every result was sent, such
+// as context.DeadlineExceeded if the query timed out. It must only be called once C
+// is closed, and is nil if the search completed or reached its limit.
+func (r *Results) Err() error {
+	return r.err
+}
+
+// SearchResults performs a search, returning each matching event along with its
+// indexed fields, in reference time order. The search is abandoned, and the channel
+// closed, if ctx is cancelled or the query times out, or an index fails to be
+// searched, which Err reports. Callers must either read the channel until it is
+// closed or cancel ctx.
+func (e *Engine) SearchResults(ctx context.Context, req *SearchRequest) (*Results, error) {
+	stats.Add("queriesRx", 1)
+	if req.Highlight != "" && req.Highlight != HighlightHTML && req.Highlight != HighlightANSI {
+		return nil, fmt.Errorf("unsupported highlight style '%s'", req.Highlight)
+	}
+	if err := validateQuery(req.Query); err != nil {
+		return nil, err
+	}
+	ctx, done, err := e.beginQuery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	e.mu.RLock()
 	defer e.mu.RUnlock()
-	stats.Add("queriesRx", 1)
 
 	// Buffer channel to control how many docs are sent back.
-	c := make(chan string, 1)
+	c := make(chan *Result, 1)
+	results := &Results{C: c}
+	q := restrict(ctx, newRangeQuery(req.Query, req.Start, req.End))
 
 	go func() {
+		defer close(c)
+		defer done()
+		n := 0
+
 		// Sequentially search each index, starting with the earliest in time.
 		// This could be done in parallel but more sorting would be required.
 		for i := len(e.indexes) - 1; i >= 0; i-- {
-			e.Logger.Printf("searching index %s", e.indexes[i].Path())
-			ids, err := e.indexes[i].Search(query)
-			if err != nil {
-				e.Logger.Println("error performing search:", err.Error())
-				break
+			if !e.indexes[i].Overlaps(req.Start, req.End) {
+				continue
 			}
-			for _, id := range ids {
-				b, err := e.indexes[i].Document(id)
+			e.Logger.Printf("searching index %s", e.indexes[i].Path())
+
+			// Retrieve the index's hits a page at a time, so that any number of
+			// events may be returned.
+			for from := 0; ; from += maxSearchHitSize {
+				hits, err := e.indexes[i].SearchHits(ctx, q, &HitsRequest{
+					Fields:    facetFields,
+					From:      from,
+					Size:      maxSearchHitSize,
+					Highlight: req.Highlight,
+				})
 				if err != nil {
-					e.Logger.Println("error getting document:", err.Error())
+					if ctx.Err() != nil {
+						e.queryCancelled(ctx.Err())
+						results.err = ctx.Err()
+						return
+					}
+					e.Logger.Println("error performing search:", err.Error())
+					results.err = err
+					return
+				}
+				for _, h := range hits {
+					if req.Limit > 0 && n == req.Limit {
+						return
+					}
+					b, err := e.indexes[i].Document(h.ID)
+					if err != nil {
+						e.Logger.Println("error getting document:", err.Error())
+						continue
+					}
+					stats.Add("docsIDsRetrived", 1)
+					select {
+					case c <- newResult(h, b):
+					case <-ctx.Done():
+						e.queryCancelled(ctx.Err())
+						results.err = ctx.Err()
+						return
+					}
+					n++
+				}
+				if len(hits) < maxSearchHitSize {
 					break
 				}
-				stats.Add("docsIDsRetrived", 1)
-				c <- string(b) // There is excessive byte-slice-to-strings here.
 			}
 		}
-		close(c)
 	}()
 
-	return c, nil
+	return results, nil
+}
+
+// Count returns the number of events matching the search. The request's limit
+// is ignored.
+func (e *Engine) Count(ctx context.Context, req *SearchRequest) (uint64, error) {
+	stats.Add("countsRx", 1)
+	if err := validateQuery(req.Query); err != nil {
+		return 0, err
+	}
+	ctx, done, err := e.beginQuery(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	q := restrict(ctx, newRangeQuery(req.Query, req.Start, req.End))
+	var total uint64
+	for _, i := range e.indexes {
+		if !i.Overlaps(req.Start, req.End) {
+			continue
+		}
+		r, err := i.Aggregate(ctx, q, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				e.queryCancelled(ctx.Err())
+				return 0, ctx.Err()
+			}
+			return 0, err
+		}
+		total += r.Total
+	}
+	return total, nil
+}
+
+// beginQuery waits until the query may run, and returns the context under which it
+// must run, along with a function which must be called once the query is done. An
+// error is returned if ctx is cancelled, or the query times out, before it may run.
+func (e *Engine) beginQuery(ctx context.Context) (context.Context, func(), error) {
+	e.semOnce.Do(func() {
+		if e.MaxConcurrentQueries > 0 {
+			e.querySem = make(chan struct{}, e.MaxConcurrentQueries)
+		}
+	})
+
+	var cancel context.CancelFunc
+	if e.QueryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, e.QueryTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	if e.querySem != nil {
+		select {
+		case e.querySem <- struct{}{}:
+		default:
+			stats.Add("queriesQueued", 1)
+			select {
+			case e.querySem <- struct{}{}:
+				stats.Add("queriesQueued", -1)
+			case <-ctx.Done():
+				stats.Add("queriesQueued", -1)
+				e.queryCancelled(ctx.Err())
+				cancel()
+				return nil, nil, ctx.Err()
+			}
+		}
+	}
+
+	stats.Add("queriesRunning", 1)
+	return ctx, func() {
+		cancel()
+		stats.Add("queriesRunning", -1)
+		if e.querySem != nil {
+			<-e.querySem
+		}
+	}, nil
+}
+
+// queryCancelled records that a query was abandoned because its context was
+// cancelled, or because it timed out.
+func (e *Engine) queryCancelled(err error) {
+	e.Logger.Printf("query abandoned: %s", err.Error())
+	stats.Add("queriesCancelled", 1)
+	if err == context.DeadlineExceeded {
+		stats.Add("queriesTimedOut", 1)
+	}
+}
+
+// IndexInfo describes an index.
+type IndexInfo struct {
+	Path      string    `json:"path"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	Shards    int       `json:"shards"`
+	Documents uint64    `json:"documents"`
+}
+
+// IndexInfo returns a description of every index, latest first.
+func (e *Engine) IndexInfo() ([]IndexInfo, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	infos := make([]IndexInfo, 0, len(e.indexes))
+	for _, i := range e.indexes {
+		total, err := i.Total()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, IndexInfo{
+			Path:      i.Path(),
+			StartTime: i.StartTime(),
+			EndTime:   i.EndTime(),
+			Shards:    len(i.Shards),
+			Documents: total,
+		})
+	}
+	return infos, nil
+}
+
+// newResult returns a Result for the given hit and source document.
+func newResult(h *Hit, source []byte) *Result {
+	r := &Result{
+		ID:         h.ID,
+		Source:     string(source), // There is excessive byte-slice-to-strings here.
+		Fields:     make(map[string]string, len(h.Fields)),
+		Highlights: h.Fragments,
+	}
+	for k, v := range h.Fields {
+		if s, ok := v.(string); ok && s != "" {
+			r.Fields[k] = s
+		}
+	}
+	return r
 }
 
 // Path returns the path to the directory of indexed data.
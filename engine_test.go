@@ -2,9 +2,13 @@ package ekanite
 
 import (
 	"bufio"
+	"context"
+	"expvar"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 
@@ -22,6 +26,24 @@ func (t *TestIndexer) Index(b []*Event) error {
 	return nil
 }
 
+// FailingIndexer fails to index every batch.
+type FailingIndexer struct{}
+
+func (f *FailingIndexer) Index(b []*Event) error {
+	return fmt.Errorf("disk full")
+}
+
+// ChanDispatcher sends the events it is given to a channel.
+type ChanDispatcher chan []*input.Event
+
+func (c ChanDispatcher) Start(ctx context.Context) error { return nil }
+func (c ChanDispatcher) Close() error                    { return nil }
+
+func (c ChanDispatcher) Dispatch(ctx context.Context, events []*input.Event) error {
+	c <- events
+	return nil
+}
+
 // TestBatcher_SingleEvent tests that a single event is sent when the batch size is 1.
 func TestBatcher_SingleEvent(t *testing.T) {
 	e := newInputEvent("", time.Now())
@@ -289,7 +311,7 @@ func TestEngine_IndexThenSearch(t *testing.T) {
 		t.Fatalf("engine total doc count, got %d, expected 3", total)
 	}
 
-	c, err := e.Search("philip")
+	c, err := e.Search(context.Background(), "philip")
 	if err != nil {
 		t.Fatalf("failed to search for indexed event: %s", err.Error())
 	}
@@ -306,6 +328,200 @@ func TestEngine_IndexThenSearch(t *testing.T) {
 	}
 }
 
+func TestEngine_SearchResults(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newEngine(dataDir, 2, time.Hour)
+	defer e.Close()
+
+	ev := newParsedEvent("router1", "%LINK-3-UPDOWN", 187, "Interface Gi0/1 is down", parseTime("1982-02-05T04:10:00Z"))
+	ev.SourceIP = "10.0.0.1:514"
+	if err := e.Index([]*Event{ev}); err != nil {
+		t.Fatalf("failed to index events: %s", err.Error())
+	}
+
+	c, err := e.SearchResults(context.Background(), &SearchRequest{Query: "down"})
+	if err != nil {
+		t.Fatalf("failed to search: %s", err.Error())
+	}
+	r := <-c.C
+	if r == nil {
+		t.Fatalf("no result returned")
+	}
+	if r.Source != ev.Text {
+		t.Fatalf("wrong source, exp %s, got %s", ev.Text, r.Source)
+	}
+	if !r.Time().Equal(ev.ReferenceTime()) {
+		t.Fatalf("wrong time, exp %s, got %s", ev.ReferenceTime(), r.Time())
+	}
+	expFields := map[string]string{
+		"host":     "router1",
+		"app":      "%LINK-3-UPDOWN",
+		"mnemonic": "UPDOWN",
+		"severity": "err",
+		"sourceip": "10.0.0.1",
+	}
+	if !reflect.DeepEqual(r.Fields, expFields) {
+		t.Fatalf("wrong fields, exp %v, got %v", expFields, r.Fields)
+	}
+	if _, more := <-c.C; more {
+		t.Fatalf("more results unexpectedly available")
+	}
+}
+
+func TestEngine_SearchRangeLimitCount(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newEngine(dataDir, 2, time.Hour)
+	defer e.Close()
+
+	var events []*Event
+	for n := 0; n < 6; n++ {
+		events = append(events, newIndexableEvent(fmt.Sprintf("event %d", n),
+			parseTime("1982-02-05T04:00:00Z").Add(time.Duration(n)*20*time.Minute)))
+	}
+	if err := e.Index(events); err != nil {
+		t.Fatalf("failed to index events: %s", err.Error())
+	}
+
+	tests := []struct {
+		req   SearchRequest
+		exp   []string
+		count uint64
+	}{
+		{
+			req:   SearchRequest{Query: "event"},
+			exp:   []string{"event 0", "event 1", "event 2", "event 3", "event 4", "event 5"},
+			count: 6,
+		},
+		{
+			req:   SearchRequest{Query: "event", Limit: 4},
+			exp:   []string{"event 0", "event 1", "event 2", "event 3"},
+			count: 6,
+		},
+		{
+			req:   SearchRequest{Start: parseTime("1982-02-05T04:40:00Z"), End: parseTime("1982-02-05T05:20:00Z")},
+			exp:   []string{"event 2", "event 3"},
+			count: 2,
+		},
+		{
+			req:   SearchRequest{Query: "5", Start: parseTime("1982-02-05T05:00:00Z")},
+			exp:   []string{"event 5"},
+			count: 1,
+		},
+	}
+	for n, tt := range tests {
+		c, err := e.SearchResults(context.Background(), &tt.req)
+		if err != nil {
+			t.Fatalf("test %d: failed to search: %s", n, err.Error())
+		}
+		var got []string
+		for r := range c.C {
+			got = append(got, r.Source)
+		}
+		if !reflect.DeepEqual(got, tt.exp) {
+			t.Errorf("test %d: wrong results, exp %v, got %v", n, tt.exp, got)
+		}
+
+		count, err := e.Count(context.Background(), &tt.req)
+		if err != nil {
+			t.Fatalf("test %d: failed to count: %s", n, err.Error())
+		}
+		if count != tt.count {
+			t.Errorf("test %d: wrong count, exp %d, got %d", n, tt.count, count)
+		}
+	}
+
+	infos, err := e.IndexInfo()
+	if err != nil {
+		t.Fatalf("failed to get index info: %s", err.Error())
+	}
+	if len(infos) != 2 || infos[0].StartTime != parseTime("1982-02-05T05:00:00Z") ||
+		infos[0].Documents != 3 || infos[0].Shards != 2 {
+		t.Fatalf("wrong index info: %v", infos)
+	}
+}
+
+// TestEngine_QueryLimits tests that queries beyond the concurrency limit are queued,
+// and that queued and running queries are abandoned when cancelled or timed out.
+func TestEngine_QueryLimits(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newEngine(dataDir, 1, time.Hour)
+	defer e.Close()
+	e.MaxConcurrentQueries = 1
+	e.QueryTimeout = 0
+
+	var events []*Event
+	for n := 0; n < 10; n++ {
+		events = append(events, newIndexableEvent(fmt.Sprintf("event %d", n),
+			parseTime("1982-02-05T04:00:00Z").Add(time.Duration(n)*time.Minute)))
+	}
+	if err := e.Index(events); err != nil {
+		t.Fatalf("failed to index events: %s", err.Error())
+	}
+
+	cancelled := statValue("queriesCancelled")
+	timedOut := statValue("queriesTimedOut")
+
+	// A query whose results are not read holds the only slot.
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := e.SearchResults(ctx, &SearchRequest{Query: "event"})
+	if err != nil {
+		t.Fatalf("failed to search: %s", err.Error())
+	}
+	<-c.C
+
+	// So a further query is queued, until its context times out.
+	tctx, tcancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer tcancel()
+	if _, err := e.Count(tctx, &SearchRequest{Query: "event"}); err != context.DeadlineExceeded {
+		t.Fatalf("queued query not timed out, got %v", err)
+	}
+	if v := statValue("queriesQueued"); v != 0 {
+		t.Fatalf("wrong number of queued queries, exp 0, got %d", v)
+	}
+
+	// Abandoning the first query frees the slot.
+	cancel()
+	for range c.C {
+	}
+	if err := c.Err(); err != context.Canceled {
+		t.Fatalf("wrong error for cancelled query, got %v", err)
+	}
+	if n, err := e.Count(context.Background(), &SearchRequest{Query: "event"}); err != nil || n != 10 {
+		t.Fatalf("failed to count after cancellation, got %d, %v", n, err)
+	}
+	if v := statValue("queriesRunning"); v != 0 {
+		t.Fatalf("wrong number of running queries, exp 0, got %d", v)
+	}
+
+	// A query which is not read times out, and closes its channel.
+	e.QueryTimeout = 50 * time.Millisecond
+	c, err = e.SearchResults(context.Background(), &SearchRequest{Query: "event"})
+	if err != nil {
+		t.Fatalf("failed to search: %s", err.Error())
+	}
+	time.Sleep(100 * time.Millisecond)
+	n := 0
+	for range c.C {
+		n++
+	}
+	if n == 10 {
+		t.Fatalf("timed out query returned all results")
+	}
+	if err := c.Err(); err != context.DeadlineExceeded {
+		t.Fatalf("timed out query not reported, got %v", err)
+	}
+
+	if v := statValue("queriesCancelled") - cancelled; v != 3 {
+		t.Fatalf("wrong number of cancelled queries, exp 3, got %d", v)
+	}
+	if v := statValue("queriesTimedOut") - timedOut; v != 2 {
+		t.Fatalf("wrong number of timed out queries, exp 2, got %d", v)
+	}
+}
+
 func TestEngine_createIndexForReferenceTime(t *testing.T) {
 	dataDir := tempPath()
 	defer os.RemoveAll(dataDir)
@@ -476,6 +692,14 @@ func tempPath() string {
 	return path
 }
 
+// statValue returns the value of the named engine counter, or 0 if it is not set.
+func statValue(name string) int64 {
+	if v, ok := stats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
 // existOrFail checks for the existence of the given file path.
 func existOrFail(t *testing.T, path string) {
 	if _, err := os.Stat(path); err != nil {
@@ -532,3 +756,24 @@ func newIndexableEvent(line string, refTime time.Time) *Event {
 		},
 	}
 }
+
+// TestBatcher_DispatchIndexFailure tests that events are dispatched even if they
+// fail to be indexed.
+func TestBatcher_DispatchIndexFailure(t *testing.T) {
+	b := NewBatcher(&FailingIndexer{}, 1, time.Hour, 0)
+	d := make(ChanDispatcher, 1)
+	b.Add(d)
+	if err := b.Start(nil); err != nil {
+		t.Fatalf("failed start batcher: %s", err.Error())
+	}
+
+	b.C() <- newInputEvent("link down", time.Now())
+	select {
+	case events := <-d:
+		if len(events) != 1 || events[0].Text != "link down" {
+			t.Fatalf("wrong events dispatched: %v", events)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("events not dispatched after indexing failed")
+	}
+}
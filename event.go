@@ -2,6 +2,7 @@ package ekanite
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/ekanite/ekanite/input"
 )
@@ -25,9 +26,23 @@ func (e Event) ID() DocID {
 // Data returns the indexable data.
 func (e Event) Data() interface{} {
 	return struct {
-		Message string
+		Message       string
+		ReferenceTime time.Time
+		ReceptionTime time.Time
+		Host          string `json:"host"`
+		App           string `json:"app"`
+		Mnemonic      string `json:"mnemonic"`
+		Severity      string `json:"severity"`
+		SourceIP      string `json:"sourceip"`
 	}{
-		Message: e.Text,
+		Message:       e.Text,
+		ReferenceTime: e.ReferenceTime(),
+		ReceptionTime: e.ReceptionTime,
+		Host:          e.Host(),
+		App:           e.App(),
+		Mnemonic:      e.Mnemonic(),
+		Severity:      e.Severity(),
+		SourceIP:      e.SenderIP(),
 	}
 }
 
@@ -35,3 +50,20 @@ func (e Event) Data() interface{} {
 func (e Event) Source() []byte {
 	return []byte(e.Text)
 }
+
+// Fields returns the non-empty indexed keyword fields of the event.
+func (e Event) Fields() map[string]string {
+	fields := make(map[string]string)
+	for k, v := range map[string]string{
+		"host":     e.Host(),
+		"app":      e.App(),
+		"mnemonic": e.Mnemonic(),
+		"severity": e.Severity(),
+		"sourceip": e.SenderIP(),
+	} {
+		if v != "" {
+			fields[k] = v
+		}
+	}
+	return fields
+}
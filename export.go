@@ -0,0 +1,167 @@
+package ekanite
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ekanite/ekanite/query"
+)
+
+// Export formats
+const (
+	ExportNDJSON = "ndjson" // One JSON object per event, with its indexed fields.
+	ExportCSV    = "csv"    // One row per event, with selected columns.
+	ExportRaw    = "raw"    // The original log lines.
+)
+
+// exportFlushInterval is the number of results written between flushes.
+const exportFlushInterval = 1000
+
+// ResultWriter writes search results in an export format. Output may be buffered
+// until Flush is called. Flushing a ResultWriter also flushes the underlying writer,
+// if it has a Flush method.
+type ResultWriter interface {
+	WriteResult(r *Result) error
+	Flush() error
+}
+
+// NewResultWriter returns a ResultWriter writing to w in the given format. Columns
+// select the fields written in CSV format. If none are given, query.DefaultColumns
+// are written. Columns are ignored by the other formats.
+func NewResultWriter(w io.Writer, format string, columns []string) (ResultWriter, error) {
+	switch strings.ToLower(format) {
+	case ExportNDJSON, "":
+		return &ndjsonWriter{w: w, enc: json.NewEncoder(w)}, nil
+	case ExportCSV:
+		if len(columns) == 0 {
+			columns = query.DefaultColumns
+		}
+		return &csvWriter{out: w, w: csv.NewWriter(w), columns: columns}, nil
+	case ExportRaw:
+		return &rawWriter{w: w}, nil
+	}
+	return nil, fmt.Errorf("unsupported export format '%s'", format)
+}
+
+// Export writes every result of the search to rw, as each is retrieved, and returns
+// the number of results written. If progress is not nil, it is called with the number
+// of results written so far after every batch of results is flushed. An error is
+// returned if the search did not complete, such as when it times out, once the
+// results retrieved are written.
+func Export(ctx context.Context, s ResultSearcher, req *SearchRequest, rw ResultWriter, progress func(n int)) (int, error) {
+	// Cancelling the search's context abandons it if the results cannot be written.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results, err := s.SearchResults(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+
+	stats.Add("exportsRunning", 1)
+	defer stats.Add("exportsRunning", -1)
+
+	n := 0
+	for r := range results.C {
+		if err := rw.WriteResult(r); err != nil {
+			return n, err
+		}
+		n++
+		stats.Add("exportedEvents", 1)
+		if n%exportFlushInterval == 0 {
+			if err := rw.Flush(); err != nil {
+				return n, err
+			}
+			if progress != nil {
+				progress(n)
+			}
+		}
+	}
+	if err := rw.Flush(); err != nil {
+		return n, err
+	}
+	if progress != nil {
+		progress(n)
+	}
+	if err := results.Err(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+type ndjsonWriter struct {
+	w   io.Writer
+	enc *json.Encoder
+}
+
+func (w *ndjsonWriter) WriteResult(r *Result) error {
+	h := newAPIHit(r)
+	return w.enc.Encode(&h)
+}
+
+func (w *ndjsonWriter) Flush() error { return flush(w.w) }
+
+type csvWriter struct {
+	out     io.Writer
+	w       *csv.Writer
+	columns []string
+	header  bool
+}
+
+func (w *csvWriter) WriteResult(r *Result) error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	row := r.Row()
+	record := make([]string, len(w.columns))
+	for i, c := range w.columns {
+		record[i] = row[c]
+	}
+	return w.w.Write(record)
+}
+
+// Flush writes any buffered rows. The header is always written, even if there
+// are no rows.
+func (w *csvWriter) Flush() error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	w.w.Flush()
+	if err := w.w.Error(); err != nil {
+		return err
+	}
+	return flush(w.out)
+}
+
+func (w *csvWriter) writeHeader() error {
+	if w.header {
+		return nil
+	}
+	w.header = true
+	return w.w.Write(w.columns)
+}
+
+type rawWriter struct {
+	w io.Writer
+}
+
+func (w *rawWriter) WriteResult(r *Result) error {
+	_, err := io.WriteString(w.w, r.Source+"\n")
+	return err
+}
+
+func (w *rawWriter) Flush() error { return flush(w.w) }
+
+// flush flushes w, if it has a Flush method.
+func flush(w io.Writer) error {
+	if f, ok := w.(interface {
+		Flush() error
+	}); ok {
+		return f.Flush()
+	}
+	return nil
+}
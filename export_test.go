@@ -0,0 +1,91 @@
+package ekanite
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestExport tests that search results are exported in each format.
+func TestExport(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newEngine(dataDir, 2, time.Hour)
+	defer e.Close()
+
+	events := []*Event{
+		newParsedEvent("router1", "%LINK-3-UPDOWN", 187, "link down", parseTime("1982-02-05T04:10:00Z")),
+		newParsedEvent("router2", "%LINK-3-UPDOWN", 187, `link "up", again`, parseTime("1982-02-05T04:50:00Z")),
+		newParsedEvent("router1", "%SYS-5-CONFIG_I", 189, "configured", parseTime("1982-02-05T05:10:00Z")),
+	}
+	if err := e.Index(events); err != nil {
+		t.Fatalf("failed to index events: %s", err.Error())
+	}
+
+	tests := []struct {
+		format  string
+		columns []string
+		query   string
+		exp     string
+	}{
+		{
+			format: ExportRaw,
+			query:  "link",
+			exp:    "link down\nlink \"up\", again\n",
+		},
+		{
+			format:  ExportCSV,
+			columns: []string{"host", "mnemonic", "_raw"},
+			query:   "link",
+			exp:     "host,mnemonic,_raw\nrouter1,UPDOWN,link down\nrouter2,UPDOWN,\"link \"\"up\"\", again\"\n",
+		},
+		{
+			format: ExportCSV,
+			query:  "nomatch",
+			exp:    "_time,host,_raw\n",
+		},
+		{
+			format: ExportNDJSON,
+			query:  "configured",
+			exp: `{"id":"` + string(events[2].ID()) + `","time":"1982-02-05T05:10:00Z","source":"configured",` +
+				`"fields":{"app":"%SYS-5-CONFIG_I","host":"router1","mnemonic":"CONFIG_I","severity":"notice"}}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		rw, err := NewResultWriter(&buf, tt.format, tt.columns)
+		if err != nil {
+			t.Fatalf("failed to create %s writer: %s", tt.format, err.Error())
+		}
+		var progress int
+		n, err := Export(context.Background(), e, &SearchRequest{Query: tt.query}, rw, func(n int) { progress = n })
+		if err != nil {
+			t.Fatalf("failed to export %s: %s", tt.format, err.Error())
+		}
+		if n != progress {
+			t.Errorf("%s: progress not reported, exp %d, got %d", tt.format, n, progress)
+		}
+		if buf.String() != tt.exp {
+			t.Errorf("%s: wrong export:\nexp=%q\ngot=%q", tt.format, tt.exp, buf.String())
+		}
+	}
+
+	if _, err := NewResultWriter(&bytes.Buffer{}, "xml", nil); err == nil {
+		t.Fatalf("unsupported format accepted")
+	}
+}
+
+// TestExportTimeout tests that an export whose search times out fails.
+func TestExportTimeout(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newEngine(dataDir, 2, time.Hour)
+	defer e.Close()
+
+	rw, _ := NewResultWriter(&bytes.Buffer{}, ExportRaw, nil)
+	if _, err := Export(context.Background(), timingOutSearcher{e}, &SearchRequest{Query: "link"}, rw, nil); err != context.DeadlineExceeded {
+		t.Fatalf("timed out export not reported, got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package ekanite
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"hash/fnv"
 	"io"
@@ -15,8 +16,10 @@ import (
 
 	"github.com/blevesearch/bleve"
 	"github.com/blevesearch/bleve/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
 	"github.com/blevesearch/bleve/analysis/tokenizer/regexp"
 	"github.com/blevesearch/bleve/mapping"
+	blevequery "github.com/blevesearch/bleve/search/query"
 )
 
 const (
@@ -60,6 +63,25 @@ func (a DocIDs) Less(i, j int) bool {
 }
 func (a DocIDs) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
 
+// Time returns the reference time encoded in the most significant word of the DocID.
+func (d DocID) Time() time.Time {
+	if len(d) < 16 {
+		return time.Time{}
+	}
+	ns, err := strconv.ParseUint(string(d[0:16]), 16, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ns)).UTC()
+}
+
+// Hit is a document which matched a search, along with its stored fields.
+type Hit struct {
+	ID        DocID
+	Fields    map[string]interface{}
+	Fragments []string // Highlighted fragments of the message, if requested.
+}
+
 // Document specifies the interface required by an object if it is to be indexed.
 type Document interface {
 	ID() DocID
@@ -246,6 +268,18 @@ func (i *Index) Contains(t time.Time) bool {
 	return (t.Equal(i.startTime) || t.After(i.startTime)) && t.Before(i.endTime)
 }
 
+// Overlaps returns whether the index's time range intersects the range from start,
+// inclusive, to end, exclusive. A zero start or end leaves that side unbounded.
+func (i *Index) Overlaps(start, end time.Time) bool {
+	if !end.IsZero() && !end.After(i.startTime) {
+		return false
+	}
+	if !start.IsZero() && !start.Before(i.endTime) {
+		return false
+	}
+	return true
+}
+
 // Index indexes the slice of documents in the index. It takes care of all shard routing.
 func (i *Index) Index(documents []Document) error {
 	var wg sync.WaitGroup
@@ -270,22 +304,65 @@ func (i *Index) Index(documents []Document) error {
 // Search performs a search of the index using the given query. Returns IDs of documents
 // which satisfy all queries. Returns Doc IDs in sorted order, ascending.
 func (i *Index) Search(q string) (DocIDs, error) {
-	query := bleve.NewQueryStringQuery(q)
-	searchRequest := bleve.NewSearchRequest(query)
-	searchRequest.Size = maxSearchHitSize
-	searchResults, err := i.Alias.Search(searchRequest)
+	hits, err := i.SearchHits(context.Background(), bleve.NewQueryStringQuery(q), &HitsRequest{Size: maxSearchHitSize})
 	if err != nil {
 		return nil, err
 	}
 
-	docIDs := make(DocIDs, 0, len(searchResults.Hits))
-	for _, d := range searchResults.Hits {
-		docIDs = append(docIDs, DocID(d.ID))
+	docIDs := make(DocIDs, 0, len(hits))
+	for _, h := range hits {
+		docIDs = append(docIDs, h.ID)
 	}
-	sort.Sort(docIDs)
 	return docIDs, nil
 }
 
+// HitsRequest describes the hits to retrieve from an index.
+type HitsRequest struct {
+	Fields    []string // Stored fields to return with each hit.
+	From      int      // Number of hits to skip.
+	Size      int      // Maximum number of hits to return.
+	Desc      bool     // Return hits in descending, rather than ascending, Doc ID order.
+	Highlight string   // Highlight style for matches in the message, "html" or "ansi". Empty disables highlighting.
+}
+
+// SearchHits performs a search of every shard in the index using the given query,
+// returning the hits described by the request. Hits are returned in Doc ID order, so
+// successive pages of hits may be retrieved by increasing the request's From. The
+// search of each shard is abandoned if ctx is cancelled.
+func (i *Index) SearchHits(ctx context.Context, q blevequery.Query, req *HitsRequest) ([]*Hit, error) {
+	searchRequest := bleve.NewSearchRequestOptions(q, req.Size, req.From, false)
+	searchRequest.Fields = req.Fields
+	// Doc IDs are fixed-width hex, so ordering them as strings orders them in time.
+	if req.Desc {
+		searchRequest.SortBy([]string{"-_id"})
+	} else {
+		searchRequest.SortBy([]string{"_id"})
+	}
+	if req.Highlight != "" {
+		searchRequest.Highlight = bleve.NewHighlightWithStyle(req.Highlight)
+		searchRequest.Highlight.AddField("Message")
+	}
+	searchResults, err := i.Alias.SearchInContext(ctx, searchRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	hits := make([]*Hit, 0, len(searchResults.Hits))
+	for _, d := range searchResults.Hits {
+		hits = append(hits, &Hit{ID: DocID(d.ID), Fields: d.Fields, Fragments: d.Fragments["Message"]})
+	}
+	return hits, nil
+}
+
+// Aggregate runs the given query against the index, and returns the total number of
+// matching documents along with the computed facets. No hits are retrieved.
+func (i *Index) Aggregate(ctx context.Context, q blevequery.Query, facets bleve.FacetsRequest) (*bleve.SearchResult, error) {
+	searchRequest := bleve.NewSearchRequest(q)
+	searchRequest.Size = 0
+	searchRequest.Facets = facets
+	return i.Alias.SearchInContext(ctx, searchRequest)
+}
+
 // Document returns the source from the index for the given ID.
 func (i *Index) Document(id DocID) ([]byte, error) {
 	s := i.Shard(id)
@@ -416,6 +493,39 @@ func listShards(path string) ([]string, error) {
 	return names, nil
 }
 
+// validateQuery returns an error if q, as passed to newRangeQuery, is not a valid
+// query string.
+func validateQuery(q string) error {
+	if q == "" {
+		return nil
+	}
+	if _, err := bleve.NewQueryStringQuery(q).Parse(); err != nil {
+		return fmt.Errorf("invalid query: %s", err.Error())
+	}
+	return nil
+}
+
+// newRangeQuery returns a query matching documents which satisfy the query string q
+// and whose reference time falls within start, inclusive, and end, exclusive. An
+// empty query string matches all documents, and a zero start or end leaves that side
+// of the range unbounded.
+func newRangeQuery(q string, start, end time.Time) blevequery.Query {
+	var qq blevequery.Query
+	if q == "" {
+		qq = bleve.NewMatchAllQuery()
+	} else {
+		qq = bleve.NewQueryStringQuery(q)
+	}
+	if start.IsZero() && end.IsZero() {
+		return qq
+	}
+
+	inclusive, exclusive := true, false
+	rq := bleve.NewDateRangeInclusiveQuery(start, end, &inclusive, &exclusive)
+	rq.SetField("ReferenceTime")
+	return bleve.NewConjunctionQuery(qq, rq)
+}
+
 func buildIndexMapping() (*mapping.IndexMappingImpl, error) {
 	var err error
 
@@ -444,22 +554,34 @@ func buildIndexMapping() (*mapping.IndexMappingImpl, error) {
 
 	// Create field-specific mappings.
 
-	simpleJustIndexed := bleve.NewTextFieldMapping()
-	simpleJustIndexed.Store = false
-	simpleJustIndexed.IncludeInAll = true // XXX Move to false when using AST
-	simpleJustIndexed.IncludeTermVectors = false
+	// The message is stored, with term vectors, so that matches can be highlighted.
+	simpleHighlighted := bleve.NewTextFieldMapping()
+	simpleHighlighted.Store = true
+	simpleHighlighted.IncludeInAll = true // XXX Move to false when using AST
+	simpleHighlighted.IncludeTermVectors = true
 
 	timeJustIndexed := bleve.NewDateTimeFieldMapping()
 	timeJustIndexed.Store = false
 	timeJustIndexed.IncludeInAll = false
 	timeJustIndexed.IncludeTermVectors = false
 
+	// Keyword fields are indexed verbatim, so they can be used as facets, and
+	// stored so they can be returned with search results.
+	keywordStored := bleve.NewTextFieldMapping()
+	keywordStored.Analyzer = keyword.Name
+	keywordStored.Store = true
+	keywordStored.IncludeInAll = false
+	keywordStored.IncludeTermVectors = false
+
 	articleMapping := bleve.NewDocumentMapping()
 
 	// Connect field mappings to fields.
-	articleMapping.AddFieldMappingsAt("Message", simpleJustIndexed)
+	articleMapping.AddFieldMappingsAt("Message", simpleHighlighted)
 	articleMapping.AddFieldMappingsAt("ReferenceTime", timeJustIndexed)
 	articleMapping.AddFieldMappingsAt("ReceptionTime", timeJustIndexed)
+	for _, f := range facetFields {
+		articleMapping.AddFieldMappingsAt(f, keywordStored)
+	}
 
 	// Tell the index about field mappings.
 	indexMapping.DefaultMapping = articleMapping
@@ -1,6 +1,13 @@
 package input
 
-import "time"
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// Severity names, indexed by the severity part of a syslog priority.
+var severities = [...]string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
 
 // Event is a log message, with a reception timestamp and sequence number.
 type Event struct {
@@ -32,3 +39,77 @@ func (e *Event) ReferenceTime() time.Time {
 	}
 	return e.referenceTime
 }
+
+// Host returns the host which generated the event. RFC5424 messages carry
+// it as the hostname field, RFC3164 messages as the identifier.
+func (e *Event) Host() string {
+	if s := e.parsedString("host"); s != "" {
+		return s
+	}
+	return e.parsedString("identifier")
+}
+
+// App returns the application, or Cisco-style mnemonic, of the event.
+func (e *Event) App() string {
+	return e.parsedString("app")
+}
+
+// Mnemonic returns the mnemonic of a Cisco-style app, for example UPDOWN for
+// %LINK-3-UPDOWN. It returns an empty string for any other app.
+func (e *Event) Mnemonic() string {
+	app := e.App()
+	if !strings.HasPrefix(app, "%") {
+		return ""
+	}
+	parts := strings.Split(app[1:], "-")
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[len(parts)-1]
+}
+
+// Message returns the parsed message, or the full text if the event
+// was not parsed.
+func (e *Event) Message() string {
+	if s := e.parsedString("message"); s != "" {
+		return s
+	}
+	return e.Text
+}
+
+// Priority returns the syslog priority of the event, and whether one was parsed.
+func (e *Event) Priority() (int, bool) {
+	if e.Parsed == nil {
+		return 0, false
+	}
+	pri, ok := e.Parsed["priority"].(int)
+	return pri, ok
+}
+
+// Severity returns the syslog severity keyword of the event, for example "err".
+// It returns an empty string if the priority is not known.
+func (e *Event) Severity() string {
+	pri, ok := e.Priority()
+	if !ok || pri < 0 {
+		return ""
+	}
+	return severities[pri%8]
+}
+
+// SenderIP returns the IP address of the sender, without any port.
+func (e *Event) SenderIP() string {
+	host, _, err := net.SplitHostPort(e.SourceIP)
+	if err != nil {
+		return e.SourceIP
+	}
+	return host
+}
+
+// parsedString returns the parsed field with the given name, if it is a string.
+func (e *Event) parsedString(name string) string {
+	if e.Parsed == nil {
+		return ""
+	}
+	s, _ := e.Parsed[name].(string)
+	return s
+}
@@ -0,0 +1,399 @@
+package ekanite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ekanite/ekanite/dispatch"
+	"github.com/ekanite/ekanite/input"
+)
+
+// Maintenance window defaults
+const (
+	MaxMaintenanceDuration = 7 * 24 * time.Hour // of each occurrence of a recurring window
+
+	maintenanceFile            = "maintenance.json"
+	maintenanceFilePermissions = 0600
+)
+
+// ErrWindowNotFound is returned when a maintenance window does not exist.
+var ErrWindowNotFound = errors.New("maintenance window not found")
+
+// weekdays maps the names of days, in full or abbreviated, to weekdays.
+var weekdays = map[string]time.Weekday{}
+
+func init() {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		weekdays[name] = d
+		weekdays[name[:3]] = d
+	}
+}
+
+// MaintenanceWindow is a period during which the triggers dispatched for the events
+// from some hosts, source addresses or tags are suppressed, or tagged with the name
+// of the window. The events are still indexed, and sent to other dispatchers.
+type MaintenanceWindow struct {
+	Name    string   `json:"name"`
+	Hosts   []string `json:"hosts,omitempty"`   // Host names, which may contain * and ? wildcards.
+	Sources []string `json:"sources,omitempty"` // CIDRs or addresses, matched against the sender's address.
+	Tags    []string `json:"tags,omitempty"`    // Matched against the tags field of events.
+
+	// Start and End bound the window. Both are required unless the window recurs
+	// on a schedule, which then only applies between them.
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+
+	Schedule *Schedule `json:"schedule,omitempty"`
+
+	// Action is suppress, the default, or tag.
+	Action  string `json:"action,omitempty"`
+	Comment string `json:"comment,omitempty"`
+
+	// Owner is the user who saved the window, if authentication is enabled.
+	Owner string `json:"owner,omitempty"`
+
+	// Active is whether the window was active when it was returned. It is not saved.
+	Active bool `json:"active,omitempty"`
+
+	hosts []*regexp.Regexp
+	nets  []*net.IPNet
+	tags  map[string]bool
+}
+
+// Schedule makes a maintenance window recur, for a duration from a time of day, on
+// some days of the week.
+type Schedule struct {
+	Days     []string `json:"days,omitempty"`     // Such as mon or monday. Every day if empty.
+	At       string   `json:"at"`                 // Time of day, such as 22:30.
+	Duration string   `json:"duration"`           // Such as 4h.
+	Timezone string   `json:"timezone,omitempty"` // IANA name, such as Europe/Paris. UTC if empty.
+
+	days     map[time.Weekday]bool
+	hour     int
+	minute   int
+	duration time.Duration
+	loc      *time.Location
+}
+
+// validate checks the maintenance window, and compiles its matches.
+func (w *MaintenanceWindow) validate() error {
+	if !savedSearchName.MatchString(w.Name) {
+		return fmt.Errorf("invalid name '%s': must be letters, digits, '_', '.' or '-'", w.Name)
+	}
+	if len(w.Hosts) == 0 && len(w.Sources) == 0 && len(w.Tags) == 0 {
+		return fmt.Errorf("at least one host, source or tag is required")
+	}
+	switch w.Action {
+	case "":
+		w.Action = dispatch.MaintenanceSuppress
+	case dispatch.MaintenanceSuppress, dispatch.MaintenanceTag:
+	default:
+		return fmt.Errorf("invalid action '%s': must be %s or %s", w.Action, dispatch.MaintenanceSuppress, dispatch.MaintenanceTag)
+	}
+
+	w.hosts, w.nets, w.tags = nil, nil, nil
+	for _, h := range w.Hosts {
+		w.hosts = append(w.hosts, globRegexp(strings.ToLower(h)))
+	}
+	for _, s := range w.Sources {
+		n, err := parseSource(s)
+		if err != nil {
+			return err
+		}
+		w.nets = append(w.nets, n)
+	}
+	if len(w.Tags) > 0 {
+		w.tags = make(map[string]bool, len(w.Tags))
+		for _, t := range w.Tags {
+			w.tags[strings.ToLower(t)] = true
+		}
+	}
+
+	if w.Schedule == nil && (w.Start == nil || w.End == nil) {
+		return fmt.Errorf("start and end are required unless the window has a schedule")
+	}
+	if w.Start != nil && w.End != nil && !w.End.After(*w.Start) {
+		return fmt.Errorf("end must be after start")
+	}
+	if w.Schedule != nil {
+		return w.Schedule.validate()
+	}
+	return nil
+}
+
+// validate checks the schedule, and parses its days, times and time zone.
+func (s *Schedule) validate() error {
+	s.days = nil
+	if len(s.Days) > 0 {
+		s.days = make(map[time.Weekday]bool, len(s.Days))
+		for _, d := range s.Days {
+			wd, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return fmt.Errorf("invalid day '%s'", d)
+			}
+			s.days[wd] = true
+		}
+	}
+	at, err := time.Parse("15:04", s.At)
+	if err != nil {
+		return fmt.Errorf("invalid time of day '%s': must be HH:MM", s.At)
+	}
+	s.hour, s.minute = at.Hour(), at.Minute()
+	if s.duration, err = time.ParseDuration(s.Duration); err != nil || s.duration <= 0 || s.duration > MaxMaintenanceDuration {
+		return fmt.Errorf("invalid duration '%s': must be at most %s", s.Duration, MaxMaintenanceDuration)
+	}
+	if s.loc, err = time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone '%s'", s.Timezone)
+	}
+	return nil
+}
+
+// parseSource parses a CIDR, or a single address.
+func parseSource(s string) (*net.IPNet, error) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source '%s': must be a CIDR or an address", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// active returns whether the window is active at t.
+func (w *MaintenanceWindow) active(t time.Time) bool {
+	if w.Start != nil && t.Before(*w.Start) {
+		return false
+	}
+	if w.End != nil && !t.Before(*w.End) {
+		return false
+	}
+	return w.Schedule == nil || w.Schedule.active(t)
+}
+
+// active returns whether an occurrence of the schedule, started on the day of t or
+// on an earlier day, includes t.
+func (s *Schedule) active(t time.Time) bool {
+	t = t.In(s.loc)
+	y, m, d := t.Date()
+	for i := 0; i <= int(s.duration/(24*time.Hour))+1; i++ {
+		start := time.Date(y, m, d-i, s.hour, s.minute, 0, 0, s.loc)
+		if s.days != nil && !s.days[start.Weekday()] {
+			continue
+		}
+		if !t.Before(start) && t.Before(start.Add(s.duration)) {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns whether the event is from one of the hosts, sources or tags of the
+// window.
+func (w *MaintenanceWindow) match(event *input.Event) bool {
+	if h := strings.ToLower(event.Host()); h != "" {
+		for _, re := range w.hosts {
+			if re.MatchString(h) {
+				return true
+			}
+		}
+	}
+	if ip := net.ParseIP(event.SenderIP()); ip != nil {
+		for _, n := range w.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	if w.tags != nil {
+		for _, t := range eventTags(event) {
+			if w.tags[strings.ToLower(t)] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// eventTags returns the tags of an event, which are the values of its tags field,
+// a list or a comma separated string.
+func eventTags(event *input.Event) []string {
+	switch v := event.Parsed["tags"].(type) {
+	case string:
+		tags := strings.Split(v, ",")
+		for i := range tags {
+			tags[i] = strings.TrimSpace(tags[i])
+		}
+		return tags
+	case []string:
+		return v
+	case []interface{}:
+		tags := make([]string, 0, len(v))
+		for _, t := range v {
+			tags = append(tags, fmt.Sprint(t))
+		}
+		return tags
+	}
+	return nil
+}
+
+// copy returns a copy of the maintenance window.
+func (w *MaintenanceWindow) copy() *MaintenanceWindow {
+	c := *w
+	if w.Schedule != nil {
+		s := *w.Schedule
+		c.Schedule = &s
+	}
+	return &c
+}
+
+// Maintenance stores maintenance windows in a directory, and matches events against
+// them. It implements dispatch.Maintenance.
+type Maintenance struct {
+	dir string
+
+	mu      sync.RWMutex
+	windows map[string]*MaintenanceWindow
+
+	now func() time.Time
+
+	Logger *log.Logger
+}
+
+// NewMaintenance returns a Maintenance storing maintenance windows in dir.
+func NewMaintenance(dir string) *Maintenance {
+	return &Maintenance{
+		dir:     dir,
+		windows: make(map[string]*MaintenanceWindow),
+		now:     time.Now,
+		Logger:  log.New(os.Stderr, "[maintenance] ", log.LstdFlags),
+	}
+}
+
+// Open loads the maintenance windows.
+func (m *Maintenance) Open() error {
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(filepath.Join(m.dir, maintenanceFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read maintenance windows: %s", err.Error())
+	}
+	var windows []*MaintenanceWindow
+	if err := json.Unmarshal(b, &windows); err != nil {
+		return fmt.Errorf("failed to parse maintenance windows: %s", err.Error())
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, w := range windows {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("maintenance window %s: %s", w.Name, err.Error())
+		}
+		m.windows[w.Name] = w
+	}
+	m.Logger.Printf("loaded %d maintenance windows", len(m.windows))
+	return nil
+}
+
+// Windows returns every maintenance window, sorted by name.
+func (m *Maintenance) Windows() []*MaintenanceWindow {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := m.now()
+	windows := make([]*MaintenanceWindow, 0, len(m.windows))
+	for _, w := range m.windows {
+		c := w.copy()
+		c.Active = w.active(now)
+		windows = append(windows, c)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Name < windows[j].Name })
+	return windows
+}
+
+// Window returns the named maintenance window.
+func (m *Maintenance) Window(name string) (*MaintenanceWindow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	w, ok := m.windows[name]
+	if !ok {
+		return nil, ErrWindowNotFound
+	}
+	c := w.copy()
+	c.Active = w.active(m.now())
+	return c, nil
+}
+
+// Save creates or replaces a maintenance window.
+func (m *Maintenance) Save(w *MaintenanceWindow) error {
+	w = w.copy()
+	if err := w.validate(); err != nil {
+		return err
+	}
+	w.Active = false
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.windows[w.Name] = w
+	return m.persist()
+}
+
+// Delete deletes the named maintenance window.
+func (m *Maintenance) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.windows[name]; !ok {
+		return ErrWindowNotFound
+	}
+	delete(m.windows, name)
+	return m.persist()
+}
+
+// Match returns the name and action of the active maintenance window matching the
+// event at t, if any. Windows suppressing triggers take precedence over those
+// tagging them, and windows are otherwise tried in order of name.
+func (m *Maintenance) Match(event *input.Event, t time.Time) (string, string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var name, action string
+	for _, w := range m.windows {
+		if !w.active(t) || !w.match(event) {
+			continue
+		}
+		switch {
+		case name == "",
+			w.Action == dispatch.MaintenanceSuppress && action != dispatch.MaintenanceSuppress,
+			w.Action == action && w.Name < name:
+			name, action = w.Name, w.Action
+		}
+	}
+	return name, action, name != ""
+}
+
+// persist writes the maintenance windows to disk. It must be called under lock.
+func (m *Maintenance) persist() error {
+	windows := make([]*MaintenanceWindow, 0, len(m.windows))
+	for _, w := range m.windows {
+		windows = append(windows, w)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Name < windows[j].Name })
+	if err := writeFileAtomic(filepath.Join(m.dir, maintenanceFile), windows, maintenanceFilePermissions); err != nil {
+		return fmt.Errorf("failed to write maintenance windows: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package ekanite
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ekanite/ekanite/input"
+)
+
+func timeRef(s string) *time.Time {
+	t := parseTime(s)
+	return &t
+}
+
+func TestMaintenanceWindow_Validate(t *testing.T) {
+	start, end := timeRef("2017-03-12T10:00:00Z"), timeRef("2017-03-12T12:00:00Z")
+	for _, w := range []*MaintenanceWindow{
+		{Name: "bad name", Hosts: []string{"router1"}, Start: start, End: end},
+		{Name: "a", Start: start, End: end},
+		{Name: "a", Hosts: []string{"router1"}, Start: start},
+		{Name: "a", Hosts: []string{"router1"}, Start: end, End: start},
+		{Name: "a", Sources: []string{"10.0.0.0/33"}, Start: start, End: end},
+		{Name: "a", Hosts: []string{"router1"}, Start: start, End: end, Action: "mute"},
+		{Name: "a", Hosts: []string{"router1"}, Schedule: &Schedule{At: "25:00", Duration: "1h"}},
+		{Name: "a", Hosts: []string{"router1"}, Schedule: &Schedule{At: "22:00", Duration: "9d"}},
+		{Name: "a", Hosts: []string{"router1"}, Schedule: &Schedule{At: "22:00", Duration: "1h", Days: []string{"funday"}}},
+		{Name: "a", Hosts: []string{"router1"}, Schedule: &Schedule{At: "22:00", Duration: "1h", Timezone: "Mars/Olympus"}},
+	} {
+		if err := w.validate(); err == nil {
+			t.Errorf("invalid maintenance window %+v passed validation", w)
+		}
+	}
+}
+
+func TestMaintenanceWindow_Active(t *testing.T) {
+	tests := []struct {
+		window *MaintenanceWindow
+		time   string
+		active bool
+	}{
+		{
+			window: &MaintenanceWindow{Start: timeRef("2017-03-12T10:00:00Z"), End: timeRef("2017-03-12T12:00:00Z")},
+			time:   "2017-03-12T10:00:00Z",
+			active: true,
+		},
+		{
+			window: &MaintenanceWindow{Start: timeRef("2017-03-12T10:00:00Z"), End: timeRef("2017-03-12T12:00:00Z")},
+			time:   "2017-03-12T12:00:00Z",
+		},
+		{
+			// Sundays from 23:00 in Paris, crossing midnight.
+			window: &MaintenanceWindow{Schedule: &Schedule{Days: []string{"sun"}, At: "23:00", Duration: "3h", Timezone: "Europe/Paris"}},
+			time:   "2017-03-12T23:30:00Z",
+			active: true,
+		},
+		{
+			window: &MaintenanceWindow{Schedule: &Schedule{Days: []string{"sun"}, At: "23:00", Duration: "3h", Timezone: "Europe/Paris"}},
+			time:   "2017-03-13T01:00:00Z",
+		},
+		{
+			window: &MaintenanceWindow{Schedule: &Schedule{Days: []string{"Saturday"}, At: "23:00", Duration: "3h", Timezone: "Europe/Paris"}},
+			time:   "2017-03-12T23:30:00Z",
+		},
+		{
+			// Every day, but only until the end of the window.
+			window: &MaintenanceWindow{End: timeRef("2017-03-12T00:00:00Z"), Schedule: &Schedule{At: "02:00", Duration: "1h"}},
+			time:   "2017-03-11T02:30:00Z",
+			active: true,
+		},
+		{
+			window: &MaintenanceWindow{End: timeRef("2017-03-12T00:00:00Z"), Schedule: &Schedule{At: "02:00", Duration: "1h"}},
+			time:   "2017-03-12T02:30:00Z",
+		},
+		{
+			// A weekend, from Friday evening.
+			window: &MaintenanceWindow{Schedule: &Schedule{Days: []string{"fri"}, At: "20:00", Duration: "60h"}},
+			time:   "2017-03-13T07:59:00Z",
+			active: true,
+		},
+	}
+	for i, tt := range tests {
+		tt.window.Name, tt.window.Hosts = "w", []string{"router1"}
+		if err := tt.window.validate(); err != nil {
+			t.Fatalf("test %d: failed to validate window: %s", i, err.Error())
+		}
+		if active := tt.window.active(parseTime(tt.time)); active != tt.active {
+			t.Errorf("test %d: window active at %s is %v, expected %v", i, tt.time, active, tt.active)
+		}
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	m := NewMaintenance(dataDir)
+	if err := m.Open(); err != nil {
+		t.Fatalf("failed to open maintenance windows: %s", err.Error())
+	}
+	start, end := timeRef("2017-03-12T10:00:00Z"), timeRef("2017-03-12T12:00:00Z")
+	for _, w := range []*MaintenanceWindow{
+		{Name: "routers", Hosts: []string{"Router*"}, Start: start, End: end},
+		{Name: "lab", Sources: []string{"10.1.0.0/16", "192.168.0.1"}, Start: start, End: end, Action: "tag"},
+		{Name: "core", Tags: []string{"core"}, Start: start, End: end, Action: "tag"},
+	} {
+		if err := m.Save(w); err != nil {
+			t.Fatalf("failed to save window %s: %s", w.Name, err.Error())
+		}
+	}
+
+	during, after := parseTime("2017-03-12T11:00:00Z"), parseTime("2017-03-12T13:00:00Z")
+	tests := []struct {
+		event  *input.Event
+		time   time.Time
+		name   string
+		action string
+	}{
+		{event: &input.Event{Parsed: map[string]interface{}{"host": "router1"}}, time: during, name: "routers", action: "suppress"},
+		{event: &input.Event{Parsed: map[string]interface{}{"host": "router1"}}, time: after},
+		{event: &input.Event{Parsed: map[string]interface{}{"host": "switch1"}, SourceIP: "10.1.2.3:514"}, time: during, name: "lab", action: "tag"},
+		{event: &input.Event{Parsed: map[string]interface{}{"host": "switch1"}, SourceIP: "192.168.0.1:514"}, time: during, name: "lab", action: "tag"},
+		{event: &input.Event{Parsed: map[string]interface{}{"host": "switch1"}, SourceIP: "10.2.0.1:514"}, time: during},
+		{event: &input.Event{Parsed: map[string]interface{}{"host": "switch1", "tags": "edge, core"}}, time: during, name: "core", action: "tag"},
+		{event: &input.Event{Parsed: map[string]interface{}{"host": "switch1", "tags": []interface{}{"edge"}}}, time: during},
+
+		// Windows suppressing triggers take precedence, and windows are otherwise
+		// tried in order of name.
+		{event: &input.Event{Parsed: map[string]interface{}{"host": "router1", "tags": "core"}, SourceIP: "10.1.2.3:514"}, time: during, name: "routers", action: "suppress"},
+		{event: &input.Event{Parsed: map[string]interface{}{"host": "switch1", "tags": "core"}, SourceIP: "10.1.2.3:514"}, time: during, name: "core", action: "tag"},
+	}
+	for i, tt := range tests {
+		name, action, ok := m.Match(tt.event, tt.time)
+		if ok != (tt.name != "") || name != tt.name || action != tt.action {
+			t.Errorf("test %d: matched window %q (%s), expected %q (%s)", i, name, action, tt.name, tt.action)
+		}
+	}
+
+	// Windows are persisted.
+	if err := m.Delete("lab"); err != nil {
+		t.Fatalf("failed to delete window: %s", err.Error())
+	}
+	if err := m.Delete("lab"); err != ErrWindowNotFound {
+		t.Fatalf("deleted a missing window, error %v", err)
+	}
+	m = NewMaintenance(dataDir)
+	if err := m.Open(); err != nil {
+		t.Fatalf("failed to reopen maintenance windows: %s", err.Error())
+	}
+	windows := m.Windows()
+	if len(windows) != 2 || windows[0].Name != "core" || windows[1].Name != "routers" || windows[1].Action != "suppress" {
+		t.Fatalf("wrong windows after reopening: %+v", windows)
+	}
+	if _, _, ok := m.Match(&input.Event{Parsed: map[string]interface{}{"host": "router2"}}, during); !ok {
+		t.Fatalf("reopened window did not match")
+	}
+
+	// Whether a window is active is not saved.
+	if err := m.Save(&MaintenanceWindow{Name: "now", Hosts: []string{"*"}, Start: start, End: timeRef("2100-01-01T00:00:00Z"), Active: true}); err != nil {
+		t.Fatalf("failed to save window: %s", err.Error())
+	}
+	if w, err := m.Window("now"); err != nil || !w.Active {
+		t.Fatalf("window not active, %v", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dataDir, maintenanceFile))
+	if err != nil {
+		t.Fatalf("failed to read maintenance windows: %s", err.Error())
+	}
+	if strings.Contains(string(b), "active") {
+		t.Fatalf("active saved: %s", b)
+	}
+}
+
+func TestHTTPServer_Maintenance(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	m := NewMaintenance(dataDir)
+	if err := m.Open(); err != nil {
+		t.Fatalf("failed to open maintenance windows: %s", err.Error())
+	}
+	m.now = func() time.Time { return parseTime("2017-03-12T11:00:00Z") }
+
+	auth, err := NewAuthenticator(&Credentials{Users: []*User{
+		{Name: "alice", Tokens: []string{tokenHash("a")}},
+		{Name: "ops", Tokens: []string{tokenHash("o")}, Admin: true},
+	}})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %s", err.Error())
+	}
+	s := NewHTTPServer("", nil)
+	s.Auth = auth
+	s.Maintenance = m
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	window := `{"name": "upgrade", "hosts": ["router1"], "start": "2017-03-12T10:00:00Z", "end": "2017-03-12T12:00:00Z"}`
+	if w := do("POST", "/api/v1/maintenance", "a", window); w.Code != http.StatusForbidden {
+		t.Fatalf("non-administrator created a window, status %d", w.Code)
+	}
+	if w := do("POST", "/api/v1/maintenance", "o", window); w.Code != http.StatusCreated {
+		t.Fatalf("failed to create window: %d %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/api/v1/maintenance", "o", window); w.Code != http.StatusConflict {
+		t.Fatalf("duplicate window created: %d", w.Code)
+	}
+	if w := do("POST", "/api/v1/maintenance", "o", `{"name": "x", "hosts": ["router1"]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid window created: %d", w.Code)
+	}
+	if w := do("PUT", "/api/v1/maintenance/nightly", "o", `{"tags": ["core"], "action": "tag", "schedule": {"at": "22:00", "duration": "4h"}}`); w.Code != http.StatusOK {
+		t.Fatalf("failed to put window: %d %s", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/api/v1/maintenance/nightly", "o", `{"name": "other", "tags": ["core"], "schedule": {"at": "22:00", "duration": "4h"}}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("window saved under another name: %d", w.Code)
+	}
+
+	w := do("GET", "/api/v1/maintenance", "a", "")
+	var mr apiMaintenanceResponse
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &mr) != nil {
+		t.Fatalf("failed to list windows: %d %s", w.Code, w.Body.String())
+	}
+	if len(mr.Windows) != 2 || mr.Windows[0].Name != "nightly" || mr.Windows[0].Active ||
+		mr.Windows[1].Name != "upgrade" || !mr.Windows[1].Active || mr.Windows[1].Owner != "ops" {
+		t.Fatalf("wrong windows listed: %s", w.Body.String())
+	}
+
+	if w := do("DELETE", "/api/v1/maintenance/upgrade", "a", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("non-administrator deleted a window, status %d", w.Code)
+	}
+	if w := do("DELETE", "/api/v1/maintenance/upgrade", "o", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("failed to delete window: %d", w.Code)
+	}
+	if w := do("GET", "/api/v1/maintenance/upgrade", "a", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("deleted window found: %d", w.Code)
+	}
+}
@@ -0,0 +1,79 @@
+package ekanite
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ekanite/ekanite/query"
+)
+
+// MaxPipelineRows is the maximum number of events a pipeline's search may match,
+// as every one is held in memory while the commands are applied.
+const MaxPipelineRows = 1000000
+
+// ResultSearcher is the interface any object that returns search results along with
+// their indexed fields should implement.
+type ResultSearcher interface {
+	SearchResults(ctx context.Context, req *SearchRequest) (*Results, error)
+}
+
+// RunPipeline parses the request's query as a pipeline, performs the pipeline's search
+// over the request's time range using s, and applies the pipeline's commands to the
+// results. The request's limit is ignored, since commands such as stats need every
+// result. Use the head command to limit output. The search is abandoned if ctx is
+// cancelled, and an error returned if it did not complete, such as when it times out,
+// or if it matched more than MaxPipelineRows events.
+func RunPipeline(ctx context.Context, s ResultSearcher, req *SearchRequest) (*query.Table, error) {
+	return runPipelineRows(ctx, s, req, MaxPipelineRows)
+}
+
+// runPipelineRows runs the pipeline as RunPipeline does, failing if its search
+// matches more than max events.
+func runPipelineRows(ctx context.Context, s ResultSearcher, req *SearchRequest, max int) (*query.Table, error) {
+	p, err := query.ParsePipeline(req.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results, err := s.SearchResults(ctx, &SearchRequest{Query: p.Search, Start: req.Start, End: req.End})
+	if err != nil {
+		return nil, err
+	}
+	var rows []query.Row
+	for r := range results.C {
+		if len(rows) == max {
+			return nil, fmt.Errorf("pipeline search matched more than %d events, narrow the search or its time range", max)
+		}
+		rows = append(rows, r.Row())
+	}
+	if err := results.Err(); err != nil {
+		return nil, err
+	}
+	stats.Add("pipelinesRx", 1)
+	return p.Eval(rows)
+}
+
+// runPipeline runs the given pipeline using s, if s supports returning search results
+// along with their fields.
+func runPipeline(ctx context.Context, s Searcher, pipeline string) (*query.Table, error) {
+	rs, ok := s.(ResultSearcher)
+	if !ok {
+		return nil, fmt.Errorf("search pipelines are not supported")
+	}
+	return RunPipeline(ctx, rs, &SearchRequest{Query: pipeline})
+}
+
+// Row returns the result as a pipeline row, holding its indexed fields, the original
+// log line and the reference time.
+func (r *Result) Row() query.Row {
+	row := make(query.Row, len(r.Fields)+2)
+	for k, v := range r.Fields {
+		row[k] = v
+	}
+	row[query.RawField] = r.Source
+	row[query.TimeField] = r.Time().Format(time.RFC3339Nano)
+	return row
+}
@@ -0,0 +1,62 @@
+package ekanite
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunPipeline(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newEngine(dataDir, 2, time.Hour)
+	defer e.Close()
+
+	events := []*Event{
+		newParsedEvent("router1", "%LINK-3-UPDOWN", 187, "Interface Gi0/1 is down", parseTime("1982-02-05T04:10:00Z")),
+		newParsedEvent("router2", "%LINK-3-UPDOWN", 187, "Interface Gi0/2 is down", parseTime("1982-02-05T04:20:00Z")),
+		newParsedEvent("router1", "%LINK-3-UPDOWN", 187, "Interface Gi0/3 is down", parseTime("1982-02-05T05:50:00Z")),
+		newParsedEvent("router1", "%SYS-5-CONFIG_I", 189, "Configured from console", parseTime("1982-02-05T05:55:00Z")),
+	}
+	if err := e.Index(events); err != nil {
+		t.Fatalf("failed to index events: %s", err.Error())
+	}
+
+	tbl, err := RunPipeline(context.Background(), e, &SearchRequest{
+		Query: `mnemonic:UPDOWN | rex "Interface (?P<ifname>\S+)" | stats count, dc(ifname) as ifs by host | sort -count`,
+	})
+	if err != nil {
+		t.Fatalf("failed to run pipeline: %s", err.Error())
+	}
+	exp := [][]string{{"router1", "2", "2"}, {"router2", "1", "1"}}
+	if !reflect.DeepEqual(tbl.Values(), exp) {
+		t.Fatalf("wrong pipeline output, exp %v, got %v", exp, tbl.Values())
+	}
+
+	tbl, err = RunPipeline(context.Background(), e, &SearchRequest{
+		Query: `mnemonic:UPDOWN | stats count`,
+		Start: parseTime("1982-02-05T05:00:00Z"),
+	})
+	if err != nil {
+		t.Fatalf("failed to run pipeline over time range: %s", err.Error())
+	}
+	exp = [][]string{{"1"}}
+	if !reflect.DeepEqual(tbl.Values(), exp) {
+		t.Fatalf("wrong pipeline output over time range, exp %v, got %v", exp, tbl.Values())
+	}
+
+	if _, err := RunPipeline(context.Background(), e, &SearchRequest{Query: `down | bogus`}); err == nil {
+		t.Fatalf("invalid pipeline did not fail")
+	}
+
+	// Searches matching more events than may be held fail, rather than truncate.
+	if _, err := runPipelineRows(context.Background(), e, &SearchRequest{Query: `mnemonic:UPDOWN | stats count`}, 3); err != nil {
+		t.Fatalf("failed to run pipeline within the row limit: %s", err.Error())
+	}
+	if _, err := runPipelineRows(context.Background(), e, &SearchRequest{Query: `* | stats count`}, 3); err == nil || !strings.Contains(err.Error(), "more than 3 events") {
+		t.Fatalf("pipeline over the row limit did not fail: %v", err)
+	}
+}
@@ -0,0 +1,529 @@
+package query
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Fields always present in rows built from search results.
+const (
+	RawField  = "_raw"  // Original log line.
+	TimeField = "_time" // Reference time of the event.
+
+	DefaultHeadSize = 10
+)
+
+// DefaultColumns are the columns displayed for search results when no command
+// selects others.
+var DefaultColumns = []string{TimeField, "host", RawField}
+
+// Row is a single result row, mapping field names to values.
+type Row map[string]string
+
+// Table is the tabular output of a pipeline.
+type Table struct {
+	Columns []string
+	Rows    []Row
+}
+
+// WriteText writes the table to w as aligned plain-text columns, preceded by a header.
+func (t *Table) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(t.Columns, "\t"))
+	for _, r := range t.Rows {
+		values := make([]string, len(t.Columns))
+		for n, c := range t.Columns {
+			values[n] = r[c]
+		}
+		fmt.Fprintln(tw, strings.Join(values, "\t"))
+	}
+	return tw.Flush()
+}
+
+// Values returns the rows of the table as slices of values, in column order.
+func (t *Table) Values() [][]string {
+	values := make([][]string, len(t.Rows))
+	for n, r := range t.Rows {
+		values[n] = make([]string, len(t.Columns))
+		for m, c := range t.Columns {
+			values[n][m] = r[c]
+		}
+	}
+	return values
+}
+
+// Eval applies the pipeline's commands, in order, to the given search result rows.
+func (p *Pipeline) Eval(rows []Row) (*Table, error) {
+	t := &Table{Columns: DefaultColumns, Rows: rows}
+	for _, c := range p.Commands {
+		var err error
+		if t, err = c.Apply(t); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Command is a pipeline command, transforming one table into another.
+type Command interface {
+	Apply(t *Table) (*Table, error)
+	String() string
+}
+
+// SearchCommand keeps only the rows matching a query expression.
+type SearchCommand struct {
+	Query string
+	Expr  Expr
+}
+
+// Apply implements Command.
+func (c *SearchCommand) Apply(t *Table) (*Table, error) {
+	rows := t.Rows[:0:0]
+	for _, r := range t.Rows {
+		if Match(c.Expr, r) {
+			rows = append(rows, r)
+		}
+	}
+	return &Table{Columns: t.Columns, Rows: rows}, nil
+}
+
+func (c *SearchCommand) String() string { return "search " + c.Query }
+
+// Match returns whether the row satisfies the expression. Terms match if they are
+// contained, ignoring case, in the value of their field.
+func Match(e Expr, r Row) bool {
+	switch e := e.(type) {
+	case *FieldExpr:
+		return strings.Contains(strings.ToLower(r[e.Field]), strings.ToLower(e.Term))
+	case *ParenExpr:
+		return Match(e.Expr, r)
+	case *BinaryExpr:
+		if e.Op == OR {
+			return Match(e.LHS, r) || Match(e.RHS, r)
+		}
+		return Match(e.LHS, r) && Match(e.RHS, r)
+	}
+	return false
+}
+
+// Aggregation is a statistical function applied to a field, for example avg(bytes).
+type Aggregation struct {
+	Func  string // count, dc, sum, avg, min or max.
+	Field string // Field the function applies to. Optional for count.
+	As    string // Output column name, if not the default.
+}
+
+// Name returns the output column name of the aggregation.
+func (a Aggregation) Name() string {
+	if a.As != "" {
+		return a.As
+	}
+	if a.Field == "" {
+		return a.Func
+	}
+	return fmt.Sprintf("%s(%s)", a.Func, a.Field)
+}
+
+// statsFuncs maps function names to implementations, which compute the function
+// over the values of a field in a group of rows.
+var statsFuncs = map[string]func(values []string) string{
+	"count": func(values []string) string {
+		return strconv.Itoa(len(values))
+	},
+	"dc": func(values []string) string {
+		distinct := make(map[string]struct{})
+		for _, v := range values {
+			distinct[v] = struct{}{}
+		}
+		return strconv.Itoa(len(distinct))
+	},
+	"sum": func(values []string) string {
+		sum, _ := numbers(values)
+		return formatFloat(sum)
+	},
+	"avg": func(values []string) string {
+		sum, n := numbers(values)
+		if n == 0 {
+			return ""
+		}
+		return formatFloat(sum / float64(n))
+	},
+	"min": func(values []string) string {
+		return extreme(values, func(a, b float64) bool { return a < b })
+	},
+	"max": func(values []string) string {
+		return extreme(values, func(a, b float64) bool { return a > b })
+	},
+}
+
+// StatsCommand computes aggregations over the rows, grouped by the By fields.
+type StatsCommand struct {
+	Aggregations []Aggregation
+	By           []string
+}
+
+// Apply implements Command.
+func (c *StatsCommand) Apply(t *Table) (*Table, error) {
+	type group struct {
+		key  Row
+		rows []Row
+	}
+	var groups []*group
+	index := make(map[string]*group)
+	for _, r := range t.Rows {
+		key := make(Row, len(c.By))
+		parts := make([]string, len(c.By))
+		for n, f := range c.By {
+			key[f] = r[f]
+			parts[n] = r[f]
+		}
+		k := strings.Join(parts, "\x00")
+		g, ok := index[k]
+		if !ok {
+			g = &group{key: key}
+			index[k] = g
+			groups = append(groups, g)
+		}
+		g.rows = append(g.rows, r)
+	}
+	if len(groups) == 0 && len(c.By) == 0 {
+		groups = append(groups, &group{key: Row{}})
+	}
+
+	out := &Table{Columns: append([]string{}, c.By...)}
+	for _, a := range c.Aggregations {
+		out.Columns = append(out.Columns, a.Name())
+	}
+	for _, g := range groups {
+		r := g.key
+		for _, a := range c.Aggregations {
+			var values []string
+			for _, gr := range g.rows {
+				if a.Field == "" {
+					values = append(values, "")
+				} else if v, ok := gr[a.Field]; ok {
+					values = append(values, v)
+				}
+			}
+			r[a.Name()] = statsFuncs[a.Func](values)
+		}
+		out.Rows = append(out.Rows, r)
+	}
+	return out, nil
+}
+
+func (c *StatsCommand) String() string {
+	aggs := make([]string, len(c.Aggregations))
+	for n, a := range c.Aggregations {
+		aggs[n] = a.Func
+		if a.Field != "" {
+			aggs[n] += "(" + a.Field + ")"
+		}
+		if a.As != "" {
+			aggs[n] += " as " + a.As
+		}
+	}
+	s := "stats " + strings.Join(aggs, ", ")
+	if len(c.By) > 0 {
+		s += " by " + strings.Join(c.By, ", ")
+	}
+	return s
+}
+
+// RexCommand extracts new fields from a field using the named capture groups of
+// a regular expression.
+type RexCommand struct {
+	Field  string
+	Regexp *regexp.Regexp
+}
+
+// Apply implements Command.
+func (c *RexCommand) Apply(t *Table) (*Table, error) {
+	out := &Table{Columns: t.Columns, Rows: make([]Row, 0, len(t.Rows))}
+	names := c.Regexp.SubexpNames()
+	for _, name := range names {
+		if name != "" && !contains(out.Columns, name) {
+			out.Columns = append(out.Columns[:len(out.Columns):len(out.Columns)], name)
+		}
+	}
+	for _, r := range t.Rows {
+		m := c.Regexp.FindStringSubmatch(r[c.Field])
+		if m != nil {
+			nr := make(Row, len(r)+len(names))
+			for k, v := range r {
+				nr[k] = v
+			}
+			for n, name := range names {
+				if name != "" {
+					nr[name] = m[n]
+				}
+			}
+			r = nr
+		}
+		out.Rows = append(out.Rows, r)
+	}
+	return out, nil
+}
+
+func (c *RexCommand) String() string {
+	return fmt.Sprintf("rex field=%s %q", c.Field, c.Regexp.String())
+}
+
+// compareOps maps comparison operators to functions which, given the result of
+// comparing two values, return whether the comparison holds.
+var compareOps = map[string]func(int) bool{
+	"=":  func(c int) bool { return c == 0 },
+	"==": func(c int) bool { return c == 0 },
+	"!=": func(c int) bool { return c != 0 },
+	"<":  func(c int) bool { return c < 0 },
+	"<=": func(c int) bool { return c <= 0 },
+	">":  func(c int) bool { return c > 0 },
+	">=": func(c int) bool { return c >= 0 },
+	"~":  nil,
+	"!~": nil,
+}
+
+// Condition compares the value of a field with a constant.
+type Condition struct {
+	Field string
+	Op    string
+	Value string
+
+	re *regexp.Regexp // Compiled Value, for the ~ and !~ operators.
+}
+
+// holds returns whether the condition holds for the row. A row without the field
+// never satisfies a condition.
+func (c Condition) holds(r Row) bool {
+	v, ok := r[c.Field]
+	if !ok {
+		return false
+	}
+	switch c.Op {
+	case "~":
+		return c.re.MatchString(v)
+	case "!~":
+		return !c.re.MatchString(v)
+	}
+	return compareOps[c.Op](compareValues(v, c.Value))
+}
+
+func (c Condition) String() string {
+	return fmt.Sprintf("%s %s %q", c.Field, c.Op, c.Value)
+}
+
+// WhereCommand keeps only the rows satisfying at least one of a set of
+// conjunctions of Conditions.
+type WhereCommand struct {
+	Or [][]Condition
+}
+
+// Apply implements Command.
+func (c *WhereCommand) Apply(t *Table) (*Table, error) {
+	rows := t.Rows[:0:0]
+	for _, r := range t.Rows {
+		for _, conj := range c.Or {
+			all := true
+			for _, cond := range conj {
+				if !cond.holds(r) {
+					all = false
+					break
+				}
+			}
+			if all {
+				rows = append(rows, r)
+				break
+			}
+		}
+	}
+	return &Table{Columns: t.Columns, Rows: rows}, nil
+}
+
+func (c *WhereCommand) String() string {
+	disj := make([]string, len(c.Or))
+	for n, conj := range c.Or {
+		conds := make([]string, len(conj))
+		for m, cond := range conj {
+			conds[m] = cond.String()
+		}
+		disj[n] = strings.Join(conds, " and ")
+	}
+	return "where " + strings.Join(disj, " or ")
+}
+
+// SortKey is a field to sort on, and the sort direction.
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// SortCommand sorts rows by one or more fields. Numeric values sort numerically.
+type SortCommand struct {
+	Keys []SortKey
+}
+
+// Apply implements Command.
+func (c *SortCommand) Apply(t *Table) (*Table, error) {
+	rows := append([]Row{}, t.Rows...)
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, k := range c.Keys {
+			cmp := compareValues(rows[i][k.Field], rows[j][k.Field])
+			if cmp == 0 {
+				continue
+			}
+			if k.Desc {
+				return cmp > 0
+			}
+			return cmp < 0
+		}
+		return false
+	})
+	return &Table{Columns: t.Columns, Rows: rows}, nil
+}
+
+func (c *SortCommand) String() string {
+	keys := make([]string, len(c.Keys))
+	for n, k := range c.Keys {
+		keys[n] = k.Field
+		if k.Desc {
+			keys[n] = "-" + k.Field
+		}
+	}
+	return "sort " + strings.Join(keys, ", ")
+}
+
+// HeadCommand keeps only the first N rows.
+type HeadCommand struct {
+	N int
+}
+
+// Apply implements Command.
+func (c *HeadCommand) Apply(t *Table) (*Table, error) {
+	rows := t.Rows
+	if len(rows) > c.N {
+		rows = rows[:c.N]
+	}
+	return &Table{Columns: t.Columns, Rows: rows}, nil
+}
+
+func (c *HeadCommand) String() string { return fmt.Sprintf("head %d", c.N) }
+
+// DedupCommand keeps only the first row for each combination of values of Fields.
+type DedupCommand struct {
+	Fields []string
+}
+
+// Apply implements Command.
+func (c *DedupCommand) Apply(t *Table) (*Table, error) {
+	seen := make(map[string]struct{})
+	rows := t.Rows[:0:0]
+	for _, r := range t.Rows {
+		parts := make([]string, len(c.Fields))
+		for n, f := range c.Fields {
+			parts[n] = r[f]
+		}
+		k := strings.Join(parts, "\x00")
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		rows = append(rows, r)
+	}
+	return &Table{Columns: t.Columns, Rows: rows}, nil
+}
+
+func (c *DedupCommand) String() string { return "dedup " + strings.Join(c.Fields, ", ") }
+
+// FieldsCommand selects the columns displayed, or removes columns if Remove is set.
+type FieldsCommand struct {
+	Fields []string
+	Remove bool
+}
+
+// Apply implements Command.
+func (c *FieldsCommand) Apply(t *Table) (*Table, error) {
+	if !c.Remove {
+		return &Table{Columns: c.Fields, Rows: t.Rows}, nil
+	}
+	var columns []string
+	for _, col := range t.Columns {
+		if !contains(c.Fields, col) {
+			columns = append(columns, col)
+		}
+	}
+	return &Table{Columns: columns, Rows: t.Rows}, nil
+}
+
+func (c *FieldsCommand) String() string {
+	if c.Remove {
+		return "fields - " + strings.Join(c.Fields, ", ")
+	}
+	return "fields " + strings.Join(c.Fields, ", ")
+}
+
+// compareValues compares two values, numerically if both are numbers.
+func compareValues(a, b string) int {
+	x, errx := strconv.ParseFloat(a, 64)
+	y, erry := strconv.ParseFloat(b, 64)
+	if errx == nil && erry == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// numbers returns the sum and count of the values which are numbers.
+func numbers(values []string) (float64, int) {
+	var sum float64
+	var n int
+	for _, v := range values {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			sum += f
+			n++
+		}
+	}
+	return sum, n
+}
+
+// extreme returns the numeric value which is preferred, by the given function, over
+// all the others.
+func extreme(values []string, better func(a, b float64) bool) string {
+	found := false
+	var e float64
+	for _, v := range values {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && (!found || better(f, e)) {
+			e, found = f, true
+		}
+	}
+	if !found {
+		return ""
+	}
+	return formatFloat(e)
+}
+
+func formatFloat(f float64) string {
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,355 @@
+package query
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Pipeline is a search, followed by a sequence of commands which transform
+// the search results, for example `mnemonic:UPDOWN | stats count by host`.
+type Pipeline struct {
+	Search   string    // Query passed to the search engine. Empty matches everything.
+	Commands []Command // Commands applied, in order, to the search results.
+}
+
+// IsPipeline returns whether the given query contains any pipeline commands.
+func IsPipeline(s string) bool {
+	stages, err := splitStages(s)
+	return err == nil && len(stages) > 1
+}
+
+// ParsePipeline parses the given string as a Pipeline. The first stage is the
+// search, optionally introduced by the "search" keyword. Every other stage is a
+// command.
+func ParsePipeline(s string) (*Pipeline, error) {
+	stages, err := splitStages(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Pipeline{Search: strings.TrimSpace(stages[0])}
+	if verb, rest := splitVerb(p.Search); strings.ToLower(verb) == "search" {
+		p.Search = rest
+	}
+
+	for _, stage := range stages[1:] {
+		verb, rest := splitVerb(stage)
+		if verb == "" {
+			return nil, fmt.Errorf("empty pipeline command")
+		}
+		parse, ok := commands[strings.ToLower(verb)]
+		if !ok {
+			return nil, fmt.Errorf("unknown command '%s'", verb)
+		}
+		args, err := lexArgs(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", strings.ToLower(verb), err.Error())
+		}
+		cmd, err := parse(rest, args)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", strings.ToLower(verb), err.Error())
+		}
+		p.Commands = append(p.Commands, cmd)
+	}
+	return p, nil
+}
+
+// String returns the string representation of the pipeline.
+func (p *Pipeline) String() string {
+	parts := []string{p.Search}
+	for _, c := range p.Commands {
+		parts = append(parts, c.String())
+	}
+	return strings.Join(parts, " | ")
+}
+
+// commandParser parses the arguments of a command. The raw argument text is
+// passed along with its lexed form.
+type commandParser func(raw string, args []arg) (Command, error)
+
+var commands map[string]commandParser
+
+func init() {
+	commands = map[string]commandParser{
+		"search": parseSearch,
+		"stats":  parseStats,
+		"rex":    parseRex,
+		"where":  parseWhere,
+		"sort":   parseSort,
+		"head":   parseHead,
+		"dedup":  parseDedup,
+		"fields": parseFields,
+	}
+}
+
+// arg is a lexed command argument.
+type arg struct {
+	lit    string
+	quoted bool
+}
+
+// is returns whether the argument is the unquoted, case-insensitive, literal s.
+func (a arg) is(s string) bool {
+	return !a.quoted && strings.EqualFold(a.lit, s)
+}
+
+func parseSearch(raw string, args []arg) (Command, error) {
+	expr, err := NewParser(strings.NewReader(raw), RawField).Parse()
+	if err != nil {
+		return nil, err
+	}
+	if expr == nil {
+		return nil, fmt.Errorf("expected SEARCH TERM")
+	}
+	return &SearchCommand{Query: strings.TrimSpace(raw), Expr: expr}, nil
+}
+
+func parseStats(raw string, args []arg) (Command, error) {
+	c := &StatsCommand{}
+	n := 0
+	for n < len(args) && !args[n].is("by") {
+		fn := strings.ToLower(args[n].lit)
+		if _, ok := statsFuncs[fn]; !ok || args[n].quoted {
+			return nil, fmt.Errorf("unknown function '%s'", args[n].lit)
+		}
+		agg := Aggregation{Func: fn}
+		n++
+		if n < len(args) && args[n].is("(") {
+			if n+2 >= len(args) || !args[n+2].is(")") {
+				return nil, fmt.Errorf("expected %s(FIELD)", fn)
+			}
+			agg.Field = args[n+1].lit
+			n += 3
+		}
+		if agg.Field == "" && fn != "count" {
+			return nil, fmt.Errorf("%s requires a field", fn)
+		}
+		if n+1 < len(args) && args[n].is("as") {
+			agg.As = args[n+1].lit
+			n += 2
+		}
+		c.Aggregations = append(c.Aggregations, agg)
+		if n < len(args) && args[n].is(",") {
+			n++
+		}
+	}
+	if len(c.Aggregations) == 0 {
+		return nil, fmt.Errorf("expected at least one function")
+	}
+	if n < len(args) {
+		c.By = fieldList(args[n+1:])
+		if len(c.By) == 0 {
+			return nil, fmt.Errorf("expected FIELD after by")
+		}
+	}
+	return c, nil
+}
+
+func parseRex(raw string, args []arg) (Command, error) {
+	c := &RexCommand{Field: RawField}
+	if len(args) == 4 && args[0].is("field") && args[1].is("=") {
+		c.Field = args[2].lit
+		args = args[3:]
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf(`expected [field=FIELD] "REGEX"`)
+	}
+	re, err := regexp.Compile(args[0].lit)
+	if err != nil {
+		return nil, err
+	}
+	if re.NumSubexp() == 0 {
+		return nil, fmt.Errorf("regex has no named capture groups")
+	}
+	c.Regexp = re
+	return c, nil
+}
+
+func parseWhere(raw string, args []arg) (Command, error) {
+	c := &WhereCommand{}
+	conj := []Condition{}
+	for n := 0; n < len(args); {
+		if n+2 >= len(args) {
+			return nil, fmt.Errorf("expected FIELD OPERATOR VALUE")
+		}
+		cond := Condition{Field: args[n].lit, Op: args[n+1].lit, Value: args[n+2].lit}
+		if _, ok := compareOps[cond.Op]; !ok || args[n+1].quoted {
+			return nil, fmt.Errorf("unknown operator '%s'", cond.Op)
+		}
+		if cond.Op == "~" || cond.Op == "!~" {
+			re, err := regexp.Compile(cond.Value)
+			if err != nil {
+				return nil, err
+			}
+			cond.re = re
+		}
+		conj = append(conj, cond)
+		n += 3
+
+		if n == len(args) || args[n].is("or") {
+			c.Or = append(c.Or, conj)
+			conj = []Condition{}
+		} else if !args[n].is("and") {
+			return nil, fmt.Errorf("found '%s', expected AND or OR", args[n].lit)
+		}
+		n++
+	}
+	if len(c.Or) == 0 || args[len(args)-1].is("and") || args[len(args)-1].is("or") {
+		return nil, fmt.Errorf("expected FIELD OPERATOR VALUE")
+	}
+	return c, nil
+}
+
+func parseSort(raw string, args []arg) (Command, error) {
+	c := &SortCommand{}
+	for _, f := range fieldList(args) {
+		k := SortKey{Field: f}
+		if strings.HasPrefix(f, "-") {
+			k.Field, k.Desc = f[1:], true
+		} else if strings.HasPrefix(f, "+") {
+			k.Field = f[1:]
+		}
+		if k.Field == "" {
+			return nil, fmt.Errorf("expected FIELD")
+		}
+		c.Keys = append(c.Keys, k)
+	}
+	if len(c.Keys) == 0 {
+		return nil, fmt.Errorf("expected at least one FIELD")
+	}
+	return c, nil
+}
+
+func parseHead(raw string, args []arg) (Command, error) {
+	c := &HeadCommand{N: DefaultHeadSize}
+	if len(args) > 1 {
+		return nil, fmt.Errorf("expected at most one COUNT")
+	} else if len(args) == 1 {
+		n, err := strconv.Atoi(args[0].lit)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid count '%s'", args[0].lit)
+		}
+		c.N = n
+	}
+	return c, nil
+}
+
+func parseDedup(raw string, args []arg) (Command, error) {
+	c := &DedupCommand{Fields: fieldList(args)}
+	if len(c.Fields) == 0 {
+		return nil, fmt.Errorf("expected at least one FIELD")
+	}
+	return c, nil
+}
+
+func parseFields(raw string, args []arg) (Command, error) {
+	c := &FieldsCommand{}
+	if len(args) > 0 && (args[0].is("-") || args[0].is("+")) {
+		c.Remove = args[0].is("-")
+		args = args[1:]
+	}
+	c.Fields = fieldList(args)
+	if len(c.Fields) == 0 {
+		return nil, fmt.Errorf("expected at least one FIELD")
+	}
+	return c, nil
+}
+
+// fieldList returns the field names in a comma or space separated argument list.
+func fieldList(args []arg) []string {
+	var fields []string
+	for _, a := range args {
+		if !a.is(",") {
+			fields = append(fields, a.lit)
+		}
+	}
+	return fields
+}
+
+// splitStages splits s on every pipe character that is not within double quotes.
+func splitStages(s string) ([]string, error) {
+	var stages []string
+	var buf bytes.Buffer
+	quoted, escaped := false, false
+	for _, ch := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && ch == '\\':
+			escaped = true
+		case ch == '"':
+			quoted = !quoted
+		case ch == '|' && !quoted:
+			stages = append(stages, buf.String())
+			buf.Reset()
+			continue
+		}
+		buf.WriteRune(ch)
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quoted string")
+	}
+	return append(stages, buf.String()), nil
+}
+
+// splitVerb returns the first word of s, and the remainder of s.
+func splitVerb(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	n := strings.IndexFunc(s, isWhitespace)
+	if n < 0 {
+		return s, ""
+	}
+	return s[:n], strings.TrimSpace(s[n:])
+}
+
+// lexArgs splits command arguments into words, double-quoted strings, and the
+// punctuation "(", ")", "," and comparison operators.
+func lexArgs(s string) ([]arg, error) {
+	var args []arg
+	r := []rune(s)
+	for n := 0; n < len(r); {
+		ch := r[n]
+		switch {
+		case isWhitespace(ch):
+			n++
+		case ch == '"':
+			var buf bytes.Buffer
+			for n++; n < len(r) && r[n] != '"'; n++ {
+				if r[n] == '\\' && n+1 < len(r) && r[n+1] == '"' {
+					n++
+				}
+				buf.WriteRune(r[n])
+			}
+			if n == len(r) {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+			args = append(args, arg{lit: buf.String(), quoted: true})
+			n++
+		case isParen(ch) || ch == ',':
+			args = append(args, arg{lit: string(ch)})
+			n++
+		case isOperator(ch):
+			m := n + 1
+			for m < len(r) && isOperator(r[m]) {
+				m++
+			}
+			args = append(args, arg{lit: string(r[n:m])})
+			n = m
+		default:
+			m := n + 1
+			for m < len(r) && !isWhitespace(r[m]) && !isParen(r[m]) && r[m] != ',' && r[m] != '"' && !isOperator(r[m]) {
+				m++
+			}
+			args = append(args, arg{lit: string(r[n:m])})
+			n = m
+		}
+	}
+	return args, nil
+}
+
+func isOperator(ch rune) bool {
+	return ch == '=' || ch == '!' || ch == '<' || ch == '>' || ch == '~'
+}
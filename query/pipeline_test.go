@@ -0,0 +1,173 @@
+package query
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// Ensure pipelines are split into a search and commands, and printed back.
+func TestParsePipeline(t *testing.T) {
+	var tests = []struct {
+		s      string
+		search string
+		str    string
+		err    string
+	}{
+		{s: `sshd`, search: `sshd`, str: `sshd`},
+		{s: `search sshd`, search: `sshd`, str: `sshd`},
+		{s: ` | stats count`, search: ``, str: ` | stats count`},
+		{
+			s:      `mnemonic:UPDOWN | stats count by host | sort -count | head 10`,
+			search: `mnemonic:UPDOWN`,
+			str:    `mnemonic:UPDOWN | stats count by host | sort -count | head 10`,
+		},
+		{
+			s:      `link | rex "Interface (?P<ifname>\S+)" | stats dc(ifname) as ifs, count by host, app`,
+			search: `link`,
+			str:    `link | rex field=_raw "Interface (?P<ifname>\\S+)" | stats dc(ifname) as ifs, count by host, app`,
+		},
+		{
+			s:      `link | rex field=host "(?P<site>[a-z]+)-" | where site = "lon" and count >= 3 or site != x`,
+			search: `link`,
+			str:    `link | rex field=host "(?P<site>[a-z]+)-" | where site = "lon" and count >= "3" or site != "x"`,
+		},
+		{
+			s:      `"a|b" | dedup host app | fields - _raw | search GET OR host:web`,
+			search: `"a|b"`,
+			str:    `"a|b" | dedup host, app | fields - _raw | search GET OR host:web`,
+		},
+		{s: `x | head`, search: `x`, str: `x | head 10`},
+
+		// Errors
+		{s: `x | `, err: `empty pipeline command`},
+		{s: `x | frobnicate`, err: `unknown command 'frobnicate'`},
+		{s: `x | stats`, err: `stats: expected at least one function`},
+		{s: `x | stats median(x)`, err: `stats: unknown function 'median'`},
+		{s: `x | stats sum`, err: `stats: sum requires a field`},
+		{s: `x | stats count by`, err: `stats: expected FIELD after by`},
+		{s: `x | rex "no groups"`, err: `rex: regex has no named capture groups`},
+		{s: `x | where a`, err: `where: expected FIELD OPERATOR VALUE`},
+		{s: `x | where a = 1 and`, err: `where: expected FIELD OPERATOR VALUE`},
+		{s: `x | where a => 1`, err: `where: unknown operator '=>'`},
+		{s: `x | head ten`, err: `head: invalid count 'ten'`},
+		{s: `x | sort`, err: `sort: expected at least one FIELD`},
+		{s: `x | search`, err: `search: expected SEARCH TERM`},
+		{s: `x | where a = "b`, err: `unterminated quoted string`},
+	}
+
+	for i, tt := range tests {
+		p, err := ParsePipeline(tt.s)
+		if tt.err != errstring(err) {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+			continue
+		} else if err != nil {
+			continue
+		}
+		if p.Search != tt.search {
+			t.Errorf("%d. %q: search mismatch: exp=%q got=%q", i, tt.s, tt.search, p.Search)
+		}
+		if p.String() != tt.str {
+			t.Errorf("%d. %q: string mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.str, p.String())
+		}
+	}
+}
+
+func TestIsPipeline(t *testing.T) {
+	for s, exp := range map[string]bool{
+		`sshd`:                  false,
+		`"a | b"`:               false,
+		`sshd | head`:           true,
+		`"unterminated | head`:  false,
+		`host:r1 | stats count`: true,
+	} {
+		if IsPipeline(s) != exp {
+			t.Errorf("%q: exp %v", s, exp)
+		}
+	}
+}
+
+// Ensure pipelines evaluate to the expected tables.
+func TestPipeline_Eval(t *testing.T) {
+	rows := []Row{
+		{TimeField: "1", "host": "r1", RawField: "Interface Gi0/1 is down", "bytes": "10"},
+		{TimeField: "2", "host": "r2", RawField: "Interface Gi0/2 is down", "bytes": "5"},
+		{TimeField: "3", "host": "r1", RawField: "Interface Gi0/1 is up", "bytes": "7.5"},
+		{TimeField: "4", "host": "r3", RawField: "Configured from console", "bytes": "x"},
+		{TimeField: "5", "host": "r1", RawField: "Interface Gi0/3 is down"},
+	}
+
+	var tests = []struct {
+		s       string
+		columns []string
+		values  [][]string
+	}{
+		{
+			s:       `* | stats count by host | sort -count, host`,
+			columns: []string{"host", "count"},
+			values:  [][]string{{"r1", "3"}, {"r2", "1"}, {"r3", "1"}},
+		},
+		{
+			s:       `* | stats count, sum(bytes), avg(bytes) as avg, min(bytes), max(bytes)`,
+			columns: []string{"count", "sum(bytes)", "avg", "min(bytes)", "max(bytes)"},
+			values:  [][]string{{"5", "22.5", "7.5", "5", "10"}},
+		},
+		{
+			s:       `* | rex "Interface (?P<ifname>\S+) is (?P<state>\w+)" | where state = down | stats dc(ifname) as ifs by host | sort host`,
+			columns: []string{"host", "ifs"},
+			values:  [][]string{{"r1", "2"}, {"r2", "1"}},
+		},
+		{
+			s:       `* | where bytes > 6 or host = r3 | fields host, bytes`,
+			columns: []string{"host", "bytes"},
+			values:  [][]string{{"r1", "10"}, {"r1", "7.5"}, {"r3", "x"}},
+		},
+		{
+			s:       `* | where _raw ~ "Gi0/[12]" and host != r2 | dedup host | fields - _raw`,
+			columns: []string{TimeField, "host"},
+			values:  [][]string{{"1", "r1"}},
+		},
+		{
+			s:       `* | search down AND host:r1 | sort -_time | head 1`,
+			columns: DefaultColumns,
+			values:  [][]string{{"5", "r1", "Interface Gi0/3 is down"}},
+		},
+		{
+			s:       `* | search notfound | stats count`,
+			columns: []string{"count"},
+			values:  [][]string{{"0"}},
+		},
+	}
+
+	for i, tt := range tests {
+		p, err := ParsePipeline(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %q: failed to parse: %s", i, tt.s, err)
+		}
+		tbl, err := p.Eval(rows)
+		if err != nil {
+			t.Fatalf("%d. %q: failed to evaluate: %s", i, tt.s, err)
+		}
+		if !reflect.DeepEqual(tbl.Columns, tt.columns) {
+			t.Errorf("%d. %q: columns mismatch: exp=%v got=%v", i, tt.s, tt.columns, tbl.Columns)
+		}
+		if !reflect.DeepEqual(tbl.Values(), tt.values) {
+			t.Errorf("%d. %q: values mismatch: exp=%v got=%v", i, tt.s, tt.values, tbl.Values())
+		}
+	}
+}
+
+func TestTable_WriteText(t *testing.T) {
+	tbl := &Table{
+		Columns: []string{"host", "count"},
+		Rows:    []Row{{"host": "router1", "count": "3"}, {"host": "r2", "count": "12"}},
+	}
+	var buf bytes.Buffer
+	if err := tbl.WriteText(&buf); err != nil {
+		t.Fatalf("failed to write table: %s", err)
+	}
+	exp := "host     count\nrouter1  3\nr2       12\n"
+	if buf.String() != exp {
+		t.Fatalf("table text mismatch:\nexp=%q\ngot=%q", exp, buf.String())
+	}
+}
@@ -2,21 +2,49 @@ package ekanite
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/ekanite/ekanite/query"
 )
 
 // Searcher is the interface any object that perform searches should implement.
+// A search must be abandoned, and its channel closed, once ctx is cancelled.
 type Searcher interface {
-	Search(query string) (<-chan string, error)
+	Search(ctx context.Context, query string) (<-chan string, error)
 }
 
+// maxAuthAttempts is the number of failed AUTH commands after which a query client
+// is disconnected.
+const maxAuthAttempts = 3
+
+// errCloseSession is returned by a protocol command when the connection must be closed.
+var errCloseSession = errors.New("session closed")
+
 // Server serves query client connections.
+//
+// Each line sent by a client is either a protocol command, such as SEARCH or COUNT,
+// or a plain search for telnet users. The response to a command is zero or more data
+// lines, each a JSON value, followed by a single status line, made of a three-digit
+// status code and a message. Status codes follow their HTTP equivalents. A plain
+// search is answered with the matching log lines, followed by two newlines.
 type Server struct {
 	iface    string
 	Searcher Searcher
+	Tailer   *Tailer        // If set, clients may tail newly indexed events.
+	Auth     *Authenticator // If set, clients must authenticate with the AUTH command.
+	TLS      *tls.Config    // If set, clients must connect using TLS.
+	Audit    *AuditLog      // If set, every query is recorded.
 
 	addr net.Addr
 
@@ -40,6 +68,9 @@ func (s *Server) Start() error {
 	}
 
 	s.addr = ln.Addr()
+	if s.TLS != nil {
+		ln = tls.NewListener(ln, s.TLS)
+	}
 
 	go func() {
 		for {
@@ -58,6 +89,46 @@ func (s *Server) Addr() net.Addr {
 	return s.addr
 }
 
+// session is the state of a query client connection.
+type session struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	ctx           context.Context // Carries the authenticated user, if any.
+	authenticated bool
+	attempts      int // Failed AUTH commands.
+
+	limit      int       // Maximum number of events returned by SEARCH. Zero is unlimited.
+	start, end time.Time // Time range searched. Zero is unbounded.
+}
+
+// client returns the address of the client.
+func (c *session) client() string {
+	return c.conn.RemoteAddr().String()
+}
+
+// status writes a status line, ending the response to a command.
+func (c *session) status(code int, format string, v ...interface{}) error {
+	_, err := fmt.Fprintf(c.conn, "%d %s\n", code, fmt.Sprintf(format, v...))
+	return err
+}
+
+// data writes v as a line of JSON.
+func (c *session) data(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(append(b, '\n'))
+	return err
+}
+
+// searchRequest returns a request for the events matching q, within the session's
+// time range and limit.
+func (c *session) searchRequest(q string) *SearchRequest {
+	return &SearchRequest{Query: q, Start: c.start, End: c.end, Limit: c.limit}
+}
+
 func (s *Server) handleConnection(conn net.Conn) {
 	defer func() {
 		conn.Close()
@@ -65,29 +136,406 @@ func (s *Server) handleConnection(conn net.Conn) {
 	}()
 	s.Logger.Printf("new connection from %s", conn.RemoteAddr())
 
-	reader := bufio.NewReader(conn)
+	c := &session{
+		conn:          conn,
+		reader:        bufio.NewReader(conn),
+		ctx:           context.Background(),
+		authenticated: s.Auth == nil,
+	}
 	for {
-		b, err := reader.ReadString('\n')
+		b, err := c.reader.ReadString('\n')
 		if err != nil {
-			conn.Close()
 			return
 		}
 
-		query := strings.Trim(b, "\r\n")
-		if query == "" {
+		line := strings.Trim(b, "\r\n")
+		if strings.TrimSpace(line) == "" {
 			continue
 		}
 
-		s.Logger.Printf("executing query '%s'", query)
-		c, err := s.Searcher.Search(query)
-		if err != nil {
-			conn.Write([]byte(err.Error()))
-		} else {
-			for s := range c {
-				conn.Write([]byte(s + "\n"))
+		verb, args := splitCommand(line)
+		cmd := lookupProtocolCommand(verb)
+		if cmd != nil && !cmd.anonymous && !c.authenticated {
+			c.status(http.StatusUnauthorized, "authentication required")
+			continue
+		}
+		if cmd != nil {
+			if err := cmd.run(s, c, args); err != nil {
+				// The client has gone away, or the session is over.
+				return
 			}
+			continue
+		}
+
+		// Any other line is a plain search.
+		if !c.authenticated {
+			c.status(http.StatusUnauthorized, "authentication required")
+			continue
+		}
+		s.Logger.Printf("executing query '%s'", line)
+		if err := s.query(c, line); err != nil {
+			// The client has gone away.
+			return
 		}
 		// Send two newlines to indicate end-of-results.
 		conn.Write([]byte("\n\n"))
 	}
 }
+
+// query writes the log lines matching q, or the output of the pipeline q as text, to
+// the connection. If the results cannot be written, the query is cancelled and the
+// write error returned.
+func (s *Server) query(c *session, q string) error {
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+
+	if query.IsPipeline(q) {
+		rec := newAuditRecord(ctx, "tcp", c.client(), "pipeline", q)
+		defer s.Audit.Record(rec)
+		t, err := runPipeline(ctx, s.Searcher, q)
+		if err != nil {
+			rec.fail(err)
+			_, err = c.conn.Write([]byte(err.Error() + "\n"))
+			return err
+		}
+		rec.Results = len(t.Rows)
+		return t.WriteText(c.conn)
+	}
+
+	rec := newAuditRecord(ctx, "tcp", c.client(), "search", q)
+	defer s.Audit.Record(rec)
+	ch, searchErr, err := searchSources(ctx, s.Searcher, q)
+	if err != nil {
+		rec.fail(err)
+		_, err = c.conn.Write([]byte(err.Error() + "\n"))
+		return err
+	}
+	for r := range ch {
+		if _, err := c.conn.Write([]byte(r + "\n")); err != nil {
+			rec.fail(err)
+			return err
+		}
+		rec.Results++
+	}
+	if err := searchErr(); err != nil {
+		// Report why the results are incomplete, rather than end them as if complete.
+		rec.fail(err)
+		_, err = fmt.Fprintf(c.conn, "error executing query after %d events: %s\n", rec.Results, err.Error())
+		return err
+	}
+	return nil
+}
+
+// searchSources performs the search q, returning the source of each matching event.
+// Once the channel is closed, searchErr reports the error which ended the search
+// early, such as the query timing out, if the searcher can report one.
+func searchSources(ctx context.Context, s Searcher, q string) (c <-chan string, searchErr func() error, err error) {
+	rs, ok := s.(ResultSearcher)
+	if !ok {
+		c, err := s.Search(ctx, q)
+		return c, func() error { return nil }, err
+	}
+	results, err := rs.SearchResults(ctx, &SearchRequest{Query: q})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sources := make(chan string, 1)
+	go func() {
+		defer close(sources)
+		// Read every result, even once ctx is cancelled, so that the search has
+		// ended, and its error is set, when the channel is closed.
+		for r := range results.C {
+			select {
+			case sources <- r.Source:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return sources, results.Err, nil
+}
+
+// protocolCommand is a command of the query protocol.
+type protocolCommand struct {
+	name        string
+	usage       string
+	description string
+	anonymous   bool // Set if the command may be run before authenticating.
+
+	// run executes the command, returning an error only if the connection must
+	// be closed.
+	run func(s *Server, c *session, args string) error
+}
+
+var protocolCommands []*protocolCommand
+
+func init() {
+	protocolCommands = []*protocolCommand{
+		{"AUTH", "AUTH USER PASSWORD | AUTH TOKEN TOKEN", "Authenticate the connection", true, (*Server).cmdAuth},
+		{"SEARCH", "SEARCH QUERY", "Return the events, or pipeline rows, matching QUERY", false, (*Server).cmdSearch},
+		{"COUNT", "COUNT QUERY", "Return the number of events matching QUERY", false, (*Server).cmdCount},
+		{"TAIL", "TAIL [QUERY]", "Return events matching QUERY as they are indexed, until another line is sent", false, (*Server).cmdTail},
+		{"INDEXES", "INDEXES", "Describe every index", false, (*Server).cmdIndexes},
+		{"STATS", "STATS", "Return the engine statistics", false, (*Server).cmdStats},
+		{"LIMIT", "LIMIT [N]", "Return at most N events from each SEARCH. Zero is unlimited", false, (*Server).cmdLimit},
+		{"RANGE", "RANGE [START [END]]", "Search only between START and END, as RFC3339, now, a duration before now, or * for unbounded", false, (*Server).cmdRange},
+		{"HELP", "HELP", "Describe every command", true, (*Server).cmdHelp},
+		{"QUIT", "QUIT", "Close the connection", true, (*Server).cmdQuit},
+	}
+}
+
+// lookupProtocolCommand returns the command with the given name, ignoring case, or
+// nil if there is no such command.
+func lookupProtocolCommand(name string) *protocolCommand {
+	for _, cmd := range protocolCommands {
+		if strings.EqualFold(cmd.name, name) {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func (s *Server) cmdAuth(c *session, args string) error {
+	u, err := s.authenticate(args)
+	if err != nil {
+		s.Logger.Printf("failed authentication from %s", c.client())
+		if err := c.status(http.StatusUnauthorized, err.Error()); err != nil {
+			return err
+		}
+		if c.attempts++; c.attempts == maxAuthAttempts {
+			return errCloseSession
+		}
+		return nil
+	}
+	s.Logger.Printf("%s authenticated as %s", c.client(), u.Name)
+	c.ctx, c.authenticated = WithUser(context.Background(), u), true
+	return c.status(http.StatusOK, "authenticated as %s", u.Name)
+}
+
+// cmdSearch writes each matching event as a JSON object. The output of a pipeline is
+// written as an array of column names, followed by an array of values for each row.
+func (s *Server) cmdSearch(c *session, args string) error {
+	rs, ok := s.Searcher.(ResultSearcher)
+	if !ok {
+		return c.status(http.StatusNotImplemented, "SEARCH is not supported")
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	req := c.searchRequest(args)
+	s.Logger.Printf("executing query '%s'", req.Query)
+
+	if query.IsPipeline(req.Query) {
+		rec := newAuditRecord(ctx, "tcp", c.client(), "pipeline", req.Query)
+		rec.setRange(req.Start, req.End)
+		defer s.Audit.Record(rec)
+		t, err := RunPipeline(ctx, rs, req)
+		if err != nil {
+			rec.fail(err)
+			return c.status(queryErrorStatus(err), "error executing pipeline: %s", err.Error())
+		}
+		rec.Results = len(t.Rows)
+		if err := c.data(t.Columns); err != nil {
+			return err
+		}
+		for _, row := range t.Values() {
+			if err := c.data(row); err != nil {
+				return err
+			}
+		}
+		return c.status(http.StatusOK, "%d rows", len(t.Rows))
+	}
+
+	rec := newAuditRecord(ctx, "tcp", c.client(), "search", req.Query)
+	rec.setRange(req.Start, req.End)
+	defer s.Audit.Record(rec)
+	results, err := rs.SearchResults(ctx, req)
+	if err != nil {
+		rec.fail(err)
+		return c.status(queryErrorStatus(err), "error executing query: %s", err.Error())
+	}
+	for r := range results.C {
+		if err := c.data(newAPIHit(r)); err != nil {
+			rec.fail(err)
+			return err
+		}
+		rec.Results++
+	}
+	if err := results.Err(); err != nil {
+		rec.fail(err)
+		return c.status(queryErrorStatus(err), "error executing query after %d events: %s", rec.Results, err.Error())
+	}
+	return c.status(http.StatusOK, "%d events", rec.Results)
+}
+
+func (s *Server) cmdCount(c *session, args string) error {
+	api, ok := s.Searcher.(APISearcher)
+	if !ok {
+		return c.status(http.StatusNotImplemented, "COUNT is not supported")
+	}
+	req := c.searchRequest(args)
+	rec := newAuditRecord(c.ctx, "tcp", c.client(), "count", req.Query)
+	rec.setRange(req.Start, req.End)
+	defer s.Audit.Record(rec)
+	n, err := api.Count(c.ctx, req)
+	if err != nil {
+		rec.fail(err)
+		return c.status(queryErrorStatus(err), "error executing query: %s", err.Error())
+	}
+	rec.Results = int(n)
+	if err := c.data(&apiCountResponse{Query: req.Query, Count: n}); err != nil {
+		return err
+	}
+	return c.status(http.StatusOK, "OK")
+}
+
+// cmdTail writes events matching the query, as JSON objects, as they are indexed, until
+// the client sends another line or disconnects.
+func (s *Server) cmdTail(c *session, args string) error {
+	if s.Tailer == nil {
+		return c.status(http.StatusNotImplemented, "TAIL is not supported")
+	}
+	rec := newAuditRecord(c.ctx, "tcp", c.client(), "tail", args)
+	defer s.Audit.Record(rec)
+	sub, err := s.Tailer.Subscribe(c.ctx, args, 0)
+	if err != nil {
+		rec.fail(err)
+		return c.status(http.StatusBadRequest, err.Error())
+	}
+	defer s.Tailer.Unsubscribe(sub)
+	s.Logger.Printf("tailing query '%s'", sub.Query)
+
+	// Any further input from the client, including disconnection, ends the tail.
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.reader.ReadString('\n')
+		done <- err
+	}()
+
+	for {
+		select {
+		case r := <-sub.C():
+			if err := c.data(newAPIHit(r)); err != nil {
+				rec.fail(err)
+				c.conn.Close()
+				<-done
+				return err
+			}
+			rec.Results++
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+			return c.status(http.StatusOK, "%d events, %d dropped", rec.Results, sub.Dropped())
+		}
+	}
+}
+
+func (s *Server) cmdIndexes(c *session, args string) error {
+	api, ok := s.Searcher.(APISearcher)
+	if !ok {
+		return c.status(http.StatusNotImplemented, "INDEXES is not supported")
+	}
+	infos, err := api.IndexInfo()
+	if err != nil {
+		return c.status(http.StatusInternalServerError, err.Error())
+	}
+	for _, i := range infos {
+		if err := c.data(i); err != nil {
+			return err
+		}
+	}
+	return c.status(http.StatusOK, "%d indexes", len(infos))
+}
+
+func (s *Server) cmdStats(c *session, args string) error {
+	if err := c.data(json.RawMessage(stats.String())); err != nil {
+		return err
+	}
+	return c.status(http.StatusOK, "OK")
+}
+
+func (s *Server) cmdLimit(c *session, args string) error {
+	if args != "" {
+		n, err := strconv.Atoi(args)
+		if err != nil || n < 0 {
+			return c.status(http.StatusBadRequest, "limit must be a non-negative integer")
+		}
+		c.limit = n
+	}
+	return c.status(http.StatusOK, "limit %d", c.limit)
+}
+
+func (s *Server) cmdRange(c *session, args string) error {
+	var start, end time.Time
+	if args != "" {
+		now := time.Now().UTC()
+		first, second := splitCommand(args)
+		var err error
+		if start, err = parseRangeTime(first, now); err != nil {
+			return c.status(http.StatusBadRequest, err.Error())
+		}
+		if end, err = parseRangeTime(second, now); err != nil {
+			return c.status(http.StatusBadRequest, err.Error())
+		}
+		if !start.IsZero() && !end.IsZero() && !end.After(start) {
+			return c.status(http.StatusBadRequest, "end must be after start")
+		}
+	}
+	c.start, c.end = start, end
+	return c.status(http.StatusOK, "range %s %s", formatRangeTime(start), formatRangeTime(end))
+}
+
+func (s *Server) cmdHelp(c *session, args string) error {
+	for _, cmd := range protocolCommands {
+		if err := c.data(map[string]string{"usage": cmd.usage, "description": cmd.description}); err != nil {
+			return err
+		}
+	}
+	return c.status(http.StatusOK, "%d commands. Any other line is a plain search", len(protocolCommands))
+}
+
+func (s *Server) cmdQuit(c *session, args string) error {
+	c.status(http.StatusOK, "bye")
+	return errCloseSession
+}
+
+// parseRangeTime parses a RANGE time as parseTimeParam does, where "*" is unbounded.
+func parseRangeTime(v string, now time.Time) (time.Time, error) {
+	if v == "*" {
+		return time.Time{}, nil
+	}
+	return parseTimeParam(v, now)
+}
+
+// formatRangeTime returns t as RFC3339, or "*" if t is zero.
+func formatRangeTime(t time.Time) string {
+	if t.IsZero() {
+		return "*"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// authenticate returns the user identified by the arguments of an AUTH command,
+// either "USER PASSWORD" or "TOKEN TOKEN".
+func (s *Server) authenticate(args string) (*User, error) {
+	if s.Auth == nil {
+		return nil, fmt.Errorf("authentication is not enabled")
+	}
+	name, secret := splitCommand(args)
+	if name == "" || secret == "" {
+		return nil, fmt.Errorf("expected AUTH USER PASSWORD or AUTH TOKEN TOKEN")
+	}
+	if strings.EqualFold(name, "TOKEN") {
+		return s.Auth.Token(secret)
+	}
+	return s.Auth.Password(name, secret)
+}
+
+// splitCommand returns the first word of the line, and the remainder of the line.
+func splitCommand(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if n := strings.IndexAny(line, " \t"); n >= 0 {
+		return line[:n], strings.TrimSpace(line[n:])
+	}
+	return line, ""
+}
@@ -0,0 +1,911 @@
+package ekanite
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ekanite/ekanite/query"
+)
+
+// REST API defaults
+const (
+	DefaultAPILimit = 100
+	MaxAPILimit     = maxSearchHitSize
+
+	exportLogInterval = 100000 // Number of exported events between progress log messages.
+)
+
+// APISearcher is the interface a Searcher must implement for the HTTPServer to
+// serve the REST API.
+type APISearcher interface {
+	ResultSearcher
+	Count(ctx context.Context, req *SearchRequest) (uint64, error)
+	IndexInfo() ([]IndexInfo, error)
+}
+
+// SurroundingSearcher is the interface a Searcher must implement for the HTTPServer
+// to serve the events surrounding an event.
+type SurroundingSearcher interface {
+	Surrounding(ctx context.Context, id DocID, before, after int) (*SurroundingResult, error)
+}
+
+// apiHit is a single search hit returned by the REST API.
+type apiHit struct {
+	ID         DocID             `json:"id"`
+	Time       time.Time         `json:"time"`
+	Source     string            `json:"source"`
+	Fields     map[string]string `json:"fields"`
+	Highlights []string          `json:"highlights,omitempty"`
+}
+
+// newAPIHit returns the REST API representation of a search result.
+func newAPIHit(r *Result) apiHit {
+	return apiHit{ID: r.ID, Time: r.Time(), Source: r.Source, Fields: r.Fields, Highlights: r.Highlights}
+}
+
+// apiHits returns the REST API representation of search results.
+func apiHits(results []*Result) []apiHit {
+	hits := make([]apiHit, 0, len(results))
+	for _, r := range results {
+		hits = append(hits, newAPIHit(r))
+	}
+	return hits
+}
+
+// apiSearchResponse is the response to a REST API search. Pipelines return
+// columns and rows, rather than hits.
+type apiSearchResponse struct {
+	Query   string     `json:"query"`
+	Total   uint64     `json:"total"`
+	Took    float64    `json:"took"` // Milliseconds
+	Hits    []apiHit   `json:"hits,omitempty"`
+	Columns []string   `json:"columns,omitempty"`
+	Rows    [][]string `json:"rows,omitempty"`
+}
+
+// apiCountResponse is the response to a REST API count.
+type apiCountResponse struct {
+	Query string  `json:"query"`
+	Count uint64  `json:"count"`
+	Took  float64 `json:"took"` // Milliseconds
+}
+
+// apiContextResponse is the response to a REST API request for the events
+// surrounding an event.
+type apiContextResponse struct {
+	Event  apiHit   `json:"event"`
+	Before []apiHit `json:"before"`
+	After  []apiHit `json:"after"`
+}
+
+// apiIndexesResponse is the response to a REST API index listing.
+type apiIndexesResponse struct {
+	Indexes []IndexInfo `json:"indexes"`
+}
+
+// apiAuditResponse is the body of an audit log search response.
+type apiAuditResponse struct {
+	Records []*AuditRecord `json:"records"`
+}
+
+// apiSavedSearchesResponse is the response to a REST API saved search listing.
+type apiSavedSearchesResponse struct {
+	Searches []*SavedSearch `json:"searches"`
+}
+
+// apiAlertsResponse is the response to a REST API alert history request.
+type apiAlertsResponse struct {
+	Alerts []*Alert `json:"alerts"`
+}
+
+// apiMaintenanceResponse is the response to a REST API maintenance window listing.
+type apiMaintenanceResponse struct {
+	Windows []*MaintenanceWindow `json:"windows"`
+}
+
+// apiReloadResponse is the response to a REST API reload request.
+type apiReloadResponse struct {
+	Changes []string `json:"changes"`
+}
+
+// apiError is the body of every REST API error response.
+type apiError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// serveAPI serves the given endpoint of the versioned REST API, such as /api/v1/search.
+func (s *HTTPServer) serveAPI(w http.ResponseWriter, r *http.Request, endpoint string) {
+	s.setCORSHeaders(w, r)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, "error parsing form: "+err.Error())
+		return
+	}
+	if endpoint == "/api/v1/searches" || strings.HasPrefix(endpoint, "/api/v1/searches/") {
+		s.apiSavedSearches(w, r, strings.Trim(strings.TrimPrefix(endpoint, "/api/v1/searches"), "/"))
+		return
+	}
+	if endpoint == "/api/v1/maintenance" || strings.HasPrefix(endpoint, "/api/v1/maintenance/") {
+		s.apiMaintenance(w, r, strings.Trim(strings.TrimPrefix(endpoint, "/api/v1/maintenance"), "/"))
+		return
+	}
+	if endpoint == "/api/v1/reload" {
+		s.apiReload(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" && r.Method != "POST" {
+		writeAPIError(w, r, http.StatusMethodNotAllowed, "unsupported method")
+		return
+	}
+
+	api, ok := s.Searcher.(APISearcher)
+	if !ok {
+		writeAPIError(w, r, http.StatusNotImplemented, "REST API is not supported")
+		return
+	}
+
+	switch strings.TrimSuffix(endpoint, "/") {
+	case "/api/v1/search":
+		s.apiSearch(w, r, api)
+	case "/api/v1/count":
+		s.apiCount(w, r, api)
+	case "/api/v1/indexes":
+		s.apiIndexes(w, r, api)
+	case "/api/v1/export":
+		s.apiExport(w, r, api)
+	case "/api/v1/context":
+		s.apiContext(w, r, api)
+	case "/api/v1/audit":
+		s.apiAudit(w, r)
+	default:
+		writeAPIError(w, r, http.StatusNotFound, fmt.Sprintf("no such endpoint %s", endpoint))
+	}
+}
+
+// apiSearch serves search results, or pipeline output, as JSON.
+func (s *HTTPServer) apiSearch(w http.ResponseWriter, r *http.Request, api APISearcher) {
+	req, err := searchRequestFromForm(r, time.Now().UTC())
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.Logger.Printf("executing API query '%s'", req.Query)
+	stats.Add("apiSearches", 1)
+
+	start := time.Now()
+	if query.IsPipeline(req.Query) {
+		rec := s.newAPIAuditRecord(r, "pipeline", req)
+		defer s.Audit.Record(rec)
+		t, err := RunPipeline(r.Context(), api, req)
+		if err != nil {
+			rec.fail(err)
+			writeAPIError(w, r, queryErrorStatus(err), "error executing pipeline: "+err.Error())
+			return
+		}
+		rec.Results = len(t.Rows)
+		writeJSON(w, r, http.StatusOK, &apiSearchResponse{
+			Query:   req.Query,
+			Total:   uint64(len(t.Rows)),
+			Took:    millis(time.Since(start)),
+			Columns: t.Columns,
+			Rows:    t.Values(),
+		})
+		return
+	}
+
+	rec := s.newAPIAuditRecord(r, "search", req)
+	defer s.Audit.Record(rec)
+	total, err := api.Count(r.Context(), req)
+	if err != nil {
+		rec.fail(err)
+		writeAPIError(w, r, queryErrorStatus(err), "error executing query: "+err.Error())
+		return
+	}
+	results, err := api.SearchResults(r.Context(), req)
+	if err != nil {
+		rec.fail(err)
+		writeAPIError(w, r, queryErrorStatus(err), "error executing query: "+err.Error())
+		return
+	}
+	hits := make([]apiHit, 0)
+	for res := range results.C {
+		hits = append(hits, newAPIHit(res))
+	}
+	if err := results.Err(); err != nil {
+		rec.fail(err)
+		writeAPIError(w, r, queryErrorStatus(err), "error executing query: "+err.Error())
+		return
+	}
+	rec.Results = len(hits)
+	writeJSON(w, r, http.StatusOK, &apiSearchResponse{
+		Query: req.Query,
+		Total: total,
+		Took:  millis(time.Since(start)),
+		Hits:  hits,
+	})
+}
+
+// apiCount serves the number of events matching a query.
+func (s *HTTPServer) apiCount(w http.ResponseWriter, r *http.Request, api APISearcher) {
+	req, err := searchRequestFromForm(r, time.Now().UTC())
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rec := s.newAPIAuditRecord(r, "count", req)
+	defer s.Audit.Record(rec)
+	start := time.Now()
+	count, err := api.Count(r.Context(), req)
+	if err != nil {
+		rec.fail(err)
+		writeAPIError(w, r, queryErrorStatus(err), "error executing query: "+err.Error())
+		return
+	}
+	rec.Results = int(count)
+	writeJSON(w, r, http.StatusOK, &apiCountResponse{
+		Query: req.Query,
+		Count: count,
+		Took:  millis(time.Since(start)),
+	})
+}
+
+// apiContext serves the event given by the "id" parameter, along with the events
+// from the same host which occurred immediately before and after it. The number of
+// events is given by the "before" and "after" parameters, or by "context" for both.
+func (s *HTTPServer) apiContext(w http.ResponseWriter, r *http.Request, api APISearcher) {
+	sr, ok := api.(SurroundingSearcher)
+	if !ok {
+		writeAPIError(w, r, http.StatusNotImplemented, "context is not supported")
+		return
+	}
+	id := DocID(r.FormValue("id"))
+	if id == "" {
+		writeAPIError(w, r, http.StatusBadRequest, "id is required")
+		return
+	}
+
+	n, err := intParam(r, "context", DefaultSurrounding)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	before, err := intParam(r, "before", n)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	after, err := intParam(r, "after", n)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rec := newAuditRecord(r.Context(), "http", r.RemoteAddr, "context", string(id))
+	defer s.Audit.Record(rec)
+	res, err := sr.Surrounding(r.Context(), id, before, after)
+	if err != nil {
+		rec.fail(err)
+		writeAPIError(w, r, queryErrorStatus(err), err.Error())
+		return
+	}
+	rec.Results = 1 + len(res.Before) + len(res.After)
+	writeJSON(w, r, http.StatusOK, &apiContextResponse{
+		Event:  newAPIHit(res.Event),
+		Before: apiHits(res.Before),
+		After:  apiHits(res.After),
+	})
+}
+
+// apiAudit serves the latest audit records matching the "user", "client" and "q"
+// parameters, within the time range given by "start" and "end". Only auditors may
+// search the audit log, if authentication is enabled.
+func (s *HTTPServer) apiAudit(w http.ResponseWriter, r *http.Request) {
+	if s.Audit == nil {
+		writeAPIError(w, r, http.StatusNotImplemented, "audit log is not enabled")
+		return
+	}
+	if s.Auth != nil {
+		if u, ok := UserFromContext(r.Context()); !ok || !u.Auditor {
+			writeAPIError(w, r, http.StatusForbidden, "only auditors may search the audit log")
+			return
+		}
+	}
+	sr, err := searchRequestFromForm(r, time.Now().UTC())
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	req := &AuditSearchRequest{
+		User:   r.FormValue("user"),
+		Client: r.FormValue("client"),
+		Query:  sr.Query,
+		Start:  sr.Start,
+		End:    sr.End,
+		Limit:  sr.Limit,
+	}
+
+	// Searches of the audit log are themselves audited.
+	rec := s.newAPIAuditRecord(r, "audit", sr)
+	defer s.Audit.Record(rec)
+	records, err := s.Audit.Search(req)
+	if err != nil {
+		rec.fail(err)
+		writeAPIError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rec.Results = len(records)
+	writeJSON(w, r, http.StatusOK, &apiAuditResponse{Records: records})
+}
+
+// apiReload reloads the dispatcher configuration. Only administrators may reload
+// it, if authentication is enabled.
+func (s *HTTPServer) apiReload(w http.ResponseWriter, r *http.Request) {
+	if s.Reload == nil {
+		writeAPIError(w, r, http.StatusNotImplemented, "reloading is not enabled")
+		return
+	}
+	if r.Method != "POST" {
+		writeAPIError(w, r, http.StatusMethodNotAllowed, "unsupported method")
+		return
+	}
+	if s.Auth != nil {
+		if u, ok := UserFromContext(r.Context()); !ok || !u.Admin {
+			writeAPIError(w, r, http.StatusForbidden, "only administrators may reload the configuration")
+			return
+		}
+	}
+	changes, err := s.Reload()
+	if err != nil {
+		writeAPIError(w, r, http.StatusUnprocessableEntity, "configuration not reloaded: "+err.Error())
+		return
+	}
+	if changes == nil {
+		changes = []string{}
+	}
+	writeJSON(w, r, http.StatusOK, &apiReloadResponse{Changes: changes})
+}
+
+// apiSavedSearches manages saved searches. The path is empty, or the name of a saved
+// search, optionally followed by /history. If authentication is enabled, users only
+// see and manage the searches they saved.
+func (s *HTTPServer) apiSavedSearches(w http.ResponseWriter, r *http.Request, path string) {
+	if s.Alerts == nil {
+		writeAPIError(w, r, http.StatusNotImplemented, "saved searches are not enabled")
+		return
+	}
+	var owner string
+	if u, ok := UserFromContext(r.Context()); ok {
+		owner = u.Name
+	}
+
+	name, sub := path, ""
+	if n := strings.Index(path, "/"); n >= 0 {
+		name, sub = path[:n], path[n+1:]
+	}
+	if name == "" {
+		switch r.Method {
+		case "GET", "HEAD":
+			writeJSON(w, r, http.StatusOK, &apiSavedSearchesResponse{Searches: s.Alerts.Searches(owner)})
+		case "POST":
+			ss, err := decodeSavedSearch(r, owner)
+			if err != nil {
+				writeAPIError(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			if existing, err := s.Alerts.Search(ss.Name); err == nil {
+				if s.Auth != nil && existing.Owner != owner {
+					// Other users' searches are not revealed.
+					writeAPIError(w, r, http.StatusNotFound, ErrSearchNotFound.Error())
+					return
+				}
+				writeAPIError(w, r, http.StatusConflict, fmt.Sprintf("saved search %s already exists", ss.Name))
+				return
+			}
+			s.saveSearch(w, r, ss, http.StatusCreated)
+		default:
+			writeAPIError(w, r, http.StatusMethodNotAllowed, "unsupported method")
+		}
+		return
+	}
+
+	existing, err := s.Alerts.Search(name)
+	if err == nil && s.Auth != nil && existing.Owner != owner {
+		// Other users' searches are not revealed.
+		existing, err = nil, ErrSearchNotFound
+	}
+	if sub == "history" && r.Method == "GET" {
+		if err != nil {
+			writeAPIError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		limit, err := intParam(r, "limit", DefaultAlertHistoryLimit)
+		if err != nil {
+			writeAPIError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		alerts, err := s.Alerts.History(name, limit)
+		if err != nil {
+			writeAPIError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, r, http.StatusOK, &apiAlertsResponse{Alerts: alerts})
+		return
+	}
+	if sub != "" {
+		writeAPIError(w, r, http.StatusNotFound, fmt.Sprintf("no such endpoint %s", r.URL.Path))
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if err != nil {
+			writeAPIError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, r, http.StatusOK, existing)
+	case "PUT":
+		if err != nil {
+			// A user may not replace another user's search, which is not revealed.
+			if _, err := s.Alerts.Search(name); err == nil {
+				writeAPIError(w, r, http.StatusNotFound, ErrSearchNotFound.Error())
+				return
+			}
+		}
+		ss, err := decodeSavedSearch(r, owner)
+		if err != nil {
+			writeAPIError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		if ss.Name == "" {
+			ss.Name = name
+		} else if ss.Name != name {
+			writeAPIError(w, r, http.StatusBadRequest, "saved search name does not match the URL")
+			return
+		}
+		s.saveSearch(w, r, ss, http.StatusOK)
+	case "DELETE":
+		if err == nil {
+			err = s.Alerts.Delete(name)
+		}
+		if err == ErrSearchNotFound {
+			writeAPIError(w, r, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeAPIError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAPIError(w, r, http.StatusMethodNotAllowed, "unsupported method")
+	}
+}
+
+// saveSearch saves the search, and responds with it.
+func (s *HTTPServer) saveSearch(w http.ResponseWriter, r *http.Request, ss *SavedSearch, code int) {
+	if err := ss.validate(); err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.Alerts.Save(ss); err != nil {
+		writeAPIError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.Logger.Printf("saved search %s saved by %s", ss.Name, r.RemoteAddr)
+	saved, err := s.Alerts.Search(ss.Name)
+	if err != nil {
+		writeAPIError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, r, code, saved)
+}
+
+// decodeSavedSearch decodes the saved search in the request body, owned by owner.
+func decodeSavedSearch(r *http.Request, owner string) (*SavedSearch, error) {
+	ss := &SavedSearch{}
+	if err := json.NewDecoder(r.Body).Decode(ss); err != nil {
+		return nil, fmt.Errorf("invalid saved search: %s", err.Error())
+	}
+	ss.Owner = owner
+	ss.LastRun = nil
+	return ss, nil
+}
+
+// apiMaintenance manages maintenance windows. The path is empty, or the name of a
+// window. If authentication is enabled, every user may list the windows, but only
+// administrators may change them.
+func (s *HTTPServer) apiMaintenance(w http.ResponseWriter, r *http.Request, name string) {
+	if s.Maintenance == nil {
+		writeAPIError(w, r, http.StatusNotImplemented, "maintenance windows are not enabled")
+		return
+	}
+	u, ok := UserFromContext(r.Context())
+	if s.Auth != nil && r.Method != "GET" && r.Method != "HEAD" && (!ok || !u.Admin) {
+		writeAPIError(w, r, http.StatusForbidden, "only administrators may change maintenance windows")
+		return
+	}
+	var owner string
+	if ok {
+		owner = u.Name
+	}
+	if strings.Contains(name, "/") {
+		writeAPIError(w, r, http.StatusNotFound, fmt.Sprintf("no such endpoint %s", r.URL.Path))
+		return
+	}
+
+	if name == "" {
+		switch r.Method {
+		case "GET", "HEAD":
+			writeJSON(w, r, http.StatusOK, &apiMaintenanceResponse{Windows: s.Maintenance.Windows()})
+		case "POST":
+			mw, err := decodeMaintenanceWindow(r, owner)
+			if err != nil {
+				writeAPIError(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			if _, err := s.Maintenance.Window(mw.Name); err == nil {
+				writeAPIError(w, r, http.StatusConflict, fmt.Sprintf("maintenance window %s already exists", mw.Name))
+				return
+			}
+			s.saveMaintenanceWindow(w, r, mw, http.StatusCreated)
+		default:
+			writeAPIError(w, r, http.StatusMethodNotAllowed, "unsupported method")
+		}
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		mw, err := s.Maintenance.Window(name)
+		if err != nil {
+			writeAPIError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, r, http.StatusOK, mw)
+	case "PUT":
+		mw, err := decodeMaintenanceWindow(r, owner)
+		if err != nil {
+			writeAPIError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		if mw.Name == "" {
+			mw.Name = name
+		} else if mw.Name != name {
+			writeAPIError(w, r, http.StatusBadRequest, "maintenance window name does not match the URL")
+			return
+		}
+		s.saveMaintenanceWindow(w, r, mw, http.StatusOK)
+	case "DELETE":
+		if err := s.Maintenance.Delete(name); err != nil {
+			writeAPIError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		s.Logger.Printf("maintenance window %s deleted by %s", name, r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAPIError(w, r, http.StatusMethodNotAllowed, "unsupported method")
+	}
+}
+
+// saveMaintenanceWindow saves the maintenance window, and responds with it.
+func (s *HTTPServer) saveMaintenanceWindow(w http.ResponseWriter, r *http.Request, mw *MaintenanceWindow, code int) {
+	if err := s.Maintenance.Save(mw); err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.Logger.Printf("maintenance window %s saved by %s", mw.Name, r.RemoteAddr)
+	saved, err := s.Maintenance.Window(mw.Name)
+	if err != nil {
+		writeAPIError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, r, code, saved)
+}
+
+// decodeMaintenanceWindow decodes the maintenance window in the request body, saved
+// by owner.
+func decodeMaintenanceWindow(r *http.Request, owner string) (*MaintenanceWindow, error) {
+	mw := &MaintenanceWindow{}
+	if err := json.NewDecoder(r.Body).Decode(mw); err != nil {
+		return nil, fmt.Errorf("invalid maintenance window: %s", err.Error())
+	}
+	mw.Owner = owner
+	return mw, nil
+}
+
+// newAPIAuditRecord returns an audit record of the search requested through the API.
+func (s *HTTPServer) newAPIAuditRecord(r *http.Request, command string, req *SearchRequest) *AuditRecord {
+	rec := newAuditRecord(r.Context(), "http", r.RemoteAddr, command, req.Query)
+	rec.setRange(req.Start, req.End)
+	return rec
+}
+
+// apiIndexes serves a description of every index.
+func (s *HTTPServer) apiIndexes(w http.ResponseWriter, r *http.Request, api APISearcher) {
+	infos, err := api.IndexInfo()
+	if err != nil {
+		writeAPIError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, &apiIndexesResponse{Indexes: infos})
+}
+
+// apiExport streams every event matching a query, in the format given by the "format"
+// parameter. CSV columns may be selected with the comma-separated "fields" parameter.
+// If the "compress" parameter is "gzip", a gzip file is served. Otherwise the response
+// is compressed in transit if the client accepts gzip encoding. The number of matching
+// events is sent in the X-Total-Count header, so clients can track progress.
+func (s *HTTPServer) apiExport(w http.ResponseWriter, r *http.Request, api APISearcher) {
+	req, err := searchRequestFromForm(r, time.Now().UTC())
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.FormValue("limit") == "" {
+		req.Limit = 0
+	}
+
+	format := strings.ToLower(r.FormValue("format"))
+	if format == "" {
+		format = ExportNDJSON
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		writeAPIError(w, r, http.StatusBadRequest, fmt.Sprintf("unsupported export format '%s'", format))
+		return
+	}
+	var columns []string
+	if v := r.FormValue("fields"); v != "" {
+		columns = strings.Split(v, ",")
+	}
+	compress := r.FormValue("compress")
+	if compress != "" && compress != "gzip" {
+		writeAPIError(w, r, http.StatusBadRequest, fmt.Sprintf("unsupported compression '%s'", compress))
+		return
+	}
+	fw := &flushWriter{w: w}
+	fw.f, _ = w.(http.Flusher)
+	rw, err := NewResultWriter(fw, format, columns)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rec := s.newAPIAuditRecord(r, "export", req)
+	defer s.Audit.Record(rec)
+	total, err := api.Count(r.Context(), req)
+	if err != nil {
+		rec.fail(err)
+		writeAPIError(w, r, queryErrorStatus(err), "error executing query: "+err.Error())
+		return
+	}
+
+	// The response is only compressed once it is known to succeed, so that errors
+	// are sent as plain JSON.
+	filename := "ekanite-export." + format
+	if compress == "gzip" {
+		filename += ".gz"
+		contentType = "application/gzip"
+		fw.gz = gzip.NewWriter(w)
+	} else if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		fw.gz = gzip.NewWriter(w)
+	}
+	if fw.gz != nil {
+		fw.w = fw.gz
+		defer fw.gz.Close()
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("X-Total-Count", strconv.FormatUint(total, 10))
+
+	s.Logger.Printf("exporting %d events matching '%s' as %s", total, req.Query, format)
+	start := time.Now()
+	n, err := Export(r.Context(), api, req, rw, func(n int) {
+		if n > 0 && n%exportLogInterval == 0 {
+			s.Logger.Printf("exported %d of %d events matching '%s'", n, total, req.Query)
+		}
+	})
+	rec.Results = n
+	if err != nil {
+		rec.fail(err)
+		// The response has begun, so the error cannot be reported to the client.
+		// Abort the response instead, so that it is not taken to be complete.
+		s.Logger.Printf("export of '%s' failed after %d events: %s", req.Query, n, err.Error())
+		panic(http.ErrAbortHandler)
+	}
+	s.Logger.Printf("exported %d events matching '%s' in %s", n, req.Query, time.Since(start))
+}
+
+// exportContentTypes are the content types of each export format.
+var exportContentTypes = map[string]string{
+	ExportNDJSON: "application/x-ndjson",
+	ExportCSV:    "text/csv; charset=utf-8",
+	ExportRaw:    "text/plain; charset=utf-8",
+}
+
+// flushWriter writes to w, and flushes any compression and the HTTP response to the
+// client whenever it is flushed, so that exports are streamed.
+type flushWriter struct {
+	w  io.Writer
+	gz *gzip.Writer
+	f  http.Flusher
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	return fw.w.Write(p)
+}
+
+// Flush sends all data written so far to the client.
+func (fw *flushWriter) Flush() error {
+	if fw.gz != nil {
+		if err := fw.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	if fw.f != nil {
+		fw.f.Flush()
+	}
+	return nil
+}
+
+// setCORSHeaders allows cross-origin requests from the configured origins.
+func (s *HTTPServer) setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	for _, o := range s.CORSOrigins {
+		if o == "*" || o == origin {
+			w.Header().Set("Access-Control-Allow-Origin", o)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.Header().Add("Vary", "Origin")
+			return
+		}
+	}
+}
+
+// queryErrorStatus returns the HTTP status code for a failed query. Queries which
+// time out, perhaps because too many queries are running, may be retried later.
+func queryErrorStatus(err error) int {
+	switch err {
+	case context.DeadlineExceeded:
+		return http.StatusServiceUnavailable
+	case ErrEventNotFound:
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+// acceptsJSON returns whether the client prefers a JSON response to HTML.
+func acceptsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// acceptsGzip returns whether the request accepts a gzip-encoded response. An
+// encoding with a q value of 0 is not acceptable.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(v, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "gzip") {
+			continue
+		}
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(p, "q="), 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// searchRequestFromForm returns the SearchRequest described by the request's
+// "q" (or "query"), "start", "end", "limit" and "highlight" parameters. A
+// "highlight" parameter without a style highlights matches as HTML.
+func searchRequestFromForm(r *http.Request, now time.Time) (*SearchRequest, error) {
+	req := &SearchRequest{Query: r.FormValue("q"), Limit: DefaultAPILimit, Highlight: r.FormValue("highlight")}
+	if _, ok := r.Form["highlight"]; ok && req.Highlight == "" {
+		req.Highlight = HighlightHTML
+	}
+	if req.Query == "" {
+		req.Query = r.FormValue("query")
+	}
+
+	var err error
+	if req.Start, err = parseTimeParam(r.FormValue("start"), now); err != nil {
+		return nil, fmt.Errorf("invalid start: %s", err.Error())
+	}
+	if req.End, err = parseTimeParam(r.FormValue("end"), now); err != nil {
+		return nil, fmt.Errorf("invalid end: %s", err.Error())
+	}
+	if v := r.FormValue("limit"); v != "" {
+		if req.Limit, err = strconv.Atoi(v); err != nil || req.Limit < 1 || req.Limit > MaxAPILimit {
+			return nil, fmt.Errorf("invalid limit: must be between 1 and %d", MaxAPILimit)
+		}
+	}
+	return req, nil
+}
+
+// intParam returns the integer value of the named parameter, or def if it is not set.
+func intParam(r *http.Request, name string, def int) (int, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", name, v)
+	}
+	return n, nil
+}
+
+// parseTimeParam parses a time given as RFC3339, as "now", or as a negative duration
+// relative to now, such as "-15m". An empty string is the zero time.
+func parseTimeParam(s string, now time.Time) (time.Time, error) {
+	switch {
+	case s == "":
+		return time.Time{}, nil
+	case s == "now":
+		return now, nil
+	case strings.HasPrefix(s, "-"):
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// writeJSON writes v as the JSON response body, pretty-printed if requested.
+func writeJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	var b []byte
+	var err error
+	if _, pretty := r.Form["pretty"]; pretty {
+		b, err = json.MarshalIndent(v, "", "    ")
+	} else {
+		b, err = json.Marshal(v)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(b)
+	w.Write([]byte("\n"))
+}
+
+// writeAPIError writes a JSON error object with the given status code.
+func writeAPIError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	stats.Add("apiErrors", 1)
+	e := &apiError{}
+	e.Error.Code = code
+	e.Error.Message = msg
+	writeJSON(w, r, code, e)
+}
+
+// millis returns the duration in milliseconds.
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
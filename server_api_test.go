@@ -0,0 +1,397 @@
+package ekanite
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHTTPServer_API tests the REST API against a real engine.
+func TestHTTPServer_API(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newEngine(dataDir, 2, time.Hour)
+	defer e.Close()
+
+	events := []*Event{
+		newParsedEvent("router1", "%LINK-3-UPDOWN", 187, "link down", parseTime("1982-02-05T04:10:00Z")),
+		newParsedEvent("router2", "%LINK-3-UPDOWN", 187, "link down", parseTime("1982-02-05T04:50:00Z")),
+		newParsedEvent("router1", "%LINK-3-UPDOWN", 187, "link up", parseTime("1982-02-05T05:45:00Z")),
+	}
+	if err := e.Index(events); err != nil {
+		t.Fatalf("failed to index events: %s", err.Error())
+	}
+
+	s := NewHTTPServer("", e)
+	s.CORSOrigins = []string{"http://dashboard.example.com"}
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	// Search, with a limit.
+	w := get("/api/v1/search?q=link&limit=2", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong search status, exp %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Fatalf("wrong search content type: %s", ct)
+	}
+	var sr apiSearchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &sr); err != nil {
+		t.Fatalf("failed to decode search response: %s", err.Error())
+	}
+	if sr.Total != 3 || len(sr.Hits) != 2 {
+		t.Fatalf("wrong search response, exp total 3 and 2 hits, got %d and %d", sr.Total, len(sr.Hits))
+	}
+	if sr.Hits[0].Source != "link down" || sr.Hits[0].Fields["host"] != "router1" ||
+		!sr.Hits[0].Time.Equal(parseTime("1982-02-05T04:10:00Z")) {
+		t.Fatalf("wrong first hit: %v", sr.Hits[0])
+	}
+
+	// Search over a time range, negotiated on the root path.
+	w = get("/?query=link&start=1982-02-05T04:30:00Z&end=1982-02-05T05:00:00Z",
+		http.Header{"Accept": []string{"application/json"}})
+	sr = apiSearchResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &sr); err != nil {
+		t.Fatalf("failed to decode negotiated search response: %s", err.Error())
+	}
+	if sr.Total != 1 || len(sr.Hits) != 1 || sr.Hits[0].Fields["host"] != "router2" {
+		t.Fatalf("wrong negotiated search response: %v", sr)
+	}
+
+	// Pipelines return columns and rows.
+	w = get("/api/v1/search?q="+url.QueryEscape("link | stats count by host | sort host"), nil)
+	sr = apiSearchResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &sr); err != nil {
+		t.Fatalf("failed to decode pipeline response: %s", err.Error())
+	}
+	if !reflect.DeepEqual(sr.Columns, []string{"host", "count"}) ||
+		!reflect.DeepEqual(sr.Rows, [][]string{{"router1", "2"}, {"router2", "1"}}) {
+		t.Fatalf("wrong pipeline response: %v", sr)
+	}
+
+	// Highlighting.
+	w = get("/api/v1/search?q=down&highlight", nil)
+	sr = apiSearchResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &sr); err != nil {
+		t.Fatalf("failed to decode highlighted search response: %s", err.Error())
+	}
+	if len(sr.Hits) != 2 || !reflect.DeepEqual(sr.Hits[0].Highlights, []string{"link <mark>down</mark>"}) {
+		t.Fatalf("wrong highlighted search response: %v", sr)
+	}
+
+	// Context.
+	w = get("/api/v1/context?id="+string(events[2].ID())+"&before=3&after=1", nil)
+	var xr apiContextResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &xr); err != nil {
+		t.Fatalf("failed to decode context response: %s", err.Error())
+	}
+	if xr.Event.ID != events[2].ID() || len(xr.Before) != 1 || xr.Before[0].ID != events[0].ID() || len(xr.After) != 0 {
+		t.Fatalf("wrong context response: %s", w.Body.String())
+	}
+
+	// Count.
+	w = get("/api/v1/count?q=down", nil)
+	var cr apiCountResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &cr); err != nil {
+		t.Fatalf("failed to decode count response: %s", err.Error())
+	}
+	if cr.Count != 2 || cr.Query != "down" {
+		t.Fatalf("wrong count response: %v", cr)
+	}
+
+	// Indexes.
+	w = get("/api/v1/indexes", nil)
+	var ir apiIndexesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &ir); err != nil {
+		t.Fatalf("failed to decode indexes response: %s", err.Error())
+	}
+	if len(ir.Indexes) != 2 {
+		t.Fatalf("wrong number of indexes, exp 2, got %d", len(ir.Indexes))
+	}
+
+	// Errors are JSON objects.
+	for path, code := range map[string]int{
+		"/api/v1/search?limit=0":        http.StatusBadRequest,
+		"/api/v1/search?start=bogus":    http.StatusBadRequest,
+		"/api/v1/search?q=x+|+bogus":    http.StatusBadRequest,
+		"/api/v1/nosuchendpoint":        http.StatusNotFound,
+		"/api/v2/search?q=link":         http.StatusNotFound,
+		"/api/v1/count?end=yesterday":   http.StatusBadRequest,
+		"/api/v1/context":               http.StatusBadRequest,
+		"/api/v1/context?id=x":          http.StatusNotFound,
+		"/api/v1/context?id=x&after=y":  http.StatusBadRequest,
+		"/api/v1/search?highlight=bold": http.StatusBadRequest,
+	} {
+		w = get(path, nil)
+		if w.Code != code {
+			t.Errorf("%s: wrong status, exp %d, got %d", path, code, w.Code)
+			continue
+		}
+		var ae apiError
+		if err := json.Unmarshal(w.Body.Bytes(), &ae); err != nil || ae.Error.Code != code || ae.Error.Message == "" {
+			t.Errorf("%s: wrong error body: %s", path, w.Body.String())
+		}
+	}
+
+	// CORS preflight from an allowed, and a disallowed, origin.
+	r := httptest.NewRequest("OPTIONS", "/api/v1/search", nil)
+	r.Header.Set("Origin", "http://dashboard.example.com")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "http://dashboard.example.com" {
+		t.Fatalf("wrong preflight response, status %d, headers %v", w.Code, w.Header())
+	}
+	w = get("/api/v1/count", http.Header{"Origin": []string{"http://evil.example.com"}})
+	if h := w.Header().Get("Access-Control-Allow-Origin"); h != "" {
+		t.Fatalf("disallowed origin granted access: %s", h)
+	}
+}
+
+// timingOutSearcher is an engine whose searches time out before any result.
+type timingOutSearcher struct {
+	*Engine
+}
+
+func (s timingOutSearcher) SearchResults(ctx context.Context, req *SearchRequest) (*Results, error) {
+	c := make(chan *Result)
+	close(c)
+	return &Results{C: c, err: context.DeadlineExceeded}, nil
+}
+
+func TestHTTPServer_APISearchTimeout(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newEngine(dataDir, 2, time.Hour)
+	defer e.Close()
+	s := NewHTTPServer("", timingOutSearcher{e})
+
+	for _, q := range []string{"link", "link | stats count"} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/search?q="+url.QueryEscape(q), nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("%s: timed out search not reported, got status %d: %s", q, w.Code, w.Body.String())
+		}
+	}
+}
+
+// TestHTTPServer_FormSearchTimeout tests that a search form whose query times out
+// shows the error rather than incomplete results.
+func TestHTTPServer_FormSearchTimeout(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newEngine(dataDir, 2, time.Hour)
+	defer e.Close()
+	s := NewHTTPServer("", timingOutSearcher{e})
+	s.template = template.Must(template.New("ServerTemplate").Parse(templateSource))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", strings.NewReader("query=link"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Error executing query after 0 results: context deadline exceeded") {
+		t.Fatalf("timed out search not reported, got status %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestHTTPServer_APIExport tests that exports are streamed, compressed on request.
+func TestHTTPServer_APIExport(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newEngine(dataDir, 2, time.Hour)
+	defer e.Close()
+
+	events := []*Event{
+		newParsedEvent("router1", "%LINK-3-UPDOWN", 187, "link down", parseTime("1982-02-05T04:10:00Z")),
+		newParsedEvent("router2", "%LINK-3-UPDOWN", 187, "link up", parseTime("1982-02-05T04:50:00Z")),
+	}
+	if err := e.Index(events); err != nil {
+		t.Fatalf("failed to index events: %s", err.Error())
+	}
+	s := NewHTTPServer("", e)
+
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		contentType    string
+		disposition    string
+		gzipped        bool
+		exp            string
+	}{
+		{
+			path:        "/api/v1/export?q=link&format=raw",
+			contentType: "text/plain; charset=utf-8",
+			disposition: `attachment; filename="ekanite-export.raw"`,
+			exp:         "link down\nlink up\n",
+		},
+		{
+			path:           "/api/v1/export?q=link&format=csv&fields=host",
+			acceptEncoding: "gzip",
+			contentType:    "text/csv; charset=utf-8",
+			disposition:    `attachment; filename="ekanite-export.csv"`,
+			gzipped:        true,
+			exp:            "host\nrouter1\nrouter2\n",
+		},
+		{
+			path:           "/api/v1/export?q=link&format=raw&end=1982-02-05T04:30:00Z",
+			acceptEncoding: "gzip;q=0, identity",
+			contentType:    "text/plain; charset=utf-8",
+			disposition:    `attachment; filename="ekanite-export.raw"`,
+			exp:            "link down\n",
+		},
+		{
+			path:        "/api/v1/export?q=link&format=raw&compress=gzip&start=1982-02-05T04:30:00Z",
+			contentType: "application/gzip",
+			disposition: `attachment; filename="ekanite-export.raw.gz"`,
+			gzipped:     true,
+			exp:         "link up\n",
+		},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		if tt.acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: wrong status, exp %d, got %d: %s", tt.path, http.StatusOK, w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != tt.contentType {
+			t.Errorf("%s: wrong content type, exp %s, got %s", tt.path, tt.contentType, ct)
+		}
+		if cd := w.Header().Get("Content-Disposition"); cd != tt.disposition {
+			t.Errorf("%s: wrong disposition, exp %s, got %s", tt.path, tt.disposition, cd)
+		}
+		body := w.Body.Bytes()
+		if tt.gzipped {
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("%s: failed to read gzip: %s", tt.path, err.Error())
+			}
+			if body, err = ioutil.ReadAll(gz); err != nil {
+				t.Fatalf("%s: failed to decompress: %s", tt.path, err.Error())
+			}
+		}
+		if string(body) != tt.exp {
+			t.Errorf("%s: wrong export, exp %q, got %q", tt.path, tt.exp, string(body))
+		}
+	}
+
+	// Errors are not compressed, even if the client accepts it.
+	for _, path := range []string{"/api/v1/export?q=link&format=xml", "/api/v1/export?q=host:"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest || w.Header().Get("Content-Encoding") != "" || !strings.Contains(w.Body.String(), `"error"`) {
+			t.Fatalf("%s: invalid export not rejected as JSON, got status %d: %q", path, w.Code, w.Body.String())
+		}
+	}
+
+	// An export whose search times out is aborted, rather than appearing complete.
+	ts := httptest.NewServer(NewHTTPServer("", timingOutSearcher{e}))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/api/v1/export?q=link&format=raw")
+	if err != nil {
+		t.Fatalf("failed to export: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if _, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Fatalf("timed out export not aborted")
+	}
+}
+
+func TestParseTimeParam(t *testing.T) {
+	now := parseTime("1982-02-05T04:00:00Z")
+	tests := []struct {
+		s   string
+		exp time.Time
+		err bool
+	}{
+		{s: "", exp: time.Time{}},
+		{s: "now", exp: now},
+		{s: "-15m", exp: parseTime("1982-02-05T03:45:00Z")},
+		{s: "1982-02-05T05:00:00Z", exp: parseTime("1982-02-05T05:00:00Z")},
+		{s: "-fortnight", err: true},
+		{s: "yesterday", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeParam(tt.s, now)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected error", tt.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tt.s, err.Error())
+			continue
+		}
+		if !got.Equal(tt.exp) {
+			t.Errorf("%q: wrong time, exp %s, got %s", tt.s, tt.exp, got)
+		}
+	}
+}
+
+func TestHTTPServer_Reload(t *testing.T) {
+	auth, err := NewAuthenticator(&Credentials{Users: []*User{
+		{Name: "alice", Tokens: []string{tokenHash("a")}},
+		{Name: "ops", Tokens: []string{tokenHash("o")}, Admin: true},
+	}})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %s", err.Error())
+	}
+
+	s := NewHTTPServer("", nil)
+	s.Auth = auth
+	var reloadErr error
+	s.Reload = func() ([]string, error) {
+		if reloadErr != nil {
+			return nil, reloadErr
+		}
+		return []string{"~ nap: rules"}, nil
+	}
+	do := func(method, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/v1/reload", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("POST", "a"); w.Code != http.StatusForbidden {
+		t.Fatalf("non-administrator reloaded the configuration, status %d", w.Code)
+	}
+	if w := do("GET", "o"); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("configuration reloaded by GET, status %d", w.Code)
+	}
+	w := do("POST", "o")
+	var rr apiReloadResponse
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &rr) != nil || len(rr.Changes) != 1 || rr.Changes[0] != "~ nap: rules" {
+		t.Fatalf("wrong response to reload, status %d: %s", w.Code, w.Body.String())
+	}
+
+	reloadErr = fmt.Errorf("dispatcher type pigeon not valid")
+	if w := do("POST", "o"); w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "pigeon") {
+		t.Fatalf("wrong response to failed reload, status %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -1,19 +1,42 @@
 package ekanite
 
 import (
+	"crypto/tls"
 	"fmt"
 	"html/template"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
+
+	"github.com/ekanite/ekanite/query"
 )
 
+// sseKeepaliveInterval is the interval between keepalive comments sent to tail clients.
+const sseKeepaliveInterval = 15 * time.Second
+
 // HTTPServer serves query client connections.
 type HTTPServer struct {
 	iface    string
 	Searcher Searcher
+	Tailer   *Tailer        // If set, clients may tail newly indexed events.
+	Auth     *Authenticator // If set, requests must carry an API token or basic credentials.
+	TLS      *tls.Config    // If set, clients must connect using HTTPS.
+	Audit    *AuditLog      // If set, every query is recorded.
+	Alerts   *Alerter       // If set, saved searches are managed through the API.
+
+	// Maintenance, if set, maintenance windows are managed through the API.
+	Maintenance *Maintenance
+
+	// Reload, if set, reloads the dispatcher configuration through the API,
+	// returning the changes made.
+	Reload func() ([]string, error)
+
+	// CORSOrigins are the origins allowed to make cross-origin API requests.
+	// "*" allows any origin.
+	CORSOrigins []string
 
 	addr     net.Addr
 	template *template.Template
@@ -38,6 +61,9 @@ func (s *HTTPServer) Start() error {
 	}
 
 	s.addr = ln.Addr()
+	if s.TLS != nil {
+		ln = tls.NewListener(ln, s.TLS)
+	}
 
 	s.template, err = template.New("ServerTemplate").Parse(templateSource)
 	if err != nil {
@@ -54,10 +80,58 @@ func (s *HTTPServer) Addr() net.Addr {
 	return s.addr
 }
 
+// authenticate returns the user identified by the request's Authorization header,
+// either an API token given as "Bearer TOKEN", or basic credentials.
+func (s *HTTPServer) authenticate(r *http.Request) (*User, error) {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		return nil, fmt.Errorf("authentication required")
+	}
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return s.Auth.Token(strings.TrimSpace(h[7:]))
+	}
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, fmt.Errorf("unsupported authorization scheme")
+	}
+	return s.Auth.Password(name, password)
+}
+
 // ServeHTTP implements a http.Handler, serving the query interface for Ekanite
 func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	dontCache(w, r)
 
+	// CORS preflight requests never carry credentials.
+	if s.Auth != nil && r.Method != "OPTIONS" {
+		u, err := s.authenticate(r)
+		if err != nil {
+			s.Logger.Printf("failed authentication from %s: %s", r.RemoteAddr, err.Error())
+			w.Header().Set("WWW-Authenticate", `Basic realm="ekanite"`)
+			if strings.HasPrefix(r.URL.Path, "/api/") || acceptsJSON(r) {
+				s.setCORSHeaders(w, r)
+				writeAPIError(w, r, http.StatusUnauthorized, err.Error())
+			} else {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+			}
+			return
+		}
+		r = r.WithContext(WithUser(r.Context(), u))
+	}
+
+	if r.URL.Path == "/tail" {
+		s.serveTail(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		s.serveAPI(w, r, r.URL.Path)
+		return
+	}
+	if r.URL.Path == "/" && acceptsJSON(r) {
+		// Clients asking for JSON get the API's search results, not the HTML page.
+		s.serveAPI(w, r, "/api/v1/search")
+		return
+	}
+
 	if r.Method == "GET" || r.Method == "HEAD" {
 		// HEAD is conveniently supported by net/http without further action
 		err := serveIndex(s, w, r)
@@ -83,12 +157,20 @@ func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		userQuery := r.FormValue("query")
 		s.Logger.Printf("executing query '%s'", userQuery)
 
+		if query.IsPipeline(userQuery) {
+			s.servePipeline(w, r, userQuery)
+			return
+		}
+
+		rec := newAuditRecord(r.Context(), "http", r.RemoteAddr, "search", userQuery)
+		defer s.Audit.Record(rec)
+
 		start := time.Now()
-		resultSet, err := s.Searcher.Search(userQuery)
-		dur := time.Since(start)
+		resultSet, searchErr, err := searchSources(r.Context(), s.Searcher, userQuery)
 		var resultSlice []string
 
 		if err != nil {
+			rec.fail(err)
 			s.Logger.Printf("Error executing query: '%s'", err)
 			http.Error(w, "Error executing query: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -97,17 +179,31 @@ func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		for s := range resultSet {
 			resultSlice = append(resultSlice, s)
 		}
+		dur := time.Since(start)
+		rec.Results = len(resultSlice)
+
+		// The results found before an error are shown, along with the error.
+		var errMessage string
+		if err := searchErr(); err != nil {
+			rec.fail(err)
+			s.Logger.Printf("Error executing query: '%s'", err)
+			errMessage = fmt.Sprintf("Error executing query after %d results: %s", len(resultSlice), err.Error())
+		}
 
 		data := struct {
 			Title         string
 			Headline      string
+			Error         string
 			ReturnResults bool
 			LogMessages   []string
+			Table         *query.Table
 		}{
 			"Ekanite query interface",
 			fmt.Sprintf(`Ekanite - Listing %d results for "%s" (%s)`, len(resultSlice), userQuery, dur.String()),
+			errMessage,
 			true,
 			resultSlice,
+			nil,
 		}
 
 		if err := s.template.Execute(w, data); err != nil {
@@ -119,18 +215,110 @@ func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// servePipeline evaluates the search pipeline and serves its output as a table.
+func (s *HTTPServer) servePipeline(w http.ResponseWriter, r *http.Request, pipeline string) {
+	rec := newAuditRecord(r.Context(), "http", r.RemoteAddr, "pipeline", pipeline)
+	defer s.Audit.Record(rec)
+
+	start := time.Now()
+	t, err := runPipeline(r.Context(), s.Searcher, pipeline)
+	dur := time.Since(start)
+	if err != nil {
+		rec.fail(err)
+		s.Logger.Printf("Error executing pipeline: '%s'", err)
+		http.Error(w, "Error executing pipeline: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rec.Results = len(t.Rows)
+
+	data := struct {
+		Title         string
+		Headline      string
+		Error         string
+		ReturnResults bool
+		LogMessages   []string
+		Table         *query.Table
+	}{
+		"Ekanite query interface",
+		fmt.Sprintf(`Ekanite - Listing %d rows for "%s" (%s)`, len(t.Rows), pipeline, dur.String()),
+		"",
+		true,
+		nil,
+		t,
+	}
+
+	if err := s.template.Execute(w, data); err != nil {
+		s.Logger.Print("Error executing template: ", err)
+	}
+}
+
+// serveTail streams events matching the "query" parameter, as they are indexed, to
+// the client as Server-Sent Events. Each event's ID is its document ID.
+func (s *HTTPServer) serveTail(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || s.Tailer == nil {
+		http.Error(w, "Tail is not supported", http.StatusNotImplemented)
+		return
+	}
+
+	rec := newAuditRecord(r.Context(), "http", r.RemoteAddr, "tail", r.FormValue("query"))
+	defer s.Audit.Record(rec)
+	sub, err := s.Tailer.Subscribe(r.Context(), r.FormValue("query"), 0)
+	if err != nil {
+		rec.fail(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer s.Tailer.Unsubscribe(sub)
+	s.Logger.Printf("tailing query '%s' for %s", sub.Query, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Periodic comments detect clients which have gone away without closing.
+	keepalive := time.NewTicker(sseKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case res := <-sub.C():
+			fmt.Fprintf(w, "id: %s\n", res.ID)
+			for _, line := range strings.Split(res.Source, "\n") {
+				fmt.Fprintf(w, "data: %s\n", line)
+			}
+			if _, err := fmt.Fprint(w, "\n"); err != nil {
+				return
+			}
+			rec.Results++
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
 // serveIndex serves the plain index for the GET request and POST failovers
 func serveIndex(s *HTTPServer, w http.ResponseWriter, r *http.Request) error {
 	data := struct {
 		Title         string
 		Headline      string
+		Error         string
 		ReturnResults bool
 		LogMessages   []string
+		Table         *query.Table
 	}{
 		"Ekanite query interface",
 		"Ekanite query interface",
+		"",
 		false,
 		[]string{},
+		nil,
 	}
 
 	return s.template.Execute(w, data)
@@ -179,21 +367,46 @@ hr {
 	background-image: linear-gradient(to bottom, #3cb0fd, #3498db);
 	text-decoration: none;
 }
+.error {
+	color: #c0392b;
+	font-weight: bold;
+	margin-bottom: 10px;
+}
 textarea {
 	margin: 20px 20px 20px 0;
 }
+table {
+	border-collapse: collapse;
+}
+th, td {
+	border: 1px solid #dddddd;
+	padding: 4px 8px;
+	text-align: left;
+}
 </style>
 </head>
 <body>
 	<h2>{{ $.Headline }}</h2>
-	<div id="help">Query language reference: <a href="http://godoc.org/github.com/blevesearch/bleve#NewQueryStringQuery">bleve</a></div>
+{{ if $.Error }}
+	<div class="error">{{ $.Error }}</div>
+{{ end }}
+	<div id="help">Query language reference: <a href="http://godoc.org/github.com/blevesearch/bleve#NewQueryStringQuery">bleve</a>.
+	Results may be piped through <a href="http://godoc.org/github.com/ekanite/ekanite/query#Pipeline">commands</a>, for example <code>link | stats count by host | sort -count | head 10</code>.</div>
 	<form action="/" method="POST">
     <textarea name="query" cols="100" rows="2"></textarea>
     <br>
     <input name="submit" type="submit" class="button" value="Query">
 	</form>
 
-{{ if $.ReturnResults }}
+{{ if $.Table }}
+	<hr>
+	<table>
+	<tr>{{range $column := $.Table.Columns }}<th>{{ $column }}</th>{{ end }}</tr>
+	{{range $row := $.Table.Values }}
+	<tr>{{range $value := $row }}<td>{{ $value }}</td>{{ end }}</tr>
+	{{ end }}
+	</table>
+{{ else if $.ReturnResults }}
 	<hr>
 	<ul>
 	{{range $message := $.LogMessages }}
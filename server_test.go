@@ -0,0 +1,202 @@
+package ekanite
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestServer_Protocol tests the query protocol commands against a real engine.
+func TestServer_Protocol(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newEngine(dataDir, 2, time.Hour)
+	defer e.Close()
+
+	events := []*Event{
+		newParsedEvent("router1", "%LINK-3-UPDOWN", 187, "link down", parseTime("1982-02-05T04:10:00Z")),
+		newParsedEvent("router2", "%LINK-3-UPDOWN", 187, "link down", parseTime("1982-02-05T04:50:00Z")),
+		newParsedEvent("router1", "%LINK-3-UPDOWN", 187, "link up", parseTime("1982-02-05T05:45:00Z")),
+	}
+	if err := e.Index(events); err != nil {
+		t.Fatalf("failed to index events: %s", err.Error())
+	}
+
+	s := NewServer("127.0.0.1:0", e)
+	s.Tailer = NewTailer()
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start server: %s", err.Error())
+	}
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err.Error())
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// send sends a command, and returns its data lines and status line.
+	send := func(line string) ([]string, string) {
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			t.Fatalf("failed to write %q: %s", line, err.Error())
+		}
+		var data []string
+		for {
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			l, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("failed to read response to %q: %s", line, err.Error())
+			}
+			// Data lines are JSON objects or arrays, so never begin with a digit.
+			l = strings.TrimSuffix(l, "\n")
+			if !strings.HasPrefix(l, "{") && !strings.HasPrefix(l, "[") {
+				return data, l
+			}
+			data = append(data, l)
+		}
+	}
+
+	data, status := send("SEARCH link")
+	if status != "200 3 events" || len(data) != 3 {
+		t.Fatalf("wrong SEARCH response: %v %q", data, status)
+	}
+	var hit apiHit
+	if err := json.Unmarshal([]byte(data[0]), &hit); err != nil || hit.Source != "link down" || hit.Fields["host"] != "router1" {
+		t.Fatalf("wrong SEARCH event: %s", data[0])
+	}
+
+	if _, status := send("LIMIT 1"); status != "200 limit 1" {
+		t.Fatalf("wrong LIMIT response: %q", status)
+	}
+	if _, status := send("RANGE 1982-02-05T04:30:00Z *"); status != "200 range 1982-02-05T04:30:00Z *" {
+		t.Fatalf("wrong RANGE response: %q", status)
+	}
+	data, status = send("search link")
+	if status != "200 1 events" || !strings.Contains(data[0], "router2") {
+		t.Fatalf("wrong limited SEARCH response: %v %q", data, status)
+	}
+	data, status = send("COUNT link")
+	if status != "200 OK" || len(data) != 1 || !strings.Contains(data[0], `"count":2`) {
+		t.Fatalf("wrong COUNT response: %v %q", data, status)
+	}
+	if _, status := send("RANGE"); status != "200 range * *" {
+		t.Fatalf("wrong RANGE response: %q", status)
+	}
+
+	data, status = send("SEARCH link | stats count by host | sort host")
+	if status != "200 2 rows" || !equalStrings(data, []string{`["host","count"]`, `["router1","2"]`, `["router2","1"]`}) {
+		t.Fatalf("wrong pipeline response: %v %q", data, status)
+	}
+
+	data, status = send("INDEXES")
+	if status != "200 2 indexes" || len(data) != 2 {
+		t.Fatalf("wrong INDEXES response: %v %q", data, status)
+	}
+	data, status = send("STATS")
+	if status != "200 OK" || len(data) != 1 || !strings.Contains(data[0], "queriesRx") {
+		t.Fatalf("wrong STATS response: %v %q", data, status)
+	}
+	data, status = send("HELP")
+	if !strings.HasPrefix(status, "200 ") || len(data) != len(protocolCommands) {
+		t.Fatalf("wrong HELP response: %v %q", data, status)
+	}
+
+	// Errors are framed by status lines.
+	for line, exp := range map[string]string{
+		"SEARCH host:": "400 ",
+		"COUNT host:":  "400 ",
+		"LIMIT many":   "400 ",
+		"RANGE never":  "400 ",
+		"TAIL host:":   "400 ",
+		"AUTH x y":     "401 ",
+	} {
+		if _, status := send(line); !strings.HasPrefix(status, exp) {
+			t.Errorf("%q: wrong status, exp %q, got %q", line, exp, status)
+		}
+	}
+
+	// Tails end, with a summary, when another line is sent.
+	if _, err := conn.Write([]byte("TAIL up\n")); err != nil {
+		t.Fatalf("failed to send TAIL: %s", err.Error())
+	}
+	for {
+		s.Tailer.mu.RLock()
+		n := len(s.Tailer.subs)
+		s.Tailer.mu.RUnlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Tailer.Publish(events)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	l, err := r.ReadString('\n')
+	if err != nil || !strings.Contains(l, `"source":"link up"`) {
+		t.Fatalf("wrong tailed event: %q (%v)", l, err)
+	}
+	if _, status := send("STOP"); status != "200 1 events, 0 dropped" {
+		t.Fatalf("wrong TAIL status: %q", status)
+	}
+
+	// Plain searches are answered with log lines, for telnet users.
+	if _, err := conn.Write([]byte("up\n")); err != nil {
+		t.Fatalf("failed to send plain search: %s", err.Error())
+	}
+	var plain []string
+	for {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read plain search results: %s", err.Error())
+		}
+		if l == "\n" {
+			break
+		}
+		plain = append(plain, l)
+	}
+	if !equalStrings(plain, []string{"link up\n"}) {
+		t.Fatalf("wrong plain search results: %q", plain)
+	}
+	r.ReadString('\n')
+
+	if _, status := send("QUIT"); status != "200 bye" {
+		t.Fatalf("wrong QUIT response: %q", status)
+	}
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Fatalf("connection not closed after QUIT")
+	}
+}
+
+// TestServer_PlainSearchTimeout tests that a plain search whose query times out ends
+// with the error, rather than as if its results were complete.
+func TestServer_PlainSearchTimeout(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newEngine(dataDir, 2, time.Hour)
+	defer e.Close()
+
+	s := NewServer("127.0.0.1:0", timingOutSearcher{e})
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start server: %s", err.Error())
+	}
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err.Error())
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	if _, err := conn.Write([]byte("link\n")); err != nil {
+		t.Fatalf("failed to send plain search: %s", err.Error())
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	l, err := r.ReadString('\n')
+	if err != nil || l != "error executing query after 0 events: context deadline exceeded\n" {
+		t.Fatalf("timed out search not reported: %q (%v)", l, err)
+	}
+	if l, err := r.ReadString('\n'); err != nil || l != "\n" {
+		t.Fatalf("results not terminated: %q (%v)", l, err)
+	}
+}
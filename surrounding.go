@@ -0,0 +1,158 @@
+package ekanite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	blevequery "github.com/blevesearch/bleve/search/query"
+)
+
+// Surrounding defaults
+const (
+	DefaultSurrounding = 5
+	MaxSurrounding     = 1000
+)
+
+// ErrEventNotFound is returned when a requested event does not exist.
+var ErrEventNotFound = errors.New("event not found")
+
+// SurroundingResult is an event, along with the events which occurred immediately
+// before and after it on the same host.
+type SurroundingResult struct {
+	Event  *Result
+	Before []*Result // In reference time order.
+	After  []*Result // In reference time order.
+}
+
+// Surrounding returns the event with the given ID, along with up to before events
+// which occurred immediately before it and up to after events which occurred
+// immediately after it, on the same host, much like grep -C. If the event has no
+// host, the surrounding events may come from any host.
+func (e *Engine) Surrounding(ctx context.Context, id DocID, before, after int) (*SurroundingResult, error) {
+	stats.Add("surroundingRx", 1)
+	if before < 0 || before > MaxSurrounding || after < 0 || after > MaxSurrounding {
+		return nil, fmt.Errorf("surrounding event count must be between 0 and %d", MaxSurrounding)
+	}
+	ctx, done, err := e.beginQuery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	event, err := e.resultByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var host blevequery.Query = bleve.NewMatchAllQuery()
+	if h := event.Fields["host"]; h != "" {
+		tq := bleve.NewTermQuery(h)
+		tq.SetField("host")
+		host = tq
+	}
+
+	// Events with the same reference time are ordered by ID, so the range includes
+	// the event's reference time, and the event itself is skipped.
+	t := event.Time()
+	r := &SurroundingResult{Event: event}
+	r.Before, err = e.scan(ctx, bleve.NewConjunctionQuery(host, newInclusiveRangeQuery(time.Time{}, t)), true, before,
+		func(d DocID) bool { return d < id })
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(r.Before)-1; i < j; i, j = i+1, j-1 {
+		r.Before[i], r.Before[j] = r.Before[j], r.Before[i]
+	}
+	r.After, err = e.scan(ctx, bleve.NewConjunctionQuery(host, newInclusiveRangeQuery(t, time.Time{})), false, after,
+		func(d DocID) bool { return d > id })
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// resultByID returns the event with the given ID.
+func (e *Engine) resultByID(ctx context.Context, id DocID) (*Result, error) {
+	q := restrict(ctx, bleve.NewDocIDQuery([]string{string(id)}))
+	for _, i := range e.indexes {
+		if !i.Contains(id.Time()) {
+			continue
+		}
+		hits, err := i.SearchHits(ctx, q, &HitsRequest{Fields: facetFields, Size: 1})
+		if err != nil {
+			return nil, err
+		}
+		if len(hits) == 0 {
+			continue
+		}
+		b, err := i.Document(id)
+		if err != nil {
+			return nil, err
+		}
+		return newResult(hits[0], b), nil
+	}
+	return nil, ErrEventNotFound
+}
+
+// scan returns up to n events matching q, and accepted by keep, searching the indexes
+// in ascending, or if desc is set descending, Doc ID order. Must be called with the
+// engine's lock held.
+func (e *Engine) scan(ctx context.Context, q blevequery.Query, desc bool, n int, keep func(DocID) bool) ([]*Result, error) {
+	results := make([]*Result, 0, n)
+	if n == 0 {
+		return results, nil
+	}
+	q = restrict(ctx, q)
+
+	// Indexes are ordered latest first.
+	indexes := make(Indexes, 0, len(e.indexes))
+	for i := range e.indexes {
+		if desc {
+			indexes = append(indexes, e.indexes[i])
+		} else {
+			indexes = append(indexes, e.indexes[len(e.indexes)-1-i])
+		}
+	}
+
+	pageSize := n + 10
+	for _, i := range indexes {
+		for from := 0; ; from += pageSize {
+			hits, err := i.SearchHits(ctx, q, &HitsRequest{Fields: facetFields, From: from, Size: pageSize, Desc: desc})
+			if err != nil {
+				return nil, err
+			}
+			for _, h := range hits {
+				if !keep(h.ID) {
+					continue
+				}
+				b, err := i.Document(h.ID)
+				if err != nil {
+					return nil, err
+				}
+				results = append(results, newResult(h, b))
+				if len(results) == n {
+					return results, nil
+				}
+			}
+			if len(hits) < pageSize {
+				break
+			}
+		}
+	}
+	return results, nil
+}
+
+// newInclusiveRangeQuery returns a query matching documents whose reference time falls
+// within start and end, both inclusive. A zero start or end leaves that side unbounded.
+func newInclusiveRangeQuery(start, end time.Time) blevequery.Query {
+	inclusive := true
+	rq := bleve.NewDateRangeInclusiveQuery(start, end, &inclusive, &inclusive)
+	rq.SetField("ReferenceTime")
+	return rq
+}
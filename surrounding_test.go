@@ -0,0 +1,105 @@
+package ekanite
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestEngine_Surrounding tests that the events surrounding an event are drawn from
+// the same host, across indexes.
+func TestEngine_Surrounding(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newEngine(dataDir, 2, time.Hour)
+	defer e.Close()
+
+	events := []*Event{
+		newParsedEvent("router1", "%SYS-5-CONFIG_I", 189, "r1 a", parseTime("1982-02-05T03:50:00Z")),
+		newParsedEvent("router1", "%SYS-5-CONFIG_I", 189, "r1 b", parseTime("1982-02-05T04:10:00Z")),
+		newParsedEvent("router2", "%SYS-5-CONFIG_I", 189, "r2 a", parseTime("1982-02-05T04:15:00Z")),
+		newParsedEvent("router1", "%SYS-5-CONFIG_I", 189, "r1 c", parseTime("1982-02-05T04:20:00Z")),
+		newParsedEvent("router1", "%LINK-3-UPDOWN", 187, "r1 d", parseTime("1982-02-05T04:30:00Z")),
+		newParsedEvent("router2", "%SYS-5-CONFIG_I", 189, "r2 b", parseTime("1982-02-05T04:35:00Z")),
+		newParsedEvent("router1", "%SYS-5-CONFIG_I", 189, "r1 e", parseTime("1982-02-05T05:10:00Z")),
+		newParsedEvent("router1", "%SYS-5-CONFIG_I", 189, "r1 f", parseTime("1982-02-05T05:20:00Z")),
+	}
+	if err := e.Index(events); err != nil {
+		t.Fatalf("failed to index events: %s", err.Error())
+	}
+
+	sources := func(results []*Result) []string {
+		s := []string{}
+		for _, r := range results {
+			s = append(s, r.Source)
+		}
+		return s
+	}
+
+	tests := []struct {
+		id     DocID
+		before int
+		after  int
+		expB   []string
+		expA   []string
+	}{
+		{id: events[4].ID(), before: 2, after: 1, expB: []string{"r1 b", "r1 c"}, expA: []string{"r1 e"}},
+		{id: events[4].ID(), before: 10, after: 10, expB: []string{"r1 a", "r1 b", "r1 c"}, expA: []string{"r1 e", "r1 f"}},
+		{id: events[5].ID(), before: 1, after: 1, expB: []string{"r2 a"}, expA: []string{}},
+		{id: events[0].ID(), before: 1, after: 0, expB: []string{}, expA: []string{}},
+	}
+	for n, tt := range tests {
+		r, err := e.Surrounding(context.Background(), tt.id, tt.before, tt.after)
+		if err != nil {
+			t.Fatalf("test %d: failed to get surrounding events: %s", n, err.Error())
+		}
+		if r.Event.ID != tt.id {
+			t.Errorf("test %d: wrong event, exp %s, got %s", n, tt.id, r.Event.ID)
+		}
+		if got := sources(r.Before); !reflect.DeepEqual(got, tt.expB) {
+			t.Errorf("test %d: wrong events before, exp %v, got %v", n, tt.expB, got)
+		}
+		if got := sources(r.After); !reflect.DeepEqual(got, tt.expA) {
+			t.Errorf("test %d: wrong events after, exp %v, got %v", n, tt.expA, got)
+		}
+	}
+
+	if _, err := e.Surrounding(context.Background(), DocID("0000000000000000000000000000000a"), 1, 1); err != ErrEventNotFound {
+		t.Fatalf("missing event not reported, got %v", err)
+	}
+	if _, err := e.Surrounding(context.Background(), events[0].ID(), MaxSurrounding+1, 1); err == nil {
+		t.Fatalf("excessive surrounding count accepted")
+	}
+}
+
+// TestEngine_Highlight tests that matches in the message are highlighted.
+func TestEngine_Highlight(t *testing.T) {
+	dataDir := tempPath()
+	defer os.RemoveAll(dataDir)
+	e := newEngine(dataDir, 1, time.Hour)
+	defer e.Close()
+
+	ev := newParsedEvent("fw1", "fortigate", 189, "action=deny srcip=10.1.1.1 dstport=22 policy=blocked", parseTime("1982-02-05T04:10:00Z"))
+	if err := e.Index([]*Event{ev}); err != nil {
+		t.Fatalf("failed to index events: %s", err.Error())
+	}
+
+	c, err := e.SearchResults(context.Background(), &SearchRequest{Query: "deny", Highlight: HighlightHTML})
+	if err != nil {
+		t.Fatalf("failed to search: %s", err.Error())
+	}
+	var results []*Result
+	for r := range c.C {
+		results = append(results, r)
+	}
+	exp := []string{"action=<mark>deny</mark> srcip=10.1.1.1 dstport=22 policy=blocked"}
+	if len(results) != 1 || !reflect.DeepEqual(results[0].Highlights, exp) {
+		t.Fatalf("wrong highlights, exp %q, got %v", exp, results)
+	}
+
+	if _, err := e.SearchResults(context.Background(), &SearchRequest{Query: "deny", Highlight: "bold"}); err == nil {
+		t.Fatalf("unsupported highlight style accepted")
+	}
+}
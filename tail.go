@@ -0,0 +1,139 @@
+package ekanite
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ekanite/ekanite/query"
+)
+
+// Tail defaults
+const (
+	DefaultTailBufferSize = 1000
+)
+
+// Tailer delivers newly indexed events to subscribers whose query the events match.
+// Each subscriber has its own buffer. If a subscriber falls behind and its buffer
+// fills, further events for that subscriber are dropped, so that a slow subscriber
+// cannot stall indexing.
+type Tailer struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+// NewTailer returns a new Tailer.
+func NewTailer() *Tailer {
+	return &Tailer{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscription is a registration for events matching a query.
+type Subscription struct {
+	Query string
+
+	expr    query.Expr    // nil matches all events
+	access  *accessFilter // nil if the subscriber may access every event
+	c       chan *Result
+	dropped int64
+}
+
+// C returns the channel on which matching events are delivered. It is closed
+// once the subscription is cancelled.
+func (s *Subscription) C() <-chan *Result {
+	return s.c
+}
+
+// Dropped returns the number of matching events which were dropped because the
+// subscription's buffer was full.
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// match returns whether the result matches the subscription's query, and may be
+// accessed by the subscriber.
+func (s *Subscription) match(r *Result) bool {
+	if s.access != nil && !s.access.match(r.Fields) {
+		return false
+	}
+	return s.expr == nil || query.Match(s.expr, r.Row())
+}
+
+// Subscribe registers a subscription for events matching q, buffering up to size
+// events. An empty query, or "*", matches all events. A size of zero means
+// DefaultTailBufferSize. If ctx carries a user, only the events the user may access
+// are delivered.
+func (t *Tailer) Subscribe(ctx context.Context, q string, size int) (*Subscription, error) {
+	q = strings.TrimSpace(q)
+	s := &Subscription{Query: q}
+	if u, ok := UserFromContext(ctx); ok {
+		s.access = u.access
+	}
+	if q != "" && q != "*" {
+		expr, err := query.NewParser(strings.NewReader(q), query.RawField).Parse()
+		if err != nil {
+			return nil, fmt.Errorf("invalid tail query: %s", err.Error())
+		}
+		s.expr = expr
+	}
+	if size <= 0 {
+		size = DefaultTailBufferSize
+	}
+	s.c = make(chan *Result, size)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.subs[s] = struct{}{}
+	stats.Add("tailSubscribers", 1)
+	return s, nil
+}
+
+// Unsubscribe cancels the subscription, and closes its channel.
+func (t *Tailer) Unsubscribe(s *Subscription) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.subs[s]; !ok {
+		return
+	}
+	delete(t.subs, s)
+	close(s.c)
+	stats.Add("tailSubscribers", -1)
+}
+
+// Publish delivers the events to every subscription they match. It never blocks.
+func (t *Tailer) Publish(events []*Event) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if len(t.subs) == 0 {
+		return
+	}
+
+	for _, ev := range events {
+		r := newEventResult(ev)
+		for s := range t.subs {
+			if !s.match(r) {
+				continue
+			}
+			select {
+			case s.c <- r:
+				stats.Add("tailEventsSent", 1)
+			default:
+				atomic.AddInt64(&s.dropped, 1)
+				stats.Add("tailEventsDropped", 1)
+			}
+		}
+	}
+}
+
+// newEventResult returns a Result for an event which has not been retrieved from an
+// index, populated with the fields that would be indexed.
+func newEventResult(ev *Event) *Result {
+	return &Result{
+		ID:     ev.ID(),
+		Source: string(ev.Source()),
+		Fields: ev.Fields(),
+	}
+}
@@ -0,0 +1,102 @@
+package ekanite
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTailer_Publish(t *testing.T) {
+	tailer := NewTailer()
+	all, err := tailer.Subscribe(context.Background(), "", 0)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err.Error())
+	}
+	down, err := tailer.Subscribe(context.Background(), "down AND host:router1", 0)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err.Error())
+	}
+
+	now := parseTime("1982-02-05T04:10:00Z")
+	tailer.Publish([]*Event{
+		newParsedEvent("router1", "%LINK-3-UPDOWN", 187, "Interface Gi0/1 is down", now),
+		newParsedEvent("router2", "%LINK-3-UPDOWN", 187, "Interface Gi0/2 is down", now),
+		newParsedEvent("router1", "%LINK-3-UPDOWN", 187, "Interface Gi0/1 is up", now),
+	})
+
+	if n := len(all.C()); n != 3 {
+		t.Fatalf("wrong number of events for match-all subscription, exp 3, got %d", n)
+	}
+	if n := len(down.C()); n != 1 {
+		t.Fatalf("wrong number of events for query subscription, exp 1, got %d", n)
+	}
+	r := <-down.C()
+	if r.Source != "Interface Gi0/1 is down" || r.Fields["host"] != "router1" {
+		t.Fatalf("wrong event delivered: %v", r)
+	}
+
+	tailer.Unsubscribe(down)
+	if _, more := <-down.C(); more {
+		t.Fatalf("channel of cancelled subscription not closed")
+	}
+	tailer.Unsubscribe(down) // Must be safe to call twice.
+
+	if _, err := tailer.Subscribe(context.Background(), "host:", 0); err == nil {
+		t.Fatalf("subscribing with invalid query did not fail")
+	}
+}
+
+func TestTailer_SlowSubscriber(t *testing.T) {
+	tailer := NewTailer()
+	slow, err := tailer.Subscribe(context.Background(), "", 2)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err.Error())
+	}
+
+	events := make([]*Event, 5)
+	for n := range events {
+		events[n] = newIndexableEvent("event", time.Now())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		tailer.Publish(events)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("publishing to a full subscriber blocked")
+	}
+
+	if len(slow.C()) != 2 || slow.Dropped() != 3 {
+		t.Fatalf("wrong delivery to slow subscriber, exp 2 buffered 3 dropped, got %d buffered %d dropped",
+			len(slow.C()), slow.Dropped())
+	}
+}
+
+func TestBatcher_Tail(t *testing.T) {
+	tailer := NewTailer()
+	sub, err := tailer.Subscribe(context.Background(), "", 0)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err.Error())
+	}
+
+	b := NewBatcher(&TestIndexer{}, 1, time.Hour, 0)
+	b.Tail(tailer)
+	c := make(chan error)
+	if err := b.Start(c); err != nil {
+		t.Fatalf("failed start batcher: %s", err.Error())
+	}
+
+	b.C() <- newInputEvent("tailed event", time.Now())
+	<-c
+	select {
+	case r := <-sub.C():
+		if r.Source != "tailed event" {
+			t.Fatalf("wrong event tailed, exp 'tailed event', got '%s'", r.Source)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for tailed event")
+	}
+}